@@ -0,0 +1,165 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+import (
+	"math"
+	"math/big"
+	"reflect"
+)
+
+var (
+	bigIntTyp = reflect.TypeOf(big.Int{})
+	bigFloatTyp = reflect.TypeOf(big.Float{})
+)
+
+// AddBig registers big.Int and big.Float as ext types intTag and floatTag.
+// The data is their GobEncode form, which round-trips exactly 
+// (including the precision and rounding mode of a big.Float).
+// 
+// Without it, they are encoded as strings (see Encoder.Encode).
+func (x *ExtRegistry) AddBig(intTag, floatTag int8) (err error) {
+	if err = x.Add(bigIntTyp, intTag, encBigIntExt, decBigIntExt); err != nil {
+		return
+	}
+	return x.Add(bigFloatTyp, floatTag, encBigFloatExt, decBigFloatExt)
+}
+
+func encBigIntExt(rv reflect.Value) ([]byte, error) {
+	return bigIntPtr(rv).GobEncode()
+}
+
+func decBigIntExt(rv reflect.Value, bs []byte) error {
+	return rv.Addr().Interface().(*big.Int).GobDecode(bs)
+}
+
+func encBigFloatExt(rv reflect.Value) ([]byte, error) {
+	return bigFloatPtr(rv).GobEncode()
+}
+
+func decBigFloatExt(rv reflect.Value, bs []byte) error {
+	return rv.Addr().Interface().(*big.Float).GobDecode(bs)
+}
+
+// bigIntPtr returns a *big.Int for rv (a big.Int), whose methods all have pointer receivers.
+func bigIntPtr(rv reflect.Value) *big.Int {
+	if rv.CanAddr() {
+		return rv.Addr().Interface().(*big.Int)
+	}
+	// a shallow copy is fine for reading it.
+	x := rv.Interface().(big.Int)
+	return &x
+}
+
+func bigFloatPtr(rv reflect.Value) *big.Float {
+	if rv.CanAddr() {
+		return rv.Addr().Interface().(*big.Float)
+	}
+	x := rv.Interface().(big.Float)
+	return &x
+}
+
+// encodeBig encodes a big.Int as its base 10 string, 
+// and a big.Float as the shortest decimal string which round-trips at its precision.
+// (So decoding it into a big.Float with that precision set gives the same value back.)
+func (e *Encoder) encodeBig(rv reflect.Value) {
+	if rv.Type() == bigIntTyp {
+		e.encString(bigIntPtr(rv).String())
+	} else {
+		e.encString(bigFloatPtr(rv).Text('g', -1))
+	}
+}
+
+// decodeBig decodes a string, integer or (for a big.Float) float into rv (a big.Int or big.Float).
+func (d *Decoder) decodeBig(bd byte, containerLen int, rv reflect.Value) {
+	var s string
+	var isInt, isFloat, unsigned bool
+	var f float64
+	switch {
+	case bd == 0xca:
+		f, isFloat = float64(math.Float32frombits(d.readUint32())), true
+	case bd == 0xcb:
+		f, isFloat = math.Float64frombits(d.readUint64()), true
+	case bd >= 0xcc && bd <= 0xcf, bd <= 0x7f:
+		isInt, unsigned = true, true
+	case bd >= 0xd0 && bd <= 0xd3, bd >= 0xe0:
+		isInt = true
+	default:
+		if containerLen < 0 {
+			containerLen = d.readContainerLen(bd, false, ContainerRawBytes)
+		}
+		s = d.readString(containerLen)
+	}
+	
+	if rv.Type() == bigIntTyp {
+		z := rv.Addr().Interface().(*big.Int)
+		switch {
+		case isFloat:
+			d.err("Cannot decode float value: %v into big.Int", f)
+		case unsigned:
+			_, ui := d.decodeInteger(bd, false)
+			z.SetUint64(ui)
+		case isInt:
+			i, _ := d.decodeInteger(bd, true)
+			z.SetInt64(i)
+		default:
+			if _, ok := z.SetString(s, 10); !ok {
+				d.err("Invalid big.Int string: %q", s)
+			}
+		}
+		return
+	}
+	
+	z := rv.Addr().Interface().(*big.Float)
+	switch {
+	case isFloat:
+		z.SetFloat64(f)
+	case unsigned:
+		_, ui := d.decodeInteger(bd, false)
+		z.SetUint64(ui)
+	case isInt:
+		i, _ := d.decodeInteger(bd, true)
+		z.SetInt64(i)
+	default:
+		// parse at the precision of z if set, else one enough for all the digits
+		if z.Prec() == 0 {
+			if prec := uint(float64(len(s)) * math.Log2(10)) + 1; prec > 64 {
+				z.SetPrec(prec)
+			}
+		}
+		if _, ok := z.SetString(s); !ok {
+			d.err("Invalid big.Float string: %q", s)
+		}
+	}
+}
+
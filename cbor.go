@@ -0,0 +1,435 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"unicode/utf8"
+)
+
+// CBORExtTagBase is the first of the CBOR tags the ext types are translated to by default: 
+// ext type n (as an unsigned byte) becomes tag CBORExtTagBase+n, with its data as a byte string.
+const CBORExtTagBase = 0x4d500000
+
+// CBOROptions configures transcoding between msgpack and CBOR (RFC 8949), 
+// with MsgpackToCBOR and CBORToMsgpack. The data models are close, and 
+// transcoding works on the wire formats directly, without decoding into Go values.
+// 
+// msgpack to CBOR:
+//   - str values become text strings, or byte strings if they are not valid UTF-8
+//   - bin values become byte strings
+//   - ext values become tagged byte strings (see CBORExtTagBase and ExtToTag)
+// 
+// CBOR to msgpack:
+//   - text and byte strings both become raw strings (the only kind this package writes)
+//   - half-precision floats become float32 
+//   - undefined becomes nil; other simple values are an error
+//   - indefinite-length strings, arrays and maps are supported
+//   - tags in the CBORExtTagBase range (or translated by TagToExt) of a byte string become ext values;
+//     other tags are dropped, leaving their content
+//   - negative integers below math.MinInt64 are an error
+type CBOROptions struct {
+	// ExtToTag, if set, gives the tag to translate ext type xtag to (instead of CBORExtTagBase+xtag), 
+	// when ok.
+	ExtToTag func(xtag int8) (tag uint64, ok bool)
+	// TagToExt, if set, gives the ext type to translate a tag (of a byte string) to, when ok. 
+	// Other tags are translated by the CBORExtTagBase range, or dropped.
+	TagToExt func(tag uint64) (xtag int8, ok bool)
+}
+
+// MsgpackToCBOR transcodes the stream of msgpack values in r into CBOR written to w, 
+// using the default CBOROptions.
+func MsgpackToCBOR(w io.Writer, r io.Reader) error {
+	return (*CBOROptions)(nil).MsgpackToCBOR(w, r)
+}
+
+// CBORToMsgpack transcodes the stream of CBOR values in r into msgpack written to w, 
+// using the default CBOROptions.
+func CBORToMsgpack(w io.Writer, r io.Reader) error {
+	return (*CBOROptions)(nil).CBORToMsgpack(w, r)
+}
+
+// MsgpackToCBOR transcodes the stream of msgpack values in r into CBOR written to w.
+func (o *CBOROptions) MsgpackToCBOR(w io.Writer, r io.Reader) (err error) {
+	if o == nil {
+		o = &CBOROptions{}
+	}
+	bw := bufio.NewWriter(w)
+	d := NewDecoder(r, nil)
+	for d.More() {
+		if err = o.toCBOR(d, bw); err != nil {
+			return
+		}
+	}
+	return bw.Flush()
+}
+
+func (o *CBOROptions) toCBOR(d *Decoder, w *bufio.Writer) (err error) {
+	defer panicToErr(&err)
+	o.writeCBOR(d, w)
+	return
+}
+
+// writeCBOR transcodes the next value in d's stream.
+func (o *CBOROptions) writeCBOR(d *Decoder, w *bufio.Writer) {
+	bd := d.readn1()
+	switch vt := descValueType(bd); vt {
+	case NilType:
+		w.WriteByte(0xf6)
+	case BoolType:
+		w.WriteByte(0xf4 + bd - 0xc2)
+	case IntType:
+		if i, _ := d.decodeInteger(bd, true); i < 0 {
+			writeCBORHead(w, 1, uint64(-1 - i))
+		} else {
+			writeCBORHead(w, 0, uint64(i))
+		}
+	case UintType:
+		_, ui := d.decodeInteger(bd, false)
+		writeCBORHead(w, 0, ui)
+	case FloatType:
+		var x [9]byte
+		if bd == 0xca {
+			x[0] = 0xfa
+			binary.BigEndian.PutUint32(x[1:], d.readUint32())
+			w.Write(x[:5])
+		} else {
+			x[0] = 0xfb
+			binary.BigEndian.PutUint64(x[1:], d.readUint64())
+			w.Write(x[:])
+		}
+	case StrType, BinType:
+		bs := d.readBytes(d.readContainerLen(bd, false, ContainerRawBytes))
+		major := byte(2)
+		if vt == StrType && utf8.Valid(bs) {
+			major = 3
+		}
+		writeCBORHead(w, major, uint64(len(bs)))
+		w.Write(bs)
+	case ExtType:
+		xtag, l := d.readExtHeader(bd)
+		data := d.readBytes(l)
+		tag, ok := uint64(0), false
+		if o.ExtToTag != nil {
+			tag, ok = o.ExtToTag(xtag)
+		}
+		if !ok {
+			tag = CBORExtTagBase + uint64(uint8(xtag))
+		}
+		writeCBORHead(w, 6, tag)
+		writeCBORHead(w, 2, uint64(len(data)))
+		w.Write(data)
+	case ArrayType:
+		n := d.readContainerLen(bd, false, ContainerList)
+		writeCBORHead(w, 4, uint64(n))
+		d.enter()
+		for j := 0; j < n; j++ {
+			o.writeCBOR(d, w)
+		}
+		d.exit()
+	case MapType:
+		n := d.readContainerLen(bd, false, ContainerMap)
+		writeCBORHead(w, 5, uint64(n))
+		d.enter()
+		for j := 0; j < 2*n; j++ {
+			o.writeCBOR(d, w)
+		}
+		d.exit()
+	default:
+		d.err("MsgpackToCBOR: %s: hex: %x, dec: %d", msgBadDesc, bd, bd)
+	}
+}
+
+// writeCBORHead writes the head of a CBOR data item: its major type and argument n.
+func writeCBORHead(w *bufio.Writer, major byte, n uint64) {
+	var x [9]byte
+	major <<= 5
+	switch {
+	case n < 24:
+		w.WriteByte(major | byte(n))
+		return
+	case n <= math.MaxUint8:
+		x[0], x[1] = major | 24, byte(n)
+		w.Write(x[:2])
+	case n <= math.MaxUint16:
+		x[0] = major | 25
+		binary.BigEndian.PutUint16(x[1:], uint16(n))
+		w.Write(x[:3])
+	case n <= math.MaxUint32:
+		x[0] = major | 26
+		binary.BigEndian.PutUint32(x[1:], uint32(n))
+		w.Write(x[:5])
+	default:
+		x[0] = major | 27
+		binary.BigEndian.PutUint64(x[1:], n)
+		w.Write(x[:])
+	}
+}
+
+// CBORToMsgpack transcodes the stream of CBOR values in r into msgpack written to w.
+func (o *CBOROptions) CBORToMsgpack(w io.Writer, r io.Reader) (err error) {
+	if o == nil {
+		o = &CBOROptions{}
+	}
+	bw := bufio.NewWriter(w)
+	c := &cborReader{ r: bufio.NewReader(r), o: o, e: NewEncoder(bw) }
+	for {
+		if _, err = c.r.Peek(1); err == io.EOF {
+			break
+		} else if err != nil {
+			return
+		}
+		if err = c.transcode(); err != nil {
+			return
+		}
+	}
+	return bw.Flush()
+}
+
+// cborReader reads CBOR data items, writing them as msgpack.
+type cborReader struct {
+	r *bufio.Reader
+	o *CBOROptions
+	e *Encoder
+	x [8]byte
+	depth int
+}
+
+func (c *cborReader) transcode() (err error) {
+	defer panicToErr(&err)
+	c.writeValue()
+	return
+}
+
+func (c *cborReader) err(format string, params ...interface{}) {
+	panic(fmt.Errorf("CBORToMsgpack: " + format, params...))
+}
+
+func (c *cborReader) read(n int) []byte {
+	bs := c.x[:n]
+	if _, err := io.ReadFull(c.r, bs); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		c.err("%v", err)
+	}
+	return bs
+}
+
+// enter and exit track the nesting of containers and tags, 
+// failing (rather than overflowing the stack) on items nested deeper than decMaxDepth.
+func (c *cborReader) enter() {
+	if c.depth++; c.depth > decMaxDepth {
+		c.err("Exceeded max nesting depth of %v", decMaxDepth)
+	}
+}
+
+func (c *cborReader) exit() {
+	c.depth--
+}
+
+// head reads the head of a data item: its major type, additional info, and argument 
+// (for additional info < 28; indefinite is set for 31).
+func (c *cborReader) head() (major, info byte, n uint64, indefinite bool) {
+	b := c.read(1)[0]
+	major, info = b >> 5, b & 0x1f
+	switch {
+	case info < 24:
+		n = uint64(info)
+	case info == 24:
+		n = uint64(c.read(1)[0])
+	case info == 25:
+		n = uint64(binary.BigEndian.Uint16(c.read(2)))
+	case info == 26:
+		n = uint64(binary.BigEndian.Uint32(c.read(4)))
+	case info == 27:
+		n = binary.BigEndian.Uint64(c.read(8))
+	case info == 31 && (major >= 2 && major <= 5 || major == 7):
+		indefinite = true
+	default:
+		c.err("Invalid additional info %d for major type %d", info, major)
+	}
+	return
+}
+
+// length checks the length n of a string or container fits in an int.
+func (c *cborReader) length(n uint64) int {
+	if n > math.MaxInt32 {
+		c.err("Length too large: %d", n)
+	}
+	return int(n)
+}
+
+// readString reads the content of a (definite or indefinite-length) string of major type major.
+func (c *cborReader) readString(major byte, n uint64, indefinite bool) []byte {
+	if !indefinite {
+		// copy into a growing buffer, so a corrupt length cannot allocate much more than r holds
+		var b bytes.Buffer
+		if _, err := io.CopyN(&b, c.r, int64(c.length(n))); err != nil {
+			c.err("%v", io.ErrUnexpectedEOF)
+		}
+		return b.Bytes()
+	}
+	var bs []byte
+	for {
+		m, _, n, indef := c.head()
+		if m == 7 && indef {
+			return bs
+		}
+		if m != major || indef {
+			c.err("Invalid chunk of indefinite-length string: major type %d", m)
+		}
+		bs = append(bs, c.readString(major, n, false)...)
+	}
+}
+
+// writeItem transcodes the next data item. It returns true, writing nothing, if it is a break 
+// (ending an indefinite-length container).
+func (c *cborReader) writeItem() (isBreak bool) {
+	major, info, n, indefinite := c.head()
+	e := c.e
+	switch major {
+	case 0:
+		e.encUint(n)
+	case 1:
+		if n > math.MaxInt64 {
+			c.err("Negative integer too large: -1-%d", n)
+		}
+		e.encInt(-1 - int64(n))
+	case 2:
+		e.encRawBytes(c.readString(major, n, indefinite))
+	case 3:
+		e.encStrBytes(c.readString(major, n, indefinite))
+	case 4, 5:
+		ct, items := ContainerList, n
+		if major == 5 {
+			ct, items = ContainerMap, 2*n
+		}
+		c.enter()
+		defer c.exit()
+		if !indefinite {
+			e.writeContainerLen(ct, c.length(n))
+			for j := uint64(0); j < items; j++ {
+				c.writeValue()
+			}
+			break
+		}
+		e.beginDeferred(ct)
+		for !c.writeItem() {
+		}
+		e.endDeferred(ct)
+	case 6:
+		c.enter()
+		defer c.exit()
+		c.writeTagged(n)
+	case 7:
+		switch {
+		case indefinite:
+			return true
+		case info == 20, info == 21:
+			e.encBool(info == 21)
+		case info == 22, info == 23:
+			e.encNil()
+		case info == 25:
+			e.encFloat32(halfToFloat32(uint16(n)))
+		case info == 26:
+			e.encFloat32(math.Float32frombits(uint32(n)))
+		case info == 27:
+			e.encFloat64(math.Float64frombits(n))
+		default:
+			c.err("Unsupported simple value: %d", n)
+		}
+	}
+	return
+}
+
+// writeValue transcodes the next data item, which must not be a break.
+func (c *cborReader) writeValue() {
+	if c.writeItem() {
+		c.err("Unexpected break")
+	}
+}
+
+// writeTagged transcodes the content of a data item tagged tag: 
+// as an ext value if the tag translates to an ext type, else as is.
+func (c *cborReader) writeTagged(tag uint64) {
+	xtag, ok := int8(0), false
+	if c.o.TagToExt != nil {
+		xtag, ok = c.o.TagToExt(tag)
+	}
+	if !ok && tag >= CBORExtTagBase && tag <= CBORExtTagBase + math.MaxUint8 {
+		xtag, ok = int8(uint8(tag - CBORExtTagBase)), true
+	}
+	if !ok {
+		c.writeValue()
+		return
+	}
+	major, _, n, indefinite := c.head()
+	if major != 2 {
+		c.err("Tag %d translated to ext type %d must hold a byte string, not major type %d", tag, xtag, major)
+	}
+	data := c.readString(major, n, indefinite)
+	c.e.writeExtHeader(xtag, len(data))
+	if len(data) > 0 {
+		c.e.writeb(len(data), data)
+	}
+}
+
+// halfToFloat32 converts an IEEE 754 half-precision float to a float32.
+func halfToFloat32(h uint16) float32 {
+	sign := uint32(h >> 15) << 31
+	exp := uint32(h >> 10) & 0x1f
+	frac := uint32(h & 0x3ff)
+	switch {
+	case exp == 0x1f:
+		// Inf or NaN
+		return math.Float32frombits(sign | 0xff << 23 | frac << 13)
+	case exp == 0 && frac == 0:
+		return math.Float32frombits(sign)
+	case exp == 0:
+		// subnormal: normalize it
+		exp = 127 - 15 + 1
+		for frac & 0x400 == 0 {
+			frac <<= 1
+			exp--
+		}
+		frac &= 0x3ff
+		return math.Float32frombits(sign | exp << 23 | frac << 13)
+	}
+	return math.Float32frombits(sign | (exp + 127 - 15) << 23 | frac << 13)
+}
@@ -0,0 +1,166 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// DefaultMaxChecksumFrame is the default for ChecksumDecoder.MaxSize.
+const DefaultMaxChecksumFrame = 64 << 20
+
+// CorruptionError is returned by a ChecksumDecoder for a message whose checksum does not match.
+type CorruptionError struct {
+	Offset int64  // offset of the frame in the stream
+	Reason string
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("%v: corrupt message at offset %d: %s", msgTagDec, e.Offset, e.Reason)
+}
+
+// ChecksumEncoder writes each message in a frame with a checksum, 
+// for reading by a ChecksumDecoder. A frame is:
+//    length of the message (uint32, big-endian) | message | checksum of the length and message
+// The checksum is computed by a hash.Hash (CRC-32C by default). Any hash can be used 
+// (e.g. an xxhash implementation), as long as both ends use the same one.
+type ChecksumEncoder struct {
+	w io.Writer
+	h hash.Hash
+	buf bytes.Buffer
+	enc *Encoder
+}
+
+// NewChecksumEncoder returns a ChecksumEncoder writing to w. 
+// h computes the checksums (CRC-32C if nil). opts configures the encoding (and may be nil).
+func NewChecksumEncoder(w io.Writer, h hash.Hash, opts *EncoderOptions) *ChecksumEncoder {
+	if h == nil {
+		h = crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	}
+	ce := &ChecksumEncoder{w: w, h: h}
+	ce.enc = NewEncoderEx(&ce.buf, opts)
+	return ce
+}
+
+// Encode encodes v, and writes it as a frame (in a single call to Write).
+func (ce *ChecksumEncoder) Encode(v interface{}) (err error) {
+	ce.buf.Reset()
+	ce.buf.Write([]byte{0, 0, 0, 0})
+	if err = ce.enc.Encode(v); err != nil {
+		return
+	}
+	bs := ce.buf.Bytes()
+	if uint64(len(bs) - 4) > 0xffffffff {
+		return fmt.Errorf("%v: ChecksumEncoder: message too large: %d bytes", msgTagEnc, len(bs) - 4)
+	}
+	binary.BigEndian.PutUint32(bs, uint32(len(bs) - 4))
+	ce.h.Reset()
+	ce.h.Write(bs)
+	_, err = ce.w.Write(ce.h.Sum(bs))
+	return
+}
+
+// ChecksumDecoder reads frames written by a ChecksumEncoder, verifying their checksums.
+type ChecksumDecoder struct {
+	// MaxSize is the size of the largest message accepted (DefaultMaxChecksumFrame if <= 0).
+	// A larger length is reported as corruption.
+	MaxSize int
+	r io.Reader
+	h hash.Hash
+	dam DecoderContainerResolver
+	off int64
+	buf []byte
+}
+
+// NewChecksumDecoder returns a ChecksumDecoder reading from r.
+// h computes the checksums (CRC-32C if nil). dam is used to decode messages (as for NewDecoder).
+func NewChecksumDecoder(r io.Reader, h hash.Hash, dam DecoderContainerResolver) *ChecksumDecoder {
+	if h == nil {
+		h = crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	}
+	return &ChecksumDecoder{r: r, h: h, dam: dam}
+}
+
+// DecodeRaw reads the next frame, and returns its message (the encoding of a value). 
+// It returns io.EOF if there are no more frames, io.ErrUnexpectedEOF if the stream ends
+// within a frame, and a *CorruptionError if the checksum does not match.
+// After a CorruptionError, the stream cannot be read further (the frame boundary is unknown).
+func (cd *ChecksumDecoder) DecodeRaw() (bs Raw, err error) {
+	var hdr [4]byte
+	if _, err = io.ReadFull(cd.r, hdr[:]); err != nil {
+		return
+	}
+	off := cd.off
+	max := cd.MaxSize
+	if max <= 0 {
+		max = DefaultMaxChecksumFrame
+	}
+	l := binary.BigEndian.Uint32(hdr[:])
+	if uint64(l) > uint64(max) {
+		return nil, &CorruptionError{off, fmt.Sprintf("message length %d exceeds %d", l, max)}
+	}
+	n := 4 + int(l) + cd.h.Size()
+	if cap(cd.buf) < n {
+		cd.buf = make([]byte, n)
+	}
+	b := cd.buf[:n]
+	copy(b, hdr[:])
+	if _, err = io.ReadFull(cd.r, b[4:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	cd.off += int64(n)
+	cd.h.Reset()
+	cd.h.Write(b[:4+l])
+	if sum := cd.h.Sum(b[n:n]); !bytes.Equal(sum, b[4+l:]) {
+		return nil, &CorruptionError{off, fmt.Sprintf("checksum mismatch: got %x, expecting %x", sum, b[4+l:])}
+	}
+	return append(Raw(nil), b[4:4+l]...), nil
+}
+
+// Decode reads the next frame (see DecodeRaw), and decodes its message into v.
+func (cd *ChecksumDecoder) Decode(v interface{}) (err error) {
+	bs, err := cd.DecodeRaw()
+	if err != nil {
+		return
+	}
+	return Unmarshal(bs, v, cd.dam)
+}
+
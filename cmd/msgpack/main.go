@@ -0,0 +1,188 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+/*
+Command msgpack converts and inspects msgpack streams.
+
+Usage:
+
+    msgpack json2mp [file]     convert a stream of JSON values to msgpack
+    msgpack mp2json [file]     convert a stream of msgpack values to JSON (one per line)
+    msgpack dump [file]        print an annotated listing of each msgpack value
+    msgpack validate [file]    check that the input is a well-formed msgpack stream
+    msgpack diff file1 file2   print the differences between two msgpack streams, value by value
+
+Input is read from the file, or from stdin if no file (or -) is given.
+Output is written to stdout. validate and diff exit with status 1 if
+the input is malformed or the streams differ.
+*/
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/ugorji/go-msgpack"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run runs the command with the arguments args (without the program name),
+// and returns its exit status.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("msgpack", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	binAsTagged := fs.Bool("tagged", false, "mp2json/json2mp: write/read bin as {\"$bin\":...} instead of a base64 string")
+	usage := func() int {
+		fmt.Fprintf(stderr, "usage: msgpack [-tagged] json2mp|mp2json|dump|validate [file]\n")
+		fmt.Fprintf(stderr, "       msgpack diff file1 file2\n")
+		fs.PrintDefaults()
+		return 2
+	}
+	fs.Usage = func() { usage() }
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	args = fs.Args()
+	if len(args) == 0 {
+		return usage()
+	}
+	var err error
+	switch cmd, args := args[0], args[1:]; cmd {
+	case "json2mp", "mp2json", "dump", "validate":
+		if len(args) > 1 {
+			return usage()
+		}
+		err = run1(cmd, args, *binAsTagged, stdin, stdout)
+	case "diff":
+		if len(args) != 2 {
+			return usage()
+		}
+		err = diff(args[0], args[1], stdin, stdout)
+	default:
+		return usage()
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "msgpack: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func open(name string, stdin io.Reader) (io.ReadCloser, error) {
+	if name == "" || name == "-" {
+		return ioutil.NopCloser(stdin), nil
+	}
+	return os.Open(name)
+}
+
+func run1(cmd string, args []string, binAsTagged bool, stdin io.Reader, stdout io.Writer) (err error) {
+	var name string
+	if len(args) > 0 {
+		name = args[0]
+	}
+	f, err := open(name, stdin)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	w := bufio.NewWriter(stdout)
+	defer func() {
+		if err2 := w.Flush(); err == nil {
+			err = err2
+		}
+	}()
+	o := &msgpack.JSONOptions{BinAsTagged: binAsTagged}
+	switch cmd {
+	case "json2mp":
+		err = o.FromJSON(w, r)
+	case "mp2json":
+		err = o.ToJSON(w, r)
+	case "dump":
+		err = msgpack.DumpStream(w, r)
+	case "validate":
+		err = msgpack.DumpStream(ioutil.Discard, r)
+	}
+	return
+}
+
+// diff compares the streams in files a and b value by value, and prints the differences.
+func diff(a, b string, stdin io.Reader, stdout io.Writer) (err error) {
+	fa, err := open(a, stdin)
+	if err != nil {
+		return
+	}
+	defer fa.Close()
+	fb, err := open(b, stdin)
+	if err != nil {
+		return
+	}
+	defer fb.Close()
+	da, db := msgpack.NewDecoder(bufio.NewReader(fa), nil), msgpack.NewDecoder(bufio.NewReader(fb), nil)
+	var n int
+	for i := 0; ; i++ {
+		ma, mb := da.More(), db.More()
+		if !ma || !mb {
+			if ma != mb {
+				return fmt.Errorf("streams have a different number of values (from value %d)", i)
+			}
+			break
+		}
+		var ra, rb []byte
+		if ra, err = da.DecodeRaw(); err != nil {
+			return fmt.Errorf("%s: %v", a, err)
+		}
+		if rb, err = db.DecodeRaw(); err != nil {
+			return fmt.Errorf("%s: %v", b, err)
+		}
+		changes, err := msgpack.Diff(ra, rb)
+		if err != nil {
+			return err
+		}
+		for _, c := range changes {
+			fmt.Fprintf(stdout, "value %d: %v\n", i, c)
+		}
+		n += len(changes)
+	}
+	if n > 0 {
+		return fmt.Errorf("streams differ (changes: %d)", n)
+	}
+	return
+}
+
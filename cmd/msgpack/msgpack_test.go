@@ -0,0 +1,95 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a.mp"), filepath.Join(dir, "b.mp")
+	// {"a":[1,"x",true]} 2 and {"a":[1,"y",true]} 2
+	mp := "\x81\xa1a\x93\x01\xa1x\xc3\x02"
+	if err := os.WriteFile(a, []byte(mp), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(b, []byte(strings.Replace(mp, "x", "y", 1)), 0666); err != nil {
+		t.Fatal(err)
+	}
+	for _, x := range []struct {
+		args   []string
+		stdin  string
+		status int
+		stdout string // the expected stdout, or a part of it prefixed by "~"
+		stderr string // a part of the expected stderr
+	}{
+		{[]string{"json2mp"}, `{"a":[1,"x",true]} 2`, 0, mp, ""},
+		{[]string{"mp2json"}, mp, 0, "{\"a\":[1,\"x\",true]}\n2\n", ""},
+		{[]string{"mp2json", a}, "", 0, "{\"a\":[1,\"x\",true]}\n2\n", ""},
+		{[]string{"mp2json", "-"}, "\xc4\x02ab", 0, "\"YWI=\"\n", ""},
+		{[]string{"-tagged", "mp2json"}, "\xc4\x02ab", 0, "{\"$bin\":\"YWI=\"}\n", ""},
+		// bin read from JSON is written as a raw string, as []byte values are
+		{[]string{"-tagged", "json2mp"}, `{"$bin":"YWI="}`, 0, "\xa2ab", ""},
+		{[]string{"json2mp"}, `{"a":`, 1, "", "msgpack: "},
+		{[]string{"dump"}, mp, 0, "~fixstr len=1 \"x\"", ""},
+		{[]string{"validate"}, mp, 0, "", ""},
+		{[]string{"validate"}, "\x92\x01", 1, "", "msgpack: "},
+		{[]string{"validate", filepath.Join(dir, "missing.mp")}, "", 1, "", "no such file"},
+		{[]string{"diff", a, a}, "", 0, "", ""},
+		{[]string{"diff", a, b}, "", 1, "value 0: $.a[1]: value changed: \"x\" => \"y\"\n", "streams differ (changes: 1)"},
+		{[]string{"diff", a, "-"}, mp[:len(mp)-1], 1, "", "different number of values"},
+		{nil, "", 2, "", "usage:"},
+		{[]string{"nope"}, "", 2, "", "usage:"},
+		{[]string{"dump", a, b}, "", 2, "", "usage:"},
+		{[]string{"diff", a}, "", 2, "", "usage:"},
+		{[]string{"-nope", "dump"}, "", 2, "", "usage:"},
+	} {
+		var stdout, stderr bytes.Buffer
+		status := run(x.args, strings.NewReader(x.stdin), &stdout, &stderr)
+		if status != x.status {
+			t.Errorf("%q: status %d, want %d (stderr: %s)", x.args, status, x.status, stderr.String())
+		}
+		if want := strings.TrimPrefix(x.stdout, "~"); want != x.stdout && !strings.Contains(stdout.String(), want) ||
+			want == x.stdout && stdout.String() != want {
+			t.Errorf("%q: stdout %q, want %q", x.args, stdout.String(), x.stdout)
+		}
+		if !strings.Contains(stderr.String(), x.stderr) {
+			t.Errorf("%q: stderr %q, want it to contain %q", x.args, stderr.String(), x.stderr)
+		}
+	}
+}
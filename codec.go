@@ -0,0 +1,133 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+)
+
+// Codec marshals and unmarshals values with preconfigured options, pooling its 
+// Encoders, Decoders and buffers, so it can serve as the serializer of a cache client 
+// (e.g. for Redis or memcache) with few allocations per value. 
+// A Codec must not be copied after first use, and is safe for concurrent use.
+// 
+// If Version is set, each blob starts with it (as one byte), so a blob stored 
+// before the schema of its values changed can be told apart, and migrated by Upgrade.
+// 
+// Sample Usage:
+//   var UserCodec = &msgpack.Codec{ Encoder: &msgpack.EncoderOptions{NilSliceAsEmpty: true}, Version: 2 }
+//   bs, err := UserCodec.Marshal(user)
+//   err = UserCodec.Unmarshal(bs, &user)
+type Codec struct {
+	Encoder *EncoderOptions
+	Decoder *DecoderOptions
+	// Version, if non-zero, is written as the first byte of each blob, and checked when unmarshaling.
+	Version byte
+	// Upgrade, if set, unmarshals a blob of another version (given without its version byte) into v, 
+	// e.g. by decoding it into the old type and converting that. 
+	// If nil, such a blob is a *CodecVersionError.
+	Upgrade func(version byte, data []byte, v interface{}) error
+
+	encs sync.Pool // of *codecEncoder
+	decs sync.Pool // of *Decoder
+}
+
+// CodecVersionError is the error of Codec.Unmarshal for a blob of another version than the Codec's.
+type CodecVersionError struct {
+	Version byte // of the blob (0 if it is empty)
+	Want byte
+}
+
+func (e *CodecVersionError) Error() string {
+	return fmt.Sprintf("%s: blob of version %d, expecting version %d", msgTagDec, e.Version, e.Want)
+}
+
+// codecEncoder is the pooled state of Codec.Marshal.
+type codecEncoder struct {
+	buf bytes.Buffer
+	e *Encoder
+}
+
+// Marshal encodes v into a new blob (prefixed with the Version, if set).
+func (c *Codec) Marshal(v interface{}) (b []byte, err error) {
+	ce, _ := c.encs.Get().(*codecEncoder)
+	if ce == nil {
+		ce = new(codecEncoder)
+		ce.e = NewEncoderEx(&ce.buf, c.Encoder)
+	}
+	ce.buf.Reset()
+	if c.Version != 0 {
+		ce.buf.WriteByte(c.Version)
+	}
+	if err = ce.e.Encode(v); err != nil {
+		// the Encoder may be left mid-value, so it is not reused.
+		return
+	}
+	b = append([]byte(nil), ce.buf.Bytes()...)
+	if ce.buf.Cap() <= 64 << 10 {
+		c.encs.Put(ce)
+	}
+	return
+}
+
+// Unmarshal decodes the blob data into v. A blob of another version is passed to Upgrade.
+func (c *Codec) Unmarshal(data []byte, v interface{}) (err error) {
+	if c.Version != 0 {
+		if len(data) == 0 {
+			return &CodecVersionError{ Want: c.Version }
+		}
+		if version := data[0]; version != c.Version {
+			if c.Upgrade == nil {
+				return &CodecVersionError{ Version: version, Want: c.Version }
+			}
+			return c.Upgrade(version, data[1:], v)
+		}
+		data = data[1:]
+	}
+	d, _ := c.decs.Get().(*Decoder)
+	if d == nil {
+		var dam DecoderContainerResolver
+		if c.Decoder != nil {
+			dam = c.Decoder
+		}
+		d = NewDecoderBytes(nil, dam)
+	}
+	d.resetBytes(data)
+	if err = d.Decode(v); err == nil {
+		d.resetBytes(nil)
+		c.decs.Put(d)
+	}
+	return
+}
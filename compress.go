@@ -0,0 +1,233 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// StreamTransform transforms each message written by a CompressedEncoder, and
+// reverses that for a CompressedDecoder. It is typically a compression algorithm: 
+// FlateTransform and GzipTransform are provided, and others (e.g. snappy or zstd) 
+// can be plugged in with a small adapter:
+//    type snappyTransform struct{}
+//    func (snappyTransform) Encode(dst, src []byte) ([]byte, error) { return snappy.Encode(dst, src), nil }
+//    func (snappyTransform) Decode(dst, src []byte) ([]byte, error) { return snappy.Decode(dst, src) }
+type StreamTransform interface {
+	// Encode appends the transformed src to dst[:0] (which may be reused), and returns it.
+	Encode(dst, src []byte) ([]byte, error)
+	// Decode reverses Encode.
+	Decode(dst, src []byte) ([]byte, error)
+}
+
+// FlateTransform is a StreamTransform compressing with DEFLATE (compress/flate).
+type FlateTransform struct {
+	Level int // compression level (0 means flate.DefaultCompression)
+	// MaxDecoded limits the size of a decompressed message (0 means unlimited), 
+	// guarding against decompression bombs.
+	MaxDecoded int
+}
+
+// GzipTransform is a StreamTransform compressing with gzip (compress/gzip).
+type GzipTransform FlateTransform
+
+func (t FlateTransform) Encode(dst, src []byte) ([]byte, error) {
+	return transformEncode(dst, src, func(w io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(w, compressLevel(t.Level))
+	})
+}
+
+func (t FlateTransform) Decode(dst, src []byte) ([]byte, error) {
+	return transformDecode(dst, flate.NewReader(bytes.NewReader(src)), t.MaxDecoded)
+}
+
+func (t GzipTransform) Encode(dst, src []byte) ([]byte, error) {
+	return transformEncode(dst, src, func(w io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriterLevel(w, compressLevel(t.Level))
+	})
+}
+
+func (t GzipTransform) Decode(dst, src []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	return transformDecode(dst, r, t.MaxDecoded)
+}
+
+func compressLevel(l int) int {
+	if l == 0 {
+		return flate.DefaultCompression
+	}
+	return l
+}
+
+func transformEncode(dst, src []byte, fn func(io.Writer) (io.WriteCloser, error)) ([]byte, error) {
+	buf := bytes.NewBuffer(dst[:0])
+	w, err := fn(buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(src); err == nil {
+		err = w.Close()
+	}
+	return buf.Bytes(), err
+}
+
+func transformDecode(dst []byte, r io.ReadCloser, max int) ([]byte, error) {
+	defer r.Close()
+	buf := bytes.NewBuffer(dst[:0])
+	var rd io.Reader = r
+	if max > 0 {
+		rd = io.LimitReader(r, int64(max) + 1)
+	}
+	if _, err := buf.ReadFrom(rd); err != nil {
+		return nil, err
+	}
+	if max > 0 && buf.Len() > max {
+		return nil, fmt.Errorf("decompressed message exceeds %d bytes", max)
+	}
+	return buf.Bytes(), nil
+}
+
+// CompressedEncoder writes each message transformed (compressed) by a StreamTransform, 
+// in a frame for reading by a CompressedDecoder. A frame is:
+//    flag (1 byte: 1 if transformed, 0 if stored as is) | length (uint32, big-endian) | data
+type CompressedEncoder struct {
+	// MinSize is the size from which messages are transformed (smaller ones are stored as is).
+	MinSize int
+	w io.Writer
+	t StreamTransform
+	buf bytes.Buffer
+	tbuf []byte
+	enc *Encoder
+}
+
+// NewCompressedEncoder returns a CompressedEncoder writing to w, transforming messages with t.
+// opts configures the encoding (and may be nil).
+func NewCompressedEncoder(w io.Writer, t StreamTransform, opts *EncoderOptions) *CompressedEncoder {
+	ce := &CompressedEncoder{w: w, t: t}
+	ce.enc = NewEncoderEx(&ce.buf, opts)
+	return ce
+}
+
+// Encode encodes v, and writes it as a frame.
+func (ce *CompressedEncoder) Encode(v interface{}) (err error) {
+	ce.buf.Reset()
+	if err = ce.enc.Encode(v); err != nil {
+		return
+	}
+	var hdr [5]byte
+	data := ce.buf.Bytes()
+	if len(data) >= ce.MinSize {
+		if ce.tbuf, err = ce.t.Encode(ce.tbuf, data); err != nil {
+			return fmt.Errorf("%v: CompressedEncoder: %v", msgTagEnc, err)
+		}
+		hdr[0], data = 1, ce.tbuf
+	}
+	if uint64(len(data)) > 0xffffffff {
+		return fmt.Errorf("%v: CompressedEncoder: message too large: %d bytes", msgTagEnc, len(data))
+	}
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(data)))
+	if _, err = ce.w.Write(hdr[:]); err == nil {
+		_, err = ce.w.Write(data)
+	}
+	return
+}
+
+// CompressedDecoder reads frames written by a CompressedEncoder.
+type CompressedDecoder struct {
+	// MaxSize is the size of the largest frame accepted (DefaultMaxChecksumFrame if <= 0).
+	// To limit the size of decoded messages, configure the StreamTransform (e.g. FlateTransform.MaxDecoded).
+	MaxSize int
+	r io.Reader
+	t StreamTransform
+	dam DecoderContainerResolver
+	buf, tbuf []byte
+}
+
+// NewCompressedDecoder returns a CompressedDecoder reading from r, reversing t.
+// dam is used to decode messages (as for NewDecoder).
+func NewCompressedDecoder(r io.Reader, t StreamTransform, dam DecoderContainerResolver) *CompressedDecoder {
+	return &CompressedDecoder{r: r, t: t, dam: dam}
+}
+
+// DecodeRaw reads the next frame, and returns its message (the encoding of a value).
+// It returns io.EOF if there are no more frames, and io.ErrUnexpectedEOF if the stream ends
+// within a frame. The returned Raw is only valid until the next call.
+func (cd *CompressedDecoder) DecodeRaw() (bs Raw, err error) {
+	var hdr [5]byte
+	if _, err = io.ReadFull(cd.r, hdr[:]); err != nil {
+		return
+	}
+	max := cd.MaxSize
+	if max <= 0 {
+		max = DefaultMaxChecksumFrame
+	}
+	l := binary.BigEndian.Uint32(hdr[1:])
+	if hdr[0] > 1 || uint64(l) > uint64(max) {
+		return nil, fmt.Errorf("%v: CompressedDecoder: invalid frame header: %x", msgTagDec, hdr)
+	}
+	if cap(cd.buf) < int(l) {
+		cd.buf = make([]byte, l)
+	}
+	data := cd.buf[:l]
+	if _, err = io.ReadFull(cd.r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	if hdr[0] == 1 {
+		if cd.tbuf, err = cd.t.Decode(cd.tbuf, data); err != nil {
+			return nil, fmt.Errorf("%v: CompressedDecoder: %v", msgTagDec, err)
+		}
+		data = cd.tbuf
+	}
+	return data, nil
+}
+
+// Decode reads the next frame (see DecodeRaw), and decodes its message into v.
+func (cd *CompressedDecoder) Decode(v interface{}) (err error) {
+	bs, err := cd.DecodeRaw()
+	if err != nil {
+		return
+	}
+	return Unmarshal(bs, v, cd.dam)
+}
+
@@ -0,0 +1,93 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// DefaultDatagramLimit is the default size limit of a datagram: the largest UDP payload
+// which fits in an Ethernet frame (1500 bytes, less 28 bytes of IPv4 and UDP headers). 
+const DefaultDatagramLimit = 1472
+
+// ErrDatagramTruncated is returned by ReadDatagram when a datagram did not fit in the buffer.
+var ErrDatagramTruncated = errors.New("msgpack: datagram truncated (larger than the buffer)")
+
+// MarshalDatagram encodes v for sending as a single datagram. It returns an error if
+// the encoding is larger than limit bytes (DefaultDatagramLimit if limit <= 0).
+func MarshalDatagram(v interface{}, limit int) (b []byte, err error) {
+	if limit <= 0 {
+		limit = DefaultDatagramLimit
+	}
+	if b, err = Marshal(v); err != nil {
+		return
+	}
+	if len(b) > limit {
+		return nil, fmt.Errorf("%v: datagram of %d bytes exceeds limit of %d", msgTagEnc, len(b), limit)
+	}
+	return
+}
+
+// WriteDatagram encodes v, and sends it to addr as a single datagram (see MarshalDatagram). 
+func WriteDatagram(c net.PacketConn, addr net.Addr, v interface{}, limit int) (err error) {
+	b, err := MarshalDatagram(v, limit)
+	if err != nil {
+		return
+	}
+	_, err = c.WriteTo(b, addr)
+	return
+}
+
+// ReadDatagram receives a datagram into buf, and decodes it into v. 
+// 
+// The datagram must hold exactly one value. As a datagram larger than buf is 
+// silently truncated by the system, one which fills buf is rejected with ErrDatagramTruncated:
+// buf should be at least one byte larger than the largest datagram expected.
+// On a decoding error, the sender's address is still returned.
+func ReadDatagram(c net.PacketConn, buf []byte, v interface{}, dam DecoderContainerResolver) (addr net.Addr, err error) {
+	n, addr, err := c.ReadFrom(buf)
+	if err != nil {
+		return
+	}
+	if n == len(buf) {
+		return addr, ErrDatagramTruncated
+	}
+	if err = CheckValid(buf[:n]); err != nil {
+		return
+	}
+	err = Unmarshal(buf[:n], v, dam)
+	return
+}
+
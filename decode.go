@@ -57,7 +57,11 @@ import (
 	// "net"
 	"time"
 	// "runtime/debug"
+	"unsafe"
 	"encoding/binary"
+	"encoding"
+	"strings"
+	"unicode/utf8"
 )
 
 // Some tagging information for error messages.
@@ -67,6 +71,17 @@ var (
 	msgBadDesc = "Unrecognized descriptor byte: "
 )
 
+const (
+	// decMaxDepth caps the nesting of values in a decoded value (see Decoder.enter).
+	decMaxDepth = 10000
+	// readChunkLen is the size of the first chunk of a large str or bin value 
+	// read from a stream (see Decoder.readChunked).
+	readChunkLen = 64 * 1024
+	// decMaxInitLen is the most elements allocated up front for an array read from a stream 
+	// (see Decoder.initLen).
+	decMaxInitLen = 1024
+)
+
 // Default DecoderContainerResolver used when a nil parameter is passed to NewDecoder().
 // Sample Usage:
 //   opts := msgpack.DefaultDecoderContainerResolver // makes a copy
@@ -81,9 +96,28 @@ var DefaultDecoderContainerResolver = SimpleDecoderContainerResolver {
 }
 
 // A Decoder reads and decodes an object from an input stream in the msgpack format.
+// 
+// A Decoder never reads past the end of the value it is decoding. At most a single byte 
+// of look-ahead is held internally, and it is available via Buffered. It is thus safe to 
+// share the underlying stream (e.g. a net.Conn) between a Decoder and other protocol logic.
+// 
+// A Decoder is not safe for concurrent use. In builds with the race detector, 
+// concurrent calls to Decode panic.
 type Decoder struct {
-	r io.Reader
+	r decReader
+	g usageGuard
 	dam DecoderContainerResolver
+	o DecoderOptions
+	interned map[string]string  // see DecoderOptions.InternMapKeys
+	kb []byte                   // scratch buffer for reading interned keys
+	refs map[uint64]reflect.Value // shared values decoded so far, by id (see EncoderOptions.SharedRefs)
+	tc *typeCache                 // type metadata, shared with the Handle the Decoder was created from (if any)
+	path []interface{}            // path of the value being decoded, when tracing (see DecoderOptions.Trace)
+	inPartial bool                // decoding a container which keeps a partial result (see beginPartial)
+	depth int                     // nesting of the value being decoded (see enter)
+	limit int64       // if > 0, the input offset not to read beyond (see setLimit)
+	limitErr error
+	rec recDecReader  // records raw values (see rawAppend)
 	x [16]byte        //temp byte array re-used internally for efficiency
 	t1, t2, t4, t8 []byte // use these, so no need to constantly re-slice
 }
@@ -103,6 +137,10 @@ type DecoderContainerResolver interface {
 	//   - If decoding into a slice, they will be the slice and the index into the slice (an int)
 	//   - Else they will be Invalid/nil
 	// 
+	// The length is that of the container, except when decoding from an io.Reader, where 
+	// it is capped so a corrupt length cannot allocate a huge value: a slice returned 
+	// shorter than the container is grown as its elements are decoded.
+	// 
 	// Custom code can use this callback to determine how specifically to decode something.
 	// A simple implementation exists which just uses some options to do it 
 	// (see SimpleDecoderContainerResolver).
@@ -179,13 +217,128 @@ func (d SimpleDecoderContainerResolver) DecoderContainer(
 	return
 }
 
+// DecoderOptions configures a Decoder.
+// 
+// A *DecoderOptions is itself a DecoderContainerResolver (delegating to its ContainerResolver),
+// so it can be passed anywhere a DecoderContainerResolver is accepted, e.g.
+//   err = msgpack.NewDecoder(r, &msgpack.DecoderOptions{ZeroCopy: true}).Decode(&v)
+type DecoderOptions struct {
+	// ContainerResolver is used when decoding a container into a nil interface{}.
+	// If nil, DefaultDecoderContainerResolver is used.
+	ContainerResolver DecoderContainerResolver
+	// RawToString decodes str values (the raw family of the original spec, or the str family 
+	// of the newer one) into a nil interface{} as a string, and bin values as a []byte, 
+	// wherever they are (instead of as the ContainerResolver says, for both alike).
+	RawToString bool
+	// ZeroCopy makes decoded strings and []byte values alias the input, instead of copying it.
+	// It only applies when decoding from a byte slice (NewDecoderBytes or Unmarshal).
+	// 
+	// The caller then owns the lifetime of the input: it must not be modified (or re-used) 
+	// for as long as any decoded value is in use. Strings are created with package unsafe, 
+	// so modifying the input would change (immutable) strings in place.
+	ZeroCopy bool
+	// InternMapKeys, if > 0, makes the Decoder keep a table of up to that many distinct
+	// string map keys, so that identical keys decoded into string-keyed maps share storage 
+	// instead of allocating a new string per occurrence. Once the table is full, new keys 
+	// are allocated as usual. The table lives as long as the Decoder.
+	InternMapKeys int
+	// ReplaceExisting controls decoding into a non-nil map or a struct.
+	// 
+	// By default, we merge: keys/fields in the stream are decoded into the existing map/struct, 
+	// leaving any others intact. Values are themselves decoded into (merged with) the existing 
+	// value for that key/field. This is useful for applying partial updates.
+	// 
+	// If ReplaceExisting is set, a map is first cleared, and exported struct fields
+	// not in the stream are set to their zero value, so the result reflects only the stream.
+	// 
+	// Slices are always replaced (see Decode), though their storage is re-used.
+	ReplaceExisting bool
+	// NonFinite says how NaN and ±Inf float values in the stream are decoded.
+	// With NonFiniteAsNil, they are decoded as if they were nil.
+	NonFinite NonFinitePolicy
+	// InvalidUTF8 says how strings which are not valid UTF-8 (e.g. Latin-1 text sent in str values)
+	// are decoded into strings, including map keys and strings decoded into interface{} values.
+	// Decoding into a []byte is unaffected. By default (UTF8PassThrough), they are decoded as-is.
+	InvalidUTF8 UTF8Policy
+	// Exts decodes the ext types registered in it. 
+	Exts *ExtRegistry
+	// DurationUnit, if set, is the unit of integers decoded into a time.Duration 
+	// (e.g. time.Millisecond), instead of nanoseconds. 
+	// Strings (e.g. "1h2m0.5s") are always accepted, and parsed by time.ParseDuration.
+	DurationUnit time.Duration
+	// Types decodes ExtTyped values into interfaces as the types named in it.
+	Types *TypeRegistry
+	// DecodeHooks, if set, convert values whose wire type does not fit the type they are decoded into 
+	// (e.g. a string into a time.Time), instead of failing. Each is called in turn with 
+	// the result of the previous one (see DecodeHook). They are not called for nil, ext values, 
+	// or values decoded into interfaces.
+	DecodeHooks []DecodeHook
+	// Migrations migrates older encodings of versioned struct types before decoding them.
+	Migrations *Migrations
+	// Validate calls the Validate method of decoded structs implementing Validator,
+	// failing with a ValidationError if it returns an error.
+	Validate bool
+	// FieldNameMapper, if set, maps the names of struct fields without names in their tags
+	// to the keys they are decoded from (see EncoderOptions.FieldNameMapper).
+	FieldNameMapper FieldNameMapper
+	// FieldTypes, if set, resolves the concrete types to decode interface-typed struct fields into
+	// (e.g. from typeof hints in their tags), instead of as into a nil interface{}.
+	FieldTypes FieldTypeResolver
+	// Trace, if set, is called with each value decoded, before decoding it (see TraceFunc),
+	// e.g. to debug a failure deep inside a nested value. It slows decoding down.
+	Trace TraceFunc
+	// PartialResults makes a failure partway through an array or map keep the elements 
+	// (or entries) decoded before it, e.g. to salvage the leading records of a corrupted file.
+	// Decode then returns a PartialError. This applies to the outermost array or map being 
+	// decoded when the failure happens (e.g. a slice field of the struct decoded).
+	PartialResults bool
+	// MaxContainerLen, if > 0, fails the decoding of arrays, maps, str, bin and ext values 
+	// longer than this, before anything is allocated for them. 
+	// 
+	// When decoding from a byte slice (e.g. Unmarshal), lengths are always checked against 
+	// the input left, so a corrupt (or malicious) length cannot cause a huge allocation. 
+	// An io.Reader's length is not known in advance: set this when decoding untrusted streams.
+	MaxContainerLen int
+	// Stats, if set, receives the Stats of each value decoded by Decode.
+	Stats StatsCollector
+}
+
+// DecoderContainer delegates to o.ContainerResolver (or DefaultDecoderContainerResolver if nil).
+func (o *DecoderOptions) DecoderContainer(parentcontainer reflect.Value, parentkey interface{}, 
+	length int, ct ContainerType) (val reflect.Value) {
+	if o.ContainerResolver == nil {
+		return DefaultDecoderContainerResolver.DecoderContainer(parentcontainer, parentkey, length, ct)
+	}
+	return o.ContainerResolver.DecoderContainer(parentcontainer, parentkey, length, ct)
+}
+
 // NewDecoder returns a Decoder for decoding a stream of bytes into an object.
-// If nil DecoderContainerResolver is passed, we use DefaultDecoderContainerResolver
+// If nil DecoderContainerResolver is passed, we use DefaultDecoderContainerResolver.
+// Pass a *DecoderOptions to configure the Decoder further.
 func NewDecoder(r io.Reader, dam DecoderContainerResolver) (d *Decoder) {
+	return newDecoder(&ioDecReader{r:r}, dam)
+}
+
+// NewDecoderBytes returns a Decoder which decodes directly from a byte slice.
+// It is more efficient than wrapping the slice in a reader and passing it to NewDecoder.
+func NewDecoderBytes(data []byte, dam DecoderContainerResolver) (d *Decoder) {
+	return newDecoder(&bytesDecReader{b:data}, dam)
+}
+
+func newDecoder(r decReader, dam DecoderContainerResolver) (d *Decoder) {
+	d = &Decoder{r:r}
+	if o, ok := dam.(*DecoderOptions); ok {
+		// a nil *DecoderOptions means the defaults
+		dam = nil
+		if o != nil {
+			d.o = *o
+			dam = o.ContainerResolver
+		}
+	}
 	if dam == nil {
 		dam = &DefaultDecoderContainerResolver
 	}
-	d = &Decoder{r:r, dam:dam}
+	d.dam = dam
 	d.t1, d.t2, d.t4, d.t8 = d.x[:1], d.x[:2], d.x[:4], d.x[:8]
 	return
 }
@@ -200,6 +353,18 @@ func NewDecoder(r io.Reader, dam DecoderContainerResolver) (d *Decoder) {
 // If you do not know what type of stream it is, pass in a pointer to a nil interface.
 // We will decode and store a value in that nil interface. 
 // 
+// When decoding into a non-nil map or a struct, keys in the stream are merged into it,
+// unless DecoderOptions.ReplaceExisting is set. A slice takes the length of the array 
+// in the stream, re-using its backing array if large enough.
+// 
+// A struct field missing from the stream is set to the default in its tag (if any) instead 
+// of its zero value: if it is zero (or always, with ReplaceExisting). The default is the last
+// tag option, and is parsed according to the field's type (a number, bool, string, duration, 
+// or the text of a type implementing encoding.TextUnmarshaler). E.g.
+//   Retries int           `msgpack:"retries,default=3"`
+//   Timeout time.Duration `msgpack:",omitempty,default=1m30s"`
+// Note that a field tagged omitempty then decodes its zero value as the default.
+// 
 // time.Time is handled transparently, by (en)decoding (to)from a 
 // []int64{Seconds since Epoch, Nanoseconds offset}.
 // 
@@ -223,6 +388,8 @@ func (d *Decoder) Decode(v interface{}) (err error) {
 // The reflect.Value must be a pointer.
 // See Decoder.Decode documentation. (Decode internally calls DecodeValue).
 func (d *Decoder) DecodeValue(rv reflect.Value) (err error) {
+	d.g.enter("Decoder")
+	defer d.g.exit()
 	defer panicToErr(&err)
 	// We cannot marshal into a non-pointer or a nil pointer 
 	// (at least pass a nil interface so we can marshal into it)
@@ -231,20 +398,229 @@ func (d *Decoder) DecodeValue(rv reflect.Value) (err error) {
 		if rv.IsValid() && rv.CanInterface() {
 			rvi = rv.Interface()
 		}
-		err = fmt.Errorf("%v: DecodeValue: Expecting valid pointer to decode into. Got: %v, %T, %v",
+		err = fmt.Errorf("%v: DecodeValue: Expecting valid pointer to decode into " + 
+			"(for a nil pointer, see DecodeNew). Got: %v, %T, %v",
 			msgTagDec, rv.Kind(), rvi, rvi)
 		return
 	}
 
+	d.refs = nil
+	d.path = d.path[:0]
+	d.inPartial = false
+	d.depth = 0
+	if d.o.Stats != nil {
+		d.decodeStats(rv.Elem())
+		return
+	}
 	//if a nil pointer is passed, set rv to the underlying value (not pointer).
 	d.decodeValueT(0, -1, true, rv.Elem(), true, true, true)
 	return
 }
 
+// DecodeMulti decodes successive values in the stream into each of vs in turn.
+// It stops at the first error.
+func (d *Decoder) DecodeMulti(vs ...interface{}) (err error) {
+	for _, v := range vs {
+		if err = d.Decode(v); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// DecodeNew decodes into the pointer v, allocating what it points to first if v is nil, 
+// and returns the (possibly new) pointer. Nil pointers within the value, 
+// including chains of them (e.g. **T), are allocated as needed.
+// 
+// Decode cannot do this, as the caller would not see the new pointer:
+//   var p *int32
+//   x, err := dec.DecodeNew(p)
+//   p = x.(*int32)
+func (d *Decoder) DecodeNew(v interface{}) (pv interface{}, err error) {
+	rv := reflectValue(v)
+	if rv.Kind() != reflect.Ptr {
+		err = fmt.Errorf("%v: DecodeNew: Expecting pointer. Got: %v", msgTagDec, rv.Kind())
+		return
+	}
+	if rv.IsNil() {
+		rv = reflect.New(rv.Type().Elem())
+	}
+	if err = d.DecodeValue(rv); err == nil {
+		pv = rv.Interface()
+	}
+	return
+}
+
+// More reports whether there is another value in the stream to decode.
+// 
+// It peeks at the next byte, which the Decoder keeps (see Buffered). Use it to process
+// a stream of back-to-back msgpack values:
+//   for dec.More() {
+//       if err = dec.Decode(&v); err != nil { ... }
+//   }
+func (d *Decoder) More() bool {
+	_, err := d.peekn1()
+	return err == nil
+}
+
+// DecodeAll decodes every remaining value in the stream, appending each one
+// to the slice pointed to by v (e.g. a *[]MyRecord or *[]interface{}).
+// 
+// On error, the slice holds all values decoded before the failing one.
+func (d *Decoder) DecodeAll(v interface{}) (err error) {
+	rv := reflectValue(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Slice {
+		err = fmt.Errorf("%v: DecodeAll: Expecting valid pointer to slice. Got: %v", msgTagDec, rv.Kind())
+		return
+	}
+	rvs := rv.Elem()
+	rvelemtype := rvs.Type().Elem()
+	for d.More() {
+		l := rvs.Len()
+		rvs.Set(reflect.Append(rvs, reflect.Zero(rvelemtype)))
+		if err = d.DecodeValue(rvs.Index(l).Addr()); err != nil {
+			rvs.SetLen(l)
+			return
+		}
+	}
+	return
+}
+
+// Skip advances past the next value in the stream (recursively, for maps and arrays), 
+// without decoding it into any Go object.
+func (d *Decoder) Skip() (err error) {
+	defer panicToErr(&err)
+	d.skip(0, true)
+	return
+}
+
+// DecodeRaw returns the undecoded msgpack encoding of the next value in the stream.
+// The returned slice is a copy, owned by the caller (unless DecoderOptions.ZeroCopy applies).
+// 
+// See also the Raw type, which does the same for a field of a struct (or any other value).
+func (d *Decoder) DecodeRaw() (bs []byte, err error) {
+	defer panicToErr(&err)
+	d.readb(1, d.t1)
+	bs = d.raw(d.t1[0])
+	return
+}
+
+// decodeRawAppend is like DecodeRaw, but appends the encoding to dst (see rawAppend).
+func (d *Decoder) decodeRawAppend(dst []byte) (bs []byte, err error) {
+	defer panicToErr(&err)
+	d.readb(1, d.t1)
+	bs = d.rawAppend(d.t1[0], dst)
+	return
+}
+
+// resetBytes makes a Decoder made by NewDecoderBytes decode from data, 
+// keeping its options and buffers.
+func (d *Decoder) resetBytes(data []byte) {
+	z := d.r.(*bytesDecReader)
+	z.b, z.c = data, 0
+	d.limit = 0
+}
+
+// ForEachMapEntry reads the next value in the stream, which must be a map (or nil), 
+// and calls fn for each of its entries in turn, without decoding the values.
+// 
+// key is the content of a str or bin key, or the encoding of any other key.
+// val is the encoding of the value, which fn can decode (e.g. with Unmarshal) or keep.
+// Both are copies, unless DecoderOptions.ZeroCopy applies.
+// 
+// If fn returns an error, ForEachMapEntry returns it at once (leaving the stream within the map).
+func (d *Decoder) ForEachMapEntry(fn func(key []byte, val Raw) error) (err error) {
+	defer panicToErr(&err)
+	bd := d.readn1()
+	if bd == 0xc0 {
+		return
+	}
+	if descValueType(bd) != MapType {
+		d.err("ForEachMapEntry: Expecting map. %s: hex: %x", msgBadDesc, bd)
+	}
+	l := d.readContainerLen(bd, false, ContainerMap)
+	for i := 0; i < l; i++ {
+		var key []byte
+		switch bd = d.readn1(); descValueType(bd) {
+		case StrType, BinType:
+			key = d.readBytes(d.readContainerLen(bd, false, ContainerRawBytes))
+		default:
+			key = d.raw(bd)
+		}
+		if err = fn(key, d.raw(d.readn1())); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// raw returns the full encoding of the value whose descriptor byte (bd) was just read.
+func (d *Decoder) raw(bd byte) (bs []byte) {
+	return d.rawAppend(bd, nil)
+}
+
+// rawAppend is like raw, but appends the encoding to dst (unless ZeroCopy applies), 
+// so the storage of dst can be re-used.
+func (d *Decoder) rawAppend(bd byte, dst []byte) (bs []byte) {
+	if z, ok := d.r.(*bytesDecReader); ok {
+		c := z.c - 1
+		d.skip(bd, false)
+		if bs = z.b[c:z.c:z.c]; !d.o.ZeroCopy {
+			bs = append(dst, bs...)
+		}
+		return
+	}
+	z := &d.rec
+	z.decReader, z.bs = d.r, append(dst, bd)
+	d.r = z
+	defer func() {
+		d.r = z.decReader
+		z.decReader, z.bs = nil, nil
+	}()
+	d.skip(bd, false)
+	return z.bs
+}
+
+func (d *Decoder) skip(bd byte, readDesc bool) {
+	// Iterate (instead of recursing) over the number of values left to skip.
+	// A map or array adds its elements to that count, raw bytes are discarded directly.
+	for n := 1; n > 0; n-- {
+		if readDesc {
+			d.readb(1, d.t1)
+			bd = d.t1[0]
+		}
+		readDesc = true
+		switch {
+		case bd == 0xc0, bd == 0xc2, bd == 0xc3, bd >= 0xe0, bd <= 0x7f:
+		case bd == 0xcc, bd == 0xd0:
+			d.skipb(1)
+		case bd == 0xcd, bd == 0xd1:
+			d.skipb(2)
+		case bd == 0xca, bd == 0xce, bd == 0xd2:
+			d.skipb(4)
+		case bd == 0xcb, bd == 0xcf, bd == 0xd3:
+			d.skipb(8)
+		case bd == 0xda, bd == 0xdb, bd == 0xd9, bd >= 0xa0 && bd <= 0xbf, bd >= 0xc4 && bd <= 0xc6:
+			d.skipb(d.readContainerLen(bd, false, ContainerRawBytes))
+		case bd >= 0xc7 && bd <= 0xc9, bd >= 0xd4 && bd <= 0xd8:
+			_, l := d.readExtHeader(bd)
+			d.skipb(l)
+		case bd == 0xdc, bd == 0xdd, bd >= 0x90 && bd <= 0x9f:
+			n += d.readContainerLen(bd, false, ContainerList)
+		case bd == 0xde, bd == 0xdf, bd >= 0x80 && bd <= 0x8f:
+			n += 2 * d.readContainerLen(bd, false, ContainerMap)
+		default:
+			d.err("skip: %s: hex: %x, dec: %d", msgBadDesc, bd, bd)
+		}
+	}
+}
+
 func (d *Decoder) decodeValueT(bd byte, containerLen int, readDesc bool, rve reflect.Value, 
 	checkWasNilIntf bool, dereferencePtr bool, setToRealValue bool) (rvn reflect.Value) {
 	rvn = rve
+	d.enter()
 	wasNilIntf, rv := d.decodeValue(bd, containerLen, readDesc, rve)
+	d.exit()
 	//if wasNilIntf, rv is either a pointer to actual value, a map or slice, or nil/invalid
 	if ((checkWasNilIntf && wasNilIntf) || !checkWasNilIntf) && rv.IsValid() {
 		if dereferencePtr && rv.Kind() == reflect.Ptr {
@@ -264,6 +640,9 @@ func (d *Decoder) nilIntfDecode(bd0 byte, containerLen0 int, readDesc bool, setC
 	if readDesc {
 		d.readb(1, d.t1)
 		bd = d.t1[0]
+		if d.o.Trace != nil {
+			d.trace(bd, rv.Type())
+		}
 	}
 	//if we set the reflect.Value to an primitive value, consider it handled and return.
 	handled = true
@@ -275,9 +654,13 @@ func (d *Decoder) nilIntfDecode(bd0 byte, containerLen0 int, readDesc bool, setC
 		rv.Set(reflect.ValueOf(true))
 
 	case bd == 0xca:
-		rv.Set(reflect.ValueOf(math.Float32frombits(d.readUint32())))
+		if f := math.Float32frombits(d.readUint32()); !d.nonFiniteAsNil(float64(f)) {
+			rv.Set(reflect.ValueOf(f))
+		}
 	case bd == 0xcb:
-		rv.Set(reflect.ValueOf(math.Float64frombits(d.readUint64())))
+		if f := math.Float64frombits(d.readUint64()); !d.nonFiniteAsNil(f) {
+			rv.Set(reflect.ValueOf(f))
+		}
 		
 	case bd == 0xcc:
 		rv.Set(reflect.ValueOf(d.readUint8()))
@@ -297,13 +680,21 @@ func (d *Decoder) nilIntfDecode(bd0 byte, containerLen0 int, readDesc bool, setC
 	case bd == 0xd3:
 		rv.Set(reflect.ValueOf(int64(d.readUint64())))
 
-	case bd == 0xda, bd == 0xdb, bd >= 0xa0 && bd <= 0xbf:
+	case bd == 0xda, bd == 0xdb, bd == 0xd9, bd >= 0xa0 && bd <= 0xbf, bd >= 0xc4 && bd <= 0xc6:
 		ct = ContainerRawBytes
 		if containerLen < 0 {
 			containerLen = d.readContainerLen(bd, false, ct)
 		}
+		if d.o.RawToString {
+			if descValueType(bd) == BinType {
+				rv.Set(reflect.ValueOf(d.readBytes(containerLen)))
+			} else {
+				rv.Set(reflect.ValueOf(d.readString(containerLen)))
+			}
+			break
+		}
 		if setContainers {
-			rv.Set(d.dam.DecoderContainer(reflect.Value{}, nil, containerLen, ct))
+			rv.Set(d.dam.DecoderContainer(reflect.Value{}, nil, d.initLen(containerLen), ct))
 			rv = rv.Elem()
 		}
 		handled = false
@@ -313,7 +704,7 @@ func (d *Decoder) nilIntfDecode(bd0 byte, containerLen0 int, readDesc bool, setC
 			containerLen = d.readContainerLen(bd, false, ct)
 		}
 		if setContainers {
-			rv.Set(d.dam.DecoderContainer(reflect.Value{}, nil, containerLen, ct))
+			rv.Set(d.dam.DecoderContainer(reflect.Value{}, nil, d.initLen(containerLen), ct))
 		}
 		handled = false
 	case bd == 0xde, bd == 0xdf, bd >= 0x80 && bd <= 0x8f:
@@ -322,9 +713,11 @@ func (d *Decoder) nilIntfDecode(bd0 byte, containerLen0 int, readDesc bool, setC
 			containerLen = d.readContainerLen(bd, false, ct)
 		}
 		if setContainers {
-			rv.Set(d.dam.DecoderContainer(reflect.Value{}, nil, containerLen, ct))
+			rv.Set(d.dam.DecoderContainer(reflect.Value{}, nil, d.initLen(containerLen), ct))
 		}
 		handled = false
+	case isExtDesc(bd):
+		d.decodeExt(bd, rv)
 	case bd >= 0xe0 && bd <= 0xff, bd >= 0x00 && bd <= 0x7f:
 		// FIXNUM
 		rv.Set(reflect.ValueOf(int8(bd)))
@@ -346,8 +739,19 @@ func (d *Decoder) decodeValue(bd byte, containerLen int, readDesc bool, rv0 refl
 	if readDesc {
 		d.readb(1, d.t1)
 		bd = d.t1[0]
+		if d.o.Trace != nil {
+			d.trace(bd, rv.Type())
+		}
 	}
 
+	if rv.Type() == valueTyp {
+		d.decodeNode(bd, containerLen, rv.Addr().Interface().(*Value))
+		return
+	}
+	if isExtDesc(bd) {
+		return d.decodeExt(bd, rv)
+	}
+	
 	rk := rv.Kind()
 	wasNilIntf = rk == reflect.Interface && rv.IsNil()
 
@@ -368,6 +772,12 @@ func (d *Decoder) decodeValue(bd byte, containerLen int, readDesc bool, rv0 refl
 		return
 	}
 	
+	if d.o.DecodeHooks != nil && containerLen < 0 && rk != reflect.Ptr && rk != reflect.Interface && 
+		!wireFits(descValueType(bd), rv.Type()) {
+		d.decodeHooked(bd, rv)
+		return
+	}
+	
 	// cases are arranged in sequence of most probable ones
 	switch rk {
 	default:
@@ -378,10 +788,18 @@ func (d *Decoder) decodeValue(bd byte, containerLen int, readDesc bool, rv0 refl
 		case 0xc3:
 			rv.SetBool(true)
 			
-		case 0xca:
-			rv.SetFloat(float64(math.Float32frombits(d.readUint32())))
-		case 0xcb:
-			rv.SetFloat(math.Float64frombits(d.readUint64()))
+		case 0xca, 0xcb:
+			var f float64
+			if bd == 0xca {
+				f = float64(math.Float32frombits(d.readUint32()))
+			} else {
+				f = math.Float64frombits(d.readUint64())
+			}
+			if d.nonFiniteAsNil(f) {
+				rv.Set(reflect.Zero(rv.Type()))
+			} else {
+				rv.SetFloat(f)
+			}
 			
 		default:
 			d.err("Unhandled single-byte value: %s: %x", msgBadDesc, bd)
@@ -391,13 +809,20 @@ func (d *Decoder) decodeValue(bd byte, containerLen int, readDesc bool, rv0 refl
 			containerLen = d.readContainerLen(bd, false, ContainerRawBytes)
 		}
 		if containerLen == 0 {
+			rv.SetString("")
 			break
 		}		
-		bs := make([]byte, containerLen)
-		d.readb(containerLen, bs)
-		rv.SetString(string(bs))
+		rv.SetString(d.readString(containerLen))
 	case reflect.Slice:
 		rvtype := rv.Type()
+		if rvtype == rawTyp {
+			rv.SetBytes(d.raw(bd))
+			break
+		}
+		if rvtype == ipTyp {
+			d.decodeIP(bd, containerLen, rv)
+			break
+		}
 		rawbytes := rvtype == byteSliceTyp
 		
 		if containerLen < 0 {
@@ -408,37 +833,59 @@ func (d *Decoder) decodeValue(bd byte, containerLen int, readDesc bool, rv0 refl
 			} 
 		}
 		if containerLen == 0 {
+			if rv.Len() != 0 {
+				rv.SetLen(0)
+			}
 			break
 		}
 		
+		// Re-use the existing backing array (truncating or extending it) if it is large enough,
+		// so decoding repeatedly into the same value does not allocate a new one each time.
 		if rawbytes {
-			var bs []byte= rv.Bytes()
-			rvlen := len(bs)
-			if rvlen == containerLen {
-			} else if rvlen > containerLen {
+			if bs := d.readZeroCopy(containerLen); bs != nil {
+				rv.SetBytes(bs)
+				break
+			}
+			bs := rv.Bytes()
+			if cap(bs) < containerLen {
+				rv.SetBytes(d.readBytes(containerLen))
+				break
+			}
+			if len(bs) != containerLen {
 				bs = bs[:containerLen]
-			} else {
-				bs = make([]byte, containerLen)
-				rv.Set(reflect.ValueOf(bs))
+				rv.SetBytes(bs)
 			}
 			d.readb(containerLen, bs)
 			break
 		}
 		
-		if rv.IsNil() {
-			rv.Set(reflect.MakeSlice(rvtype, containerLen, containerLen))
-		} else {
-			rvlen := rv.Len()
-			if containerLen > rv.Cap() {
-				rv2 := reflect.MakeSlice(rvtype, containerLen, containerLen)
-				if rvlen > 0 {
-					reflect.Copy(rv2, rv)
+		rvlen := rv.Len()
+		n := containerLen
+		if n > rv.Cap() {
+			// from a stream, the slice is grown as elements are decoded (see Decoder.growSlice)
+			if n = d.initLen(containerLen); n < rv.Cap() {
+				n = rv.Cap()
+			}
+		}
+		if n > rv.Cap() {
+			rv2 := reflect.MakeSlice(rvtype, n, n)
+			if rvlen > 0 {
+				reflect.Copy(rv2, rv)
+			}
+			rv.Set(rv2)
+		} else if n != rvlen {
+			rv.SetLen(n)
+			// elements between the old length and the capacity are stale. Zero them.
+			if n > rvlen {
+				rvzero := reflect.Zero(rvtype.Elem())
+				for j := rvlen; j < n; j++ {
+					rv.Index(j).Set(rvzero)
 				}
-				rv.Set(rv2)
-			} else if containerLen > rvlen {
-				rv.SetLen(containerLen)
 			}
-		}		
+		}
+		if n == containerLen && d.decodeSliceFast(rv, containerLen) {
+			break
+		}
 		d.decodeValuePostList(rv, containerLen, rvtype.Elem() == intfTyp)
 	case reflect.Array:
 		rvtype := rv.Type()
@@ -452,22 +899,18 @@ func (d *Decoder) decodeValue(bd byte, containerLen int, readDesc bool, rv0 refl
 				containerLen = d.readContainerLen(bd, false, ContainerList)
 			} 
 		}
-		if containerLen == 0 {
-			break
-		}
 		
+		// A byte array (e.g. a hash or key) must be given exactly its length in bytes.
+		// Read straight into it.
 		if rawbytes {
-			var bs []byte = rv.Slice(0, rvlen).Bytes()
-			if rvlen == containerLen {
-				d.readb(containerLen, bs)
-			} else if rvlen > containerLen {
-				d.readb(containerLen, bs[:containerLen])
-			} else {
-				d.err("Array len: %d must be >= container Len: %d", rvlen, containerLen)
-			} 
+			if rvlen != containerLen {
+				d.err("Array len: %d must equal bytes len: %d, decoding into: %v", rvlen, containerLen, rvtype)
+			}
+			d.readb(containerLen, rv.Slice(0, rvlen).Bytes())
 			break
 		}
 		
+		// Other arrays can be given fewer elements: the rest are zeroed.
 		rvelemtype := rvtype.Elem()
 		if rvlen < containerLen {
 			d.err("Array len: %d must be >= container Len: %d", rvlen, containerLen)
@@ -485,30 +928,30 @@ func (d *Decoder) decodeValue(bd byte, containerLen int, readDesc bool, rv0 refl
 			rv.Set(reflect.ValueOf(time.Unix(tt[0], tt[1]).UTC()))
 			break
 		}
-		
-		if containerLen < 0 {
-			containerLen = d.readContainerLen(bd, false, ContainerMap)
+		if rvtype == bigIntTyp || rvtype == bigFloatTyp {
+			d.decodeBig(bd, containerLen, rv)
+			break
 		}
-		if containerLen == 0 {
+		if rvtype == ipNetTyp || rvtype == urlTyp {
+			d.decodeNetValue(bd, containerLen, rv)
 			break
 		}
-		for j := 0; j < containerLen; j++ {
-			rvkencname := ""
-			rvk := reflect.ValueOf(&rvkencname).Elem()
-			d.decodeValue(0, -1, true, rvk)
-			rvksi := getStructFieldInfos(rvtype).getForEncName(rvkencname)
-			if rvksi == nil {
-				// d.err("DecodeValue: Invalid Enc Field: %s", rvkencname) (skip it)
-				var nilintf0 interface{}
-				d.decodeValueT(0, -1, true, reflect.ValueOf(&nilintf0), true, true, true)
-			} else {
-				d.decodeValueT(0, -1, true, rvksi.field(rv), true, true, true)
-			}
+		if d.o.Migrations != nil && containerLen < 0 && d.o.Migrations.has(rvtype) {
+			d.decodeMigrated(bd, rv)
+			break
 		}
+		d.decodeStruct(bd, containerLen, rv)
 	case reflect.Map:
+		if containerLen < 0 && descValueType(bd) == ArrayType && isSetType(rv.Type()) {
+			d.decodeSet(d.readContainerLen(bd, false, ContainerList), rv)
+			break
+		}
 		if containerLen < 0 {
 			containerLen = d.readContainerLen(bd, false, ContainerMap)
 		}
+		if d.o.ReplaceExisting && !rv.IsNil() {
+			rv.Clear()
+		}
 		if containerLen == 0 {
 			break
 		}
@@ -518,21 +961,61 @@ func (d *Decoder) decodeValue(bd byte, containerLen int, readDesc bool, rv0 refl
 			rvn := reflect.MakeMap(rvtype)
 			rv.Set(rvn)
 		}
-		for j := 0; j < containerLen; j++ {
-			rvk := reflect.New(ktype).Elem()
-			rvk = d.decodeValueT(0, -1, true, rvk, true, true, false)
+		var j int
+		var off int64
+		partial := d.beginPartial()
+		if partial {
+			defer d.endPartial(rv, &j, &off)
+		}
+		if rvtype == mapStringStringTyp && rv.CanInterface() && d.o.Trace == nil && d.o.DecodeHooks == nil {
+			m := rv.Interface().(map[string]string)
+			for j = 0; j < containerLen; j++ {
+				if partial {
+					off = d.r.numread()
+				}
+				k := d.decodeMapKeyString()
+				m[k] = d.decodeString()
+			}
+			break
+		}
+		keyText := ktype.Kind() != reflect.String && reflect.PtrTo(ktype).Implements(textUnmarshalerTyp) || 
+			ktype.Kind() == reflect.Ptr && ktype.Implements(textUnmarshalerTyp)
+		// keys of these kinds may hold values which cannot be map keys (e.g. slices in interfaces)
+		keyCheck := ktype.Kind() == reflect.Interface || ktype.Kind() == reflect.Struct || ktype.Kind() == reflect.Array
+		for j = 0; j < containerLen; j++ {
+			if partial {
+				off = d.r.numread()
+			}
+			var rvk reflect.Value
+			if ktype == stringTyp {
+				rvk = reflect.ValueOf(d.decodeMapKeyString())
+			} else if keyText {
+				rvk = d.decodeTextKey(ktype)
+			} else {
+				rvk = reflect.New(ktype).Elem()
+				rvk = d.decodeValueT(d.readn1(), -1, false, rvk, true, true, false)
+			}
 			
+			if ktype == intfTyp && rvk.Kind() == reflect.Interface && !rvk.IsNil() {
+				rvk = rvk.Elem()
+			}
 			if ktype == intfTyp && rvk.Type() == byteSliceTyp {
-				rvk = reflect.ValueOf(string(rvk.Bytes()))
+				rvk = reflect.ValueOf(d.checkUTF8(string(rvk.Bytes())))
+			}
+			if keyCheck && !rvk.Comparable() {
+				d.err("Unhashable map key of type: %v", rvk.Type())
 			}
-			rvv := rv.MapIndex(rvk)
-			if !rvv.IsValid() {
-				rvv = reflect.New(vtype).Elem()
+			// decode into (a settable copy of) the existing value if there is one,
+			// so its storage can be re-used.
+			rvv := reflect.New(vtype).Elem()
+			if rvv0 := rv.MapIndex(rvk); rvv0.IsValid() {
+				rvv.Set(rvv0)
 			}
+			d.tracePush(rvk.Interface())
 			if vtype == intfTyp && rvv.IsNil() {
 				rvv, bd0, ct0, containerLen0, handled0 := d.nilIntfDecode(0, -1, true, false, rvv)
 				if !handled0 {
-					if rvv2 := d.dam.DecoderContainer(rv, rvk, containerLen0, ct0); rvv2.IsValid() {
+					if rvv2 := d.dam.DecoderContainer(rv, rvk, d.initLen(containerLen0), ct0); rvv2.IsValid() {
 						rvv2 = d.decodeValueT(bd0, containerLen0, false, rvv2, false, true, false)
 						rvv.Set(rvv2)
 					} else {
@@ -542,6 +1025,7 @@ func (d *Decoder) decodeValue(bd byte, containerLen int, readDesc bool, rv0 refl
 			} else {
 				rvv = d.decodeValueT(0, -1, true, rvv, true, true, false)
 			}
+			d.tracePop()
 			rv.SetMapIndex(rvk, rvv)
 		}
 	case reflect.Ptr:
@@ -550,8 +1034,31 @@ func (d *Decoder) decodeValue(bd byte, containerLen int, readDesc bool, rv0 refl
 		}
 		d.decodeValue(bd, containerLen, false, rv.Elem())
 	case reflect.Interface:
-		d.decodeValue(bd, containerLen, false, rv.Elem())
+		// a non-nil interface: decode into the value it holds.
+		// Only pointers and maps can be updated in place, else work on a settable copy.
+		rve := rv.Elem()
+		if rk2 := rve.Kind(); rk2 == reflect.Ptr || rk2 == reflect.Map {
+			d.decodeValue(bd, containerLen, false, rve)
+		} else {
+			rve2 := reflect.New(rve.Type()).Elem()
+			rve2.Set(rve)
+			if d.o.PartialResults {
+				// keep a partial result even if decoding fails (see DecoderOptions.PartialResults)
+				defer rv.Set(rve2)
+			}
+			d.decodeValue(bd, containerLen, false, rve2)
+			rv.Set(rve2)
+		}
+	case reflect.Complex128, reflect.Complex64:
+		// [real, imag] (see Encoder.Encode)
+		var c [2]float64
+		d.decodeValue(bd, containerLen, false, reflect.ValueOf(&c).Elem())
+		rv.SetComplex(complex(c[0], c[1]))
 	case reflect.Int, reflect.Int64, reflect.Int32, reflect.Int8, reflect.Int16:
+		if rk == reflect.Int64 && rv.Type() == durationTyp {
+			rv.SetInt(int64(d.decodeDuration(bd, containerLen)))
+			break
+		}
 		i, _ := d.decodeInteger(bd, true)
 		if rv.OverflowInt(i) {
 			d.err("Overflow int value: %v into kind: %v", i, rk)
@@ -569,14 +1076,95 @@ func (d *Decoder) decodeValue(bd byte, containerLen int, readDesc bool, rv0 refl
 	return
 }
 
-func (d *Decoder) decodeValuePostList(rv reflect.Value, containerLen int, elemIsIntf bool) {
+// decodeStruct decodes a map (with descriptor bd) into the struct rv, by field name.
+func (d *Decoder) decodeStruct(bd byte, containerLen int, rv reflect.Value) {
+	rvtype := rv.Type()
+	if containerLen < 0 {
+		containerLen = d.readContainerLen(bd, false, ContainerMap)
+	}
+	sis := getStructFieldInfos(rvtype)
+	var seen []bool // fields in the stream, tracked if we must zero (or default) the others
+	if d.o.ReplaceExisting || sis.anyDefault {
+		seen = make([]bool, len(sis.sis))
+	}
 	for j := 0; j < containerLen; j++ {
+		rvkencname := ""
+		rvk := reflect.ValueOf(&rvkencname).Elem()
+		d.decodeValue(d.readn1(), -1, false, rvk)
+		d.tracePush(rvkencname)
+		var rvksi *structFieldInfo
+		if d.o.FieldNameMapper != nil {
+			rvksi = d.structField(rvtype, sis, rvkencname)
+		} else {
+			rvksi = sis.getForEncName(rvkencname)
+		}
+		if rvksi == nil {
+			// d.err("DecodeValue: Invalid Enc Field: %s", rvkencname) (skip it)
+			var nilintf0 interface{}
+			d.decodeValueT(0, -1, true, reflect.ValueOf(&nilintf0), true, true, true)
+		} else {
+			if rvf := rvksi.field(rv); d.o.FieldTypes != nil && rvf.Kind() == reflect.Interface {
+				d.decodeFieldTyped(rvtype, rvksi, rvf)
+			} else {
+				d.decodeField(rvksi, rvf)
+			}
+			if seen != nil {
+				seen[rvksi.ix] = true
+			}
+		}
+		d.tracePop()
+	}
+	for j, si := range sis.sis {
+		if seen != nil && !seen[j] {
+			rvf := si.field(rv)
+			if si.hasDef && (d.o.ReplaceExisting || rvf.IsZero()) {
+				d.setFieldDefault(rvtype, si, rvf)
+			} else if d.o.ReplaceExisting {
+				rvf.Set(reflect.Zero(rvf.Type()))
+			}
+		}
+	}
+	if sis.afterDecode {
+		d.afterDecode(rv)
+	}
+	if sis.validate && d.o.Validate {
+		d.validate(rv)
+	}
+}
+
+// decodeField decodes the value of the struct field si into rv, as its tag options say.
+func (d *Decoder) decodeField(si *structFieldInfo, rv reflect.Value) {
+	switch {
+	case si.hasExt:
+		d.decodeFieldExt(si, rv)
+	case si.asString:
+		d.decodeFieldString(si, rv)
+	default:
+		d.decodeValueT(0, -1, true, rv, true, true, true)
+	}
+}
+
+func (d *Decoder) decodeValuePostList(rv reflect.Value, containerLen int, elemIsIntf bool) {
+	var j int
+	var off int64
+	partial := d.beginPartial()
+	if partial {
+		defer d.endPartial(rv, &j, &off)
+	}
+	for j = 0; j < containerLen; j++ {
+		if partial {
+			off = d.r.numread()
+		}
+		if j == rv.Len() {
+			d.growSlice(rv, containerLen)
+		}
 		rvj := rv.Index(j)
+		d.tracePush(j)
 		if elemIsIntf && rvj.IsNil() {
 			rvj, bd0, ct0, containerLen0, handled0 := d.nilIntfDecode(0, -1, true, false, rvj)
 			// fmt.Printf("intfTyp: %v, %v, %v, %v, %v\n", rvj.Interface(), bd0, ct0, containerLen0, handled0)
 			if !handled0 {
-				if rvj2 := d.dam.DecoderContainer(rv, j, containerLen0, ct0); rvj2.IsValid() {
+				if rvj2 := d.dam.DecoderContainer(rv, j, d.initLen(containerLen0), ct0); rvj2.IsValid() {
 					rvj2 = d.decodeValueT(bd0, containerLen0, false, rvj2, false, true, false)
 					rvj.Set(rvj2)
 				} else {
@@ -586,9 +1174,174 @@ func (d *Decoder) decodeValuePostList(rv reflect.Value, containerLen int, elemIs
 		} else {
 			d.decodeValueT(0, -1, true, rvj, true, true, true)
 		}
+		d.tracePop()
 	}
 }
 	
+// growSlice doubles the length of the slice rv (up to containerLen), 
+// for a slice allocated with less than its container length (see Decoder.initLen).
+func (d *Decoder) growSlice(rv reflect.Value, containerLen int) {
+	n := 2 * rv.Len()
+	if n > containerLen {
+		n = containerLen
+	}
+	rv2 := reflect.MakeSlice(rv.Type(), n, n)
+	reflect.Copy(rv2, rv)
+	rv.Set(rv2)
+}
+
+// decodeSliceFast decodes the elements of the most common slice types without reflection.
+// It returns false if rv is not one of them.
+func (d *Decoder) decodeSliceFast(rv reflect.Value, containerLen int) bool {
+	if !rv.CanInterface() || d.o.Trace != nil || d.o.PartialResults || d.o.DecodeHooks != nil || 
+		d.o.Exts != nil && d.o.Exts.byType[rv.Type().Elem()] != nil {
+		return false
+	}
+	switch rv.Type() {
+	case stringSliceTyp:
+		v := rv.Interface().([]string)
+		for j := 0; j < containerLen; j++ {
+			v[j] = d.decodeString()
+		}
+	case int64SliceTyp:
+		v := rv.Interface().([]int64)
+		for j := 0; j < containerLen; j++ {
+			if bd := d.readn1(); bd == 0xc0 {
+				v[j] = 0
+			} else {
+				v[j], _ = d.decodeInteger(bd, true)
+			}
+		}
+	case float64SliceTyp:
+		v := rv.Interface().([]float64)
+		for j := 0; j < containerLen; j++ {
+			switch bd := d.readn1(); bd {
+			case 0xc0:
+				v[j] = 0
+			case 0xca:
+				v[j] = float64(math.Float32frombits(d.readUint32()))
+			case 0xcb:
+				v[j] = math.Float64frombits(d.readUint64())
+			default:
+				d.err("Unhandled single-byte value: %s: %x", msgBadDesc, bd)
+			}
+			if d.nonFiniteAsNil(v[j]) {
+				v[j] = 0
+			}
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// decodeString decodes a string value (nil decodes as "") without reflection.
+func (d *Decoder) decodeString() (s string) {
+	bd := d.readn1()
+	if bd == 0xc0 {
+		return
+	}
+	if l := d.readContainerLen(bd, false, ContainerRawBytes); l > 0 {
+		s = d.readString(l)
+	}
+	return
+}
+
+// decodeMapKeyString decodes a string map key, interning it if configured to.
+func (d *Decoder) decodeMapKeyString() (s string) {
+	if d.o.InternMapKeys <= 0 || d.o.ZeroCopy {
+		return d.decodeString()
+	}
+	bd := d.readn1()
+	if bd == 0xc0 {
+		return
+	}
+	l := d.readContainerLen(bd, false, ContainerRawBytes)
+	if l == 0 {
+		return
+	}
+	if cap(d.kb) < l {
+		d.kb = make([]byte, l)
+	}
+	kb := d.kb[:l]
+	d.readb(l, kb)
+	// the compiler does not allocate for a map lookup by string(kb).
+	if s, ok := d.interned[string(kb)]; ok {
+		return s
+	}
+	s = d.checkUTF8(string(kb))
+	if d.interned == nil {
+		d.interned = make(map[string]string)
+	}
+	if len(d.interned) < d.o.InternMapKeys {
+		d.interned[s] = s
+	}
+	return
+}
+
+// readBytes reads l bytes into a new slice (or aliases the input if ZeroCopy is set).
+func (d *Decoder) readBytes(l int) (bs []byte) {
+	if bs = d.readZeroCopy(l); bs != nil {
+		return
+	}
+	if _, ok := d.r.(*bytesDecReader); !ok && l > readChunkLen {
+		return d.readChunked(l)
+	}
+	bs = make([]byte, l)
+	d.readb(l, bs)
+	return
+}
+
+// readChunked reads l bytes from a stream, growing the slice as they are read, 
+// so a corrupt length cannot allocate much more than the stream holds.
+func (d *Decoder) readChunked(l int) (bs []byte) {
+	for n := readChunkLen; len(bs) < l; n *= 2 {
+		if n > l - len(bs) {
+			n = l - len(bs)
+		}
+		bs = append(bs, make([]byte, n)...)
+		d.readb(n, bs[len(bs)-n:])
+	}
+	return
+}
+
+// readString reads l bytes as a string (aliasing the input if ZeroCopy is set).
+func (d *Decoder) readString(l int) string {
+	if bs := d.readZeroCopy(l); bs != nil {
+		return d.checkUTF8(unsafe.String(&bs[0], l))
+	}
+	return d.checkUTF8(string(d.readBytes(l)))
+}
+
+// checkUTF8 applies DecoderOptions.InvalidUTF8 to a decoded string.
+func (d *Decoder) checkUTF8(s string) string {
+	if d.o.InvalidUTF8 == UTF8PassThrough || utf8.ValidString(s) {
+		return s
+	}
+	if d.o.InvalidUTF8 == UTF8Error {
+		d.err("Invalid UTF-8 in string ending at offset: %d", d.r.numread())
+	}
+	return strings.ToValidUTF8(s, string(utf8.RuneError))
+}
+
+// readZeroCopy returns the next l (> 0) bytes of the input without copying them, 
+// if ZeroCopy is set and we are decoding from a byte slice. Else it returns nil.
+func (d *Decoder) readZeroCopy(l int) (bs []byte) {
+	if !d.o.ZeroCopy || l == 0 {
+		return
+	}
+	z, ok := d.r.(*bytesDecReader)
+	if !ok {
+		return
+	}
+	if l > len(z.b) - z.c {
+		d.skipb(l) // reports the appropriate EOF error
+	}
+	bs = z.b[z.c:z.c+l:z.c+l]
+	z.c += l
+	return
+}
+
 // decode an integer from the stream
 func (d *Decoder) decodeInteger(bd byte, sign bool) (i int64, ui uint64) {
 	switch {
@@ -667,21 +1420,56 @@ func (d *Decoder) decodeInteger(bd byte, sign bool) (i int64, ui uint64) {
 	return
 }
 
+// setLimit makes the decoder fail with err, rather than read (or allocate for) more than 
+// the next n bytes of input. n <= 0 removes the limit.
+func (d *Decoder) setLimit(n int64, err error) {
+	if n <= 0 {
+		d.limit = 0
+		return
+	}
+	d.limit, d.limitErr = d.r.numread() + n, err
+}
+
+// checkLimit fails if the next n bytes of input go beyond the limit (see setLimit).
+func (d *Decoder) checkLimit(n int) {
+	if d.limit > 0 && d.r.numread() + int64(n) > d.limit {
+		panic(d.limitErr)
+	}
+}
+
 // read a number of bytes into bs
 func (d *Decoder) readb(numbytes int, bs []byte) {
-	n, err := io.ReadAtLeast(d.r, bs, numbytes) 
+	d.checkLimit(numbytes)
+	n, err := d.r.readFull(bs[:numbytes]) 
 	if err != nil {
 		// propagage io.EOF upwards (it's special, and must be returned AS IS)
 		if err == io.EOF {
 			panic(err)
 		} else {
-			d.err("Error: %v", err)
+			d.err("Error: %w", err)
 		}
 	} else if n != numbytes {
 		d.err("read: Incorrect num bytes read. Expecting: %v, Received: %v", numbytes, n)
 	}
 }
 
+// skip a number of bytes
+func (d *Decoder) skipb(numbytes int) {
+	d.checkLimit(numbytes)
+	if err := d.r.skip(numbytes); err != nil {
+		if err == io.EOF {
+			panic(err)
+		} else {
+			d.err("Error: %w", err)
+		}
+	}
+}
+
+func (d *Decoder) readn1() uint8 {
+	d.readb(1, d.t1)
+	return d.t1[0]
+}
+
 func (d *Decoder) readUint8() uint8 {
 	d.readb(1, d.t1)
 	return d.t1[0]
@@ -708,27 +1496,196 @@ func (d *Decoder) readContainerLen(bd byte, readDesc bool, ct ContainerType) (l
 		d.readb(1, d.t1)
 		bd = d.t1[0]
 	}
-	_, b0, b1, b2 := getContainerByteDesc(ct)
+	cutoff, b0, b1, b2 := getContainerByteDesc(ct)
 
+	// raw bytes may also come as one of the str8 or bin families of the newer spec.
+	if ct == ContainerRawBytes {
+		switch bd {
+		case 0xd9, 0xc4:
+			return d.checkContainerLen(int(d.readUint8()), ct)
+		case 0xc5:
+			return d.checkContainerLen(int(d.readUint16()), ct)
+		case 0xc6:
+			return d.checkContainerLen(int(d.readUint32()), ct)
+		}
+	}
 	switch {
 	case bd == b1:
 		l = int(d.readUint16())
 	case bd == b2:
 		l = int(d.readUint32())
-	case (b0 & bd) == b0:
+	case bd >= b0 && int(bd) < int(b0) + cutoff:
 		l = int(b0 ^ bd)
 	default:
 		d.err("readContainerLen: %s: hex: %x, dec: %d", msgBadDesc, bd, bd)
 	}
-	return	
+	return d.checkContainerLen(l, ct)
+}
+
+// checkContainerLen checks a container of length l fits within the limit (see setLimit), 
+// and the input left (or MaxContainerLen), before anything is allocated for it: 
+// each element takes at least a byte (a map entry, two).
+func (d *Decoder) checkContainerLen(l int, ct ContainerType) int {
+	n := l
+	if ct == ContainerMap {
+		n = 2 * l
+	}
+	if n < 0 {
+		d.err("Invalid container length: %d", l)
+	}
+	if d.limit > 0 {
+		d.checkLimit(n)
+	}
+	if z, ok := d.r.(*bytesDecReader); ok {
+		if n > len(z.b) - z.c {
+			// the input is truncated (or corrupt): report it as for a short read
+			panic(fmt.Errorf("%s: Container length: %d exceeds the %d bytes of input left: %w", 
+				msgTagDec, l, len(z.b) - z.c, io.ErrUnexpectedEOF))
+		}
+	} else if d.o.MaxContainerLen > 0 && l > d.o.MaxContainerLen {
+		d.err("Container length: %d exceeds MaxContainerLen: %d", l, d.o.MaxContainerLen)
+	}
+	return l
+}
+
+// initLen returns the number of elements to allocate up front for a container of length l. 
+// From a byte slice, that is l (checked against the input left by checkContainerLen). 
+// From a stream, it is at most decMaxInitLen, and the container grows as elements are decoded, 
+// so a corrupt length cannot allocate much more than the stream holds.
+func (d *Decoder) initLen(l int) int {
+	if _, ok := d.r.(*bytesDecReader); !ok && l > decMaxInitLen {
+		return decMaxInitLen
+	}
+	return l
+}
+
+// enter and exit are called around decoding each value, to fail (rather than exhaust the stack)
+// on values nested deeper than decMaxDepth.
+func (d *Decoder) enter() {
+	if d.depth++; d.depth > decMaxDepth {
+		d.err("Exceeded max nesting depth of %v", decMaxDepth)
+	}
+}
+
+func (d *Decoder) exit() {
+	d.depth--
+}
+
+// readExtHeader reads the type and data length of an ext value, 
+// given its descriptor byte (one of the fixext or ext 8/16/32 families).
+func (d *Decoder) readExtHeader(bd byte) (xtag int8, l int) {
+	switch bd {
+	case 0xd4:
+		l = 1
+	case 0xd5:
+		l = 2
+	case 0xd6:
+		l = 4
+	case 0xd7:
+		l = 8
+	case 0xd8:
+		l = 16
+	case 0xc7:
+		l = int(d.readUint8())
+	case 0xc8:
+		l = int(d.readUint16())
+	case 0xc9:
+		l = int(d.readUint32())
+	default:
+		d.err("readExtHeader: %s: hex: %x, dec: %d", msgBadDesc, bd, bd)
+	}
+	xtag = int8(d.readUint8())
+	d.checkContainerLen(l, ContainerRawBytes)
+	return
+}
+
+// decodeTextKey decodes a string map key into a new value of type ktype 
+// (whose pointer, or which as a pointer type itself, implements encoding.TextUnmarshaler).
+func (d *Decoder) decodeTextKey(ktype reflect.Type) reflect.Value {
+	bd := d.readn1()
+	var bs []byte
+	if bd != 0xc0 {
+		bs = d.readBytes(d.readContainerLen(bd, false, ContainerRawBytes))
+	}
+	ptr := ktype.Kind() == reflect.Ptr && ktype.Implements(textUnmarshalerTyp)
+	var rvk reflect.Value
+	if ptr {
+		rvk = reflect.New(ktype.Elem())
+	} else {
+		rvk = reflect.New(ktype)
+	}
+	if err := rvk.Interface().(encoding.TextUnmarshaler).UnmarshalText(bs); err != nil {
+		d.err("UnmarshalText for map key of type: %v: %v", ktype, err)
+	}
+	if ptr {
+		return rvk
+	}
+	return rvk.Elem()
+}
+
+// decodeDuration decodes an integer (see DecoderOptions.DurationUnit) or string as a time.Duration.
+func (d *Decoder) decodeDuration(bd byte, containerLen int) (dur time.Duration) {
+	if bd >= 0xa0 && bd <= 0xbf || bd == 0xd9 || bd == 0xda || bd == 0xdb {
+		if containerLen < 0 {
+			containerLen = d.readContainerLen(bd, false, ContainerRawBytes)
+		}
+		s := d.readString(containerLen)
+		dur, err := time.ParseDuration(s)
+		if err != nil {
+			d.err("Invalid time.Duration: %v", err)
+		}
+		return dur
+	}
+	i, _ := d.decodeInteger(bd, true)
+	if u := d.o.DurationUnit; u > 1 {
+		if i > math.MaxInt64 / int64(u) || i < math.MinInt64 / int64(u) {
+			d.err("Overflow time.Duration value: %v of unit: %v", i, u)
+		}
+		i *= int64(u)
+	}
+	return time.Duration(i)
+}
+
+// nonFiniteAsNil applies DecoderOptions.NonFinite to a decoded float.
+// It returns true if f should be treated as nil.
+func (d *Decoder) nonFiniteAsNil(f float64) bool {
+	if d.o.NonFinite == NonFinitePassThrough || !isNonFinite(f) {
+		return false
+	}
+	if d.o.NonFinite == NonFiniteError {
+		d.err("Non-finite float value: %v", f)
+	}
+	return true
 }
 
 func (d *Decoder) err(format string, params ...interface{}) {
 	doPanic(msgTagDec, format, params)
 }
 
+// InputOffset returns the number of bytes consumed from the input stream so far.
+// After a successful Decode, it is the offset just past the end of the decoded value,
+// which is where the next value (or some other framing) begins.
+func (d *Decoder) InputOffset() int64 {
+	return d.r.numread()
+}
+
+// Buffered returns a reader of the data read from the input stream but not yet consumed.
+// 
+// When decoding from an io.Reader, this is at most the single byte of look-ahead
+// the Decoder may hold. When decoding from a byte slice, it is the rest of the slice.
+// Reading from Buffered followed by the original reader yields the remainder of the stream.
+func (d *Decoder) Buffered() io.Reader {
+	return bytes.NewReader(d.r.buffered())
+}
+
 // Unmarshal is a convenience function which decodes a stream of bytes into v.
 // It delegates to Decoder.Decode.
 func Unmarshal(data []byte, v interface{}, dam DecoderContainerResolver) error {
-	return NewDecoder(bytes.NewBuffer(data), dam).Decode(v)
+	return NewDecoderBytes(data, dam).Decode(v)
+}
+
+// UnmarshalNew is a convenience function which decodes a stream of bytes into the pointer v,
+// allocating it if nil, and returns it. It delegates to Decoder.DecodeNew.
+func UnmarshalNew(data []byte, v interface{}, dam DecoderContainerResolver) (interface{}, error) {
+	return NewDecoderBytes(data, dam).DecodeNew(v)
 }
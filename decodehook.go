@@ -0,0 +1,169 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+import (
+	"encoding"
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+)
+
+// DecodeHook converts a value read from the stream, whose wire type (from) does not fit 
+// the type it is decoded into (to), e.g. a string for a time.Time, or an int for a string enum. 
+// data is the value decoded as into a nil interface{}, with integers as int64 (or uint64 if too large), 
+// floats as float64 and str values as strings.
+// 
+// It returns the converted value, which must be assignable or convertible to to, 
+// or data itself if it does not handle the conversion (leaving it to the next hook).
+// See DecoderOptions.DecodeHooks.
+type DecodeHook func(from ValueType, to reflect.Type, data interface{}) (interface{}, error)
+
+// StringToTimeHook returns a DecodeHook parsing strings into time.Time values with layout
+// (e.g. time.RFC3339).
+func StringToTimeHook(layout string) DecodeHook {
+	return func(from ValueType, to reflect.Type, data interface{}) (interface{}, error) {
+		if s, ok := data.(string); ok && to == timeTyp {
+			return time.Parse(layout, s)
+		}
+		return data, nil
+	}
+}
+
+// TextUnmarshalerHook is a DecodeHook decoding strings into the types whose pointers implement 
+// encoding.TextUnmarshaler (e.g. enums with names), by their UnmarshalText method.
+func TextUnmarshalerHook(from ValueType, to reflect.Type, data interface{}) (interface{}, error) {
+	s, ok := data.(string)
+	if !ok || !reflect.PtrTo(to).Implements(textUnmarshalerTyp) {
+		return data, nil
+	}
+	rv := reflect.New(to)
+	if err := rv.Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s)); err != nil {
+		return nil, err
+	}
+	return rv.Elem().Interface(), nil
+}
+
+// wireFits says whether a value of wire type vt can be decoded into type rt as is. 
+// Containers are checked only as such (not their contents).
+func wireFits(vt ValueType, rt reflect.Type) bool {
+	isStr := vt == StrType || vt == BinType
+	switch rt.Kind() {
+	case reflect.Bool:
+		return vt == BoolType
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, 
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return vt == IntType || vt == UintType || isStr && rt == durationTyp
+	case reflect.Float32, reflect.Float64:
+		return vt == FloatType
+	case reflect.String:
+		return isStr
+	case reflect.Slice:
+		if rt == rawTyp {
+			return true
+		}
+		if rt == byteSliceTyp || rt == ipTyp {
+			return isStr
+		}
+		return vt == ArrayType
+	case reflect.Array:
+		if rt.Elem().Kind() == reflect.Uint8 && rt.Len() > 0 {
+			return isStr
+		}
+		return vt == ArrayType
+	case reflect.Struct:
+		switch rt {
+		case timeTyp:
+			return vt == ArrayType
+		case bigIntTyp, bigFloatTyp:
+			return vt != ArrayType && vt != MapType
+		case ipNetTyp, urlTyp:
+			return isStr
+		}
+		return vt == MapType
+	case reflect.Map:
+		return vt == MapType || vt == ArrayType && isSetType(rt)
+	case reflect.Complex64, reflect.Complex128:
+		return vt == ArrayType
+	}
+	return true
+}
+
+// decodeHooked decodes the value with descriptor bd (which does not fit rv's type) 
+// as into a nil interface{}, and sets rv to its conversion by DecoderOptions.DecodeHooks.
+func (d *Decoder) decodeHooked(bd byte, rv reflect.Value) {
+	from, rt := descValueType(bd), rv.Type()
+	var data interface{}
+	d.decodeValueT(bd, -1, false, reflect.ValueOf(&data).Elem(), true, true, true)
+	switch dv := reflect.ValueOf(data); dv.Kind() {
+	case reflect.Int8, reflect.Int16, reflect.Int32:
+		data = dv.Int()
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		data = int64(dv.Uint())
+	case reflect.Uint64:
+		if ui := dv.Uint(); ui <= math.MaxInt64 {
+			data = int64(ui)
+		}
+	case reflect.Float32:
+		data = dv.Float()
+	case reflect.Slice:
+		if bs, ok := data.([]byte); ok && from == StrType {
+			data = string(bs)
+		}
+	}
+	for _, hook := range d.o.DecodeHooks {
+		var err error
+		if data, err = hook(from, rt, data); err != nil {
+			d.err("DecodeHook: decoding %v into %v: %v", from, rt, err)
+		}
+	}
+	dv := reflect.ValueOf(data)
+	switch {
+	case !dv.IsValid():
+		rv.Set(reflect.Zero(rt))
+	case dv.Type().AssignableTo(rt):
+		rv.Set(dv)
+	case dv.Type().ConvertibleTo(rt) && hookConvertible(dv.Kind(), rt.Kind()):
+		rv.Set(dv.Convert(rt))
+	default:
+		d.err("Cannot decode %v value: %v into: %v", from, fmt.Sprint(data), rt)
+	}
+}
+
+// hookConvertible says whether a value of kind from returned by a DecodeHook is converted to kind to: 
+// between numbers, or between strings. (Not e.g. an int to a string, which reflect would make a rune.)
+func hookConvertible(from, to reflect.Kind) bool {
+	isNum := func(k reflect.Kind) bool { return k >= reflect.Int && k <= reflect.Float64 }
+	return isNum(from) && isNum(to) || from == reflect.String && to == reflect.String
+}
@@ -0,0 +1,108 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+import (
+	"encoding"
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// parseFieldDefault parses the default=value of a field of type rt from its struct tag (see Decode).
+// A default for a pointer field is parsed for the type it points to.
+func parseFieldDefault(rt reflect.Type, s string) (rv reflect.Value, err error) {
+	if rt.Kind() == reflect.Ptr {
+		rt = rt.Elem()
+	}
+	rv = reflect.New(rt).Elem()
+	if reflect.PtrTo(rt).Implements(textUnmarshalerTyp) {
+		err = rv.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s))
+		return
+	}
+	err = parseScalar(rv, s)
+	return
+}
+
+// parseScalar sets the string, bool or number rv from its text (a duration as e.g. "1m30s").
+func parseScalar(rv reflect.Value, s string) (err error) {
+	switch rt := rv.Type(); rt.Kind() {
+	case reflect.String:
+		rv.SetString(s)
+	case reflect.Bool:
+		var b bool
+		b, err = strconv.ParseBool(s)
+		rv.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var i int64
+		if rt == durationTyp {
+			var dur time.Duration
+			dur, err = time.ParseDuration(s)
+			i = int64(dur)
+		} else {
+			i, err = strconv.ParseInt(s, 10, rt.Bits())
+		}
+		rv.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		var ui uint64
+		ui, err = strconv.ParseUint(s, 10, rt.Bits())
+		rv.SetUint(ui)
+	case reflect.Float32, reflect.Float64:
+		var f float64
+		f, err = strconv.ParseFloat(s, rt.Bits())
+		rv.SetFloat(f)
+	default:
+		err = fmt.Errorf("type %v is not a string, bool or number", rt)
+	}
+	return
+}
+
+// setFieldDefault sets the field rvf of struct type rt, missing from the stream, to the default from its tag.
+func (d *Decoder) setFieldDefault(rt reflect.Type, si *structFieldInfo, rvf reflect.Value) {
+	if si.defErr != nil {
+		d.err("Invalid default for field: %v.%v: %v", rt, si.name, si.defErr)
+	}
+	def := si.def
+	if def.Kind() == reflect.Slice {
+		// (e.g. a net.IP) do not share the default's backing array.
+		def = reflect.AppendSlice(reflect.MakeSlice(def.Type(), 0, def.Len()), def)
+	}
+	if rvf.Kind() == reflect.Ptr {
+		rvp := reflect.New(def.Type())
+		rvp.Elem().Set(def)
+		rvf.Set(rvp)
+	} else {
+		rvf.Set(def)
+	}
+}
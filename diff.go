@@ -0,0 +1,318 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// ChangeKind is the kind of a difference reported by Diff.
+type ChangeKind int
+
+const (
+	ChangeAdded   ChangeKind = iota + 1 // map key or array element only in b
+	ChangeRemoved                       // map key or array element only in a
+	ChangeType                          // value has a different type in b (see diffType)
+	ChangeValue                         // value is different in b
+)
+
+var changeKindNames = [...]string{
+	ChangeAdded: "added",
+	ChangeRemoved: "removed",
+	ChangeType: "type changed",
+	ChangeValue: "value changed",
+}
+
+func (k ChangeKind) String() string {
+	if k > 0 && int(k) < len(changeKindNames) {
+		return changeKindNames[k]
+	}
+	return fmt.Sprintf("ChangeKind(%d)", int(k))
+}
+
+// Change is a difference between two msgpack documents, as reported by Diff.
+type Change struct {
+	// Path locates the value from the top of the document: each element is 
+	// an array index (int) or a map key (string for str keys, []byte for bin keys,
+	// int64 or uint64 for integer keys, etc). 
+	Path []interface{}
+	Kind ChangeKind
+	// A and B are the encodings of the value in a and b (nil if missing). 
+	// They alias the slices passed to Diff.
+	A, B Raw
+}
+
+// String returns a description of the change, e.g. `$.users[2].name: value changed: "ann" => "bob"`.
+func (c Change) String() string {
+	return fmt.Sprintf("%s: %v: %s => %s", pathString(c.Path), c.Kind, rawString(c.A), rawString(c.B))
+}
+
+// Diff compares the msgpack documents (single values) a and b, and returns
+// their differences, path by path. 
+// 
+// Maps are compared by key, regardless of the order of their entries.
+// Integers compare by value regardless of their encoding (e.g. fixint, uint16 and int32),
+// as do float32 and float64. str, bin and ext are different types. 
+// Containers are compared element by element; when a container's type differs, 
+// a single ChangeType is reported for it.
+// 
+// Diff returns no changes if a and b are equivalent. 
+// It returns an error if either document is malformed.
+func Diff(a, b []byte) (changes []Change, err error) {
+	na, err := parseDiffNode(a)
+	if err != nil {
+		return nil, fmt.Errorf("%v: Diff: a: %v", msgTagDec, err)
+	}
+	nb, err := parseDiffNode(b)
+	if err != nil {
+		return nil, fmt.Errorf("%v: Diff: b: %v", msgTagDec, err)
+	}
+	diffNodes(&na, &nb, nil, &changes)
+	return
+}
+
+// diffNode is a value parsed from the document, enough to compare it.
+type diffNode struct {
+	vt ValueType     // see diffType
+	v interface{}    // scalar value: bool, int64 (< 0), uint64, float64, string, []byte, ext.
+	raw []byte
+	elems []diffNode // array elements, or map values
+	keys []diffNode  // map keys
+}
+
+type diffExt struct {
+	tag int8
+	data string
+}
+
+// diffType folds the ValueTypes which compare by value.
+func diffType(vt ValueType) ValueType {
+	if vt == UintType {
+		return IntType
+	}
+	return vt
+}
+
+func parseDiffNode(b []byte) (n diffNode, err error) {
+	defer panicToErr(&err)
+	d := NewDecoderBytes(b, &DecoderOptions{ZeroCopy: true})
+	d.parseDiffNode(b, &n)
+	return
+}
+
+// parseDiffNode parses the next value into n. n.raw is set only if b (the input) is given.
+func (d *Decoder) parseDiffNode(b []byte, n *diffNode) {
+	off := d.r.numread()
+	bd := d.readn1()
+	switch n.vt = diffType(descValueType(bd)); n.vt {
+	case NilType:
+	case BoolType:
+		n.v = bd == 0xc3
+	case IntType:
+		if bd == 0xcf {
+			_, n.v = d.decodeInteger(bd, false)
+		} else if i, _ := d.decodeInteger(bd, true); i < 0 {
+			n.v = i
+		} else {
+			n.v = uint64(i)
+		}
+	case FloatType:
+		if bd == 0xca {
+			n.v = float64(math.Float32frombits(d.readUint32()))
+		} else {
+			n.v = math.Float64frombits(d.readUint64())
+		}
+	case StrType:
+		n.v = string(d.readBytes(d.readContainerLen(bd, false, ContainerRawBytes)))
+	case BinType:
+		n.v = d.readBytes(d.readContainerLen(bd, false, ContainerRawBytes))
+	case ExtType:
+		xtag, l := d.readExtHeader(bd)
+		n.v = diffExt{xtag, string(d.readBytes(l))}
+	case ArrayType:
+		n.elems = make([]diffNode, d.readContainerLen(bd, false, ContainerList))
+		d.enter()
+		for i := range n.elems {
+			d.parseDiffNode(b, &n.elems[i])
+		}
+		d.exit()
+	case MapType:
+		l := d.readContainerLen(bd, false, ContainerMap)
+		n.keys, n.elems = make([]diffNode, l), make([]diffNode, l)
+		d.enter()
+		for i := range n.elems {
+			d.parseDiffNode(b, &n.keys[i])
+			d.parseDiffNode(b, &n.elems[i])
+		}
+		d.exit()
+	default:
+		d.err("%s: hex: %x, dec: %d", msgBadDesc, bd, bd)
+	}
+	if b != nil {
+		n.raw = b[off:d.r.numread()]
+	}
+}
+
+// key returns a string identifying a map key, equal for keys which compare equal.
+func (n *diffNode) key() string {
+	switch v := n.v.(type) {
+	case float64:
+		if math.IsNaN(v) {
+			return "f:NaN"
+		}
+		return fmt.Sprintf("f:%v", v)
+	case nil, bool, int64, uint64, string, diffExt:
+		return fmt.Sprintf("%d:%v", n.vt, v)
+	case []byte:
+		return fmt.Sprintf("%d:%s", n.vt, v)
+	}
+	return "raw:" + string(n.raw)
+}
+
+// pathElem returns the value used for n in a Change.Path.
+func (n *diffNode) pathElem() interface{} {
+	if n.elems != nil || n.keys != nil {
+		return Raw(n.raw)
+	}
+	return n.v
+}
+
+func diffNodes(a, b *diffNode, path []interface{}, changes *[]Change) {
+	if a.vt != b.vt {
+		*changes = append(*changes, diffChange(path, ChangeType, a.raw, b.raw))
+		return
+	}
+	switch a.vt {
+	case ArrayType:
+		for i := 0; i < len(a.elems) || i < len(b.elems); i++ {
+			p := append(path[:len(path):len(path)], i)
+			switch {
+			case i >= len(b.elems):
+				*changes = append(*changes, diffChange(p, ChangeRemoved, a.elems[i].raw, nil))
+			case i >= len(a.elems):
+				*changes = append(*changes, diffChange(p, ChangeAdded, nil, b.elems[i].raw))
+			default:
+				diffNodes(&a.elems[i], &b.elems[i], p, changes)
+			}
+		}
+	case MapType:
+		bm := make(map[string]int, len(b.keys))
+		for i := range b.keys {
+			bm[b.keys[i].key()] = i
+		}
+		seen := make(map[string]bool, len(a.keys))
+		for i := range a.keys {
+			k := a.keys[i].key()
+			seen[k] = true
+			p := append(path[:len(path):len(path)], a.keys[i].pathElem())
+			if j, ok := bm[k]; ok {
+				diffNodes(&a.elems[i], &b.elems[j], p, changes)
+			} else {
+				*changes = append(*changes, diffChange(p, ChangeRemoved, a.elems[i].raw, nil))
+			}
+		}
+		for i := range b.keys {
+			if !seen[b.keys[i].key()] {
+				p := append(path[:len(path):len(path)], b.keys[i].pathElem())
+				*changes = append(*changes, diffChange(p, ChangeAdded, nil, b.elems[i].raw))
+			}
+		}
+	default:
+		if !diffScalarEqual(a.v, b.v) {
+			*changes = append(*changes, diffChange(path, ChangeValue, a.raw, b.raw))
+		}
+	}
+}
+
+func diffScalarEqual(a, b interface{}) bool {
+	switch av := a.(type) {
+	case []byte:
+		return bytes.Equal(av, b.([]byte))
+	case float64:
+		bv := b.(float64)
+		return av == bv || math.IsNaN(av) && math.IsNaN(bv)
+	}
+	return a == b
+}
+
+func diffChange(path []interface{}, kind ChangeKind, a, b []byte) Change {
+	return Change{Path: append([]interface{}(nil), path...), Kind: kind, A: a, B: b}
+}
+
+// pathString formats a path as $, followed by .key for each str key and [x] for other elements.
+func pathString(path []interface{}) string {
+	var buf strings.Builder
+	buf.WriteByte('$')
+	for _, p := range path {
+		switch v := p.(type) {
+		case string:
+			if isPathIdent(v) {
+				buf.WriteString("." + v)
+			} else {
+				fmt.Fprintf(&buf, "[%q]", v)
+			}
+		case Raw:
+			fmt.Fprintf(&buf, "[%s]", rawString(v))
+		case []byte:
+			fmt.Fprintf(&buf, "[0x%x]", v)
+		default:
+			fmt.Fprintf(&buf, "[%v]", v)
+		}
+	}
+	return buf.String()
+}
+
+func isPathIdent(s string) bool {
+	for i, c := range s {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// rawString formats an encoded value as JSON (or as "missing" if it is nil).
+func rawString(r Raw) string {
+	if r == nil {
+		return "missing"
+	}
+	var buf bytes.Buffer
+	if err := ToJSON(&buf, bytes.NewReader(r)); err != nil {
+		return fmt.Sprintf("0x%x", []byte(r))
+	}
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
@@ -0,0 +1,235 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// dumpMaxData is the number of bytes of a str, bin or ext value shown by Dump.
+const dumpMaxData = 48
+
+// Dump returns an annotated, indented listing of the msgpack values in b, for debugging.
+// 
+// Each line shows a value's offset in b (hex), its encoded length in bytes,
+// its wire format (e.g. fixmap, uint16, str8) and its value (or number of elements).
+// Container elements are indented under the container; map keys are marked "key".
+// For example:
+//   000000   14  fixmap len=2
+//   000001    2    fixstr len=1 "a" key
+//   000003    3    uint16 1616
+//   ...
+// 
+// If b is malformed, the listing ends with the error, and the lengths of
+// containers that were not fully read are shown as ?.
+func Dump(b []byte) string {
+	var buf bytes.Buffer
+	if err := DumpStream(&buf, bytes.NewReader(b)); err != nil {
+		fmt.Fprintf(&buf, "error: %v\n", err)
+	}
+	return buf.String()
+}
+
+// DumpStream writes an annotated listing (see Dump) of the msgpack values read from r to w.
+func DumpStream(w io.Writer, r io.Reader) (err error) {
+	d := NewDecoder(r, nil)
+	var lines []dumpLine
+	for d.More() {
+		lines, err = dumpValue(d, lines[:0])
+		// write what was read, even on error
+		for _, l := range lines {
+			size := "?"
+			if l.size >= 0 {
+				size = strconv.FormatInt(l.size, 10)
+			}
+			fmt.Fprintf(w, "%06x %4s  %s%s\n", l.off, size, strings.Repeat("  ", l.depth), l.text)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+type dumpLine struct {
+	off int64
+	size int64 // -1 if not known (on error), shown as ?
+	depth int
+	text string
+}
+
+func dumpValue(d *Decoder, lines []dumpLine) (lines2 []dumpLine, err error) {
+	defer func() {
+		if x := recover(); x != nil {
+			panicToErrT(x, &err)
+		}
+		lines2 = lines
+	}()
+	dumpValue1(d, &lines, 0, "")
+	return
+}
+
+// dumpValue1 appends the lines for the next value. suffix is appended to its text.
+func dumpValue1(d *Decoder, lines *[]dumpLine, depth int, suffix string) {
+	if depth > decMaxDepth {
+		d.err("Exceeded max nesting depth of %v", decMaxDepth)
+	}
+	off := d.r.numread()
+	bd := d.readn1()
+	j := len(*lines)
+	*lines = append(*lines, dumpLine{off: off, size: -1, depth: depth})
+	name := descName(bd)
+	var text string
+	switch vt := descValueType(bd); vt {
+	case NilType:
+		text = name
+	case BoolType:
+		text = name
+	case IntType:
+		i, _ := d.decodeInteger(bd, true)
+		text = name + " " + strconv.FormatInt(i, 10)
+	case UintType:
+		_, ui := d.decodeInteger(bd, false)
+		text = name + " " + strconv.FormatUint(ui, 10)
+	case FloatType:
+		if bd == 0xca {
+			text = name + " " + strconv.FormatFloat(float64(math.Float32frombits(d.readUint32())), 'g', -1, 32)
+		} else {
+			text = name + " " + strconv.FormatFloat(math.Float64frombits(d.readUint64()), 'g', -1, 64)
+		}
+	case StrType, BinType:
+		l := d.readContainerLen(bd, false, ContainerRawBytes)
+		bs := d.readBytes(l)
+		text = fmt.Sprintf("%s len=%d %s", name, l, dumpData(bs, vt == StrType))
+	case ExtType:
+		xtag, l := d.readExtHeader(bd)
+		bs := d.readBytes(l)
+		text = fmt.Sprintf("%s type=%d len=%d %s", name, xtag, l, dumpData(bs, false))
+	case ArrayType:
+		l := d.readContainerLen(bd, false, ContainerList)
+		(*lines)[j].text = fmt.Sprintf("%s len=%d%s", name, l, suffix)
+		for k := 0; k < l; k++ {
+			dumpValue1(d, lines, depth+1, "")
+		}
+	case MapType:
+		l := d.readContainerLen(bd, false, ContainerMap)
+		(*lines)[j].text = fmt.Sprintf("%s len=%d%s", name, l, suffix)
+		for k := 0; k < l; k++ {
+			dumpValue1(d, lines, depth+1, " key")
+			dumpValue1(d, lines, depth+1, "")
+		}
+	default:
+		(*lines)[j].text = name
+		d.err("%s: hex: %x, dec: %d", msgBadDesc, bd, bd)
+	}
+	if text != "" {
+		(*lines)[j].text = text + suffix
+	}
+	(*lines)[j].size = d.r.numread() - off
+}
+
+// dumpData shows (up to dumpMaxData bytes of) a str as a quoted string, or other data as hex.
+func dumpData(bs []byte, isStr bool) string {
+	more := ""
+	if len(bs) > dumpMaxData {
+		bs, more = bs[:dumpMaxData], "..."
+	}
+	if isStr {
+		return strconv.Quote(string(bs)) + more
+	}
+	if len(bs) == 0 {
+		return ""
+	}
+	return "0x" + hex.EncodeToString(bs) + more
+}
+
+// descName returns the name (in the msgpack spec) of the format with descriptor byte bd.
+func descName(bd byte) string {
+	switch {
+	case bd <= 0x7f:
+		return "positive fixint"
+	case bd <= 0x8f:
+		return "fixmap"
+	case bd <= 0x9f:
+		return "fixarray"
+	case bd <= 0xbf:
+		return "fixstr"
+	case bd >= 0xe0:
+		return "negative fixint"
+	}
+	if s := descNames[bd - 0xc0]; s != "" {
+		return s
+	}
+	return "(never used)"
+}
+
+var descNames = [...]string{
+	0xc0 - 0xc0: "nil",
+	0xc2 - 0xc0: "false",
+	0xc3 - 0xc0: "true",
+	0xc4 - 0xc0: "bin8",
+	0xc5 - 0xc0: "bin16",
+	0xc6 - 0xc0: "bin32",
+	0xc7 - 0xc0: "ext8",
+	0xc8 - 0xc0: "ext16",
+	0xc9 - 0xc0: "ext32",
+	0xca - 0xc0: "float32",
+	0xcb - 0xc0: "float64",
+	0xcc - 0xc0: "uint8",
+	0xcd - 0xc0: "uint16",
+	0xce - 0xc0: "uint32",
+	0xcf - 0xc0: "uint64",
+	0xd0 - 0xc0: "int8",
+	0xd1 - 0xc0: "int16",
+	0xd2 - 0xc0: "int32",
+	0xd3 - 0xc0: "int64",
+	0xd4 - 0xc0: "fixext1",
+	0xd5 - 0xc0: "fixext2",
+	0xd6 - 0xc0: "fixext4",
+	0xd7 - 0xc0: "fixext8",
+	0xd8 - 0xc0: "fixext16",
+	0xd9 - 0xc0: "str8",
+	0xda - 0xc0: "str16",
+	0xdb - 0xc0: "str32",
+	0xdc - 0xc0: "array16",
+	0xdd - 0xc0: "array32",
+	0xde - 0xc0: "map16",
+	0xdf - 0xc0: "map32",
+}
+
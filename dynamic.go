@@ -0,0 +1,221 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+import (
+	"math"
+)
+
+// M is a map of str keys to values, for building or decoding documents dynamically.
+// Its getters do the type assertions (and conversions) which values decoded into 
+// an interface{} need. For example:
+//   var m msgpack.M
+//   err = msgpack.Unmarshal(b, &m, nil)
+//   id, ok := m.GetInt64("id")
+//   name, _ := m.GetMap("user").GetString("name")
+type M map[string]interface{}
+
+// A is an array of values, with getters like those of M.
+type A []interface{}
+
+// GetString returns the str at k. Raw bytes (how str values decode by default) are converted.
+func (m M) GetString(k string) (string, bool) { return asString(m[k]) }
+
+// GetBytes returns the str or bin at k as a []byte.
+func (m M) GetBytes(k string) ([]byte, bool) { return asBytes(m[k]) }
+
+// GetBool returns the bool at k.
+func (m M) GetBool(k string) (v bool, ok bool) {
+	v, ok = m[k].(bool)
+	return
+}
+
+// GetInt64 returns the integer at k, if it fits in an int64.
+func (m M) GetInt64(k string) (int64, bool) { return asInt64(m[k]) }
+
+// GetUint64 returns the non-negative integer at k.
+func (m M) GetUint64(k string) (uint64, bool) { return asUint64(m[k]) }
+
+// GetFloat64 returns the float (or integer, converted) at k.
+func (m M) GetFloat64(k string) (float64, bool) { return asFloat64(m[k]) }
+
+// GetMap returns the map at k as an M, or nil if there is none. 
+// A map with other key types is converted if all its keys are strings (or raw bytes).
+// As the getters of a nil M work, calls can be chained: m.GetMap("a").GetMap("b").GetString("c").
+func (m M) GetMap(k string) M { return asM(m[k]) }
+
+// GetArray returns the array at k as an A, or nil if there is none.
+func (m M) GetArray(k string) A { return asA(m[k]) }
+
+// Len returns the number of elements of a.
+func (a A) Len() int { return len(a) }
+
+func (a A) get(i int) interface{} {
+	if i < 0 || i >= len(a) {
+		return nil
+	}
+	return a[i]
+}
+
+// GetString returns the str at index i (see M.GetString).
+func (a A) GetString(i int) (string, bool) { return asString(a.get(i)) }
+
+// GetBytes returns the str or bin at index i as a []byte.
+func (a A) GetBytes(i int) ([]byte, bool) { return asBytes(a.get(i)) }
+
+// GetBool returns the bool at index i.
+func (a A) GetBool(i int) (v bool, ok bool) {
+	v, ok = a.get(i).(bool)
+	return
+}
+
+// GetInt64 returns the integer at index i, if it fits in an int64.
+func (a A) GetInt64(i int) (int64, bool) { return asInt64(a.get(i)) }
+
+// GetUint64 returns the non-negative integer at index i.
+func (a A) GetUint64(i int) (uint64, bool) { return asUint64(a.get(i)) }
+
+// GetFloat64 returns the float (or integer, converted) at index i.
+func (a A) GetFloat64(i int) (float64, bool) { return asFloat64(a.get(i)) }
+
+// GetMap returns the map at index i as an M, or nil if there is none (see M.GetMap).
+func (a A) GetMap(i int) M { return asM(a.get(i)) }
+
+// GetArray returns the array at index i as an A, or nil if there is none.
+func (a A) GetArray(i int) A { return asA(a.get(i)) }
+
+func asString(x interface{}) (string, bool) {
+	switch v := x.(type) {
+	case string:
+		return v, true
+	case []byte:
+		return string(v), true
+	}
+	return "", false
+}
+
+func asBytes(x interface{}) ([]byte, bool) {
+	switch v := x.(type) {
+	case string:
+		return []byte(v), true
+	case []byte:
+		return v, true
+	}
+	return nil, false
+}
+
+func asInt64(x interface{}) (int64, bool) {
+	switch v := x.(type) {
+	case int:
+		return int64(v), true
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	}
+	if ui, ok := asUint64(x); ok && ui <= math.MaxInt64 {
+		return int64(ui), true
+	}
+	return 0, false
+}
+
+func asUint64(x interface{}) (uint64, bool) {
+	switch v := x.(type) {
+	case uint:
+		return uint64(v), true
+	case uint8:
+		return uint64(v), true
+	case uint16:
+		return uint64(v), true
+	case uint32:
+		return uint64(v), true
+	case uint64:
+		return v, true
+	case int, int8, int16, int32, int64:
+		if i, _ := asInt64(v); i >= 0 {
+			return uint64(i), true
+		}
+	}
+	return 0, false
+}
+
+func asFloat64(x interface{}) (float64, bool) {
+	switch v := x.(type) {
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	if i, ok := asInt64(x); ok {
+		return float64(i), true
+	}
+	if ui, ok := asUint64(x); ok {
+		return float64(ui), true
+	}
+	return 0, false
+}
+
+func asM(x interface{}) M {
+	switch v := x.(type) {
+	case M:
+		return v
+	case map[string]interface{}:
+		return M(v)
+	case map[interface{}]interface{}:
+		m := make(M, len(v))
+		for k, e := range v {
+			s, ok := asString(k)
+			if !ok {
+				return nil
+			}
+			m[s] = e
+		}
+		return m
+	}
+	return nil
+}
+
+func asA(x interface{}) A {
+	switch v := x.(type) {
+	case A:
+		return v
+	case []interface{}:
+		return A(v)
+	}
+	return nil
+}
+
@@ -47,7 +47,12 @@ import (
 	"reflect"
 	"math"
 	"time"
+	"sync"
+	"sync/atomic"
 	"encoding/binary"
+	"encoding"
+	"sort"
+	"bufio"
 )
 
 var (
@@ -56,15 +61,143 @@ var (
 ) 
 
 // An Encoder writes an object to an output stream in the msgpack format.
+// 
+// An Encoder is not safe for concurrent use: values encoded by goroutines sharing one 
+// would be interleaved in the stream. Use a SyncEncoder for that. In builds with the 
+// race detector, concurrent calls to Encode panic.
 type Encoder struct {
 	w io.Writer
+	bw *bufio.Writer   // buffering writes to the underlying writer, unless it is nil (see EncoderOptions.Unbuffered)
+	g usageGuard
 	x [16]byte        //temp byte array re-used internally for efficiency
 	t1, t2, t3, t31, t5, t51, t9, t91 []byte // use these, so no need to constantly re-slice
+	deferred []deferredContainer // containers opened by BeginArray/BeginMap, innermost last
+	o EncoderOptions
+	inNilPtrZero bool  // encoding the zero value for a nil pointer (see NilPointerAsZero)
+	depth int          // nesting of pointers, maps and slices being encoded
+	seen map[encRef]struct{} // pointers, maps and slices being encoded, once depth > encCycleCheckDepth
+	refs map[sharedRefKey]*sharedRef // see EncoderOptions.SharedRefs
+	numRefs int
+	inExt int          // > 0 while encoding an ext's data into a buffer of its own (see countValue)
+	tc *typeCache      // type metadata, shared with the Handle the Encoder was created from (if any)
+}
+
+// encRef identifies a pointer, map or slice (which needs its length too) for cycle detection.
+type encRef struct {
+	p uintptr
+	l int
+}
+
+const (
+	// Cycles are only checked for past this depth, so the common (shallow) case 
+	// does not pay for tracking visited pointers.
+	encCycleCheckDepth = 1000
+	// encMaxDepth caps the nesting of pointers, maps and slices in an encoded value.
+	encMaxDepth = 10000
+)
+
+// EncoderOptions configures an Encoder.
+type EncoderOptions struct {
+	// NilSliceAsEmpty encodes a nil slice as an empty array (or empty raw bytes for a []byte), 
+	// instead of nil.
+	NilSliceAsEmpty bool
+	// NilMapAsEmpty encodes a nil map as an empty map, instead of nil.
+	NilMapAsEmpty bool
+	// NilPointerAsZero encodes a nil pointer as the zero value of the type it points to, 
+	// instead of nil. Nil pointers within that zero value are encoded as nil 
+	// (so recursive types terminate). A nil interface{} is still encoded as nil.
+	NilPointerAsZero bool
+	// SharedRefs preserves aliasing: a pointer occurring more than once in the encoded value
+	// is encoded in full only the first time (wrapped in an ExtSharedDef ext), 
+	// and as a small ExtSharedRef ext referring back to it after that.
+	// Decoding restores the sharing, so graphs of shared nodes do not blow up into
+	// deep copies (and values with cycles through pointers can be encoded: a map or slice 
+	// holding itself is still a cycle error). Cyclic values round-trip when decoded 
+	// into typed pointers (e.g. a *node whose fields are *node), not into interface{}: 
+	// that is an error, as a value decoded into interface{} only exists once fully decoded.
+	// 
+	// It costs an extra pass over the value to find the shared pointers, 
+	// and the peer must be able to decode the ext types.
+	SharedRefs bool
+	// NonFinite says how NaN and ±Inf float values are encoded.
+	NonFinite NonFinitePolicy
+	// Exts encodes values of the types registered in it as their ext types.
+	Exts *ExtRegistry
+	// DurationUnit, if set, encodes a time.Duration as an integer count of this unit 
+	// (e.g. time.Millisecond), truncated, instead of as nanoseconds.
+	DurationUnit time.Duration
+	// DurationAsString encodes a time.Duration as a string, e.g. "1h2m0.5s" (see time.Duration.String).
+	DurationAsString bool
+	// Types encodes values of the types named in it, when held in interfaces, 
+	// as ExtTyped exts carrying their names.
+	Types *TypeRegistry
+	// SortMapKeys encodes the entries of maps with string keys in (bytewise) order of their keys,
+	// so equal maps encode to the same bytes (e.g. for comparing output, or as cache keys).
+	// Other maps are encoded in Go's (random) iteration order.
+	SortMapKeys bool
+	// FieldNameMapper, if set, maps the names of struct fields without names in their tags 
+	// to their keys, e.g. SnakeCase. Decode with the same DecoderOptions.FieldNameMapper.
+	FieldNameMapper FieldNameMapper
+	// SetsAsArrays encodes set-shaped maps (with struct{} values, e.g. map[string]struct{}) 
+	// as arrays of their keys, instead of maps. They are decoded back from either.
+	// A struct field of such a type can be encoded so on its own with the set tag option.
+	SetsAsArrays bool
+	// Unbuffered makes the Encoder write to its writer as it encodes, in many small writes. 
+	// 
+	// By default, an Encoder buffers its writes internally (unless its writer is buffered itself, 
+	// i.e. implements io.ByteWriter, like a bytes.Buffer or bufio.Writer), and flushes the buffer 
+	// at the end of each call (Encode, WriteInt64, etc), so an error of the writer is returned 
+	// by the call which wrote the data.
+	Unbuffered bool
+	// DeferFlush makes a buffering Encoder flush its buffer only when it is full, or on Flush, 
+	// e.g. to batch many small values written with the Write methods. An error of the writer 
+	// may then be returned by a later call (or Flush).
+	DeferFlush bool
+	// Tee, if set, receives a copy of every byte written to the Encoder's writer, 
+	// e.g. to journal or checksum the stream, without encoding each value twice. 
+	// It is written to after the writer, in the same chunks; an error from either fails the call.
+	Tee io.Writer
+	// Stats, if set, receives the Stats of each value encoded by Encode.
+	Stats StatsCollector
+	// UseBinType encodes []byte values (and byte arrays) as bin, and strings of 32 to 255 bytes
+	// as str8, per the newer spec. By default, both are encoded as raw bytes (str) of the 
+	// original spec, which peers implementing only that can decode.
+	UseBinType bool
+	// PositiveIntAsUint encodes non-negative signed integers in the uint formats (when they
+	// do not fit a positive fixnum), as most other implementations do.
+	PositiveIntAsUint bool
+	// Float32AsFloat64 encodes float32 values as (exactly equal) float64 values.
+	Float32AsFloat64 bool
+}
+
+// deferredContainer holds the values written into a container whose length is not yet known.
+type deferredContainer struct {
+	ct ContainerType
+	buf *bytes.Buffer
+	w io.Writer      // writer to restore (and write the container into) when it is ended
+	n int            // values written into it (keys and values, for a map)
+	owed int         // elements still to be written of the containers started within it
 }
 
 // NewDecoder returns an Encoder for encoding an object.
 func NewEncoder(w io.Writer) (e *Encoder) {	
+	return NewEncoderEx(w, nil)
+}
+
+// NewEncoderEx returns an Encoder configured by opts (which may be nil).
+func NewEncoderEx(w io.Writer, opts *EncoderOptions) (e *Encoder) {	
 	e = &Encoder{w:w}
+	if opts != nil {
+		e.o = *opts
+	}
+	if e.o.Tee != nil {
+		w = io.MultiWriter(w, e.o.Tee)
+		e.w = w
+	}
+	if _, ok := w.(io.ByteWriter); !ok && !e.o.Unbuffered {
+		e.bw = bufio.NewWriter(w)
+		e.w = e.bw
+	}
 	e.t1, e.t2, e.t3, e.t31, e.t5, e.t51, e.t9, e.t91 = 
 		e.x[:1], e.x[:2], e.x[:3], e.x[1:3], e.x[:5], e.x[1:5], e.x[:9], e.x[1:9]
 	return
@@ -74,6 +207,13 @@ func NewEncoder(w io.Writer) (e *Encoder) {
 // 
 // time.Time is handled transparently, by (en)decoding (to)from a 
 // []int64{Seconds since Epoch, Nanoseconds offset}.
+// Complex numbers are encoded as a 2-element array of floats: {real, imaginary}
+// (unless registered as an ext type: see ExtRegistry.AddComplex).
+// A time.Duration is encoded as an integer count of nanoseconds (see EncoderOptions for other forms).
+// Map keys implementing encoding.TextMarshaler (except string types) are encoded as strings.
+// A net.IP is encoded as 4 (IPv4) or 16 raw bytes, and a net.IPNet or url.URL as a string.
+// A big.Int or big.Float is encoded as a decimal string (see ExtRegistry.AddBig for an exact form).
+// A Value is encoded as the document it holds.
 // 
 // Struct values encode as maps. Each exported struct field is encoded unless:
 //    - the field's tag is "-", or
@@ -91,7 +231,16 @@ func NewEncoder(w io.Writer) (e *Encoder) {
 // followed by an optional comma and options. 
 // 
 // To set an option on all fields (e.g. omitempty on all fields), you 
-// can create a field called _struct, and set flags on it.
+// can create a field called _struct, and set flags on it. Its version=N option 
+// gives the struct a schema version, encoded with it (see SchemaVersionKey and Migrations).
+// 
+// A field with the ext=N option is encoded as an ext of type N, holding its binary form: 
+// the ext data of its type in EncoderOptions.Exts if registered there, else its MarshalBinary
+// (see encoding.BinaryMarshaler). It is decoded back the same way.
+// 
+// A bool or number field (or pointer to one) with the string option is encoded as a string,
+// as with encoding/json: e.g. "true", "42" or "1.5" (or "1m30s" for a time.Duration).
+// Either a string or a value of the type is then decoded into it.
 // 
 // Examples:
 //    
@@ -101,6 +250,9 @@ func NewEncoder(w io.Writer) (e *Encoder) {
 //          Field2 int      `msgpack:"myName"`       //Use key "myName" in encode stream
 //          Field3 int32    `msgpack:",omitempty"`   //use key "Field3". Omit if empty.
 //          Field4 bool     `msgpack:"f4,omitempty"` //use key "f4". Omit if empty.
+//          Field5 UUID     `msgpack:",ext=42"`      //encode the binary form as ext type 42
+//          Field6 int64    `msgpack:",string"`      //encode as a string, e.g. "42"
+//          Field7 map[string]struct{} `msgpack:",set"` //encode the keys as an array
 //          ...
 //      }
 //    
@@ -108,13 +260,221 @@ func (e *Encoder) Encode(v interface{}) (err error) {
 	return e.EncodeValue(reflectValue(v))
 }
 
+// EncodeMulti encodes each of vs in turn, as successive values in the stream.
+// It stops at the first error.
+func (e *Encoder) EncodeMulti(vs ...interface{}) (err error) {
+	for _, v := range vs {
+		if err = e.Encode(v); err != nil {
+			return
+		}
+	}
+	return
+}
+
 // EncodeValue encodes a reflect.Value.
 func (e *Encoder) EncodeValue(rv reflect.Value) (err error) {
-	defer panicToErr(&err) 
+	e.g.enter("Encoder")
+	defer e.g.exit()
+	defer e.done(&err)
+	e.inNilPtrZero = false
+	if e.depth != 0 {
+		// a previous Encode failed midway
+		e.depth = 0
+		e.seen = nil
+	}
+	var sw *statsWriter
+	if e.o.Stats != nil {
+		sw = &statsWriter{w: e.w}
+		defer func(w io.Writer) { e.w = w }(e.w)
+		e.w = sw
+	}
+	if e.o.SharedRefs {
+		defer e.endSharedRefs(e.w)
+		e.refs = make(map[sharedRefKey]*sharedRef)
+		e.countSharedRefs(rv, make(map[encRef]struct{}))
+	}
 	e.encodeValue(rv)
+	if sw != nil {
+		e.o.Stats.CollectStats(StatsOf(sw.bs))
+	}
+	return
+}
+
+// The Write methods below are a low-level API for writing msgpack primitives
+// directly, without reflection. They can be used (with each other, or with Encode)
+// by hand-written encoders on hot paths. 
+// 
+// For containers, write the header (WriteArrayHeader or WriteMapHeader), 
+// then exactly that many values (or key/value pairs for a map).
+
+// WriteNil writes a nil value.
+func (e *Encoder) WriteNil() (err error) {
+	defer e.done(&err)
+	e.encNil()
+	return
+}
+
+// WriteBool writes a bool value.
+func (e *Encoder) WriteBool(b bool) (err error) {
+	defer e.done(&err)
+	e.encBool(b)
+	return
+}
+
+// WriteInt64 writes a signed integer, using the smallest encoding which fits it.
+func (e *Encoder) WriteInt64(i int64) (err error) {
+	defer e.done(&err)
+	e.encInt(i)
+	return
+}
+
+// WriteUint64 writes an unsigned integer, using the smallest encoding which fits it.
+func (e *Encoder) WriteUint64(ui uint64) (err error) {
+	defer e.done(&err)
+	e.encUint(ui)
+	return
+}
+
+// WriteFloat32 writes a float32 value.
+func (e *Encoder) WriteFloat32(f float32) (err error) {
+	defer e.done(&err)
+	e.encFloat32(f)
+	return
+}
+
+// WriteFloat64 writes a float64 value.
+func (e *Encoder) WriteFloat64(f float64) (err error) {
+	defer e.done(&err)
+	e.encFloat64(f)
+	return
+}
+
+// WriteString writes a string as raw bytes.
+func (e *Encoder) WriteString(s string) (err error) {
+	defer e.done(&err)
+	e.encString(s)
+	return
+}
+
+// WriteBytes writes a []byte as raw bytes (or bin: see EncoderOptions.UseBinType).
+func (e *Encoder) WriteBytes(bs []byte) (err error) {
+	defer e.done(&err)
+	e.encRawBytes(bs)
+	return
+}
+
+// WriteArrayHeader writes the header for an array of l elements.
+func (e *Encoder) WriteArrayHeader(l int) (err error) {
+	defer e.done(&err)
+	e.writeContainerLen(ContainerList, l)
+	return
+}
+
+// WriteMapHeader writes the header for a map of l key/value pairs.
+func (e *Encoder) WriteMapHeader(l int) (err error) {
+	defer e.done(&err)
+	e.writeContainerLen(ContainerMap, l)
+	return
+}
+
+// WriteExt writes an ext value of type xtag with the given data.
+func (e *Encoder) WriteExt(xtag int8, data []byte) (err error) {
+	defer e.done(&err)
+	e.writeExtHeader(xtag, len(data))
+	if len(data) > 0 {
+		e.writeb(len(data), data)
+	}
+	return
+}
+
+// BeginArray starts an array whose length is not known up front.
+// 
+// All values written afterwards (via Encode or the Write methods) are elements
+// of the array, until the matching EndArray call. They are buffered internally 
+// until then, so the header (with the smallest encoding for the final length) 
+// can be written before them. Deferred arrays and maps can be nested.
+func (e *Encoder) BeginArray() (err error) {
+	e.beginDeferred(ContainerList)
+	return
+}
+
+// EndArray ends the array started by the matching BeginArray, writing it out.
+func (e *Encoder) EndArray() (err error) {
+	defer e.done(&err)
+	e.endDeferred(ContainerList)
 	return
 }
 
+// BeginMap starts a map whose length is not known up front.
+// Keys and values are written alternately until the matching EndMap call.
+// See BeginArray.
+func (e *Encoder) BeginMap() (err error) {
+	e.beginDeferred(ContainerMap)
+	return
+}
+
+// EndMap ends the map started by the matching BeginMap, writing it out.
+func (e *Encoder) EndMap() (err error) {
+	defer e.done(&err)
+	e.endDeferred(ContainerMap)
+	return
+}
+
+// Flush writes any data buffered internally to the underlying writer 
+// (see EncoderOptions.Unbuffered and DeferFlush).
+func (e *Encoder) Flush() error {
+	if e.bw == nil {
+		return nil
+	}
+	return e.bw.Flush()
+}
+
+// done ends an exported method: it sets *err from a panic (see panicToErr), 
+// and flushes the internal buffer (unless EncoderOptions.DeferFlush).
+func (e *Encoder) done(err *error) {
+	if x := recover(); x != nil {
+		e.inExt = 0 // an ext's data may have failed midway
+		panicToErrT(x, err)
+	}
+	if e.bw != nil && !e.o.DeferFlush {
+		if ferr := e.bw.Flush(); *err == nil {
+			*err = ferr
+		}
+	}
+}
+
+func (e *Encoder) beginDeferred(ct ContainerType) {
+	dc := deferredContainer{ct: ct, buf: new(bytes.Buffer), w: e.w}
+	e.deferred = append(e.deferred, dc)
+	e.w = dc.buf
+}
+
+func (e *Encoder) endDeferred(ct ContainerType) {
+	n := len(e.deferred) - 1
+	if n < 0 || e.deferred[n].ct != ct {
+		e.err("End called without a matching Begin for container type: %c", ct)
+	}
+	dc := e.deferred[n]
+	e.deferred = e.deferred[:n]
+	e.w = dc.w
+	
+	if dc.owed > 0 {
+		e.err("End called with an incomplete value (%d elements missing)", dc.owed)
+	}
+	bs, l := dc.buf.Bytes(), dc.n
+	if ct == ContainerMap {
+		if l % 2 != 0 {
+			e.err("EndMap: Odd number of keys and values: %d", l)
+		}
+		l /= 2
+	}
+	e.writeContainerHeader(ct, l)
+	e.countValue(0)
+	if len(bs) > 0 {
+		e.writeb(len(bs), bs)
+	}
+}
+
 func (e *Encoder) encode(v interface{}) {
 	e.encodeValue(reflectValue(v))
 }
@@ -128,6 +488,10 @@ func (e *Encoder) encodeValue(rv reflect.Value) {
 	// Tested with a type assertion for all common types first, but this increased encoding time
 	// sometimes by up to 20% (weird). So just use the reflect.Kind switch alone.
 	
+	if e.o.Exts != nil && rv.IsValid() && e.encodeExt(rv) {
+		return
+	}
+	
 	// ensure more common cases appear early in switch.
 	switch rk := rv.Kind(); rk {
 	case reflect.Bool:
@@ -135,34 +499,50 @@ func (e *Encoder) encodeValue(rv reflect.Value) {
 	case reflect.String:
 		e.encString(rv.String())
 	case reflect.Int, reflect.Int8, reflect.Int64, reflect.Int32, reflect.Int16:
+		if rk == reflect.Int64 && (e.o.DurationUnit > 0 || e.o.DurationAsString) && rv.Type() == durationTyp {
+			e.encDuration(time.Duration(rv.Int()))
+			break
+		}
 		e.encInt(rv.Int())
 	case reflect.Uint8, reflect.Uint64, reflect.Uint, reflect.Uint32, reflect.Uint16:
 		e.encUint(rv.Uint())
 	case reflect.Float64:
-		e.t9[0] = 0xcb
-		binary.BigEndian.PutUint64(e.t91, math.Float64bits(rv.Float()))
-		e.writeb(9, e.t9)
+		e.encFloat64(rv.Float())
 	case reflect.Float32:
-		e.t5[0] = 0xca
-		binary.BigEndian.PutUint32(e.t51, math.Float32bits(float32(rv.Float())))
-		e.writeb(5, e.t5)
+		e.encFloat32(float32(rv.Float()))
 	case reflect.Slice:
-		if rv.IsNil() {
+		if rv.IsNil() && !e.o.NilSliceAsEmpty {
 			e.encNil()
 			break
 		} 
 		l := rv.Len()
-		if rv.Type() == byteSliceTyp {
-			e.writeContainerLen(ContainerRawBytes, l)
-			if l > 0 {
-				e.writeb(l, rv.Bytes())
+		if rv.Type() == rawTyp {
+			if l == 0 {
+				// an empty Raw (e.g. a nil one, with NilSliceAsEmpty) holds no value, 
+				// and writing nothing would leave the stream one value short.
+				e.encNil()
+				break
 			}
+			e.countValue(0)
+			e.writeb(l, rv.Bytes())
 			break
 		}
-		e.writeContainerLen(ContainerList, l)
-		for j := 0; j < l; j++ {
-			e.encode(rv.Index(j))
+		if rv.Type() == byteSliceTyp {
+			e.encRawBytes(rv.Bytes())
+			break
+		}
+		if rv.Type() == ipTyp {
+			e.encodeIP(rv.Bytes())
+			break
 		}
+		ref, tracked := e.enterRef(rv, l)
+		if !e.encodeFast(rv) {
+			e.writeContainerLen(ContainerList, l)
+			for j := 0; j < l; j++ {
+				e.encode(rv.Index(j))
+			}
+		}
+		e.exitRef(ref, tracked)
 	case reflect.Array:
 		l := rv.Len()
 		// this should not happen (a 0-elem array makes no sense) ... but just in case
@@ -173,8 +553,15 @@ func (e *Encoder) encodeValue(rv reflect.Value) {
 		// log("---- %v", rv.Type())
 		// if rv.Type().Elem().Kind == reflect.Uint8 { // surprisingly expensive (check 1st value instead)
 		if rv.Index(0).Kind() == reflect.Uint8 {
-			e.writeContainerLen(ContainerRawBytes, l)
-			e.writeb(l, rv.Slice(0, l).Bytes())
+			e.writeBinLen(l)
+			if rv.CanAddr() {
+				e.writeb(l, rv.Slice(0, l).Bytes())
+			} else {
+				// e.g. in a map or interface{}: copy it out
+				bs := make([]byte, l)
+				reflect.Copy(reflect.ValueOf(bs), rv)
+				e.writeb(l, bs)
+			}
 			break
 		}
 		e.writeContainerLen(ContainerList, l)
@@ -182,15 +569,33 @@ func (e *Encoder) encodeValue(rv reflect.Value) {
 			e.encode(rv.Index(j))
 		}
 	case reflect.Map:
-		if rv.IsNil() {
+		if e.o.SetsAsArrays && isSetType(rv.Type()) {
+			e.encodeSet(rv)
+			break
+		}
+		if rv.IsNil() && !e.o.NilMapAsEmpty {
 			e.encNil()
 			break
 		}
-		e.writeContainerLen(ContainerMap, rv.Len())
-		for _, mk := range rv.MapKeys() {
-			e.encode(mk)
-			e.encode(rv.MapIndex(mk))
+		ref, tracked := e.enterRef(rv, 0)
+		if !e.encodeFast(rv) {
+			e.writeContainerLen(ContainerMap, rv.Len())
+			ktype := rv.Type().Key()
+			keyText := ktype.Kind() != reflect.String && ktype.Implements(textMarshalerTyp)
+			mks := rv.MapKeys()
+			if e.o.SortMapKeys && ktype.Kind() == reflect.String {
+				sort.Slice(mks, func(i, j int) bool { return mks[i].String() < mks[j].String() })
+			}
+			for _, mk := range mks {
+				if keyText {
+					e.encodeTextKey(mk)
+				} else {
+					e.encode(mk)
+				}
+				e.encode(rv.MapIndex(mk))
+			}
 		}
+		e.exitRef(ref, tracked)
 	case reflect.Struct:
 		rt := rv.Type()
 		//treat time.Time specially
@@ -199,13 +604,53 @@ func (e *Encoder) encodeValue(rv reflect.Value) {
 			e.encode([2]int64{tt.Unix(), int64(tt.Nanosecond())})
 			break
 		}
+		if rt == bigIntTyp || rt == bigFloatTyp {
+			e.encodeBig(rv)
+			break
+		}
+		if rt == ipNetTyp || rt == urlTyp {
+			e.encodeNetValue(rv)
+			break
+		}
+		if rt == valueTyp {
+			v := rv.Interface().(Value)
+			e.encodeNode(&v)
+			break
+		}
 		e.encodeStruct(rt, rv)
 	case reflect.Ptr, reflect.Interface:
 		if rv.IsNil() {
-			e.encNil()
+			if rk == reflect.Ptr && e.o.NilPointerAsZero && !e.inNilPtrZero {
+				e.inNilPtrZero = true
+				e.encodeValue(reflect.Zero(rv.Type().Elem()))
+				e.inNilPtrZero = false
+			} else {
+				e.encNil()
+			}
+			break
+		}
+		if rk == reflect.Interface {
+			if e.o.Types == nil || !e.encodeTyped(rv.Elem()) {
+				e.encodeValue(rv.Elem())
+			}
 			break
 		}
+		if e.refs != nil && e.encodeSharedPtr(rv) {
+			break
+		}
+		ref, tracked := e.enterRef(rv, 0)
 		e.encodeValue(rv.Elem())
+		e.exitRef(ref, tracked)
+	case reflect.Complex128:
+		c := rv.Complex()
+		e.writeContainerLen(ContainerList, 2)
+		e.encFloat64(real(c))
+		e.encFloat64(imag(c))
+	case reflect.Complex64:
+		c := rv.Complex()
+		e.writeContainerLen(ContainerList, 2)
+		e.encFloat32(float32(real(c)))
+		e.encFloat32(float32(imag(c)))
 	case reflect.Invalid:
 		e.encNil()
 	default:
@@ -214,7 +659,158 @@ func (e *Encoder) encodeValue(rv reflect.Value) {
 	return
 }
 
+// encodeTextKey encodes a map key using its encoding.TextMarshaler implementation.
+func (e *Encoder) encodeTextKey(mk reflect.Value) {
+	if mk.Kind() == reflect.Ptr && mk.IsNil() {
+		e.encString("")
+		return
+	}
+	bs, err := mk.Interface().(encoding.TextMarshaler).MarshalText()
+	if err != nil {
+		e.err("MarshalText for map key of type: %v: %v", mk.Type(), err)
+	}
+	e.encStrBytes(bs)
+}
+
+// enterRef is called before encoding the contents of a pointer, map or slice (of length l). 
+// It errors if the value is nested too deeply, or (past encCycleCheckDepth) 
+// if it is already being encoded further up, i.e. it refers back to itself.
+// Call exitRef with its results once done.
+func (e *Encoder) enterRef(rv reflect.Value, l int) (ref encRef, tracked bool) {
+	e.depth++
+	if e.depth <= encCycleCheckDepth {
+		return
+	}
+	if e.depth > encMaxDepth {
+		e.err("Exceeded max nesting depth of %v, encoding: %v", encMaxDepth, rv.Type())
+	}
+	ref = encRef{rv.Pointer(), l}
+	if _, ok := e.seen[ref]; ok {
+		e.err("Encountered a cycle (value refers back to itself), encoding: %v", rv.Type())
+	}
+	if e.seen == nil {
+		e.seen = make(map[encRef]struct{})
+	}
+	e.seen[ref] = struct{}{}
+	tracked = true
+	return
+}
+
+func (e *Encoder) exitRef(ref encRef, tracked bool) {
+	if tracked {
+		delete(e.seen, ref)
+	}
+	e.depth--
+}
+
+// encodeFast encodes the most common composite types without reflection.
+// It returns false if rv is not one of them.
+func (e *Encoder) encodeFast(rv reflect.Value) bool {
+	if !rv.CanInterface() || e.o.Exts != nil && e.o.Exts.byType[rv.Type().Elem()] != nil {
+		return false
+	}
+	// the interfaces in a []interface{} or map[string]interface{} may hold named types.
+	if e.o.Types != nil && rv.Type().Elem().Kind() == reflect.Interface {
+		return false
+	}
+	switch rv.Type() {
+	case intfSliceTyp:
+		v := rv.Interface().([]interface{})
+		e.writeContainerLen(ContainerList, len(v))
+		for _, x := range v {
+			e.encode(x)
+		}
+	case stringSliceTyp:
+		v := rv.Interface().([]string)
+		e.writeContainerLen(ContainerList, len(v))
+		for _, x := range v {
+			e.encString(x)
+		}
+	case int64SliceTyp:
+		v := rv.Interface().([]int64)
+		e.writeContainerLen(ContainerList, len(v))
+		for _, x := range v {
+			e.encInt(x)
+		}
+	case float64SliceTyp:
+		v := rv.Interface().([]float64)
+		e.writeContainerLen(ContainerList, len(v))
+		for _, x := range v {
+			e.encFloat64(x)
+		}
+	case mapStringIntfTyp:
+		v := rv.Interface().(map[string]interface{})
+		e.writeContainerLen(ContainerMap, len(v))
+		if e.o.SortMapKeys {
+			for _, k := range sortedMapKeys(v) {
+				e.encString(k)
+				e.encode(v[k])
+			}
+			break
+		}
+		for k, x := range v {
+			e.encString(k)
+			e.encode(x)
+		}
+	case mapStringStringTyp:
+		v := rv.Interface().(map[string]string)
+		e.writeContainerLen(ContainerMap, len(v))
+		if e.o.SortMapKeys {
+			for _, k := range sortedMapKeys(v) {
+				e.encString(k)
+				e.encString(v[k])
+			}
+			break
+		}
+		for k, x := range v {
+			e.encString(k)
+			e.encString(x)
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// sortedMapKeys returns the keys of m in order (see EncoderOptions.SortMapKeys).
+func sortedMapKeys[V any](m map[string]V) []string {
+	ks := make([]string, 0, len(m))
+	for k := range m {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	return ks
+}
+
+// countValue is called as each value is started, with the number of elements which follow it 
+// (for an array or map header), to count the values written into the innermost deferred container. 
+// Values within an ext's data (e.g. of a shared reference) are not counted: only its header is.
+func (e *Encoder) countValue(elems int) {
+	if n := len(e.deferred) - 1; n >= 0 && e.inExt == 0 {
+		dc := &e.deferred[n]
+		if dc.owed > 0 {
+			dc.owed--
+		} else {
+			dc.n++
+		}
+		dc.owed += elems
+	}
+}
+
 func (e *Encoder) writeContainerLen(ct ContainerType, l int) {
+	switch ct {
+	case ContainerList:
+		e.countValue(l)
+	case ContainerMap:
+		e.countValue(2 * l)
+	default:
+		e.countValue(0)
+	}
+	e.writeContainerHeader(ct, l)
+}
+
+// writeContainerHeader writes the header of a container, without counting it (see countValue).
+func (e *Encoder) writeContainerHeader(ct ContainerType, l int) {
 	locutoff, b0, b1, b2 := getContainerByteDesc(ct)
 
 	switch {
@@ -232,12 +828,60 @@ func (e *Encoder) writeContainerLen(ct ContainerType, l int) {
 	}
 }
 
+// writeExtHeader writes the header of an ext value with l bytes of data, 
+// using a fixext descriptor where possible.
+func (e *Encoder) writeExtHeader(xtag int8, l int) {
+	e.countValue(0)
+	switch l {
+	case 1, 2, 4, 8, 16:
+		var bd byte
+		switch l {
+		case 1:
+			bd = 0xd4
+		case 2:
+			bd = 0xd5
+		case 4:
+			bd = 0xd6
+		case 8:
+			bd = 0xd7
+		default:
+			bd = 0xd8
+		}
+		e.t2[0], e.t2[1] = bd, byte(xtag)
+		e.writeb(2, e.t2)
+		return
+	}
+	switch {
+	case l < 256:
+		e.t3[0], e.t3[1], e.t3[2] = 0xc7, byte(l), byte(xtag)
+		e.writeb(3, e.t3)
+	case l < 65536:
+		e.t3[0] = 0xc8
+		binary.BigEndian.PutUint16(e.t31, uint16(l))
+		e.writeb(3, e.t3)
+		e.t1[0] = byte(xtag)
+		e.writeb(1, e.t1)
+	default:
+		e.t5[0] = 0xc9
+		binary.BigEndian.PutUint32(e.t51, uint32(l))
+		e.writeb(5, e.t5)
+		e.t1[0] = byte(xtag)
+		e.writeb(1, e.t1)
+	}
+}
+
 func (e *Encoder) encNil() {
+	e.countValue(0)
 	e.t1[0] = 0xc0
 	e.writeb(1, e.t1)
 }
 
 func (e *Encoder) encInt(i int64) {
+	if i > math.MaxInt8 && e.o.PositiveIntAsUint {
+		e.encUint(uint64(i))
+		return
+	}
+	e.countValue(0)
 	switch {
 	case i < math.MinInt32 || i > math.MaxInt32:
 		e.t9[0] = 0xd3
@@ -263,6 +907,7 @@ func (e *Encoder) encInt(i int64) {
 }
 
 func (e *Encoder) encUint(i uint64) {
+	e.countValue(0)
 	switch {
 	case i <= math.MaxInt8:
 		e.t1[0] = byte(i)
@@ -285,7 +930,49 @@ func (e *Encoder) encUint(i uint64) {
 	}
 }
 
+func (e *Encoder) encFloat64(f float64) {
+	if e.o.NonFinite != NonFinitePassThrough && isNonFinite(f) && e.nonFinite(f) {
+		return
+	}
+	e.countValue(0)
+	e.t9[0] = 0xcb
+	binary.BigEndian.PutUint64(e.t91, math.Float64bits(f))
+	e.writeb(9, e.t9)
+}
+
+func (e *Encoder) encFloat32(f float32) {
+	if e.o.Float32AsFloat64 {
+		e.encFloat64(float64(f))
+		return
+	}
+	if e.o.NonFinite != NonFinitePassThrough && isNonFinite(float64(f)) && e.nonFinite(float64(f)) {
+		return
+	}
+	e.countValue(0)
+	e.t5[0] = 0xca
+	binary.BigEndian.PutUint32(e.t51, math.Float32bits(f))
+	e.writeb(5, e.t5)
+}
+
+func (e *Encoder) encDuration(d time.Duration) {
+	if e.o.DurationAsString {
+		e.encString(d.String())
+	} else {
+		e.encInt(int64(d / e.o.DurationUnit))
+	}
+}
+
+// nonFinite applies EncoderOptions.NonFinite to f. It returns true if f was handled (as nil).
+func (e *Encoder) nonFinite(f float64) bool {
+	if e.o.NonFinite == NonFiniteError {
+		e.err("Non-finite float value: %v", f)
+	}
+	e.encNil()
+	return true
+}
+
 func (e *Encoder) encBool(b bool) {
+	e.countValue(0)
 	if b {
 		e.t1[0] = 0xc3
 	} else {
@@ -296,37 +983,129 @@ func (e *Encoder) encBool(b bool) {
 
 func (e *Encoder) encodeStruct(rt reflect.Type, rv reflect.Value) {
 	sis := getStructFieldInfos(rt)
-	// e.writeContainerLen(ContainerMap, len(sis.sis))
-	// for _, si := range sis.sis {
-	// 	e.encode(si.encNameBs)
-	// 	e.encode(si.field(rv))
-	// }
-	// return
+	if sis.beforeEncode {
+		rv = e.beforeEncode(rv)
+	}
+	versioned := 0
+	if sis.version > 0 {
+		versioned = 1
+	}
+	var names [][]byte
+	if e.o.FieldNameMapper != nil {
+		names = e.structNames(rt, sis)
+	}
+	if !sis.anyOmitEmpty {
+		e.writeContainerLen(ContainerMap, len(sis.sis) + versioned)
+		if versioned > 0 {
+			e.encodeSchemaVersion(sis)
+		}
+		for _, si := range sis.sis {
+			if names != nil {
+				e.encStrBytes(names[si.ix])
+			} else {
+				e.encStrBytes(si.encNameBs)
+			}
+			e.encodeField(si, si.field(rv))
+		}
+		return
+	}
 	
 	encNames := make([][]byte, len(sis.sis))
 	rvals := make([]reflect.Value, len(sis.sis))
+	rsis := make([]*structFieldInfo, len(sis.sis))
 	newlen := 0
 	for _, si := range sis.sis {
 		rval0 := si.field(rv)
 		if si.omitEmpty && isEmptyValue(rval0) {
 			continue
 		}
-		encNames[newlen] = si.encNameBs
+		rsis[newlen] = si
+		if names != nil {
+			encNames[newlen] = names[si.ix]
+		} else {
+			encNames[newlen] = si.encNameBs
+		}
 		rvals[newlen] = rval0
 		newlen++
 	}
 	
-	e.writeContainerLen(ContainerMap, newlen)
+	e.writeContainerLen(ContainerMap, newlen + versioned)
+	if versioned > 0 {
+		e.encodeSchemaVersion(sis)
+	}
 	for j := 0; j < newlen; j++ {
-		e.encode(encNames[j])
-		e.encode(rvals[j])
+		e.encStrBytes(encNames[j])
+		e.encodeField(rsis[j], rvals[j])
 	}
 	
 }
 
+// encodeField encodes the value rv of the struct field si, as its tag options say.
+func (e *Encoder) encodeField(si *structFieldInfo, rv reflect.Value) {
+	switch {
+	case si.hasExt:
+		e.encodeFieldExt(si, rv)
+	case si.asString:
+		e.encodeFieldString(rv)
+	case si.asSet && isSetType(rv.Type()):
+		e.encodeSet(rv)
+	default:
+		e.encode(rv)
+	}
+}
+
+// encRawBytes encodes bs as a []byte (see EncoderOptions.UseBinType).
+func (e *Encoder) encRawBytes(bs []byte) {
+	e.writeBinLen(len(bs))
+	if len(bs) > 0 {
+		e.writeb(len(bs), bs)
+	}
+}
+
+// encStrBytes encodes bs as a string.
+func (e *Encoder) encStrBytes(bs []byte) {
+	e.writeStrLen(len(bs))
+	if len(bs) > 0 {
+		e.writeb(len(bs), bs)
+	}
+}
+
+// writeBinLen writes the header of a []byte of l bytes: bin with UseBinType, else raw bytes.
+func (e *Encoder) writeBinLen(l int) {
+	if !e.o.UseBinType {
+		e.writeContainerLen(ContainerRawBytes, l)
+		return
+	}
+	e.countValue(0)
+	switch {
+	case l <= math.MaxUint8:
+		e.t2[0], e.t2[1] = 0xc4, byte(l)
+		e.writeb(2, e.t2)
+	case l <= math.MaxUint16:
+		e.t3[0] = 0xc5
+		binary.BigEndian.PutUint16(e.t31, uint16(l))
+		e.writeb(3, e.t3)
+	default:
+		e.t5[0] = 0xc6
+		binary.BigEndian.PutUint32(e.t51, uint32(l))
+		e.writeb(5, e.t5)
+	}
+}
+
+// writeStrLen writes the header of a string of l bytes, as str8 with UseBinType if it fits.
+func (e *Encoder) writeStrLen(l int) {
+	if e.o.UseBinType && l >= 32 && l <= math.MaxUint8 {
+		e.countValue(0)
+		e.t2[0], e.t2[1] = 0xd9, byte(l)
+		e.writeb(2, e.t2)
+		return
+	}
+	e.writeContainerLen(ContainerRawBytes, l)
+}
+
 func (e *Encoder) encString(s string) {
 	numbytes := len(s)
-	e.writeContainerLen(ContainerRawBytes, numbytes)
+	e.writeStrLen(numbytes)
 	// e.encode([]byte(s)) // using io.WriteString is faster
 	n, err := io.WriteString(e.w, s)
 	if err != nil {
@@ -359,12 +1138,98 @@ func (e *Encoder) err(format string, params ...interface{}) {
 
 // Marshal is a convenience function which encodes v to a stream of bytes. 
 // It delegates to Encoder.Encode.
+// 
+// The Encoder and buffer used internally are pooled, so they are not allocated per call.
 func Marshal(v interface{}) (b []byte, err error) {
-	bs := new(bytes.Buffer)
-	if err = NewEncoder(bs).Encode(v); err == nil {
-		b = bs.Bytes()
+	ms := getMarshalState()
+	if err = ms.e.Encode(v); err == nil {
+		b = append([]byte(nil), ms.buf.Bytes()...)
 	}
+	putMarshalState(ms)
+	return
+}
+
+// EncodedSize returns the number of bytes v encodes to, without producing the encoding.
+// It can be used to pre-allocate exact buffers, write length prefixes for framing,
+// or reject oversized values before encoding them.
+func EncodedSize(v interface{}) (n int, err error) {
+	var cw countWriter
+	err = NewEncoderEx(&cw, &EncoderOptions{ Unbuffered: true }).Encode(v)
+	n = cw.n
 	return
 }
 
+// countWriter discards everything written to it, counting the bytes.
+type countWriter struct {
+	n int
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	w.n += len(p)
+	return len(p), nil
+}
+
+func (w *countWriter) WriteString(s string) (int, error) {
+	w.n += len(s)
+	return len(s), nil
+}
+
+// marshalState is the pooled state used by Marshal.
+type marshalState struct {
+	buf bytes.Buffer
+	e *Encoder
+}
+
+// Pooled marshalStates are grouped by the capacity of their buffer (size class), and Marshal 
+// takes from the class of the size it last encoded: a burst of large messages doesn't leave 
+// large buffers serving small ones, nor small ones (re-grown on each use) serving large ones. 
+// Buffers past twice the largest class are not retained at all.
+var (
+	marshalSizeClasses = [...]int{ 256, 1 << 10, 4 << 10, 16 << 10, 64 << 10 }
+	marshalPools [len(marshalSizeClasses)]sync.Pool
+	marshalLastClass int32 // size class of the last encoded message (accessed atomically)
+)
+
+// marshalSizeClass returns the smallest size class holding n bytes (or the largest).
+func marshalSizeClass(n int) int {
+	for j, c := range marshalSizeClasses {
+		if n <= c {
+			return j
+		}
+	}
+	return len(marshalSizeClasses) - 1
+}
+
+func getMarshalState() (ms *marshalState) {
+	// without falling through to other classes, which may hold much larger buffers.
+	j := atomic.LoadInt32(&marshalLastClass)
+	if x := marshalPools[j].Get(); x != nil {
+		ms = x.(*marshalState)
+		ms.buf.Reset()
+		return
+	}
+	ms = new(marshalState)
+	ms.buf.Grow(marshalSizeClasses[j])
+	ms.e = NewEncoder(&ms.buf)
+	return
+}
+
+func putMarshalState(ms *marshalState) {
+	atomic.StoreInt32(&marshalLastClass, int32(marshalSizeClass(ms.buf.Len())))
+	c := ms.buf.Cap()
+	if c > 2 * marshalSizeClasses[len(marshalSizeClasses)-1] {
+		return
+	}
+	ms.e.deferred = ms.e.deferred[:0]
+	ms.e.w = &ms.buf
+	ms.e.o = EncoderOptions{}
+	ms.e.tc = nil
+	for j := len(marshalSizeClasses) - 1; j >= 0; j-- {
+		if c >= marshalSizeClasses[j] || j == 0 {
+			marshalPools[j].Put(ms)
+			return
+		}
+	}
+}
+
 
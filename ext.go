@@ -0,0 +1,279 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+import (
+	"encoding"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// ExtEncodeFn returns the ext data for rv (a value of the type it was registered for).
+type ExtEncodeFn func(rv reflect.Value) ([]byte, error)
+
+// ExtDecodeFn sets rv (a settable value of the type it was registered for) from ext data.
+type ExtDecodeFn func(rv reflect.Value, data []byte) error
+
+// ExtRegistry maps Go types to application-defined msgpack ext types.
+// Pass it to Encoders and Decoders via EncoderOptions.Exts and DecoderOptions.Exts.
+// 
+// Add all types before use: it is then safe for concurrent use by many Encoders and Decoders.
+type ExtRegistry struct {
+	byType map[reflect.Type]*extInfo
+	byTag map[int8]*extInfo
+}
+
+type extInfo struct {
+	rt reflect.Type
+	tag int8
+	enc ExtEncodeFn
+	dec ExtDecodeFn
+}
+
+// NewExtRegistry returns an empty ExtRegistry.
+func NewExtRegistry() *ExtRegistry {
+	return &ExtRegistry{
+		byType: make(map[reflect.Type]*extInfo),
+		byTag: make(map[int8]*extInfo),
+	}
+}
+
+// Add registers values of type rt to be encoded as ext type tag, using encFn and decFn.
+// 
+// Register the non-pointer type: a pointer to it is (de)referenced as usual. 
+// More than one type may share a tag: a value of that ext type decoded into a 
+// nil interface{} then gets the type registered first.
+func (x *ExtRegistry) Add(rt reflect.Type, tag int8, encFn ExtEncodeFn, decFn ExtDecodeFn) (err error) {
+	switch {
+	case rt == nil || encFn == nil || decFn == nil:
+		err = fmt.Errorf("ExtRegistry.Add: type and functions must be non-nil")
+	case tag == ExtSharedDef || tag == ExtSharedRef || tag == ExtTyped:
+		err = fmt.Errorf("ExtRegistry.Add: ext type %v is reserved", tag)
+	case x.byType[rt] != nil:
+		err = fmt.Errorf("ExtRegistry.Add: type %v is already registered", rt)
+	}
+	if err != nil {
+		return
+	}
+	xi := &extInfo{rt: rt, tag: tag, enc: encFn, dec: decFn}
+	x.byType[rt] = xi
+	if x.byTag[tag] == nil {
+		x.byTag[tag] = xi
+	}
+	return
+}
+
+// AddComplex registers complex128 and complex64 as ext type tag.
+// The data is the real then imaginary parts, as big-endian IEEE 754 floats 
+// (16 bytes for complex128, 8 for complex64). Either is decoded into either type. 
+// 
+// Without it, complex numbers are encoded as a 2-element array of floats.
+func (x *ExtRegistry) AddComplex(tag int8) (err error) {
+	if err = x.Add(reflect.TypeOf(complex128(0)), tag, encComplexExt, decComplexExt); err != nil {
+		return
+	}
+	return x.Add(reflect.TypeOf(complex64(0)), tag, encComplexExt, decComplexExt)
+}
+
+func encComplexExt(rv reflect.Value) (bs []byte, err error) {
+	c := rv.Complex()
+	if rv.Kind() == reflect.Complex64 {
+		bs = make([]byte, 8)
+		binary.BigEndian.PutUint32(bs, math.Float32bits(float32(real(c))))
+		binary.BigEndian.PutUint32(bs[4:], math.Float32bits(float32(imag(c))))
+		return
+	}
+	bs = make([]byte, 16)
+	binary.BigEndian.PutUint64(bs, math.Float64bits(real(c)))
+	binary.BigEndian.PutUint64(bs[8:], math.Float64bits(imag(c)))
+	return
+}
+
+func decComplexExt(rv reflect.Value, bs []byte) (err error) {
+	switch len(bs) {
+	case 8:
+		rv.SetComplex(complex(float64(math.Float32frombits(binary.BigEndian.Uint32(bs))), 
+			float64(math.Float32frombits(binary.BigEndian.Uint32(bs[4:])))))
+	case 16:
+		rv.SetComplex(complex(math.Float64frombits(binary.BigEndian.Uint64(bs)), 
+			math.Float64frombits(binary.BigEndian.Uint64(bs[8:]))))
+	default:
+		err = fmt.Errorf("complex: expecting 8 or 16 bytes, got %d", len(bs))
+	}
+	return
+}
+
+// encodeExt encodes rv as an ext, if its type is registered in EncoderOptions.Exts.
+func (e *Encoder) encodeExt(rv reflect.Value) bool {
+	xi := e.o.Exts.byType[rv.Type()]
+	if xi == nil {
+		return false
+	}
+	bs, err := xi.enc(rv)
+	if err != nil {
+		e.err("Ext type %v: %v", xi.tag, err)
+	}
+	e.writeExtHeader(xi.tag, len(bs))
+	if len(bs) > 0 {
+		e.writeb(len(bs), bs)
+	}
+	return true
+}
+
+func isExtDesc(bd byte) bool {
+	return bd >= 0xd4 && bd <= 0xd8 || bd >= 0xc7 && bd <= 0xc9
+}
+
+// decodeExt decodes an ext value (given its descriptor byte) into rv.
+// If rv is a nil interface{}, it is set, and the value it was set to is returned (as decodeValue does).
+func (d *Decoder) decodeExt(bd byte, rv reflect.Value) (wasNilIntf bool, rvn reflect.Value) {
+	xtag, l := d.readExtHeader(bd)
+	if xtag == ExtSharedDef || xtag == ExtSharedRef {
+		return d.decodeSharedRef(xtag, rv)
+	}
+	if xtag == ExtTyped {
+		return d.decodeTyped(rv)
+	}
+	wasNilIntf = rv.Kind() == reflect.Interface && rv.IsNil()
+	rvn = rv
+	var xi *extInfo
+	if x := d.o.Exts; x != nil {
+		if wasNilIntf {
+			if xi = x.byTag[xtag]; xi != nil {
+				rvn = reflect.New(xi.rt).Elem()
+			}
+		} else {
+			for xi = x.byType[rvn.Type()]; xi == nil && rvn.Kind() == reflect.Ptr; xi = x.byType[rvn.Type()] {
+				if rvn.IsNil() {
+					rvn.Set(reflect.New(rvn.Type().Elem()))
+				}
+				rvn = rvn.Elem()
+			}
+		}
+	}
+	if xi == nil || xi.tag != xtag {
+		d.err("Unsupported ext type: %v, decoding into: %v", xtag, rv.Type())
+	}
+	if err := xi.dec(rvn, d.readBytes(l)); err != nil {
+		d.err("Ext type %v: %v", xtag, err)
+	}
+	if wasNilIntf {
+		rv.Set(rvn)
+	}
+	return
+}
+
+// encodeFieldExt encodes the struct field rv, tagged ext=N, as an ext of type N holding its binary form: 
+// the data of its type's ext in EncoderOptions.Exts (if registered), else its MarshalBinary.
+func (e *Encoder) encodeFieldExt(si *structFieldInfo, rv reflect.Value) {
+	for rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			e.encNil()
+			return
+		}
+		rv = rv.Elem()
+	}
+	var bs []byte
+	var err error
+	if xi := e.o.Exts.lookup(rv.Type()); xi != nil {
+		bs, err = xi.enc(rv)
+	} else if m, ok := binaryMarshaler(rv); ok {
+		bs, err = m.MarshalBinary()
+	} else {
+		e.err("Field %v (ext=%d): type %v has no binary form", si.name, si.ext, rv.Type())
+	}
+	if err != nil {
+		e.err("Field %v (ext=%d): %v", si.name, si.ext, err)
+	}
+	e.writeExtHeader(si.ext, len(bs))
+	if len(bs) > 0 {
+		e.writeb(len(bs), bs)
+	}
+}
+
+// decodeFieldExt decodes the struct field rv, tagged ext=N, from an ext of type N (see encodeFieldExt). 
+// Values which are not exts (e.g. from before the field was tagged) are decoded as usual.
+func (d *Decoder) decodeFieldExt(si *structFieldInfo, rv reflect.Value) {
+	d.readb(1, d.t1)
+	bd := d.t1[0]
+	if !isExtDesc(bd) {
+		d.decodeValueT(bd, -1, false, rv, true, true, true)
+		return
+	}
+	xtag, l := d.readExtHeader(bd)
+	if xtag != si.ext {
+		d.err("Field %v (ext=%d): unexpected ext type: %v", si.name, si.ext, xtag)
+	}
+	bs := d.readBytes(l)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			rv.Set(reflect.New(rv.Type().Elem()))
+		}
+		rv = rv.Elem()
+	}
+	var err error
+	if xi := d.o.Exts.lookup(rv.Type()); xi != nil {
+		err = xi.dec(rv, bs)
+	} else if u, ok := rv.Addr().Interface().(encoding.BinaryUnmarshaler); ok {
+		err = u.UnmarshalBinary(bs)
+	} else {
+		d.err("Field %v (ext=%d): type %v has no binary form", si.name, si.ext, rv.Type())
+	}
+	if err != nil {
+		d.err("Field %v (ext=%d): %v", si.name, si.ext, err)
+	}
+}
+
+// lookup returns the extInfo of type rt, or nil if not registered (or x is nil).
+func (x *ExtRegistry) lookup(rt reflect.Type) *extInfo {
+	if x == nil {
+		return nil
+	}
+	return x.byType[rt]
+}
+
+// binaryMarshaler returns rv (or its address, or a copy's) as an encoding.BinaryMarshaler, if it is one.
+func binaryMarshaler(rv reflect.Value) (m encoding.BinaryMarshaler, ok bool) {
+	if m, ok = rv.Interface().(encoding.BinaryMarshaler); ok {
+		return
+	}
+	if !rv.CanAddr() {
+		rv2 := reflect.New(rv.Type()).Elem()
+		rv2.Set(rv)
+		rv = rv2
+	}
+	m, ok = rv.Addr().Interface().(encoding.BinaryMarshaler)
+	return
+}
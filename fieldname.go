@@ -0,0 +1,117 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+import (
+	"reflect"
+	"strings"
+	"unicode"
+)
+
+// FieldNameMapper maps the name of a struct field to the key it is encoded as (and decoded from), 
+// e.g. SnakeCase. It applies to the fields whose tags do not name them.
+// See EncoderOptions.FieldNameMapper and DecoderOptions.FieldNameMapper.
+type FieldNameMapper func(name string) string
+
+// SnakeCase is a FieldNameMapper turning Go field names into snake_case: 
+// e.g. UserID into user_id, and HTTPServer into http_server.
+func SnakeCase(name string) string {
+	rs := []rune(name)
+	var b strings.Builder
+	for i, r := range rs {
+		if unicode.IsUpper(r) {
+			if i > 0 && (!unicode.IsUpper(rs[i-1]) || i+1 < len(rs) && unicode.IsLower(rs[i+1])) {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// CamelCase is a FieldNameMapper turning Go field names into (lower) camelCase: 
+// e.g. UserID into userID, and HTTPServer into httpServer.
+func CamelCase(name string) string {
+	rs := []rune(name)
+	for i, r := range rs {
+		if !unicode.IsUpper(r) || i > 0 && i+1 < len(rs) && unicode.IsLower(rs[i+1]) {
+			break
+		}
+		rs[i] = unicode.ToLower(r)
+	}
+	return string(rs)
+}
+
+// mappedName returns the mapped encode name of si (see FieldNameMapper).
+func (si *structFieldInfo) mappedName(fn FieldNameMapper) string {
+	if si.named {
+		return si.encName
+	}
+	return fn(si.name)
+}
+
+// structNames returns the encode names of the fields of rt mapped by EncoderOptions.FieldNameMapper,
+// computed once per Encoder (or Handle).
+func (e *Encoder) structNames(rt reflect.Type, sis *structFieldInfos) (names [][]byte) {
+	if e.tc == nil {
+		e.tc = new(typeCache)
+	} else if names = e.tc.loadNames(rt); names != nil {
+		return
+	}
+	names = make([][]byte, len(sis.sis))
+	for j, si := range sis.sis {
+		names[j] = []byte(si.mappedName(e.o.FieldNameMapper))
+	}
+	e.tc.names.Store(rt, names)
+	return
+}
+
+// structField returns the field of rt encoded as name, mapped by DecoderOptions.FieldNameMapper 
+// (or nil if none), indexing the mapped names once per Decoder (or Handle).
+func (d *Decoder) structField(rt reflect.Type, sis *structFieldInfos, name string) *structFieldInfo {
+	var fields map[string]*structFieldInfo
+	if d.tc == nil {
+		d.tc = new(typeCache)
+	} else {
+		fields = d.tc.loadFields(rt)
+	}
+	if fields == nil {
+		fields = make(map[string]*structFieldInfo, len(sis.sis))
+		for _, si := range sis.sis {
+			fields[si.mappedName(d.o.FieldNameMapper)] = si
+		}
+		d.tc.fields.Store(rt, fields)
+	}
+	return fields[name]
+}
@@ -0,0 +1,90 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+import (
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// encodeFieldString encodes the struct field rv, with the string option, as a string if it is
+// a bool or number (or a pointer to one): e.g. "true", "42" or "1.5". A time.Duration is encoded
+// as e.g. "1m30s". Other values are encoded as usual.
+func (e *Encoder) encodeFieldString(rv reflect.Value) {
+	if rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	switch rv.Kind() {
+	case reflect.Bool:
+		e.encString(strconv.FormatBool(rv.Bool()))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if rv.Type() == durationTyp {
+			e.encString(time.Duration(rv.Int()).String())
+		} else {
+			e.encString(strconv.FormatInt(rv.Int(), 10))
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		e.encString(strconv.FormatUint(rv.Uint(), 10))
+	case reflect.Float32, reflect.Float64:
+		e.encString(strconv.FormatFloat(rv.Float(), 'g', -1, rv.Type().Bits()))
+	default:
+		e.encode(rv)
+	}
+}
+
+// decodeFieldString decodes the struct field rv, with the string option, parsing a string
+// into a bool or number (see encodeFieldString). Other values are decoded as usual.
+func (d *Decoder) decodeFieldString(si *structFieldInfo, rv reflect.Value) {
+	d.readb(1, d.t1)
+	bd := d.t1[0]
+	rt := rv.Type()
+	if rt.Kind() == reflect.Ptr {
+		rt = rt.Elem()
+	}
+	if k := rt.Kind(); descValueType(bd) != StrType || !(k == reflect.Bool || k >= reflect.Int && k <= reflect.Float64) {
+		d.decodeValueT(bd, -1, false, rv, true, true, true)
+		return
+	}
+	var s string
+	d.decodeValue(bd, -1, false, reflect.ValueOf(&s).Elem())
+	if rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			rv.Set(reflect.New(rt))
+		}
+		rv = rv.Elem()
+	}
+	if err := parseScalar(rv, s); err != nil {
+		d.err("Field %v (string): %v", si.name, err)
+	}
+}
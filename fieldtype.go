@@ -0,0 +1,85 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+import (
+	"reflect"
+)
+
+// FieldTypeResolver returns the concrete type to decode an interface-typed struct field into, 
+// or nil to decode it as into a nil interface{} as usual. st is the struct type, field the name 
+// of the field, and hint the typeof=hint option of its tag (or "" if none). E.g. for
+//   type Drawing struct {
+//       Outline Shape `msgpack:",typeof=Circle"`
+//   }
+// it is called with (Drawing, "Outline", "Circle"). See DecoderOptions.FieldTypes.
+type FieldTypeResolver func(st reflect.Type, field string, hint string) reflect.Type
+
+// TypeHints returns a FieldTypeResolver resolving typeof hints to the types of values 
+// (which are otherwise unused) by their names: e.g. Circle to the type of a Circle{}, 
+// or *Circle to that of a &Circle{}. Unknown hints are left to decode as usual.
+func TypeHints(values ...interface{}) FieldTypeResolver {
+	byName := make(map[string]reflect.Type, len(values))
+	for _, v := range values {
+		rt := reflect.TypeOf(v)
+		name := ""
+		for ; rt.Kind() == reflect.Ptr && rt.Name() == ""; rt = rt.Elem() {
+			name += "*"
+		}
+		byName[name + rt.Name()] = reflect.TypeOf(v)
+	}
+	return func(st reflect.Type, field string, hint string) reflect.Type {
+		return byName[hint]
+	}
+}
+
+// decodeFieldTyped decodes the interface-typed struct field si of st into rv, as the type 
+// DecoderOptions.FieldTypes resolves for it (if any).
+func (d *Decoder) decodeFieldTyped(st reflect.Type, si *structFieldInfo, rv reflect.Value) {
+	rt := d.o.FieldTypes(st, si.name, si.typeOf)
+	if rt == nil {
+		d.decodeValueT(0, -1, true, rv, true, true, true)
+		return
+	}
+	if !rt.AssignableTo(rv.Type()) {
+		d.err("Field %v: resolved type %v is not assignable to %v", si.name, rt, rv.Type())
+	}
+	d.readb(1, d.t1)
+	if bd := d.t1[0]; bd == 0xc0 {
+		rv.Set(reflect.Zero(rv.Type()))
+	} else {
+		rvn := reflect.New(rt).Elem()
+		d.decodeValue(bd, -1, false, rvn)
+		rv.Set(rvn)
+	}
+}
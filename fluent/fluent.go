@@ -0,0 +1,385 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+/*
+Package fluent implements the fluentd Forward protocol (v1), to ship log events 
+to fluentd or fluent-bit, or to receive them.
+
+A Client sends events in Message mode (Post), Forward mode (Forward) or 
+PackedForward mode (PackedForward, optionally gzip-compressed). If Options.RequireAck 
+is set, each send carries a chunk id, and waits for the server to acknowledge it.
+Times are sent as EventTime (ext type 0, with nanoseconds) unless Options.SecondsTime is set.
+
+ReadMessage decodes any of the modes (for a receiver), and WriteAck acknowledges a chunk.
+The handshake phase (shared key authentication) is not implemented.
+*/
+package fluent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/ugorji/go-msgpack"
+)
+
+// EventTimeExt is the ext type of EventTime.
+const EventTimeExt = 0
+
+// Entry is a log event. 
+type Entry struct {
+	Time time.Time
+	// Record is the event (usually a map of string keys). 
+	// In entries returned by ReadMessage, it is a msgpack.Raw, for decoding as needed.
+	Record interface{}
+}
+
+// Options configures a Client.
+type Options struct {
+	// RequireAck makes each send wait for the server to acknowledge it.
+	RequireAck bool
+	// SecondsTime sends times as integer seconds, for servers which do not support EventTime.
+	SecondsTime bool
+	// Encoder configures the encoding of records (may be nil).
+	Encoder *msgpack.EncoderOptions
+}
+
+// Client sends events over a connection to a fluentd server.
+type Client struct {
+	conn io.ReadWriter
+	o Options
+	buf bytes.Buffer
+	enc *msgpack.Encoder
+	dec *msgpack.Decoder
+}
+
+// NewClient returns a Client sending over conn. opts may be nil.
+func NewClient(conn io.ReadWriter, opts *Options) *Client {
+	c := &Client{conn: conn}
+	if opts != nil {
+		c.o = *opts
+	}
+	c.enc = msgpack.NewEncoderEx(&c.buf, c.o.Encoder)
+	c.dec = msgpack.NewDecoder(conn, nil)
+	return c
+}
+
+// Post sends a single event in Message mode: [tag, time, record, option].
+func (c *Client) Post(tag string, t time.Time, record interface{}) (err error) {
+	c.buf.Reset()
+	option, chunk := c.option(0, "")
+	if err = c.enc.WriteArrayHeader(3 + len(option)); err != nil {
+		return
+	}
+	if err = c.enc.WriteString(tag); err != nil {
+		return
+	}
+	if err = c.writeTime(c.enc, t); err != nil {
+		return
+	}
+	if err = c.enc.Encode(record); err != nil {
+		return
+	}
+	return c.send(option, chunk)
+}
+
+// Forward sends events in Forward mode: [tag, [[time, record], ...], option].
+func (c *Client) Forward(tag string, entries []Entry) (err error) {
+	c.buf.Reset()
+	option, chunk := c.option(len(entries), "")
+	if err = c.enc.WriteArrayHeader(2 + len(option)); err != nil {
+		return
+	}
+	if err = c.enc.WriteString(tag); err != nil {
+		return
+	}
+	if err = c.enc.WriteArrayHeader(len(entries)); err != nil {
+		return
+	}
+	for _, e := range entries {
+		if err = c.writeEntry(c.enc, e); err != nil {
+			return
+		}
+	}
+	return c.send(option, chunk)
+}
+
+// PackedForward sends events in PackedForward mode: [tag, bin of entries, option]. 
+// If compress is set, the entries are gzip-compressed (CompressedPackedForward mode).
+func (c *Client) PackedForward(tag string, entries []Entry, compress bool) (err error) {
+	var packed bytes.Buffer
+	var w io.Writer = &packed
+	var zw *gzip.Writer
+	if compress {
+		zw = gzip.NewWriter(&packed)
+		w = zw
+	}
+	penc := msgpack.NewEncoderEx(w, c.o.Encoder)
+	for _, e := range entries {
+		if err = c.writeEntry(penc, e); err != nil {
+			return
+		}
+	}
+	// penc buffers (writing to a gzip.Writer), and with EncoderOptions.DeferFlush does not flush by itself.
+	if err = penc.Flush(); err != nil {
+		return
+	}
+	if zw != nil {
+		if err = zw.Close(); err != nil {
+			return
+		}
+	}
+	c.buf.Reset()
+	compressed := ""
+	if compress {
+		compressed = "gzip"
+	}
+	option, chunk := c.option(len(entries), compressed)
+	if err = c.enc.WriteArrayHeader(2 + len(option)); err != nil {
+		return
+	}
+	if err = c.enc.WriteString(tag); err != nil {
+		return
+	}
+	if err = c.enc.Encode(msgpack.NewBin(packed.Bytes())); err != nil {
+		return
+	}
+	return c.send(option, chunk)
+}
+
+// option returns the option map to send (as a 0 or 1 element slice), and its chunk id if any.
+func (c *Client) option(size int, compressed string) (option []map[string]interface{}, chunk string) {
+	m := make(map[string]interface{})
+	if size > 0 {
+		m["size"] = size
+	}
+	if compressed != "" {
+		m["compressed"] = compressed
+	}
+	if c.o.RequireAck {
+		var id [16]byte
+		rand.Read(id[:])
+		chunk = base64.StdEncoding.EncodeToString(id[:])
+		m["chunk"] = chunk
+	}
+	if len(m) > 0 {
+		option = append(option, m)
+	}
+	return
+}
+
+// send writes the message in the buffer, with its option, and waits for the ack if required.
+func (c *Client) send(option []map[string]interface{}, chunk string) (err error) {
+	for _, m := range option {
+		if err = c.enc.Encode(m); err != nil {
+			return
+		}
+	}
+	if _, err = c.conn.Write(c.buf.Bytes()); err != nil || chunk == "" {
+		return
+	}
+	var ack struct {
+		Ack string `msgpack:"ack"`
+	}
+	if err = c.dec.Decode(&ack); err != nil {
+		return
+	}
+	if ack.Ack != chunk {
+		err = fmt.Errorf("fluent: ack mismatch: got %q, expecting %q", ack.Ack, chunk)
+	}
+	return
+}
+
+func (c *Client) writeEntry(enc *msgpack.Encoder, e Entry) (err error) {
+	if err = enc.WriteArrayHeader(2); err != nil {
+		return
+	}
+	if err = c.writeTime(enc, e.Time); err != nil {
+		return
+	}
+	return enc.Encode(e.Record)
+}
+
+func (c *Client) writeTime(enc *msgpack.Encoder, t time.Time) error {
+	if c.o.SecondsTime {
+		return enc.WriteInt64(t.Unix())
+	}
+	var b [8]byte
+	binary.BigEndian.PutUint32(b[:4], uint32(t.Unix()))
+	binary.BigEndian.PutUint32(b[4:], uint32(t.Nanosecond()))
+	return enc.WriteExt(EventTimeExt, b[:])
+}
+
+// Message is a message received by ReadMessage, in any mode.
+type Message struct {
+	Tag string
+	Entries []Entry
+	Option map[string]interface{}
+}
+
+// Chunk returns the chunk id to acknowledge (see WriteAck), or "" if none was requested.
+func (m *Message) Chunk() string {
+	s, _ := msgpack.M(m.Option).GetString("chunk")
+	return s
+}
+
+// ReadMessage reads the next message from d, in any of the Forward protocol modes.
+func ReadMessage(d *msgpack.Decoder) (m *Message, err error) {
+	n, err := d.ReadArrayHeader()
+	if err != nil {
+		return
+	}
+	if n < 2 || n > 4 {
+		return nil, fmt.Errorf("fluent: invalid message: array of %d elements", n)
+	}
+	m = new(Message)
+	if m.Tag, err = d.ReadString(); err != nil {
+		return nil, err
+	}
+	vt, err := d.PeekType()
+	if err != nil {
+		return nil, err
+	}
+	var packed []byte
+	switch vt {
+	case msgpack.ArrayType: // Forward
+		l, err := d.ReadArrayHeader()
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < l; i++ {
+			e, err := readEntry(d)
+			if err != nil {
+				return nil, err
+			}
+			m.Entries = append(m.Entries, e)
+		}
+		n -= 2
+	case msgpack.StrType, msgpack.BinType: // PackedForward
+		if packed, err = d.ReadBytes(); err != nil {
+			return nil, err
+		}
+		n -= 2
+	default: // Message
+		t, err := readTime(d)
+		if err != nil {
+			return nil, err
+		}
+		if n < 3 {
+			return nil, fmt.Errorf("fluent: invalid message: no record")
+		}
+		record, err := d.DecodeRaw()
+		if err != nil {
+			return nil, err
+		}
+		m.Entries = append(m.Entries, Entry{t, msgpack.Raw(record)})
+		n -= 3
+	}
+	if n > 0 {
+		m.Option = make(map[string]interface{})
+		if err = d.Decode(&m.Option); err != nil {
+			return nil, err
+		}
+		for k, v := range m.Option {
+			if bs, ok := v.([]byte); ok {
+				m.Option[k] = string(bs)
+			}
+		}
+	}
+	if packed != nil {
+		var r io.Reader = bytes.NewReader(packed)
+		if c, _ := msgpack.M(m.Option).GetString("compressed"); c == "gzip" {
+			if r, err = gzip.NewReader(r); err != nil {
+				return nil, err
+			}
+		} else if c != "" && c != "text" {
+			return nil, fmt.Errorf("fluent: unsupported compression: %q", c)
+		}
+		pd := msgpack.NewDecoder(r, nil)
+		for pd.More() {
+			e, err := readEntry(pd)
+			if err != nil {
+				return nil, err
+			}
+			m.Entries = append(m.Entries, e)
+		}
+	}
+	return
+}
+
+func readEntry(d *msgpack.Decoder) (e Entry, err error) {
+	n, err := d.ReadArrayHeader()
+	if err != nil {
+		return
+	}
+	if n != 2 {
+		return e, fmt.Errorf("fluent: invalid entry: array of %d elements", n)
+	}
+	if e.Time, err = readTime(d); err != nil {
+		return
+	}
+	record, err := d.DecodeRaw()
+	e.Record = msgpack.Raw(record)
+	return
+}
+
+// readTime reads an EventTime, or an integer count of seconds.
+func readTime(d *msgpack.Decoder) (t time.Time, err error) {
+	vt, err := d.PeekType()
+	if err != nil {
+		return
+	}
+	if vt != msgpack.ExtType {
+		var sec int64
+		sec, err = d.ReadInt64()
+		return time.Unix(sec, 0), err
+	}
+	xtag, b, err := d.ReadExt()
+	if err != nil {
+		return
+	}
+	if xtag != EventTimeExt || len(b) != 8 {
+		return t, fmt.Errorf("fluent: invalid EventTime: ext type %d of %d bytes", xtag, len(b))
+	}
+	return time.Unix(int64(binary.BigEndian.Uint32(b[:4])), int64(binary.BigEndian.Uint32(b[4:]))), nil
+}
+
+// WriteAck acknowledges the chunk of a message (see Message.Chunk).
+func WriteAck(w io.Writer, chunk string) error {
+	return msgpack.NewEncoder(w).Encode(map[string]string{"ack": chunk})
+}
+
@@ -0,0 +1,119 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package fluent
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ugorji/go-msgpack"
+)
+
+func TestForwardModes(t *testing.T) {
+	deferFlush := &Options{Encoder: &msgpack.EncoderOptions{DeferFlush: true}}
+	for _, opts := range []*Options{nil, {RequireAck: true}, {SecondsTime: true}, deferFlush} {
+		c1, c2 := net.Pipe()
+		c := NewClient(c1, opts)
+		now := time.Unix(1700000000, 123456789)
+		entries := []Entry{{now, map[string]interface{}{"msg": "a"}}, {now.Add(time.Second), map[string]interface{}{"msg": "b"}}}
+		errc := make(chan error, 1)
+		go func() {
+			err := c.Post("app.log", now, map[string]interface{}{"msg": "hello"})
+			if err == nil {
+				err = c.Forward("app.fwd", entries)
+			}
+			if err == nil {
+				err = c.PackedForward("app.packed", entries, false)
+			}
+			if err == nil {
+				err = c.PackedForward("app.gz", entries, true)
+			}
+			errc <- err
+		}()
+		
+		d := msgpack.NewDecoder(c2, nil)
+		for _, exp := range []struct {
+			tag string
+			msgs []string
+		}{
+			{"app.log", []string{"hello"}},
+			{"app.fwd", []string{"a", "b"}},
+			{"app.packed", []string{"a", "b"}},
+			{"app.gz", []string{"a", "b"}},
+		} {
+			m, err := ReadMessage(d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.Tag != exp.tag || len(m.Entries) != len(exp.msgs) {
+				t.Fatalf("expected %s with %d entries, got: %+v", exp.tag, len(exp.msgs), m)
+			}
+			for i, e := range m.Entries {
+				var rec msgpack.M
+				if err = msgpack.Unmarshal(e.Record.(msgpack.Raw), &rec, nil); err != nil {
+					t.Fatal(err)
+				}
+				if s, _ := rec.GetString("msg"); s != exp.msgs[i] {
+					t.Fatalf("%s: entry %d: expected msg %q, got: %v", exp.tag, i, exp.msgs[i], rec)
+				}
+				expTime := now.Add(time.Duration(i) * time.Second)
+				if opts != nil && opts.SecondsTime {
+					expTime = expTime.Truncate(time.Second)
+				}
+				if !e.Time.Equal(expTime) {
+					t.Fatalf("%s: entry %d: expected time %v, got %v", exp.tag, i, expTime, e.Time)
+				}
+			}
+			if exp.tag == "app.gz" && !reflect.DeepEqual(m.Option["compressed"], "gzip") {
+				t.Fatalf("expected compressed option, got: %v", m.Option)
+			}
+			if chunk := m.Chunk(); opts != nil && opts.RequireAck {
+				if chunk == "" {
+					t.Fatal("expected chunk id")
+				}
+				if err = WriteAck(c2, chunk); err != nil {
+					t.Fatal(err)
+				}
+			} else if chunk != "" {
+				t.Fatalf("unexpected chunk id: %q", chunk)
+			}
+		}
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+		c1.Close()
+		c2.Close()
+	}
+}
@@ -0,0 +1,335 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// GenerateStructs infers Go type definitions from one or more sample msgpack documents,
+// and returns them as formatted Go source. The top-level type is called typeName.
+// 
+// Maps with string keys become structs (one type per nested map, named after its parent 
+// and field), with a msgpack tag giving the key. Fields missing from some samples 
+// are tagged omitempty. Types seen for the same field or array element across samples
+// are merged: int and float become float64, and otherwise conflicting types become interface{}.
+// Raw bytes are assumed to be strings.
+// 
+// The result is a starting point, to be reviewed: e.g. samples cannot tell a
+// field which is always nil what type it should have.
+func GenerateStructs(typeName string, docs ...[]byte) (src []byte, err error) {
+	if len(docs) == 0 {
+		err = fmt.Errorf("GenerateStructs: No sample documents")
+		return
+	}
+	dopts := &SimpleDecoderContainerResolver{
+		BytesStringLiteral: true, BytesStringSliceElement: true, BytesStringMapValue: true,
+	}
+	var t *genType
+	for i, doc := range docs {
+		var v interface{}
+		if err = Unmarshal(doc, &v, dopts); err != nil {
+			err = fmt.Errorf("GenerateStructs: sample %d: %v", i, err)
+			return
+		}
+		t = mergeGenTypes(t, inferGenType(v))
+	}
+	g := genWriter{names: make(map[string]bool)}
+	g.names[typeName] = true
+	g.pending = append(g.pending, genNamed{typeName, t})
+	for len(g.pending) > 0 {
+		n := g.pending[0]
+		g.pending = g.pending[1:]
+		g.writeType(n.name, n.t)
+	}
+	if src, err = format.Source(append(bytes.TrimRight(g.buf.Bytes(), "\n"), '\n')); err != nil {
+		err = fmt.Errorf("GenerateStructs: %v", err)
+	}
+	return
+}
+
+type genKind int
+
+const (
+	genNil genKind = iota
+	genBool
+	genInt
+	genUint
+	genFloat
+	genString
+	genBytes
+	genArray
+	genStruct
+	genMap
+	genAny
+)
+
+type genType struct {
+	kind genKind
+	elem *genType       // for genArray and genMap
+	key *genType        // for genMap
+	fields map[string]*genField // for genStruct
+	samples int         // number of maps merged into a genStruct
+}
+
+type genField struct {
+	t *genType
+	n int // number of samples with it
+}
+
+func inferGenType(v interface{}) (t *genType) {
+	t = new(genType)
+	switch x := v.(type) {
+	case nil:
+		t.kind = genNil
+	case bool:
+		t.kind = genBool
+	case int8, int16, int32, int64, uint8, uint16, uint32:
+		t.kind = genInt
+	case uint64:
+		if x > math.MaxInt64 {
+			t.kind = genUint
+		} else {
+			t.kind = genInt
+		}
+	case float32, float64:
+		t.kind = genFloat
+	case string:
+		t.kind = genString
+	case []byte:
+		t.kind = genBytes
+	case []interface{}:
+		t.kind = genArray
+		for _, e := range x {
+			t.elem = mergeGenTypes(t.elem, inferGenType(e))
+		}
+	case map[interface{}]interface{}:
+		if len(x) == 0 {
+			// could be either a struct or map (see mergeGenTypes)
+			t.kind = genMap
+			return
+		}
+		allStrings := true
+		for k := range x {
+			if _, ok := k.(string); !ok {
+				allStrings = false
+				break
+			}
+		}
+		if !allStrings {
+			t.kind = genMap
+			for k, e := range x {
+				t.key = mergeGenTypes(t.key, inferGenType(k))
+				t.elem = mergeGenTypes(t.elem, inferGenType(e))
+			}
+			return
+		}
+		t.kind, t.samples = genStruct, 1
+		t.fields = make(map[string]*genField, len(x))
+		for k, e := range x {
+			t.fields[k.(string)] = &genField{inferGenType(e), 1}
+		}
+	default:
+		t.kind = genAny
+	}
+	return
+}
+
+// mergeGenTypes returns the type which can hold values of both a and b (either may be nil).
+func mergeGenTypes(a, b *genType) *genType {
+	if isEmptyGenMap(b) && a != nil && (a.kind == genStruct || a.kind == genMap) {
+		a, b = b, a
+	}
+	if isEmptyGenMap(a) && b != nil && (b.kind == genStruct || b.kind == genMap) {
+		if b.kind == genStruct {
+			// a sample without any of its fields
+			t := *b
+			t.samples++
+			return &t
+		}
+		return b
+	}
+	switch {
+	case a == nil:
+		return b
+	case b == nil:
+		return a
+	case a.kind == genNil:
+		return b
+	case b.kind == genNil:
+		return a
+	case a.kind == b.kind:
+	case (a.kind == genInt || a.kind == genUint || a.kind == genFloat) && 
+		(b.kind == genInt || b.kind == genUint || b.kind == genFloat):
+		if a.kind == genFloat || b.kind == genFloat {
+			return &genType{kind: genFloat}
+		}
+		return &genType{kind: genInt}
+	default:
+		return &genType{kind: genAny}
+	}
+	switch a.kind {
+	case genArray:
+		return &genType{kind: genArray, elem: mergeGenTypes(a.elem, b.elem)}
+	case genMap:
+		return &genType{kind: genMap, key: mergeGenTypes(a.key, b.key), elem: mergeGenTypes(a.elem, b.elem)}
+	case genStruct:
+		t := &genType{kind: genStruct, samples: a.samples + b.samples, fields: make(map[string]*genField)}
+		for k, f := range a.fields {
+			t.fields[k] = &genField{f.t, f.n}
+		}
+		for k, f := range b.fields {
+			if f0 := t.fields[k]; f0 != nil {
+				t.fields[k] = &genField{mergeGenTypes(f0.t, f.t), f0.n + f.n}
+			} else {
+				t.fields[k] = &genField{f.t, f.n}
+			}
+		}
+		return t
+	}
+	return a
+}
+
+func isEmptyGenMap(t *genType) bool {
+	return t != nil && t.kind == genMap && t.key == nil && t.elem == nil
+}
+
+type genNamed struct {
+	name string
+	t *genType
+}
+
+type genWriter struct {
+	buf bytes.Buffer
+	names map[string]bool // type names used so far
+	pending []genNamed    // struct types still to be written
+}
+
+func (g *genWriter) writeType(name string, t *genType) {
+	if t.kind != genStruct {
+		fmt.Fprintf(&g.buf, "type %s %s\n\n", name, g.typeExpr(name, t))
+		return
+	}
+	keys := make([]string, 0, len(t.fields))
+	for k := range t.fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	fmt.Fprintf(&g.buf, "type %s struct {\n", name)
+	used := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		f := t.fields[k]
+		fname := genFieldName(k)
+		for j := 2; used[fname]; j++ {
+			fname = fmt.Sprintf("%s%d", genFieldName(k), j)
+		}
+		used[fname] = true
+		tag := k
+		if f.n < t.samples {
+			tag += ",omitempty"
+		}
+		fmt.Fprintf(&g.buf, "\t%s %s `msgpack:%q`\n", fname, g.typeExpr(name + fname, f.t), tag)
+	}
+	g.buf.WriteString("}\n\n")
+}
+
+// typeExpr returns the Go type for t. A struct is queued to be written with a name based on hint.
+func (g *genWriter) typeExpr(hint string, t *genType) string {
+	if t == nil {
+		return "interface{}"
+	}
+	switch t.kind {
+	case genBool:
+		return "bool"
+	case genInt:
+		return "int64"
+	case genUint:
+		return "uint64"
+	case genFloat:
+		return "float64"
+	case genString:
+		return "string"
+	case genBytes:
+		return "[]byte"
+	case genArray:
+		return "[]" + g.typeExpr(hint + "Elem", t.elem)
+	case genMap:
+		return "map[" + g.typeExpr(hint + "Key", t.key) + "]" + g.typeExpr(hint + "Value", t.elem)
+	case genStruct:
+		name := hint
+		for j := 2; g.names[name]; j++ {
+			name = fmt.Sprintf("%s%d", hint, j)
+		}
+		g.names[name] = true
+		g.pending = append(g.pending, genNamed{name, t})
+		return name
+	}
+	return "interface{}"
+}
+
+var genInitialisms = map[string]string{
+	"id": "ID", "url": "URL", "uri": "URI", "http": "HTTP", "ip": "IP", 
+	"json": "JSON", "api": "API", "uuid": "UUID", "ttl": "TTL",
+}
+
+// genFieldName converts a map key (e.g. "user_id") to an exported Go identifier (e.g. "UserID").
+func genFieldName(k string) string {
+	parts := strings.FieldsFunc(k, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	var b strings.Builder
+	for _, p := range parts {
+		if s, ok := genInitialisms[strings.ToLower(p)]; ok {
+			b.WriteString(s)
+			continue
+		}
+		rs := []rune(p)
+		rs[0] = unicode.ToUpper(rs[0])
+		b.WriteString(string(rs))
+	}
+	s := b.String()
+	if s == "" {
+		return "Field"
+	}
+	if r := []rune(s)[0]; !unicode.IsLetter(r) || !unicode.IsUpper(r) {
+		s = "F" + s
+	}
+	return s
+}
+
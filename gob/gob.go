@@ -0,0 +1,165 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+/*
+Package gob offers the API of encoding/gob (Encoder, Decoder, Register and RegisterName) 
+backed by msgpack, so a program can switch its serialization by changing an import, 
+and exchange its payloads with programs in other languages.
+
+Values held in interfaces (e.g. interface-typed struct fields) must have their types 
+registered, as with encoding/gob: each is then encoded as a msgpack.ExtTyped ext 
+carrying the name of its type. Everything else is plain msgpack.
+
+Unlike encoding/gob, a stream carries no type descriptions: values are decoded 
+as the msgpack package decodes them (e.g. struct fields by name).
+*/
+package gob
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"reflect"
+	"sync"
+
+	"github.com/ugorji/go-msgpack"
+)
+
+// types names the types registered with Register and RegisterName.
+var types = msgpack.NewTypeRegistry()
+
+// Register records a type, identified by a value for it, under its default name 
+// (as encoding/gob names it: e.g. "main.T", or "*main.T" for a pointer), 
+// so values of it held in interfaces can be decoded. It panics if the type or name 
+// is already registered differently.
+func Register(value interface{}) {
+	rt := reflect.TypeOf(value)
+	name := rt.String()
+	star := ""
+	if rt.Name() == "" && rt.Kind() == reflect.Ptr {
+		star, rt = "*", rt.Elem()
+	}
+	if rt.Name() != "" {
+		if rt.PkgPath() == "" {
+			name = star + rt.Name()
+		} else {
+			name = star + rt.PkgPath() + "." + rt.Name()
+		}
+	}
+	RegisterName(name, value)
+}
+
+// RegisterName is like Register, but uses name for the type. It panics if the type or name 
+// is already registered differently.
+func RegisterName(name string, value interface{}) {
+	if err := types.Register(name, value); err != nil {
+		panic("gob: " + err.Error())
+	}
+}
+
+// An Encoder writes values to a stream as msgpack. It is safe for concurrent use.
+type Encoder struct {
+	e *msgpack.Encoder
+	mu sync.Mutex
+}
+
+// NewEncoder returns an Encoder writing to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{ e: msgpack.NewEncoderEx(w, &msgpack.EncoderOptions{ Types: types }) }
+}
+
+// Encode writes the value e to the stream.
+func (enc *Encoder) Encode(e interface{}) error {
+	return enc.EncodeValue(reflect.ValueOf(e))
+}
+
+// EncodeValue writes the value held in value to the stream. 
+// It fails for a nil pointer or an invalid value, as nothing would be decoded from them.
+func (enc *Encoder) EncodeValue(value reflect.Value) error {
+	if !value.IsValid() {
+		return errors.New("gob: cannot encode nil value")
+	}
+	if value.Kind() == reflect.Ptr && value.IsNil() {
+		return errors.New("gob: cannot encode nil pointer of type " + value.Type().String())
+	}
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+	return enc.e.EncodeValue(value)
+}
+
+// A Decoder reads values from a stream of msgpack. It is safe for concurrent use.
+type Decoder struct {
+	d *msgpack.Decoder
+	mu sync.Mutex
+}
+
+// NewDecoder returns a Decoder reading from r. 
+// If r is not an io.ByteReader, it is read through a bufio.Reader, so the Decoder may read 
+// past the values it decodes.
+func NewDecoder(r io.Reader) *Decoder {
+	if _, ok := r.(io.ByteReader); !ok {
+		r = bufio.NewReader(r)
+	}
+	return &Decoder{ d: msgpack.NewDecoder(r, &msgpack.DecoderOptions{ Types: types }) }
+}
+
+// Decode reads the next value from the stream into e, which must be a pointer 
+// (or nil, to discard the value). At the end of the stream, it returns io.EOF.
+func (dec *Decoder) Decode(e interface{}) error {
+	if e == nil {
+		return dec.DecodeValue(reflect.Value{})
+	}
+	value := reflect.ValueOf(e)
+	if value.Kind() != reflect.Ptr {
+		return errors.New("gob: attempt to decode into a non-pointer")
+	}
+	return dec.DecodeValue(value)
+}
+
+// DecodeValue reads the next value from the stream into value, which must be a non-nil pointer 
+// or a settable value (or invalid, to discard the value). At the end of the stream, it returns io.EOF.
+func (dec *Decoder) DecodeValue(value reflect.Value) error {
+	dec.mu.Lock()
+	defer dec.mu.Unlock()
+	switch {
+	case !value.IsValid():
+		return dec.d.Skip()
+	case value.Kind() == reflect.Ptr:
+		if value.IsNil() {
+			return errors.New("gob: DecodeValue of nil pointer")
+		}
+		return dec.d.DecodeValue(value)
+	case !value.CanSet():
+		return errors.New("gob: DecodeValue of unassignable value")
+	}
+	return dec.d.DecodeValue(value.Addr())
+}
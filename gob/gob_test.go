@@ -0,0 +1,155 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package gob
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io"
+	"reflect"
+	"testing"
+)
+
+type shape interface {
+	Area() float64
+}
+
+type rect struct {
+	W, H float64
+}
+
+func (r rect) Area() float64 { return r.W * r.H }
+
+type circle struct {
+	R float64
+}
+
+func (c *circle) Area() float64 { return 3 * c.R * c.R }
+
+type square struct {
+	S float64
+}
+
+func (s *square) Area() float64 { return s.S * s.S }
+
+type drawing struct {
+	Name string
+	Shapes []shape
+	Main shape
+	Attrs map[string]interface{}
+}
+
+func init() {
+	Register(rect{})
+	Register(&circle{})
+	RegisterName("point", [2]int{})
+}
+
+func TestRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	in := drawing{ 
+		Name: "d", 
+		Shapes: []shape{ rect{ 1, 2 }, &circle{ 3 } }, 
+		Main: &circle{ 1 },
+		Attrs: map[string]interface{}{ "origin": [2]int{ 4, 5 }, "scale": rect{ 2, 2 } },
+	}
+	for _, v := range []interface{}{ &in, 42, "x" } {
+		if err := enc.Encode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dec := NewDecoder(&buf)
+	var out drawing
+	if err := dec.Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Fatalf("decoded %#v, expecting %#v", out, in)
+	}
+	if err := dec.Decode(nil); err != nil {
+		t.Fatal(err)
+	}
+	var s string
+	if err := dec.Decode(&s); err != nil || s != "x" {
+		t.Fatalf("decoded %q (%v), expecting %q", s, err, "x")
+	}
+	if err := dec.Decode(&s); err != io.EOF {
+		t.Fatalf("expecting io.EOF, got %v", err)
+	}
+	if err := dec.Decode(s); err == nil {
+		t.Fatalf("expecting an error decoding into a non-pointer")
+	}
+	if err := enc.Encode(nil); err == nil {
+		t.Fatalf("expecting an error encoding nil")
+	}
+}
+
+func TestRegister(t *testing.T) {
+	// a type of a different name, or a name of a different type, panics (as with encoding/gob).
+	for _, fn := range []func(){ func() { RegisterName("rect2", rect{}) }, func() { RegisterName("point", rect{}) } } {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("expecting a panic")
+				}
+			}()
+			fn()
+		}()
+	}
+	Register(rect{}) // again, under the same name
+
+	// an unregistered type in an interface cannot be decoded.
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).Encode(&drawing{ Main: &square{ 1 } }); err != nil {
+		t.Fatal(err)
+	}
+	var out drawing
+	if err := NewDecoder(&buf).Decode(&out); err == nil {
+		t.Fatalf("expecting an error decoding an unregistered type")
+	}
+}
+
+// TestGobAPI checks the method sets match encoding/gob's, so switching the import compiles.
+func TestGobAPI(t *testing.T) {
+	for _, x := range [][2]interface{}{ { &gob.Encoder{}, &Encoder{} }, { &gob.Decoder{}, &Decoder{} } } {
+		gt, mt := reflect.TypeOf(x[0]), reflect.TypeOf(x[1])
+		for i := 0; i < gt.NumMethod(); i++ {
+			gm := gt.Method(i)
+			m, ok := mt.MethodByName(gm.Name)
+			if !ok || m.Type.NumIn() != gm.Type.NumIn() || m.Type.NumOut() != gm.Type.NumOut() {
+				t.Fatalf("%v: method %v missing or of another signature", mt, gm.Name)
+			}
+		}
+	}
+}
@@ -0,0 +1,147 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"sync"
+)
+
+// Handle bundles the options and registries of an application's Encoders and Decoders, 
+// so they are configured once, and cheap Encoders and Decoders are created from it. 
+// Metadata computed for types (e.g. struct field names mapped by a FieldNameMapper) is 
+// cached in the Handle and shared by them.
+// 
+// Exts and Types, if set, are used by Encoders and Decoders whose options do not set their own.
+// 
+// A Handle must not be changed (or copied) after first use. It is then safe for concurrent use,
+// though each Encoder and Decoder created from it is not.
+// 
+// Sample Usage:
+//   var mh = &msgpack.Handle{ Exts: exts, Encoder: &msgpack.EncoderOptions{ SortMapKeys: true } }
+//   err := mh.NewEncoder(w).Encode(v)
+//   err = mh.NewDecoderBytes(b).Decode(&v)
+type Handle struct {
+	Encoder *EncoderOptions
+	Decoder *DecoderOptions
+	Exts *ExtRegistry
+	Types *TypeRegistry
+	
+	once sync.Once
+	eo EncoderOptions
+	do DecoderOptions
+	tc typeCache
+}
+
+// typeCache is the type metadata shared by the Encoders and Decoders of a Handle.
+type typeCache struct {
+	names sync.Map  // reflect.Type to [][]byte (see Encoder.structNames)
+	fields sync.Map // reflect.Type to map[string]*structFieldInfo (see Decoder.structField)
+}
+
+func (h *Handle) init() {
+	h.once.Do(func() {
+		if h.Encoder != nil {
+			h.eo = *h.Encoder
+		}
+		if h.Decoder != nil {
+			h.do = *h.Decoder
+		}
+		if h.eo.Exts == nil {
+			h.eo.Exts = h.Exts
+		}
+		if h.do.Exts == nil {
+			h.do.Exts = h.Exts
+		}
+		if h.eo.Types == nil {
+			h.eo.Types = h.Types
+		}
+		if h.do.Types == nil {
+			h.do.Types = h.Types
+		}
+	})
+}
+
+// NewEncoder returns an Encoder writing to w, configured by the Handle.
+func (h *Handle) NewEncoder(w io.Writer) (e *Encoder) {
+	h.init()
+	e = NewEncoderEx(w, &h.eo)
+	e.tc = &h.tc
+	return
+}
+
+// NewDecoder returns a Decoder reading from r, configured by the Handle.
+func (h *Handle) NewDecoder(r io.Reader) (d *Decoder) {
+	h.init()
+	d = NewDecoder(r, &h.do)
+	d.tc = &h.tc
+	return
+}
+
+// NewDecoderBytes returns a Decoder reading from data, configured by the Handle.
+func (h *Handle) NewDecoderBytes(data []byte) (d *Decoder) {
+	h.init()
+	d = NewDecoderBytes(data, &h.do)
+	d.tc = &h.tc
+	return
+}
+
+// Marshal encodes v, configured by the Handle.
+func (h *Handle) Marshal(v interface{}) (b []byte, err error) {
+	var buf bytes.Buffer
+	if err = h.NewEncoder(&buf).Encode(v); err == nil {
+		b = buf.Bytes()
+	}
+	return
+}
+
+// Unmarshal decodes data into v, configured by the Handle.
+func (h *Handle) Unmarshal(data []byte, v interface{}) error {
+	return h.NewDecoderBytes(data).Decode(v)
+}
+
+func (tc *typeCache) loadNames(rt reflect.Type) [][]byte {
+	if x, ok := tc.names.Load(rt); ok {
+		return x.([][]byte)
+	}
+	return nil
+}
+
+func (tc *typeCache) loadFields(rt reflect.Type) map[string]*structFieldInfo {
+	if x, ok := tc.fields.Load(rt); ok {
+		return x.(map[string]*structFieldInfo)
+	}
+	return nil
+}
@@ -33,17 +33,58 @@ SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package msgpack
 
 import (
+	"encoding"
 	"unicode"
 	"unicode/utf8"
 	"reflect"
 	"sync"
 	"strings"
 	"fmt"
+	"math"
+	"strconv"
 	"time"
 )
 
 type ContainerType byte
 
+// Raw is the undecoded msgpack encoding of a single value.
+// 
+// A Raw captures the encoding of whatever value is in the stream when decoded into, 
+// and is written out as-is when encoded (a nil or empty Raw is encoded as msgpack nil). 
+// It can be used (like json.RawMessage) to delay decoding part of a message, 
+// or to pass it along unchanged.
+type Raw []byte
+
+// NonFinitePolicy says how the non-finite float values (NaN, +Inf and -Inf) are handled.
+// See EncoderOptions.NonFinite and DecoderOptions.NonFinite.
+type NonFinitePolicy byte
+
+const (
+	// NonFinitePassThrough encodes/decodes them as-is (IEEE 754). This is the default.
+	NonFinitePassThrough NonFinitePolicy = iota
+	// NonFiniteAsNil replaces them with nil (which decodes as 0 into a float).
+	NonFiniteAsNil
+	// NonFiniteError fails with an error.
+	NonFiniteError
+)
+
+// UTF8Policy says how strings which are not valid UTF-8 are decoded.
+// See DecoderOptions.InvalidUTF8.
+type UTF8Policy byte
+
+const (
+	// UTF8PassThrough decodes them as-is. This is the default.
+	UTF8PassThrough UTF8Policy = iota
+	// UTF8Replace replaces each run of invalid bytes with the replacement character U+FFFD.
+	UTF8Replace
+	// UTF8Error fails with an error.
+	UTF8Error
+)
+
+func isNonFinite(f float64) bool {
+	return math.IsNaN(f) || math.IsInf(f, 0)
+}
+
 const (
 	ContainerRawBytes = ContainerType('b')
 	ContainerList = ContainerType('a')
@@ -53,32 +94,62 @@ const (
 var (
 	structInfoFieldName = "_struct"
 	
-	cachedStructFieldInfos = make(map[reflect.Type]*structFieldInfos, 4)
-	cachedStructFieldInfosMutex sync.Mutex
+	// cachedStructFieldInfos maps reflect.Type to its *structFieldInfos, computed once per type.
+	cachedStructFieldInfos sync.Map
 
 	nilIntfSlice = []interface{}(nil)
 	intfSliceTyp = reflect.TypeOf(nilIntfSlice)
 	intfTyp = intfSliceTyp.Elem()
 	byteSliceTyp = reflect.TypeOf([]byte(nil))
+	rawTyp = reflect.TypeOf(Raw(nil))
 	timeTyp = reflect.TypeOf(time.Time{})
+	durationTyp = reflect.TypeOf(time.Duration(0))
+	textMarshalerTyp = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	textUnmarshalerTyp = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
 	mapStringIntfTyp = reflect.TypeOf(map[string]interface{}(nil))
 	mapIntfIntfTyp = reflect.TypeOf(map[interface{}]interface{}(nil))
+	mapStringStringTyp = reflect.TypeOf(map[string]string(nil))
+	stringTyp = reflect.TypeOf("")
+	stringSliceTyp = reflect.TypeOf([]string(nil))
+	int64SliceTyp = reflect.TypeOf([]int64(nil))
+	float64SliceTyp = reflect.TypeOf([]float64(nil))
 )
 
 type structFieldInfo struct {
+	ix        int      // index in structFieldInfos.sis
 	i         int      // field index in struct
 	is        []int
 	tag       string
 	omitEmpty bool
 	encName   string   // encode name
 	encNameBs []byte
+	named     bool     // tag gives the encode name (so it is not mapped by a FieldNameMapper)
+	hasExt    bool     // tag gives an ext type to wrap the field's binary form in
+	ext       int8
+	asString  bool     // tag has the string option: a bool or number is encoded as a string
+	asSet     bool     // tag has the set option: a set-shaped map is encoded as an array of keys
+	typeOf    string   // tag's typeof=hint option, for resolving the type of an interface field
 	name      string   // field name
+	hasDef    bool     // tag specifies a default (parsed into def, or failing with defErr)
+	def       reflect.Value
+	defErr    error
+	defTag    string
 }
 
 type structFieldInfos struct {
 	sis []*structFieldInfo
+	encNames map[string]*structFieldInfo // only set for structs with many fields
+	anyOmitEmpty bool                    // if false, all fields are always encoded
+	beforeEncode bool                    // pointer implements BeforeMsgpackEncoder
+	afterDecode bool                     // pointer implements AfterMsgpackDecoder
+	validate bool                        // pointer implements Validator
+	anyDefault bool                      // some field has a default for when it is missing
+	version int                          // schema version, from the _struct tag (see SchemaVersionKey)
 }
 
+// structFieldInfos with more fields than this are looked up by name via a map.
+const structFieldInfosLinearSearchMax = 16
+
 func (si *structFieldInfo) field(struc reflect.Value) (rv reflect.Value) {
 	if si.i > -1 {
 		rv = struc.Field(si.i)
@@ -89,7 +160,11 @@ func (si *structFieldInfo) field(struc reflect.Value) (rv reflect.Value) {
 }
 
 // linear search. faster than binary search in my testing up to 16-field structs.
+// Larger structs use a map.
 func (sis *structFieldInfos) getForEncName(name string) (si *structFieldInfo) {
+	if sis.encNames != nil {
+		return sis.encNames[name]
+	}
 	for _, si = range sis.sis {
 		if si.encName == name {
 			return
@@ -100,22 +175,40 @@ func (sis *structFieldInfos) getForEncName(name string) (si *structFieldInfo) {
 }
 
 func getStructFieldInfos(rt reflect.Type) (sis *structFieldInfos) {
-	sis, ok := cachedStructFieldInfos[rt]
-	if ok {
-		return 
+	if x, ok := cachedStructFieldInfos.Load(rt); ok {
+		return x.(*structFieldInfos)
 	}
 	
-	cachedStructFieldInfosMutex.Lock()
-	defer cachedStructFieldInfosMutex.Unlock()
-	
 	sis = new(structFieldInfos)
 	
 	var siInfo *structFieldInfo
 	if f, ok := rt.FieldByName(structInfoFieldName); ok {
 		siInfo = parseStructFieldInfo(structInfoFieldName, f.Tag.Get("msgpack"))
+		sis.version = parseSchemaVersion(siInfo.tag)
 	}
 	rgetStructFieldInfos(rt, nil, sis, siInfo)
-	cachedStructFieldInfos[rt] = sis
+	rpt := reflect.PtrTo(rt)
+	sis.beforeEncode = rpt.Implements(beforeMsgpackEncoderTyp)
+	sis.afterDecode = rpt.Implements(afterMsgpackDecoderTyp)
+	sis.validate = rpt.Implements(validatorTyp)
+	for j, si := range sis.sis {
+		si.ix = j
+		if si.omitEmpty {
+			sis.anyOmitEmpty = true
+		}
+		if si.hasDef {
+			sis.anyDefault = true
+		}
+	}
+	if len(sis.sis) > structFieldInfosLinearSearchMax {
+		sis.encNames = make(map[string]*structFieldInfo, len(sis.sis))
+		for _, si := range sis.sis {
+			sis.encNames[si.encName] = si
+		}
+	}
+	// If computed concurrently for the same type, all callers share the first one stored.
+	x, _ := cachedStructFieldInfos.LoadOrStore(rt, sis)
+	sis = x.(*structFieldInfos)
 	return
 }
 
@@ -139,6 +232,9 @@ func rgetStructFieldInfos(rt reflect.Type, indexstack []int, sis *structFieldInf
 			}
 		}
 		si := parseStructFieldInfo(f.Name, stag)
+		if si.hasDef {
+			si.def, si.defErr = parseFieldDefault(f.Type, si.defTag)
+		}
 		
 		if len(indexstack) == 0 {
 			si.i = j
@@ -174,15 +270,32 @@ func parseStructFieldInfo(fname string, stag string) (si *structFieldInfo) {
 		tag: stag,
 	}	
 	
+	// default=value is the last option, and can hold commas.
+	if i := strings.Index(stag, ",default="); i >= 0 {
+		si.hasDef, si.defTag = true, stag[i+len(",default="):]
+		stag = stag[:i]
+	}
 	if stag != "" {
-		for i, s := range strings.Split(si.tag, ",") {
+		for i, s := range strings.Split(stag, ",") {
 			if i == 0 {
 				if s != "" {
-					si.encName = s
+					si.encName, si.named = s, true
 				}
 			} else {
 				if s == "omitempty" {
 					si.omitEmpty = true
+				} else if s == "string" {
+					si.asString = true
+				} else if s == "set" {
+					si.asSet = true
+				} else if strings.HasPrefix(s, "typeof=") {
+					si.typeOf = s[len("typeof="):]
+				} else if strings.HasPrefix(s, "ext=") {
+					x, err := strconv.ParseInt(s[len("ext="):], 0, 8)
+					if err != nil {
+						panic(fmt.Errorf("msgpack: invalid ext type in struct tag of field %s: %q", fname, stag))
+					}
+					si.hasExt, si.ext = true, int8(x)
 				}
 			}
 		}
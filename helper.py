@@ -64,20 +64,49 @@ def get_test_data_list():
          ]
     return l
 
+def sort_keys(v):
+    # order dicts with all-string keys by key, as the Go test encodes them (SortMapKeys)
+    if isinstance(v, list):
+        return [sort_keys(x) for x in v]
+    if isinstance(v, dict):
+        items = [(k, sort_keys(x)) for k, x in v.items()]
+        if all(isinstance(k, str) for k in v):
+            items.sort(key=lambda kv: kv[0].encode('utf-8'))
+        return dict(items)
+    return v
+
 def build_test_data(destdir):
     l = get_test_data_list()
     for i in range(len(l)):
         packer = msgpack.Packer()
-        serialized = packer.pack(l[i])
+        serialized = packer.pack(sort_keys(l[i]))
         f = open(os.path.join(destdir, str(i) + '.golden'), 'wb')
         f.write(serialized)
         f.close()
 
+def verify_test_data(srcdir):
+    # check the files encoded by the Go side (see the interop package): N.msgpack holds value N
+    l = get_test_data_list()
+    bad = []
+    for i in range(len(l)):
+        path = os.path.join(srcdir, str(i) + '.msgpack')
+        if not os.path.exists(path):
+            continue
+        with open(path, 'rb') as f:
+            v = msgpack.unpackb(f.read(), strict_map_key=False)
+        if v != l[i]:
+            bad.append(i)
+    if bad:
+        print("Values do not match: %s" % bad)
+        sys.exit(1)
+
 def doMain(args):
     if len(args) == 2 and args[0] == "testdata":
         build_test_data(args[1])
+    elif len(args) == 2 and args[0] == "verify":
+        verify_test_data(args[1])
     else:
-        print("Usage: build.py [testdata]")
+        print("Usage: build.py [testdata|verify] dir")
     
 if __name__ == "__main__":
     doMain(sys.argv[1:])
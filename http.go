@@ -0,0 +1,173 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// MsgpackContentType is the media type of a msgpack HTTP body.
+const MsgpackContentType = "application/msgpack"
+
+// ErrUnsupportedMediaType is the error of DecodeRequest for a body which is neither msgpack nor JSON 
+// (to be answered with http.StatusUnsupportedMediaType).
+var ErrUnsupportedMediaType = errors.New("msgpack: unsupported media type")
+
+// DecodeRequest decodes the body of r into v: as msgpack if its Content-Type is application/msgpack 
+// (or application/x-msgpack, or unset), or as JSON if it is application/json (or +json), 
+// transcoding it to msgpack first (see FromJSON), so v is decoded the same way in both cases.
+// Any other Content-Type is an ErrUnsupportedMediaType.
+func DecodeRequest(r *http.Request, v interface{}) (err error) {
+	var body io.Reader = r.Body
+	switch httpMediaType(r.Header.Get("Content-Type")) {
+	case "msgpack":
+	case "json":
+		var buf bytes.Buffer
+		if err = FromJSON(&buf, r.Body); err != nil {
+			return
+		}
+		body = &buf
+	default:
+		return ErrUnsupportedMediaType
+	}
+	return NewDecoder(body, nil).Decode(v)
+}
+
+// WriteResponse writes v as the body of a response with the status code. 
+// It is written as msgpack, unless the Content-Type of w is already application/json 
+// (e.g. set by NegotiateResponse), when the msgpack is transcoded to JSON (see ToJSON).
+// v is encoded before anything is written, so if it fails (e.g. v cannot be encoded), 
+// the response can still be written, e.g. with an error status.
+// 
+// Sample Usage:
+//   var req Request
+//   if err := msgpack.DecodeRequest(r, &req); err != nil { ... }
+//   msgpack.NegotiateResponse(w, r)
+//   err = msgpack.WriteResponse(w, http.StatusOK, resp)
+func WriteResponse(w http.ResponseWriter, code int, v interface{}) (err error) {
+	bs, err := Marshal(v)
+	if err != nil {
+		return
+	}
+	h := w.Header()
+	if httpMediaType(h.Get("Content-Type")) == "json" {
+		var buf bytes.Buffer
+		if err = ToJSON(&buf, bytes.NewReader(bs)); err != nil {
+			return
+		}
+		bs = buf.Bytes()
+	} else {
+		h.Set("Content-Type", MsgpackContentType)
+	}
+	h.Set("Content-Length", strconv.Itoa(len(bs)))
+	w.WriteHeader(code)
+	_, err = w.Write(bs)
+	return
+}
+
+// NegotiateResponse sets the Content-Type of w to application/json if the Accept header of r 
+// prefers JSON to msgpack, else to application/msgpack, for WriteResponse. 
+// Each media range of Accept is weighed by its q parameter, the most specific range 
+// (e.g. application/json over application/* over */*) matching a type giving its weight.
+func NegotiateResponse(w http.ResponseWriter, r *http.Request) {
+	ct := MsgpackContentType
+	if accept := r.Header.Get("Accept"); accept != "" {
+		// application/x-msgpack counts as msgpack, if named.
+		mq, ms := httpAcceptQuality(accept, MsgpackContentType)
+		if q, s := httpAcceptQuality(accept, "application/x-msgpack"); s > ms || s == ms && q > mq {
+			mq = q
+		}
+		if q, _ := httpAcceptQuality(accept, "application/json"); q > mq {
+			ct = "application/json"
+		}
+	}
+	w.Header().Set("Content-Type", ct)
+}
+
+// httpMediaType classifies a Content-Type as "msgpack" (also if empty), "json", or "" (anything else).
+func httpMediaType(contentType string) string {
+	if contentType == "" {
+		return "msgpack"
+	}
+	mt, _, err := mime.ParseMediaType(contentType)
+	switch {
+	case err != nil:
+		return ""
+	case mt == MsgpackContentType || mt == "application/x-msgpack":
+		return "msgpack"
+	case mt == "application/json" || strings.HasSuffix(mt, "+json"):
+		return "json"
+	}
+	return ""
+}
+
+// httpAcceptQuality returns the weight given to the media type mt by the Accept header accept: 
+// the q of its most specific matching media range, and how specific that is 
+// (2 for mt itself, 1 for type/*, 0 for */*), or -1 for both if none matches.
+func httpAcceptQuality(accept, mt string) (q float64, specificity int) {
+	q, specificity = -1, -1
+	for _, rng := range strings.Split(accept, ",") {
+		rt, params, err := mime.ParseMediaType(strings.TrimSpace(rng))
+		if err != nil {
+			continue
+		}
+		var s int
+		switch {
+		case rt == mt:
+			s = 2
+		case rt == "*/*":
+			s = 0
+		case strings.HasSuffix(rt, "/*") && strings.HasPrefix(mt, rt[:len(rt)-1]):
+			s = 1
+		default:
+			continue
+		}
+		if s <= specificity {
+			continue
+		}
+		rq := 1.0
+		if x, ok := params["q"]; ok {
+			if rq, err = strconv.ParseFloat(x, 64); err != nil {
+				rq = 0
+			}
+		}
+		q, specificity = rq, s
+	}
+	return
+}
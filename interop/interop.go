@@ -0,0 +1,198 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+/*
+Package interop checks, from go tests, that msgpack streams are compatible both ways
+with other implementations (msgpack-python, Ruby, Node, Java, etc).
+
+A Generator provides golden files: the encodings of a list of test values by 
+another implementation, one per file, named by the index of the value 
+(0.golden, 1.golden, ...). A Command runs a program (e.g. a script using the other 
+implementation) to write them, and a Dir holds pre-committed ones.
+
+Check decodes each golden file, compares the result to the expected value, and 
+re-encodes it, comparing that to the golden bytes. If the Generator is also a Verifier,
+Check then writes our encodings (0.msgpack, 1.msgpack, ...) for it to decode and check in turn.
+
+    func TestPythonInterop(t *testing.T) {
+        g := &interop.Command{
+            GenerateArgs: []string{"python", "helper.py", "testdata"},
+            VerifyArgs: []string{"python", "helper.py", "verify"},
+        }
+        h := &msgpack.Handle{Encoder: new(msgpack.EncoderOptions).PresetPythonCompat()}
+        h.Encoder.SortMapKeys = true
+        interop.Check(t, g, values, h)
+    }
+
+The test is skipped if the program of a Command is not installed.
+*/
+package interop
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/ugorji/go-msgpack"
+)
+
+// ErrNotInstalled is returned (wrapped) by a Generator or Verifier which cannot run
+// because the implementation it uses is not installed. Check skips the test then.
+var ErrNotInstalled = errors.New("interop: not installed")
+
+// Skip, as an expected value, only checks that its golden file decodes:
+// not what it decodes to, nor that it re-encodes to the same bytes 
+// (e.g. for values whose map keys have no defined order).
+var Skip interface{} = skip{}
+
+type skip struct{}
+
+// Generator provides the golden files of a list of test values.
+type Generator interface {
+	// Golden returns the directory holding the golden files, which it may write into tmpdir 
+	// (an empty directory removed after the check).
+	Golden(tmpdir string) (dir string, err error)
+}
+
+// Verifier checks our encodings of a list of test values.
+type Verifier interface {
+	// Verify checks the files in dir: N.msgpack holds our encoding of value N.
+	Verify(dir string) error
+}
+
+// Dir is a Generator of the pre-committed golden files in a directory.
+type Dir string
+
+func (d Dir) Golden(tmpdir string) (string, error) {
+	return string(d), nil
+}
+
+// Command is a Generator and Verifier running external programs. The directory to write 
+// the golden files into, or holding the files to verify, is appended to their arguments.
+type Command struct {
+	GenerateArgs []string // command line writing the golden files
+	VerifyArgs []string   // command line checking our files (if nil, Verify does nothing)
+}
+
+func (c *Command) Golden(tmpdir string) (string, error) {
+	return tmpdir, run(c.GenerateArgs, tmpdir)
+}
+
+func (c *Command) Verify(dir string) error {
+	if len(c.VerifyArgs) == 0 {
+		return nil
+	}
+	return run(c.VerifyArgs, dir)
+}
+
+func run(args []string, dir string) error {
+	if len(args) == 0 {
+		return errors.New("interop: no command")
+	}
+	path, err := exec.LookPath(args[0])
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNotInstalled, err)
+	}
+	cmd := exec.Command(path, append(args[1:len(args):len(args)], dir)...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("interop: %s: %v\n%s", args[0], err, out)
+	}
+	return nil
+}
+
+// Check checks values against the golden files of g, encoding and decoding with h 
+// (or the default options, if nil). For each value N: 
+//   - N.golden must decode (into a nil interface{}) to a value deeply equal to it,
+//   - and re-encode to the same bytes.
+// 
+// Then, if g is a Verifier, the value decoded from each golden file is encoded 
+// into N.msgpack, and g verifies them.
+// 
+// Failures are reported with t.Errorf, and t.Skip is called if g is not installed.
+func Check(t testing.TB, g Generator, values []interface{}, h *msgpack.Handle) {
+	t.Helper()
+	if h == nil {
+		h = &msgpack.Handle{}
+	}
+	tmpdir := t.TempDir()
+	dir, err := g.Golden(tmpdir)
+	if err != nil {
+		if errors.Is(err, ErrNotInstalled) {
+			t.Skip(err)
+		}
+		t.Fatalf("generating golden files: %v", err)
+	}
+	outdir := filepath.Join(tmpdir, "out")
+	if err = os.Mkdir(outdir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range values {
+		bs, err := os.ReadFile(filepath.Join(dir, strconv.Itoa(i) + ".golden"))
+		if err != nil {
+			t.Errorf("#%d: %v", i, err)
+			continue
+		}
+		var v1 interface{}
+		if err = h.Unmarshal(bs, &v1); err != nil {
+			t.Errorf("#%d: decoding golden file: %v", i, err)
+			continue
+		}
+		bs1, err := h.Marshal(v1)
+		if err != nil {
+			t.Errorf("#%d: encoding: %v", i, err)
+			continue
+		}
+		if v != Skip {
+			if !reflect.DeepEqual(v1, v) {
+				t.Errorf("#%d: decoded: %#v, expected: %#v", i, v1, v)
+			} else if !bytes.Equal(bs1, bs) {
+				t.Errorf("#%d: encoded:\n%sgolden:\n%s", i, msgpack.Dump(bs1), msgpack.Dump(bs))
+			}
+		}
+		if err = os.WriteFile(filepath.Join(outdir, strconv.Itoa(i) + ".msgpack"), bs1, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if vr, ok := g.(Verifier); ok && !t.Failed() {
+		if err = vr.Verify(outdir); errors.Is(err, ErrNotInstalled) {
+			t.Skip(err)
+		} else if err != nil {
+			t.Errorf("verifying our encodings: %v", err)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package interop
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ugorji/go-msgpack"
+)
+
+// selfGenerator generates and verifies with this package itself.
+type selfGenerator struct {
+	values []interface{}
+	verified []interface{}
+}
+
+func (g *selfGenerator) Golden(tmpdir string) (string, error) {
+	for i, v := range g.values {
+		bs, err := msgpack.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		if err = os.WriteFile(filepath.Join(tmpdir, strconv.Itoa(i) + ".golden"), bs, 0666); err != nil {
+			return "", err
+		}
+	}
+	return tmpdir, nil
+}
+
+func (g *selfGenerator) Verify(dir string) error {
+	for i := range g.values {
+		bs, err := os.ReadFile(filepath.Join(dir, strconv.Itoa(i) + ".msgpack"))
+		if err != nil {
+			return err
+		}
+		var v interface{}
+		if err = msgpack.Unmarshal(bs, &v, nil); err != nil {
+			return err
+		}
+		g.verified = append(g.verified, v)
+	}
+	return nil
+}
+
+// errorsTB records the errors reported to it.
+type errorsTB struct {
+	testing.TB
+	errs []string
+}
+
+func (t *errorsTB) Errorf(format string, args ...interface{}) {
+	t.errs = append(t.errs, fmt.Sprintf(format, args...))
+}
+
+func (t *errorsTB) Failed() bool {
+	return len(t.errs) > 0
+}
+
+func TestCheck(t *testing.T) {
+	values := []interface{}{int8(1), "abc", []interface{}{true, nil, 2.5}}
+	g := &selfGenerator{values: values}
+	Check(t, g, values, nil)
+	if !reflect.DeepEqual(g.verified, values) {
+		t.Fatalf("verified: %#v", g.verified)
+	}
+	
+	// pre-committed files.
+	dir := t.TempDir()
+	if _, err := (&selfGenerator{values: values}).Golden(dir); err != nil {
+		t.Fatal(err)
+	}
+	Check(t, Dir(dir), append(values[:2:2], Skip), nil)
+	
+	// a mismatch is reported.
+	tb := &errorsTB{TB: t}
+	Check(tb, Dir(dir), []interface{}{int8(1), "abd", Skip}, nil)
+	if len(tb.errs) != 1 || !strings.HasPrefix(tb.errs[0], "#1: decoded: ") {
+		t.Fatalf("unexpected errors: %q", tb.errs)
+	}
+}
+
+func TestCheckNotInstalled(t *testing.T) {
+	var sub *testing.T
+	t.Run("missing", func(t *testing.T) {
+		sub = t
+		Check(t, &Command{GenerateArgs: []string{"no-such-msgpack-generator"}}, nil, nil)
+	})
+	if !sub.Skipped() {
+		t.Fatal("expected a missing generator to skip the test")
+	}
+	if err := (&Command{}).Verify(t.TempDir()); err != nil {
+		t.Fatalf("expected no verification without VerifyArgs, got: %v", err)
+	}
+}
@@ -0,0 +1,400 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// JSONOptions configures transcoding between msgpack and JSON (ToJSON and FromJSON).
+// 
+// Transcoding works on the wire formats directly, without decoding into Go values.
+// 
+// msgpack to JSON:
+//   - str values become JSON strings (invalid UTF-8 is replaced with U+FFFD)
+//   - bin values become base64 strings, or {"$bin": "<base64>"} if BinAsTagged is set
+//   - ext values become {"$ext": <type>, "$data": "<base64>"} (see ExtToJSON)
+//   - non-string map keys become strings holding their JSON text (e.g. "1", "true")
+//   - NaN and ±Inf, which JSON cannot represent, are an error
+// 
+// JSON to msgpack:
+//   - integral numbers become ints (or uints, if too large for int64), others floats
+//   - an object of exactly the form {"$bin": "<base64>"} becomes bin, and 
+//     {"$ext": <type>, "$data": "<base64>"} becomes an ext value
+type JSONOptions struct {
+	// BinAsTagged renders bin values as {"$bin": "<base64>"} instead of a plain base64 string,
+	// so FromJSON can tell them apart from strings.
+	BinAsTagged bool
+	// ExtToJSON, if set, returns the JSON text to render an ext value as.
+	ExtToJSON func(xtag int8, data []byte) ([]byte, error)
+}
+
+// ToJSON transcodes the stream of msgpack values in r into JSON written to w, 
+// one value per line, using the default JSONOptions.
+func ToJSON(w io.Writer, r io.Reader) error {
+	return (*JSONOptions)(nil).ToJSON(w, r)
+}
+
+// FromJSON transcodes the stream of JSON values in r into msgpack written to w, 
+// using the default JSONOptions.
+func FromJSON(w io.Writer, r io.Reader) error {
+	return (*JSONOptions)(nil).FromJSON(w, r)
+}
+
+// ToJSON transcodes the stream of msgpack values in r into JSON written to w, one value per line.
+func (o *JSONOptions) ToJSON(w io.Writer, r io.Reader) (err error) {
+	if o == nil {
+		o = &JSONOptions{}
+	}
+	bw := bufio.NewWriter(w)
+	d := NewDecoder(r, nil)
+	for d.More() {
+		if err = o.toJSON(d, bw); err != nil {
+			return
+		}
+		bw.WriteByte('\n')
+	}
+	return bw.Flush()
+}
+
+type jsonWriter interface {
+	io.Writer
+	io.ByteWriter
+	io.StringWriter
+}
+
+func (o *JSONOptions) toJSON(d *Decoder, w jsonWriter) (err error) {
+	defer panicToErr(&err)
+	o.writeJSON(d, w, false)
+	return
+}
+
+// writeJSON transcodes the next value in d's stream.
+// If asKey, it is a map key, so is written as a JSON string.
+func (o *JSONOptions) writeJSON(d *Decoder, w jsonWriter, asKey bool) {
+	o.writeJSONValue(d, w, d.readn1(), asKey)
+}
+
+// writeJSONValue transcodes the value with descriptor byte bd.
+func (o *JSONOptions) writeJSONValue(d *Decoder, w jsonWriter, bd byte, asKey bool) {
+	vt := descValueType(bd)
+	if asKey {
+		switch vt {
+		case StrType, BinType:
+		case ArrayType, MapType, ExtType:
+			d.err("ToJSON: Cannot use %v as JSON object key", vt)
+		default:
+			// a scalar: quote its JSON text
+			var sb strings.Builder
+			o.writeJSONValue(d, &sb, bd, false)
+			writeJSONString(w, []byte(sb.String()))
+			return
+		}
+	}
+	var x [32]byte
+	switch vt {
+	case NilType:
+		w.WriteString("null")
+	case BoolType:
+		w.WriteString(strconv.FormatBool(bd == 0xc3))
+	case IntType:
+		i, _ := d.decodeInteger(bd, true)
+		w.Write(strconv.AppendInt(x[:0], i, 10))
+	case UintType:
+		_, ui := d.decodeInteger(bd, false)
+		w.Write(strconv.AppendUint(x[:0], ui, 10))
+	case FloatType:
+		f, bits := 0.0, 64
+		if bd == 0xca {
+			f, bits = float64(math.Float32frombits(d.readUint32())), 32
+		} else {
+			f = math.Float64frombits(d.readUint64())
+		}
+		if isNonFinite(f) {
+			d.err("ToJSON: Cannot represent %v in JSON", f)
+		}
+		w.Write(strconv.AppendFloat(x[:0], f, 'g', -1, bits))
+	case StrType:
+		writeJSONString(w, d.readBytes(d.readContainerLen(bd, false, ContainerRawBytes)))
+	case BinType:
+		bs := d.readBytes(d.readContainerLen(bd, false, ContainerRawBytes))
+		if o.BinAsTagged && !asKey {
+			w.WriteString(`{"$bin":"`)
+			w.WriteString(base64.StdEncoding.EncodeToString(bs))
+			w.WriteString(`"}`)
+		} else {
+			writeJSONString(w, []byte(base64.StdEncoding.EncodeToString(bs)))
+		}
+	case ExtType:
+		xtag, l := d.readExtHeader(bd)
+		data := d.readBytes(l)
+		if o.ExtToJSON != nil {
+			bs, err := o.ExtToJSON(xtag, data)
+			if err != nil {
+				d.err("ToJSON: ext type %v: %v", xtag, err)
+			}
+			w.Write(bs)
+			break
+		}
+		w.WriteString(`{"$ext":`)
+		w.Write(strconv.AppendInt(x[:0], int64(xtag), 10))
+		w.WriteString(`,"$data":"`)
+		w.WriteString(base64.StdEncoding.EncodeToString(data))
+		w.WriteString(`"}`)
+	case ArrayType:
+		n := d.readContainerLen(bd, false, ContainerList)
+		d.enter()
+		w.WriteByte('[')
+		for j := 0; j < n; j++ {
+			if j > 0 {
+				w.WriteByte(',')
+			}
+			o.writeJSON(d, w, false)
+		}
+		w.WriteByte(']')
+		d.exit()
+	case MapType:
+		n := d.readContainerLen(bd, false, ContainerMap)
+		d.enter()
+		w.WriteByte('{')
+		for j := 0; j < n; j++ {
+			if j > 0 {
+				w.WriteByte(',')
+			}
+			o.writeJSON(d, w, true)
+			w.WriteByte(':')
+			o.writeJSON(d, w, false)
+		}
+		w.WriteByte('}')
+		d.exit()
+	default:
+		d.err("ToJSON: %s: hex: %x, dec: %d", msgBadDesc, bd, bd)
+	}
+}
+
+const jsonHex = "0123456789abcdef"
+
+// writeJSONString writes bs as a quoted JSON string.
+func writeJSONString(w jsonWriter, bs []byte) {
+	w.WriteByte('"')
+	for i := 0; i < len(bs); {
+		c := bs[i]
+		if c < utf8.RuneSelf {
+			switch {
+			case c == '"', c == '\\':
+				w.WriteByte('\\')
+				w.WriteByte(c)
+			case c == '\n':
+				w.WriteString(`\n`)
+			case c == '\r':
+				w.WriteString(`\r`)
+			case c == '\t':
+				w.WriteString(`\t`)
+			case c < 0x20:
+				w.WriteString(`\u00`)
+				w.WriteByte(jsonHex[c>>4])
+				w.WriteByte(jsonHex[c&0xf])
+			default:
+				w.WriteByte(c)
+			}
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRune(bs[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			w.WriteString(`\ufffd`)
+		case r == '\u2028', r == '\u2029':
+			// valid JSON, but not valid JavaScript
+			w.WriteString(`\u202`)
+			w.WriteByte(jsonHex[r&0xf])
+		default:
+			w.Write(bs[i:i+size])
+		}
+		i += size
+	}
+	w.WriteByte('"')
+}
+
+// FromJSON transcodes the stream of JSON values in r into msgpack written to w.
+func (o *JSONOptions) FromJSON(w io.Writer, r io.Reader) (err error) {
+	bw := bufio.NewWriter(w)
+	e := NewEncoder(bw)
+	jd := json.NewDecoder(r)
+	jd.UseNumber()
+	for {
+		var tok json.Token
+		if tok, err = jd.Token(); err == io.EOF {
+			break
+		} else if err != nil {
+			return
+		}
+		if err = fromJSON(jd, tok, e); err != nil {
+			return
+		}
+	}
+	return bw.Flush()
+}
+
+func fromJSON(jd *json.Decoder, tok json.Token, e *Encoder) (err error) {
+	defer panicToErr(&err)
+	e.depth = 0
+	writeFromJSON(jd, tok, e)
+	return
+}
+
+func jsonToken(jd *json.Decoder) json.Token {
+	tok, err := jd.Token()
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		panic(fmt.Errorf("FromJSON: %v", err))
+	}
+	return tok
+}
+
+// writeFromJSON writes the JSON value starting with tok (reading the rest of it from jd).
+func writeFromJSON(jd *json.Decoder, tok json.Token, e *Encoder) {
+	switch x := tok.(type) {
+	case nil:
+		e.encNil()
+	case bool:
+		e.encBool(x)
+	case string:
+		e.encString(x)
+	case json.Number:
+		writeJSONNumber(x, e)
+	case json.Delim:
+		// like decoding, fail (rather than exhaust the stack) on arrays and objects nested too deep.
+		if e.depth++; e.depth > decMaxDepth {
+			e.err("FromJSON: Exceeded max nesting depth of %v", decMaxDepth)
+		}
+		defer func() { e.depth-- }()
+		if x == '[' {
+			e.beginDeferred(ContainerList)
+			for jd.More() {
+				writeFromJSON(jd, jsonToken(jd), e)
+			}
+			jsonToken(jd) // ]
+			e.endDeferred(ContainerList)
+			return
+		}
+		writeFromJSONObject(jd, e)
+	}
+}
+
+func writeJSONNumber(x json.Number, e *Encoder) {
+	s := string(x)
+	if !strings.ContainsAny(s, ".eE") {
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			e.encInt(i)
+			return
+		}
+		if ui, err := strconv.ParseUint(s, 10, 64); err == nil {
+			e.encUint(ui)
+			return
+		}
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		e.err("FromJSON: Invalid number: %v", s)
+	}
+	e.encFloat64(f)
+}
+
+// writeFromJSONObject writes a JSON object (after its opening brace),
+// recognizing the tagged forms for bin and ext values.
+func writeFromJSONObject(jd *json.Decoder, e *Encoder) {
+	if !jd.More() {
+		jsonToken(jd) // }
+		e.writeContainerLen(ContainerMap, 0)
+		return
+	}
+	k := jsonToken(jd).(string)
+	v := jsonToken(jd)
+	var k2 string
+	var v2 json.Token
+	var has2 bool // a second pair was read (v2 may be nil, for null)
+	switch n, isNum := v.(json.Number); {
+	case k == "$bin":
+		if s, ok := v.(string); ok && !jd.More() {
+			jsonToken(jd) // }
+			e.encRawBytes(decodeJSONBase64(e, s))
+			return
+		}
+	case k == "$ext" && isNum && jd.More():
+		k2, v2, has2 = jsonToken(jd).(string), jsonToken(jd), true
+		s, ok := v2.(string)
+		if xtag, err := strconv.ParseInt(string(n), 10, 8); err == nil && ok && k2 == "$data" && !jd.More() {
+			jsonToken(jd) // }
+			bs := decodeJSONBase64(e, s)
+			e.writeExtHeader(int8(xtag), len(bs))
+			if len(bs) > 0 {
+				e.writeb(len(bs), bs)
+			}
+			return
+		}
+	}
+	// a regular object: the pairs read so far are its first ones.
+	e.beginDeferred(ContainerMap)
+	e.encString(k)
+	writeFromJSON(jd, v, e)
+	if has2 {
+		e.encString(k2)
+		writeFromJSON(jd, v2, e)
+	}
+	for jd.More() {
+		e.encString(jsonToken(jd).(string))
+		writeFromJSON(jd, jsonToken(jd), e)
+	}
+	jsonToken(jd) // }
+	e.endDeferred(ContainerMap)
+}
+
+func decodeJSONBase64(e *Encoder, s string) []byte {
+	bs, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		e.err("FromJSON: Invalid base64 data: %v", err)
+	}
+	return bs
+}
+
@@ -0,0 +1,191 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+import (
+	"fmt"
+	"io"
+)
+
+// LazyIndex is an index of the offsets of the elements of an array (or the entries of a map)
+// in a document read through an io.ReaderAt, such as a large file (or an mmap'ed one).
+// Elements are read and decoded on demand, one at a time; nested containers can be 
+// indexed in turn (see Sub). 
+// 
+// Building the index reads the container's encoding once, except str, bin and ext data, 
+// which are skipped without being read. The index holds one offset per element (two per map entry).
+// For example:
+//   x, err := msgpack.NewLazyIndex(f, 0, nil) // f holds a large array
+//   err = x.Decode(123456, &rec)
+type LazyIndex struct {
+	r io.ReaderAt
+	dam DecoderContainerResolver
+	vt ValueType
+	offs []int64 // offsets of the elements (for a map: of each key and value), then of the end
+}
+
+// NewLazyIndex indexes the array or map at offset off in r. 
+// dam is used when decoding elements (as for NewDecoder).
+func NewLazyIndex(r io.ReaderAt, off int64, dam DecoderContainerResolver) (x *LazyIndex, err error) {
+	defer panicToErr(&err)
+	z := &readerAtDecReader{r: r, pos: off}
+	d := newDecoder(z, dam)
+	x2 := &LazyIndex{r: r, dam: dam}
+	bd := d.readn1()
+	var n int
+	switch x2.vt = descValueType(bd); x2.vt {
+	case ArrayType:
+		n = d.readContainerLen(bd, false, ContainerList)
+	case MapType:
+		n = 2 * d.readContainerLen(bd, false, ContainerMap)
+	default:
+		d.err("NewLazyIndex: Expecting array or map. %s: hex: %x", msgBadDesc, bd)
+	}
+	// do not trust a length from the input to size the index.
+	x2.offs = make([]int64, 0, minInt(n, 1 << 16) + 1)
+	for i := 0; i < n; i++ {
+		x2.offs = append(x2.offs, z.pos)
+		d.skip(0, true)
+	}
+	x2.offs = append(x2.offs, z.pos)
+	// skipped data is not read: check the input does not end before the container does.
+	if n > 0 {
+		if k, _ := r.ReadAt(d.t1, z.pos - 1); k != 1 {
+			panic(io.ErrUnexpectedEOF)
+		}
+	}
+	return x2, nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Type returns the type of the indexed container: ArrayType or MapType.
+func (x *LazyIndex) Type() ValueType { return x.vt }
+
+// Len returns the number of elements of an array, or of entries of a map.
+func (x *LazyIndex) Len() int {
+	if x.vt == MapType {
+		return (len(x.offs) - 1) / 2
+	}
+	return len(x.offs) - 1
+}
+
+// End returns the offset just past the end of the container.
+func (x *LazyIndex) End() int64 { return x.offs[len(x.offs)-1] }
+
+// pos returns the position in offs of element i (or its key, if key is set).
+func (x *LazyIndex) pos(i int, key bool) (j int, err error) {
+	if key && x.vt != MapType {
+		return -1, fmt.Errorf("%v: LazyIndex: no keys in %v", msgTagDec, x.vt)
+	}
+	if i < 0 || i >= x.Len() {
+		return -1, fmt.Errorf("%v: LazyIndex: index %d out of range of %v of length %d", msgTagDec, i, x.vt, x.Len())
+	}
+	if x.vt == MapType {
+		j = 2 * i
+		if !key {
+			j++
+		}
+	} else {
+		j = i
+	}
+	return
+}
+
+func (x *LazyIndex) raw(i int, key bool) (bs Raw, err error) {
+	j, err := x.pos(i, key)
+	if err != nil {
+		return
+	}
+	bs = make(Raw, x.offs[j+1] - x.offs[j])
+	if n, err := x.r.ReadAt(bs, x.offs[j]); n < len(bs) {
+		return nil, err
+	}
+	return
+}
+
+func (x *LazyIndex) decode(i int, key bool, v interface{}) (err error) {
+	j, err := x.pos(i, key)
+	if err != nil {
+		return
+	}
+	return newDecoder(&readerAtDecReader{r: x.r, pos: x.offs[j]}, x.dam).Decode(v)
+}
+
+// Raw returns the encoding of the i'th element of an array (or value of a map).
+func (x *LazyIndex) Raw(i int) (Raw, error) { return x.raw(i, false) }
+
+// Decode decodes the i'th element of an array (or value of a map) into v.
+func (x *LazyIndex) Decode(i int, v interface{}) error { return x.decode(i, false, v) }
+
+// RawKey returns the encoding of the key of the i'th entry of a map.
+func (x *LazyIndex) RawKey(i int) (Raw, error) { return x.raw(i, true) }
+
+// DecodeKey decodes the key of the i'th entry of a map into v.
+func (x *LazyIndex) DecodeKey(i int, v interface{}) error { return x.decode(i, true, v) }
+
+// Sub indexes the i'th element of an array (or value of a map), which must be an array or map.
+func (x *LazyIndex) Sub(i int) (*LazyIndex, error) {
+	j, err := x.pos(i, false)
+	if err != nil {
+		return nil, err
+	}
+	return NewLazyIndex(x.r, x.offs[j], x.dam)
+}
+
+// Find returns the position of the entry of a map with the given key, or -1 if there is none.
+// Keys match as for GetPath. Each key is read from r, until a match is found.
+func (x *LazyIndex) Find(key interface{}) (i int, err error) {
+	if x.vt != MapType {
+		return -1, fmt.Errorf("%v: LazyIndex.Find: not a map: %v", msgTagDec, x.vt)
+	}
+	defer panicToErr(&err)
+	pk := pathKey(key)
+	z := &readerAtDecReader{r: x.r}
+	d := newDecoder(z, x.dam)
+	for i = 0; i < x.Len(); i++ {
+		z.pos = x.offs[2*i]
+		var k diffNode
+		d.parseDiffNode(nil, &k)
+		if pathKeyMatch(pk, &k) {
+			return
+		}
+	}
+	return -1, nil
+}
+
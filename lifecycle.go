@@ -0,0 +1,108 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// BeforeMsgpackEncoder is implemented by struct types (or their pointers) which prepare themselves 
+// for encoding, e.g. populating derived fields. BeforeMsgpackEncode is called before the struct 
+// is encoded (on a copy if the struct is not addressable), and an error it returns fails the encoding.
+type BeforeMsgpackEncoder interface {
+	BeforeMsgpackEncode() error
+}
+
+// AfterMsgpackDecoder is implemented by struct types (or their pointers) which finish decoding themselves, 
+// e.g. populating derived fields or validating invariants. AfterMsgpackDecode is called once the struct's 
+// fields have been decoded, and an error it returns fails the decoding.
+type AfterMsgpackDecoder interface {
+	AfterMsgpackDecode() error
+}
+
+// Validator is implemented by struct types (or their pointers) which check their invariants. 
+// With DecoderOptions.Validate, Validate is called once the struct is decoded 
+// (after AfterMsgpackDecode), and an error it returns fails the decoding with a ValidationError.
+type Validator interface {
+	Validate() error
+}
+
+// ValidationError is returned by Decode when the Validate method of a decoded struct fails.
+type ValidationError struct {
+	Type reflect.Type // the struct type
+	Err error         // returned by Validate
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s: invalid %v: %v", msgTagDec, e.Type, e.Err)
+}
+
+// Unwrap returns the error returned by Validate.
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+var (
+	beforeMsgpackEncoderTyp = reflect.TypeOf((*BeforeMsgpackEncoder)(nil)).Elem()
+	afterMsgpackDecoderTyp = reflect.TypeOf((*AfterMsgpackDecoder)(nil)).Elem()
+	validatorTyp = reflect.TypeOf((*Validator)(nil)).Elem()
+)
+
+// beforeEncode calls BeforeMsgpackEncode on the struct rv (or a copy, if it cannot be addressed), 
+// and returns the struct to encode.
+func (e *Encoder) beforeEncode(rv reflect.Value) reflect.Value {
+	if !rv.CanAddr() {
+		rv2 := reflect.New(rv.Type()).Elem()
+		rv2.Set(rv)
+		rv = rv2
+	}
+	if err := rv.Addr().Interface().(BeforeMsgpackEncoder).BeforeMsgpackEncode(); err != nil {
+		e.err("BeforeMsgpackEncode: %v: %v", rv.Type(), err)
+	}
+	return rv
+}
+
+// afterDecode calls AfterMsgpackDecode on the decoded struct rv.
+func (d *Decoder) afterDecode(rv reflect.Value) {
+	if err := rv.Addr().Interface().(AfterMsgpackDecoder).AfterMsgpackDecode(); err != nil {
+		d.err("AfterMsgpackDecode: %v: %v", rv.Type(), err)
+	}
+}
+
+// validate calls Validate on the decoded struct rv.
+func (d *Decoder) validate(rv reflect.Value) {
+	if err := rv.Addr().Interface().(Validator).Validate(); err != nil {
+		panic(&ValidationError{ Type: rv.Type(), Err: err })
+	}
+}
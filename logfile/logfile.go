@@ -0,0 +1,324 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+/*
+Package logfile implements an append-only log of msgpack records, which survives crashes.
+
+Each record is written as:
+    'R' | length (uint32, big-endian) | CRC-32C of the payload (uint32) | payload
+where the payload is the msgpack encoding of the record. 
+
+A Writer also writes a sync marker (a fixed 16-byte sequence starting with 'S') when it
+starts, and after every Options.SyncEvery records. A Reader which finds a corrupt record
+skips to the next sync marker, so damage in the middle of a log loses at most the records 
+up to that marker.
+
+A crash while appending leaves a torn (partial) final record. A Reader stops before it, 
+returning ErrTorn, and can continue from there if more data is appended; OpenFile truncates
+it before appending.
+*/
+package logfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/ugorji/go-msgpack"
+)
+
+const (
+	recordTag = 'R'
+	headerLen = 9
+	// MaxRecordSize is the size of the largest record payload. A longer length 
+	// in a record header is treated as corruption.
+	MaxRecordSize = 1 << 28
+	// DefaultSyncEvery is the default for Options.SyncEvery.
+	DefaultSyncEvery = 64
+)
+
+var syncMarker = []byte("S\xfe\xc1msgpack-sync\xc1")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrTorn is returned by Reader.Next when the input ends within a record.
+var ErrTorn = errors.New("logfile: torn record at end of input")
+
+// Options configures a Writer.
+type Options struct {
+	// SyncEvery is the number of records between sync markers (DefaultSyncEvery if <= 0).
+	SyncEvery int
+	// Encoder configures the encoding of records (may be nil).
+	Encoder *msgpack.EncoderOptions
+}
+
+// Writer appends records to a log.
+type Writer struct {
+	w io.Writer
+	o Options
+	buf bytes.Buffer
+	enc *msgpack.Encoder
+	n int // records since the last sync marker
+}
+
+// NewWriter returns a Writer which appends records to w, starting with a sync marker.
+// opts may be nil.
+func NewWriter(w io.Writer, opts *Options) (lw *Writer, err error) {
+	lw = &Writer{w: w}
+	if opts != nil {
+		lw.o = *opts
+	}
+	if lw.o.SyncEvery <= 0 {
+		lw.o.SyncEvery = DefaultSyncEvery
+	}
+	lw.enc = msgpack.NewEncoderEx(&lw.buf, lw.o.Encoder)
+	if _, err = w.Write(syncMarker); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// OpenFile opens (or creates) the log file name for appending, first truncating
+// any torn record a crash left at its end.
+func OpenFile(name string, opts *Options) (lw *Writer, f *os.File, err error) {
+	if f, err = os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0666); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			f = nil
+		}
+	}()
+	n, err := ValidSize(f)
+	if err != nil {
+		return
+	}
+	if err = f.Truncate(n); err != nil {
+		return
+	}
+	if _, err = f.Seek(n, io.SeekStart); err != nil {
+		return
+	}
+	lw, err = NewWriter(f, opts)
+	return
+}
+
+// Append encodes v and appends it as a record. 
+// The record is written with a single call to Write on the underlying writer.
+func (lw *Writer) Append(v interface{}) (err error) {
+	lw.buf.Reset()
+	lw.buf.Write(make([]byte, headerLen))
+	if err = lw.enc.Encode(v); err != nil {
+		return
+	}
+	bs := lw.buf.Bytes()
+	payload := bs[headerLen:]
+	if len(payload) > MaxRecordSize {
+		return errors.New("logfile: record too large")
+	}
+	bs[0] = recordTag
+	binary.BigEndian.PutUint32(bs[1:5], uint32(len(payload)))
+	binary.BigEndian.PutUint32(bs[5:9], crc32.Checksum(payload, crcTable))
+	if lw.n++; lw.n >= lw.o.SyncEvery {
+		lw.buf.Write(syncMarker)
+		lw.n = 0
+		bs = lw.buf.Bytes()
+	}
+	_, err = lw.w.Write(bs)
+	return
+}
+
+// Sync writes a sync marker, and flushes the underlying writer to stable storage
+// if it has a Sync method (as *os.File does).
+func (lw *Writer) Sync() (err error) {
+	if _, err = lw.w.Write(syncMarker); err != nil {
+		return
+	}
+	lw.n = 0
+	if s, ok := lw.w.(interface{ Sync() error }); ok {
+		err = s.Sync()
+	}
+	return
+}
+
+// Reader reads the records of a log.
+type Reader struct {
+	r io.Reader
+	dam msgpack.DecoderContainerResolver
+	buf []byte // bytes read, from offset off
+	off int64
+	skipped int64
+}
+
+// NewReader returns a Reader of the log in r. dam is used to decode records (as for msgpack.NewDecoder).
+func NewReader(r io.Reader, dam msgpack.DecoderContainerResolver) *Reader {
+	return &Reader{r: r, dam: dam}
+}
+
+// Offset returns the offset (in the input) just after the last record read.
+func (r *Reader) Offset() int64 { return r.off }
+
+// Skipped returns the number of bytes skipped over because they were corrupt.
+func (r *Reader) Skipped() int64 { return r.skipped }
+
+// Next decodes the next record into v. 
+// It returns io.EOF at the end of the input, or ErrTorn if the input ends within a record.
+// In both cases, Next can be called again if more data may be appended to the input.
+func (r *Reader) Next(v interface{}) (err error) {
+	bs, err := r.NextRaw()
+	if err != nil {
+		return
+	}
+	return msgpack.Unmarshal(bs, v, r.dam)
+}
+
+// NextRaw returns the payload (the encoding) of the next record. See Next.
+func (r *Reader) NextRaw() (payload msgpack.Raw, err error) {
+	for {
+		if err = r.fill(1); err != nil {
+			return
+		}
+		switch r.buf[0] {
+		case recordTag:
+			if err = r.fill(headerLen); err != nil {
+				return
+			}
+			l := binary.BigEndian.Uint32(r.buf[1:5])
+			if l > MaxRecordSize {
+				r.resync()
+				continue
+			}
+			if err = r.fill(headerLen + int(l)); err == ErrTorn && bytes.Contains(r.buf[1:], syncMarker) {
+				// not the final record: its length is corrupt.
+				r.resync()
+				continue
+			} else if err != nil {
+				return
+			}
+			p := r.buf[headerLen:headerLen+int(l)]
+			if crc32.Checksum(p, crcTable) != binary.BigEndian.Uint32(r.buf[5:9]) || !msgpack.Valid(p) {
+				r.resync()
+				continue
+			}
+			payload = append(msgpack.Raw(nil), p...)
+			r.consume(headerLen + int(l))
+			return
+		case syncMarker[0]:
+			if err = r.fill(len(syncMarker)); err != nil {
+				return
+			}
+			if bytes.Equal(r.buf[:len(syncMarker)], syncMarker) {
+				r.consume(len(syncMarker))
+				continue
+			}
+		}
+		r.resync()
+	}
+}
+
+// fill reads until at least n bytes are buffered, returning io.EOF if there is no more input 
+// and none are buffered, or ErrTorn if some are.
+func (r *Reader) fill(n int) (err error) {
+	for len(r.buf) < n {
+		if cap(r.buf) < n {
+			buf := make([]byte, len(r.buf), n + 4096)
+			copy(buf, r.buf)
+			r.buf = buf
+		}
+		var k int
+		k, err = r.r.Read(r.buf[len(r.buf):cap(r.buf)])
+		r.buf = r.buf[:len(r.buf)+k]
+		if k == 0 && err == nil {
+			err = io.ErrNoProgress
+		}
+		if err == io.EOF {
+			if len(r.buf) >= n {
+				return nil
+			}
+			if len(r.buf) > 0 {
+				err = ErrTorn
+			}
+			return
+		} else if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (r *Reader) consume(n int) {
+	r.buf = r.buf[:copy(r.buf, r.buf[n:])]
+	r.off += int64(n)
+}
+
+// resync skips the corrupt data at the start of the buffer, up to the next sync marker.
+func (r *Reader) resync() {
+	for {
+		if i := bytes.Index(r.buf[1:], syncMarker); i >= 0 {
+			r.skipped += int64(i + 1)
+			r.consume(i + 1)
+			return
+		}
+		// keep the bytes which may start a marker, and read more.
+		k := len(r.buf) - len(syncMarker) + 1
+		if k > 1 {
+			r.skipped += int64(k)
+			r.consume(k)
+		}
+		if r.fill(len(r.buf) + 1) != nil {
+			// the rest of the input is corrupt: drop it.
+			r.skipped += int64(len(r.buf))
+			r.consume(len(r.buf))
+			return
+		}
+	}
+}
+
+// ValidSize returns the size of the log in r up to the end of its last complete record
+// (or sync marker), excluding any torn record at its end.
+func ValidSize(r io.Reader) (n int64, err error) {
+	lr := NewReader(r, nil)
+	for {
+		if _, err = lr.NextRaw(); err != nil {
+			break
+		}
+	}
+	if err == io.EOF || err == ErrTorn {
+		err = nil
+	}
+	return lr.off, err
+}
+
@@ -0,0 +1,169 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package logfile
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type rec struct {
+	N int
+	S string
+}
+
+func writeLog(t *testing.T, w io.Writer, from, to int, opts *Options) {
+	lw, err := NewWriter(w, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := from; i < to; i++ {
+		if err = lw.Append(rec{i, "some record"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readLog reads all records, returning their numbers, and the final error.
+func readLog(r *Reader) (ns []int, err error) {
+	for {
+		var v rec
+		if err = r.Next(&v); err != nil {
+			return
+		}
+		ns = append(ns, v.N)
+	}
+}
+
+func checkNs(t *testing.T, ns []int, exp ...int) {
+	if len(ns) != len(exp) {
+		t.Fatalf("expected records %v, got %v", exp, ns)
+	}
+	for i := range ns {
+		if ns[i] != exp[i] {
+			t.Fatalf("expected records %v, got %v", exp, ns)
+		}
+	}
+}
+
+func seq(from, to int, except ...int) (ns []int) {
+	for i := from; i < to; i++ {
+		if len(except) > 0 && i >= except[0] && i < except[1] {
+			continue
+		}
+		ns = append(ns, i)
+	}
+	return
+}
+
+func TestReadWrite(t *testing.T) {
+	var buf bytes.Buffer
+	writeLog(t, &buf, 0, 10, &Options{SyncEvery: 4})
+	ns, err := readLog(NewReader(bytes.NewReader(buf.Bytes()), nil))
+	if err != io.EOF {
+		t.Fatal(err)
+	}
+	checkNs(t, ns, seq(0, 10)...)
+}
+
+func TestCorruption(t *testing.T) {
+	var buf bytes.Buffer
+	writeLog(t, &buf, 0, 12, &Options{SyncEvery: 4})
+	bs := buf.Bytes()
+	recLen := (len(bs) - 4 * len(syncMarker)) / 12
+	// corrupt the payload of record 5, then the length of record 9: 
+	// each is skipped, with the records up to the next marker.
+	bs[len(syncMarker) + 4*recLen + len(syncMarker) + recLen + headerLen + 2] ^= 0xff
+	bs[len(syncMarker) + 8*recLen + 2*len(syncMarker) + recLen + 1] = 0x7f
+	r := NewReader(bytes.NewReader(bs), nil)
+	ns, err := readLog(r)
+	if err != io.EOF {
+		t.Fatal(err)
+	}
+	checkNs(t, ns, 0, 1, 2, 3, 4, 8)
+	if r.Skipped() == 0 {
+		t.Fatal("expected skipped bytes")
+	}
+}
+
+func TestTornRecord(t *testing.T) {
+	var buf bytes.Buffer
+	writeLog(t, &buf, 0, 3, nil)
+	full := buf.Len()
+	writeLog(t, &buf, 3, 4, nil)
+	bs := buf.Bytes()
+	
+	// the reader stops before the torn record, and resumes when it is completed.
+	var live bytes.Buffer
+	live.Write(bs[:len(bs)-3])
+	r := NewReader(&live, nil)
+	ns, err := readLog(r)
+	if err != ErrTorn {
+		t.Fatalf("expected ErrTorn, got: %v", err)
+	}
+	checkNs(t, ns, 0, 1, 2)
+	live.Write(bs[len(bs)-3:])
+	ns, err = readLog(r)
+	if err != io.EOF {
+		t.Fatal(err)
+	}
+	checkNs(t, ns, 3)
+	
+	// OpenFile truncates the torn record before appending.
+	name := filepath.Join(t.TempDir(), "log")
+	if err = os.WriteFile(name, bs[:len(bs)-3], 0666); err != nil {
+		t.Fatal(err)
+	}
+	lw, f, err := OpenFile(name, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the valid part ends with the second writer's marker; the third writer adds another.
+	if fi, _ := f.Stat(); fi.Size() != int64(full + 2*len(syncMarker)) {
+		t.Fatalf("expected size %d after recovery, got %d", full + 2*len(syncMarker), fi.Size())
+	}
+	if err = lw.Append(rec{4, "x"}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	f, _ = os.Open(name)
+	defer f.Close()
+	ns, err = readLog(NewReader(f, nil))
+	if err != io.EOF {
+		t.Fatal(err)
+	}
+	checkNs(t, ns, 0, 1, 2, 4)
+}
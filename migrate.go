@@ -0,0 +1,183 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// SchemaVersionKey is the map key under which a versioned struct's schema version is encoded.
+// 
+// A struct type is versioned by a version=N option on its _struct field (see Encoder.Encode), e.g.
+//   type User struct {
+//       _struct bool `msgpack:",version=2"`
+//       ...
+//   }
+// Encoded structs without the key (e.g. from before the type was versioned) are version 1.
+const SchemaVersionKey = "_version"
+
+// MigrationFunc migrates an encoded struct from one schema version to the next,
+// by transforming the map it was decoded into (e.g. renaming or re-typing keys) in place.
+// 
+// Values in it are as decoded into a nil interface{} with the DefaultDecoderContainerResolver:
+// e.g. strings as strings, and nested maps as map[interface{}]interface{}.
+type MigrationFunc func(m map[string]interface{}) error
+
+// Migrations holds the MigrationFuncs of versioned struct types, so older encodings of them 
+// can be decoded. Pass it to Decoders via DecoderOptions.Migrations.
+// 
+// When a registered type is decoded, its map is first decoded as a map[string]interface{}. 
+// If its version is older than the type's, the MigrationFuncs from that version up are applied 
+// to it in turn, and the result is decoded into the struct. Encodings of a newer version fail to decode.
+// 
+// It is safe for concurrent use, and migrations may be added at any time.
+type Migrations struct {
+	mu sync.RWMutex
+	m map[reflect.Type]map[int]MigrationFunc
+}
+
+// NewMigrations returns an empty Migrations.
+func NewMigrations() *Migrations {
+	return &Migrations{ m: make(map[reflect.Type]map[int]MigrationFunc) }
+}
+
+// Add registers fn to migrate encodings of the struct type of value (or the type it points to) 
+// from version from to version from+1. It fails if from is not below the type's version.
+func (r *Migrations) Add(value interface{}, from int, fn MigrationFunc) (err error) {
+	rt := reflect.TypeOf(value)
+	for rt != nil && rt.Kind() == reflect.Ptr {
+		rt = rt.Elem()
+	}
+	switch {
+	case rt == nil || rt.Kind() != reflect.Struct || fn == nil:
+		return fmt.Errorf("Migrations.Add: a struct type and a function are required")
+	case from < 1 || from >= getStructFieldInfos(rt).version:
+		return fmt.Errorf("Migrations.Add: type %v has version %d: cannot migrate from %d", 
+			rt, getStructFieldInfos(rt).version, from)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.m[rt] == nil {
+		r.m[rt] = make(map[int]MigrationFunc)
+	}
+	r.m[rt][from] = fn
+	return
+}
+
+func (r *Migrations) has(rt reflect.Type) (ok bool) {
+	r.mu.RLock()
+	_, ok = r.m[rt]
+	r.mu.RUnlock()
+	return
+}
+
+func (r *Migrations) get(rt reflect.Type, from int) (fn MigrationFunc) {
+	r.mu.RLock()
+	fn = r.m[rt][from]
+	r.mu.RUnlock()
+	return
+}
+
+// parseSchemaVersion returns the version=N option of the tag of a _struct field (or 0 if none).
+func parseSchemaVersion(stag string) (version int) {
+	for _, s := range strings.Split(stag, ",")[1:] {
+		if strings.HasPrefix(s, "version=") {
+			var err error
+			if version, err = strconv.Atoi(s[len("version="):]); err != nil || version < 1 {
+				panic(fmt.Errorf("msgpack: invalid schema version in struct tag: %q", stag))
+			}
+		}
+	}
+	return
+}
+
+// encodeSchemaVersion writes the key and value of the version of a versioned struct.
+func (e *Encoder) encodeSchemaVersion(sis *structFieldInfos) {
+	e.encString(SchemaVersionKey)
+	e.encInt(int64(sis.version))
+}
+
+// decodeMigrated decodes the map (with descriptor bd) of an encoding of a versioned struct into rv,
+// migrating it to the version of rv's type first if it is older.
+func (d *Decoder) decodeMigrated(bd byte, rv reflect.Value) {
+	rt := rv.Type()
+	bs := d.raw(bd)
+	m := make(map[string]interface{})
+	if err := Unmarshal(bs, &m, nil); err != nil {
+		d.err("Decoding %v for migration: %v", rt, err)
+	}
+	version := 1
+	if v, ok := m[SchemaVersionKey]; ok {
+		rvv := reflect.ValueOf(v)
+		switch rvv.Kind() {
+		case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			version = int(rvv.Int())
+		case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			version = int(rvv.Uint())
+		default:
+			d.err("Invalid %s of %v: %v", SchemaVersionKey, rt, v)
+		}
+	}
+	current := getStructFieldInfos(rt).version
+	if current < 1 {
+		current = 1
+	}
+	if version > current {
+		d.err("Cannot decode version %d of %v into version %d", version, rt, current)
+	}
+	if version < current {
+		for ; version < current; version++ {
+			fn := d.o.Migrations.get(rt, version)
+			if fn == nil {
+				d.err("No migration of %v from version %d", rt, version)
+			}
+			if err := fn(m); err != nil {
+				d.err("Migrating %v from version %d: %v", rt, version, err)
+			}
+		}
+		delete(m, SchemaVersionKey)
+		var err error
+		if bs, err = Marshal(m); err != nil {
+			d.err("Encoding migrated %v: %v", rt, err)
+		}
+	}
+	// decode the (migrated) map with a decoder sharing this one's state.
+	d2 := newDecoder(&bytesDecReader{b: bs}, d.dam)
+	d2.o, d2.interned, d2.refs = d.o, d.interned, d.refs
+	d2.readb(1, d2.t1)
+	d2.decodeStruct(d2.t1[0], -1, rv)
+}
@@ -52,13 +52,38 @@ import (
 	"testing"
 	"net/rpc"
 	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
 	"time"
 	"os"
 	"os/exec"
 	"io/ioutil"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"net"
+	"net/url"
+	"unsafe"
+	"errors"
+	"context"
+	"sync/atomic"
+	"sync"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"runtime"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"sort"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
 )
 
 var (
@@ -469,6 +494,4824 @@ func TestDecodeStructSubset(t *testing.T) {
 	}
 }
 
+func TestDecoderInputOffset(t *testing.T) {
+	b0, err := Marshal("first")
+	checkErrT(t, err)
+	b1, err := Marshal([]int{1, 2, 3})
+	checkErrT(t, err)
+	trailer := []byte("not-msgpack")
+	buf := bytes.NewBuffer(nil)
+	buf.Write(b0)
+	buf.Write(b1)
+	buf.Write(trailer)
+	
+	dec := NewDecoder(buf, nil)
+	var s string
+	checkErrT(t, dec.Decode(&s))
+	checkEqualT(t, dec.InputOffset(), int64(len(b0)))
+	var l []int
+	checkErrT(t, dec.Decode(&l))
+	checkEqualT(t, dec.InputOffset(), int64(len(b0) + len(b1)))
+	
+	//whatever follows the value must still be readable by someone else
+	rest, err := ioutil.ReadAll(io.MultiReader(dec.Buffered(), buf))
+	checkErrT(t, err)
+	checkEqualT(t, rest, trailer)
+}
+
+func TestDecoderNoOverRead(t *testing.T) {
+	b0, err := Marshal(map[string]int{"a": 1})
+	checkErrT(t, err)
+	trailer := []byte{0xff, 0xfe}
+	
+	// decoding from bytes: the rest of the slice is left in Buffered
+	dec := NewDecoderBytes(append(b0, trailer...), nil)
+	var m map[string]int
+	checkErrT(t, dec.Decode(&m))
+	rest, err := ioutil.ReadAll(dec.Buffered())
+	checkErrT(t, err)
+	checkEqualT(t, rest, trailer)
+	
+	// a byte of look-ahead is kept by the decoder, and handed back via Buffered
+	r := &ioDecReader{r: bytes.NewReader(trailer)}
+	b, err := r.readn1()
+	checkErrT(t, err)
+	checkEqualT(t, b, trailer[0])
+	r.unreadn1()
+	checkEqualT(t, r.numread(), int64(0))
+	checkEqualT(t, r.buffered(), trailer[:1])
+	bs := make([]byte, 2)
+	_, err = r.readFull(bs)
+	checkErrT(t, err)
+	checkEqualT(t, bs, trailer)
+	checkEqualT(t, len(r.buffered()), 0)
+}
+
+func TestDecoderMore(t *testing.T) {
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf)
+	for i := 0; i < 5; i++ {
+		checkErrT(t, enc.Encode(map[string]int{"i": i}))
+	}
+	bs := buf.Bytes()
+	
+	dec := NewDecoder(bytes.NewReader(bs), nil)
+	n := 0
+	for dec.More() {
+		var m map[string]int
+		checkErrT(t, dec.Decode(&m))
+		checkEqualT(t, m["i"], n)
+		n++
+	}
+	checkEqualT(t, n, 5)
+	
+	var ms []map[string]int
+	checkErrT(t, NewDecoderBytes(bs, nil).DecodeAll(&ms))
+	checkEqualT(t, len(ms), 5)
+	checkEqualT(t, ms[4]["i"], 4)
+	
+	//a truncated final record is an error, but the leading records are kept
+	ms = nil
+	if err := NewDecoderBytes(bs[:len(bs)-1], nil).DecodeAll(&ms); err == nil {
+		logT(t, "------- Expecting error decoding truncated stream")
+		t.FailNow()
+	}
+	checkEqualT(t, len(ms), 4)
+}
+
+func TestDecoderSkip(t *testing.T) {
+	ts := newTestStruc(1, false)
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf)
+	checkErrT(t, enc.Encode(&ts))
+	checkErrT(t, enc.Encode(table))
+	checkErrT(t, enc.Encode("last"))
+	bs := buf.Bytes()
+	
+	for _, dec := range []*Decoder{NewDecoderBytes(bs, nil), NewDecoder(bytes.NewReader(bs), nil)} {
+		checkErrT(t, dec.Skip())
+		checkErrT(t, dec.Skip())
+		var s string
+		checkErrT(t, dec.Decode(&s))
+		checkEqualT(t, s, "last")
+		checkEqualT(t, dec.InputOffset(), int64(len(bs)))
+	}
+	if err := NewDecoderBytes(bs[:len(bs)/2], nil).Skip(); err == nil {
+		logT(t, "------- Expecting error skipping truncated value")
+		t.FailNow()
+	}
+}
+
+func TestDecodeRaw(t *testing.T) {
+	type envelope struct {
+		Kind string
+		Payload Raw
+		Missing Raw
+	}
+	ts := newTestStruc(0, false)
+	bs, err := Marshal(map[string]interface{}{"Kind": "TestStruc", "Payload": &ts, "Missing": nil})
+	checkErrT(t, err)
+	
+	for _, dec := range []*Decoder{NewDecoderBytes(bs, nil), NewDecoder(bytes.NewReader(bs), nil)} {
+		var env envelope
+		checkErrT(t, dec.Decode(&env))
+		checkEqualT(t, env.Kind, "TestStruc")
+		checkEqualT(t, env.Missing, Raw(nil))
+		var ts2 TestStruc
+		checkErrT(t, Unmarshal(env.Payload, &ts2, nil))
+		checkEqualT(t, ts2.Islice, ts.Islice)
+		
+		//re-encoding emits the raw bytes as-is
+		bs2, err := Marshal(&env)
+		checkErrT(t, err)
+		var env2 envelope
+		checkErrT(t, Unmarshal(bs2, &env2, nil))
+		checkEqualT(t, env2.Payload, env.Payload)
+	}
+	
+	pbs, err := Marshal(&ts)
+	checkErrT(t, err)
+	dec := NewDecoder(bytes.NewReader(append(pbs, 0xc3)), nil)
+	raw, err := dec.DecodeRaw()
+	checkErrT(t, err)
+	checkEqualT(t, raw, pbs)
+	raw, err = dec.DecodeRaw()
+	checkErrT(t, err)
+	checkEqualT(t, raw, []byte{0xc3})
+}
+
+func TestDecoderTokens(t *testing.T) {
+	v := map[string]interface{}{
+		"list": []interface{}{int64(-6464646464), uint64(6464646464), 3.5, nil, false},
+		"skipme": newTestStruc(0, false),
+	}
+	bs, err := Marshal(v)
+	checkErrT(t, err)
+	
+	dec := NewDecoderBytes(bs, nil)
+	vt, err := dec.NextType()
+	checkErrT(t, err)
+	checkEqualT(t, vt, MapType)
+	n, err := dec.ReadMapHeader()
+	checkErrT(t, err)
+	checkEqualT(t, n, 2)
+	for i := 0; i < n; i++ {
+		k, err := dec.ReadString()
+		checkErrT(t, err)
+		if k == "skipme" {
+			checkErrT(t, dec.Skip())
+			continue
+		}
+		checkEqualT(t, k, "list")
+		if _, err = dec.ReadMapHeader(); err == nil {
+			logT(t, "------- Expecting error reading array as a map header")
+			t.FailNow()
+		}
+		dec.r.(*bytesDecReader).c-- // step back over the descriptor consumed by the failed read
+		l, err := dec.ReadArrayHeader()
+		checkErrT(t, err)
+		checkEqualT(t, l, 5)
+		i64, err := dec.ReadInt64()
+		checkErrT(t, err)
+		checkEqualT(t, i64, int64(-6464646464))
+		u64, err := dec.ReadUint64()
+		checkErrT(t, err)
+		checkEqualT(t, u64, uint64(6464646464))
+		f64, err := dec.ReadFloat64()
+		checkErrT(t, err)
+		checkEqualT(t, f64, 3.5)
+		vt, err = dec.NextType()
+		checkErrT(t, err)
+		checkEqualT(t, vt, NilType)
+		checkErrT(t, dec.ReadNil())
+		b, err := dec.ReadBool()
+		checkErrT(t, err)
+		checkEqualT(t, b, false)
+	}
+	checkEqualT(t, dec.More(), false)
+}
+
+func TestEncoderWritePrimitives(t *testing.T) {
+	v := []interface{}{
+		nil, true, int64(-6464646464), uint64(6464646464), float32(-3232.0), 6464646464.0, 
+		"someday", []byte("bytes"), []interface{}{int8(1)}, map[string]bool{"true": true},
+	}
+	vbs, err := Marshal(v)
+	checkErrT(t, err)
+	
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf)
+	checkErrT(t, enc.WriteArrayHeader(len(v)))
+	checkErrT(t, enc.WriteNil())
+	checkErrT(t, enc.WriteBool(true))
+	checkErrT(t, enc.WriteInt64(-6464646464))
+	checkErrT(t, enc.WriteUint64(6464646464))
+	checkErrT(t, enc.WriteFloat32(-3232.0))
+	checkErrT(t, enc.WriteFloat64(6464646464.0))
+	checkErrT(t, enc.WriteString("someday"))
+	checkErrT(t, enc.WriteBytes([]byte("bytes")))
+	checkErrT(t, enc.WriteArrayHeader(1))
+	checkErrT(t, enc.WriteInt64(1))
+	checkErrT(t, enc.WriteMapHeader(1))
+	checkErrT(t, enc.WriteString("true"))
+	checkErrT(t, enc.WriteBool(true))
+	checkEqualT(t, buf.Bytes(), vbs)
+}
+
+func TestEncoderDeferredContainers(t *testing.T) {
+	strs := make([]string, 20) //more than fits in a fixarray
+	for i := range strs {
+		strs[i] = strconv.Itoa(i)
+	}
+	v := map[string]interface{}{"strs": strs}
+	vbs, err := Marshal(v)
+	checkErrT(t, err)
+	
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf)
+	checkErrT(t, enc.BeginMap())
+	checkErrT(t, enc.WriteString("strs"))
+	checkErrT(t, enc.BeginArray())
+	for _, s := range strs {
+		checkErrT(t, enc.Encode(s))
+	}
+	checkErrT(t, enc.EndArray())
+	checkErrT(t, enc.EndMap())
+	checkEqualT(t, buf.Bytes(), vbs)
+	
+	if err = enc.EndArray(); err == nil {
+		logT(t, "------- Expecting error for EndArray without BeginArray")
+		t.FailNow()
+	}
+	
+	// values of every kind (including those with nested values, or ext data encoded separately) 
+	// count as one element each.
+	type typed struct{ A int }
+	types := NewTypeRegistry()
+	checkErrT(t, types.Register("typed", typed{}))
+	shared := &typed{ 7 }
+	elems := []interface{}{ 
+		nil, true, -300, uint64(1 << 40), 1.5, float32(2.5), math.NaN(), "s", strings.Repeat("x", 40), []byte{ 1, 2 },
+		[]interface{}{ 1, []int{ 2, 3 }, map[string]int{ "a": 1 } }, map[string]interface{}{ "m": []string{ "x" } },
+		Raw{ 0x92, 0x01, 0x02 }, []*typed{ shared, shared }, typed{ 1 }, NewArray(NewInt(1), NewStr("v")),
+		[3]byte{ 1, 2, 3 }, time.Unix(1, 2),
+	}
+	opts := &EncoderOptions{ SharedRefs: true, Types: types, UseBinType: true, NonFinite: NonFiniteAsNil }
+	whole := new(bytes.Buffer)
+	checkErrT(t, NewEncoderEx(whole, opts).Encode(elems))
+	buf.Reset()
+	enc = NewEncoderEx(buf, opts)
+	checkErrT(t, enc.BeginArray())
+	for i := range elems {
+		checkErrT(t, enc.Encode(&elems[i])) // held in an interface{}, as in elems
+	}
+	checkErrT(t, enc.EndArray())
+	checkEqualT(t, buf.Bytes(), whole.Bytes())
+	
+	// nested deferred containers, and containers started with the Write methods.
+	buf.Reset()
+	enc = NewEncoder(buf)
+	checkErrT(t, enc.BeginMap())
+	checkErrT(t, enc.WriteString("a"))
+	checkErrT(t, enc.WriteArrayHeader(2))
+	checkErrT(t, enc.BeginArray())
+	checkErrT(t, enc.WriteInt64(1))
+	checkErrT(t, enc.EndArray())
+	checkErrT(t, enc.WriteMapHeader(1))
+	checkErrT(t, enc.WriteString("b"))
+	checkErrT(t, enc.WriteExt(5, []byte{ 9 }))
+	checkErrT(t, enc.WriteString("c"))
+	checkErrT(t, enc.WriteNil())
+	checkErrT(t, enc.EndMap())
+	checkErrT(t, CheckValid(buf.Bytes()))
+	checkEqualT(t, buf.Bytes()[0], byte(0x82))
+	
+	// ending a container holding an incomplete value is an error.
+	checkErrT(t, enc.BeginArray())
+	checkErrT(t, enc.WriteArrayHeader(2))
+	checkErrT(t, enc.WriteNil())
+	if err = enc.EndArray(); err == nil || !strings.Contains(err.Error(), "incomplete") {
+		logT(t, "Expecting an error ending an array with an incomplete value, got: %v", err)
+		t.FailNow()
+	}
+}
+
+func TestDecoderPeekType(t *testing.T) {
+	// values in the newer spec formats: str8, bin8, fixext1, ext8
+	bs := []byte{
+		0xd9, 0x03, 'a', 'b', 'c', 
+		0xc4, 0x02, 0x01, 0x02, 
+		0xd4, 0x05, 0x01, 
+		0xc7, 0x02, 0x05, 0xaa, 0xbb,
+		0xd1, 0x01, 0x02,
+	}
+	dec := NewDecoderBytes(bs, nil)
+	checkType := func(vt ValueType, rk reflect.Kind) {
+		vt2, err := dec.PeekType()
+		checkErrT(t, err)
+		checkEqualT(t, vt2, vt)
+		rk2, err := dec.NextValueKind()
+		checkErrT(t, err)
+		checkEqualT(t, rk2, rk)
+	}
+	checkType(StrType, reflect.String)
+	var s string
+	checkErrT(t, dec.Decode(&s))
+	checkEqualT(t, s, "abc")
+	checkType(BinType, reflect.Slice)
+	var b []byte
+	checkErrT(t, dec.Decode(&b))
+	checkEqualT(t, b, []byte{1, 2})
+	checkType(ExtType, reflect.Invalid)
+	checkErrT(t, dec.Skip())
+	checkType(ExtType, reflect.Invalid)
+	checkErrT(t, dec.Skip())
+	checkType(IntType, reflect.Int16)
+	var v interface{}
+	checkErrT(t, dec.Decode(&v))
+	checkEqualT(t, v, int16(0x0102))
+}
+
+func TestStructFieldInfosCache(t *testing.T) {
+	// a struct with more fields than we search linearly
+	type wide struct {
+		F0, F1, F2, F3, F4, F5, F6, F7, F8, F9 int
+		F10, F11, F12, F13, F14, F15, F16, F17 int
+		S string `msgpack:"s,omitempty"`
+	}
+	rt := reflect.TypeOf(wide{})
+	sis := getStructFieldInfos(rt)
+	if sis != getStructFieldInfos(rt) {
+		logT(t, "------- Expecting cached structFieldInfos to be re-used")
+		t.FailNow()
+	}
+	checkEqualT(t, sis.anyOmitEmpty, true)
+	checkEqualT(t, sis.getForEncName("s").name, "S")
+	checkEqualT(t, sis.getForEncName("F17").name, "F17")
+	if sis.getForEncName("S") != nil {
+		logT(t, "------- Expecting no field for encode name: S")
+		t.FailNow()
+	}
+	
+	w := wide{F3: 3, F17: 17, S: "s"}
+	bs, err := Marshal(w)
+	checkErrT(t, err)
+	var w2 wide
+	checkErrT(t, Unmarshal(bs, &w2, nil))
+	checkEqualT(t, w2, w)
+}
+
+func TestFastPathTypes(t *testing.T) {
+	type fast struct {
+		Ms map[string]string
+		Mi map[string]interface{}
+		Li []interface{}
+		Ls []string
+		L64 []int64
+		Lf []float64
+		Lb []byte
+	}
+	v := fast{
+		Ms: map[string]string{"a": "A", "b": ""},
+		Mi: map[string]interface{}{"a": "A", "i": int8(1)},
+		Li: []interface{}{"one", int8(2), nil},
+		Ls: []string{"one", "", "three"},
+		L64: []int64{-6464646464, 0, 6464646464},
+		Lf: []float64{-0.5, 6464646464.0},
+		Lb: []byte("bytes"),
+	}
+	bs, err := Marshal(v)
+	checkErrT(t, err)
+	var v2 fast
+	checkErrT(t, Unmarshal(bs, &v2, nil))
+	checkEqualT(t, v2, v)
+	
+	//the fast paths must encode the same bytes as the reflection-based ones.
+	type mystrings []string
+	bs, err = Marshal(v.Ls)
+	checkErrT(t, err)
+	bs2, err := Marshal(mystrings(v.Ls))
+	checkErrT(t, err)
+	checkEqualT(t, bs, bs2)
+}
+
+func TestDecodeZeroCopy(t *testing.T) {
+	type zc struct {
+		S string
+		B []byte
+		R Raw
+	}
+	bs, err := Marshal(zc{"some string", []byte("some bytes"), Raw{0xc3}})
+	checkErrT(t, err)
+	input := append([]byte(nil), bs...)
+	
+	var v zc
+	checkErrT(t, Unmarshal(input, &v, &DecoderOptions{ZeroCopy: true}))
+	checkEqualT(t, v.S, "some string")
+	checkEqualT(t, v.B, []byte("some bytes"))
+	checkEqualT(t, v.R, Raw{0xc3})
+	
+	// everything decoded aliases the input
+	i := bytes.Index(input, []byte("some string"))
+	checkEqualT(t, unsafe.StringData(v.S), &input[i])
+	v.B[0] = 'S'
+	checkEqualT(t, bytes.Contains(input, []byte("Some bytes")), true)
+	
+	//without the option (or from a reader), we copy.
+	var v2 zc
+	checkErrT(t, Unmarshal(bs, &v2, &DecoderOptions{}))
+	v2.B[0] = 'S'
+	checkEqualT(t, bytes.Contains(bs, []byte("some bytes")), true)
+}
+
+func TestEncodeEmptyRaw(t *testing.T) {
+	// an empty Raw (or a nil one, encoded as empty) still takes up a value: msgpack nil.
+	type env struct {
+		A int
+		P Raw
+		B int
+	}
+	for _, o := range []*EncoderOptions{ nil, { NilSliceAsEmpty: true } } {
+		for _, p := range []Raw{ nil, {} } {
+			buf := new(bytes.Buffer)
+			checkErrT(t, NewEncoderEx(buf, o).Encode(env{ 1, p, 2 }))
+			bs := buf.Bytes()
+			checkErrT(t, CheckValid(bs))
+			var v env
+			checkErrT(t, Unmarshal(bs, &v, nil))
+			checkEqualT(t, v.A + v.B, 3)
+			checkEqualT(t, len(v.P), 0)
+		}
+	}
+}
+
+func TestDecoderNilOptions(t *testing.T) {
+	// a typed-nil *DecoderOptions behaves as the defaults.
+	var o *DecoderOptions
+	bs, err := Marshal([]float64{ 1, 2 })
+	checkErrT(t, err)
+	var v interface{}
+	checkErrT(t, NewDecoder(bytes.NewReader(bs), o).Decode(&v))
+	checkEqualT(t, v, []interface{}{ 1.0, 2.0 })
+	v = nil
+	checkErrT(t, Unmarshal(bs, &v, o))
+	checkEqualT(t, v, []interface{}{ 1.0, 2.0 })
+}
+
+func TestDecodeInternMapKeys(t *testing.T) {
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf)
+	checkErrT(t, enc.Encode(map[string]string{"key1": "a", "key2": "b"}))
+	checkErrT(t, enc.Encode(map[string]string{"key1": "c", "key2": "d"}))
+	
+	dec := NewDecoder(buf, &DecoderOptions{InternMapKeys: 1})
+	var m1, m2 map[string]string
+	checkErrT(t, dec.Decode(&m1))
+	checkErrT(t, dec.Decode(&m2))
+	checkEqualT(t, m2, map[string]string{"key1": "c", "key2": "d"})
+	keyData := func(m map[string]string, k string) *byte {
+		for k2 := range m {
+			if k2 == k {
+				return unsafe.StringData(k2)
+			}
+		}
+		return nil
+	}
+	// only 1 key fits in the intern table
+	var interned, notInterned string = "key1", "key2"
+	if _, ok := dec.interned["key1"]; !ok {
+		interned, notInterned = notInterned, interned
+	}
+	checkEqualT(t, keyData(m1, interned) == keyData(m2, interned), true)
+	checkEqualT(t, keyData(m1, notInterned) == keyData(m2, notInterned), false)
+}
+
+func TestMarshalPooled(t *testing.T) {
+	small := map[string]int{"a": 1}
+	large := make([]string, 8 << 10)
+	for i := range large {
+		large[i] = "value"
+	}
+	bsSmall, err := Marshal(small)
+	checkErrT(t, err)
+	bsLarge, err := Marshal(large)
+	checkErrT(t, err)
+	
+	done := make(chan bool)
+	for i := 0; i < 8; i++ {
+		go func(i int) {
+			defer func() { done <- true }()
+			for j := 0; j < 50; j++ {
+				v, expect := interface{}(small), bsSmall
+				if (i + j) % 3 == 0 {
+					v, expect = large, bsLarge
+				}
+				bs, err := Marshal(v)
+				if err != nil || !bytes.Equal(bs, expect) {
+					logT(t, "------- Pooled Marshal mismatch. Err: %v", err)
+					t.Fail()
+					return
+				}
+			}
+		}(i)
+	}
+	for i := 0; i < 8; i++ {
+		<-done
+	}
+	// a failed Marshal must not leave state behind for the next one.
+	if _, err = Marshal(make(chan int)); err == nil {
+		logT(t, "------- Expecting error marshalling a chan")
+		t.FailNow()
+	}
+	bs, err := Marshal(small)
+	checkErrT(t, err)
+	checkEqualT(t, bs, bsSmall)
+	
+	// buffers come from the size class of the last message: 
+	// large after a large one, and small (never a pooled large one) after a small one.
+	_, err = Marshal(large)
+	checkErrT(t, err)
+	ms := getMarshalState()
+	if ms.buf.Cap() < len(bsLarge) {
+		logT(t, "------- Expecting a buffer for %v bytes after a large Marshal, got cap: %v", len(bsLarge), ms.buf.Cap())
+		t.FailNow()
+	}
+	putMarshalState(ms)
+	_, err = Marshal(small)
+	checkErrT(t, err)
+	ms = getMarshalState()
+	if ms.buf.Cap() >= marshalSizeClasses[1] {
+		logT(t, "------- Expecting a small buffer after a small Marshal, got cap: %v", ms.buf.Cap())
+		t.FailNow()
+	}
+	putMarshalState(ms)
+}
+
+func TestEncodedSize(t *testing.T) {
+	for i, v := range table {
+		bs, err := Marshal(v)
+		checkErrT(t, err)
+		n, err := EncodedSize(v)
+		checkErrT(t, err)
+		if n != len(bs) {
+			logT(t, "------- EncodedSize mismatch for #%d: %d, expecting: %d", i, n, len(bs))
+			t.FailNow()
+		}
+	}
+	if _, err := EncodedSize(make(chan int)); err == nil {
+		logT(t, "------- Expecting error for EncodedSize of a chan")
+		t.FailNow()
+	}
+}
+
+func TestDecodeReuseContainers(t *testing.T) {
+	type reuse struct {
+		L []int
+		B []byte
+		M map[string][]int
+		I []interface{}
+	}
+	bs, err := Marshal(reuse{
+		L: []int{1, 2},
+		B: []byte("ab"),
+		M: map[string][]int{"k": []int{3}},
+		I: []interface{}{"x", int8(5)},
+	})
+	checkErrT(t, err)
+	
+	ml := make([]int, 3, 10)
+	v := reuse{
+		L: []int{9, 9, 9, 9},
+		B: make([]byte, 5, 10),
+		M: map[string][]int{"k": ml},
+		I: []interface{}{"y", int8(1)},
+	}
+	l0, b0 := &v.L[0], &v.B[0]
+	checkErrT(t, Unmarshal(bs, &v, nil))
+	checkEqualT(t, v.L, []int{1, 2})
+	checkEqualT(t, v.B, []byte("ab"))
+	checkEqualT(t, v.M["k"], []int{3})
+	checkEqualT(t, v.I, []interface{}{"x", int8(5)})
+	// storage was re-used
+	checkEqualT(t, &v.L[0] == l0, true)
+	checkEqualT(t, &v.B[0] == b0, true)
+	checkEqualT(t, &v.M["k"][0] == &ml[0], true)
+	
+	//extending into existing capacity does not leak stale elements
+	type el struct {
+		A, B int
+	}
+	bs, err = Marshal([]map[string]int{{"A": 1}})
+	checkErrT(t, err)
+	els := []el{{7, 7}}
+	els = els[:0]
+	checkErrT(t, Unmarshal(bs, &els, nil))
+	checkEqualT(t, els, []el{{1, 0}})
+}
+
+func TestDecodeMergeOrReplace(t *testing.T) {
+	type inner struct {
+		X, Y int
+	}
+	type outer struct {
+		S string
+		N int
+		In inner
+		M map[string]int
+	}
+	bs, err := Marshal(map[string]interface{}{
+		"S": "", 
+		"In": map[string]int{"X": 1},
+		"M": map[string]int{"a": 1},
+	})
+	checkErrT(t, err)
+	existing := func() outer {
+		return outer{S: "s", N: 5, In: inner{9, 9}, M: map[string]int{"a": 9, "b": 9}}
+	}
+	
+	// merge (default)
+	v := existing()
+	checkErrT(t, Unmarshal(bs, &v, nil))
+	checkEqualT(t, v, outer{S: "", N: 5, In: inner{1, 9}, M: map[string]int{"a": 1, "b": 9}})
+	
+	// replace
+	v = existing()
+	m := v.M
+	checkErrT(t, Unmarshal(bs, &v, &DecoderOptions{ReplaceExisting: true}))
+	checkEqualT(t, v, outer{In: inner{X: 1}, M: map[string]int{"a": 1}})
+	checkEqualT(t, len(m), 1) //same map was re-used
+}
+
+func TestEncodeNilOptions(t *testing.T) {
+	type nils struct {
+		L []int
+		B []byte
+		M map[string]int
+		P *int64
+		S *TestStruc
+		I interface{}
+	}
+	encode := func(opts *EncoderOptions) []byte {
+		buf := new(bytes.Buffer)
+		checkErrT(t, NewEncoderEx(buf, opts).Encode(nils{}))
+		return buf.Bytes()
+	}
+	var v nils
+	checkErrT(t, Unmarshal(encode(nil), &v, nil))
+	checkEqualT(t, v, nils{})
+	
+	opts := &EncoderOptions{NilSliceAsEmpty: true, NilMapAsEmpty: true, NilPointerAsZero: true}
+	var m map[string]interface{}
+	checkErrT(t, Unmarshal(encode(opts), &m, testDecOpts(mapStringIntfTyp, nil, true, true, false)))
+	checkEqualT(t, m["L"], []interface{}{})
+	checkEqualT(t, m["B"], []byte{})
+	checkEqualT(t, m["M"], map[string]interface{}{})
+	checkEqualT(t, m["P"], int8(0))
+	checkEqualT(t, len(m["S"].(map[string]interface{})), len(getStructFieldInfos(reflect.TypeOf(TestStruc{})).sis))
+	checkEqualT(t, m["I"], nil)
+}
+
+func TestEncodeCycle(t *testing.T) {
+	type node struct {
+		V int
+		Next *node
+	}
+	n := &node{V: 1}
+	n.Next = &node{V: 2, Next: n}
+	_, err := Marshal(n)
+	if err == nil || !strings.Contains(err.Error(), "cycle") {
+		logT(t, "Expecting cycle error, got: %v", err)
+		t.FailNow()
+	}
+	
+	m := map[string]interface{}{}
+	m["self"] = m
+	if _, err = Marshal(m); err == nil {
+		logT(t, "Expecting cycle error for self-referencing map")
+		t.FailNow()
+	}
+	
+	// a long (acyclic) list, and the same pointer shared by siblings, are fine.
+	var head *node
+	for i := 0; i < 2*encCycleCheckDepth; i++ {
+		head = &node{V: i, Next: head}
+	}
+	_, err = Marshal(head)
+	checkErrT(t, err)
+	shared := &node{V: 7}
+	_, err = Marshal([]*node{shared, shared})
+	checkErrT(t, err)
+	
+	// the Encoder is usable after an error.
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf)
+	if err = enc.Encode(n); err == nil {
+		logT(t, "Expecting cycle error")
+		t.FailNow()
+	}
+	buf.Reset()
+	checkErrT(t, enc.Encode(shared))
+	var v node
+	checkErrT(t, Unmarshal(buf.Bytes(), &v, nil))
+	checkEqualT(t, v, node{V: 7})
+}
+
+func TestEncodeSharedRefs(t *testing.T) {
+	type node struct {
+		Name string
+		Kids []*node
+		Up *node
+	}
+	leaf := &node{Name: "leaf"}
+	root := &node{Name: "root"}
+	for i := 0; i < 3; i++ {
+		root.Kids = append(root.Kids, &node{Name: "kid", Kids: []*node{leaf}, Up: root})
+	}
+	
+	buf := new(bytes.Buffer)
+	checkErrT(t, NewEncoderEx(buf, &EncoderOptions{SharedRefs: true}).Encode(root))
+	var v *node
+	checkErrT(t, Unmarshal(buf.Bytes(), &v, nil))
+	checkEqualT(t, len(v.Kids), 3)
+	for _, k := range v.Kids {
+		if k.Up != v || k.Kids[0] != v.Kids[0].Kids[0] {
+			logT(t, "Expecting shared pointers to be restored")
+			t.FailNow()
+		}
+	}
+	checkEqualT(t, v.Kids[0].Kids[0].Name, "leaf")
+	
+	// the leaf is only encoded in full once.
+	x := []*node{leaf, leaf, leaf, leaf}
+	full, err := Marshal(x)
+	checkErrT(t, err)
+	buf.Reset()
+	checkErrT(t, NewEncoderEx(buf, &EncoderOptions{SharedRefs: true}).Encode(x))
+	if buf.Len() >= len(full) {
+		logT(t, "Expecting shared encoding (%d bytes) to be smaller than %d bytes", buf.Len(), len(full))
+		t.FailNow()
+	}
+	var x2 []*node
+	checkErrT(t, Unmarshal(buf.Bytes(), &x2, nil))
+	checkEqualT(t, x2[0] == x2[3], true)
+	
+	// into interface{}: values are decoded, and references resolve to them.
+	var xi []interface{}
+	checkErrT(t, Unmarshal(buf.Bytes(), &xi, testDecOpts(mapStringIntfTyp, nil, true, true, true)))
+	checkEqualT(t, xi[3].(map[string]interface{})["Name"], "leaf")
+	
+	// a map or slice holding itself is a cycle error, as without SharedRefs.
+	self := map[string]interface{}{}
+	self["self"] = self
+	list := []interface{}{ nil }
+	list[0] = list
+	for _, x := range []interface{}{ self, list } {
+		if err = NewEncoderEx(io.Discard, &EncoderOptions{SharedRefs: true}).Encode(x); err == nil || 
+			!strings.Contains(err.Error(), "cycle") {
+			logT(t, "Expecting a cycle error encoding %T holding itself, got: %v", x, err)
+			t.FailNow()
+		}
+	}
+	// a map shared (not cyclic) is walked once, and encoded in full each time.
+	shm := map[string]*node{ "leaf": leaf }
+	buf.Reset()
+	checkErrT(t, NewEncoderEx(buf, &EncoderOptions{SharedRefs: true}).Encode([]interface{}{ shm, shm, leaf }))
+	xi = nil
+	checkErrT(t, Unmarshal(buf.Bytes(), &xi, testDecOpts(mapStringIntfTyp, nil, true, true, true)))
+	checkEqualT(t, len(xi), 3)
+	for _, x := range xi[:2] {
+		checkEqualT(t, x.(map[string]interface{})["leaf"].(map[string]interface{})["Name"], "leaf")
+	}
+	
+	// cycles need typed pointer targets: into interface{}, they are an error.
+	buf.Reset()
+	checkErrT(t, NewEncoderEx(buf, &EncoderOptions{SharedRefs: true}).Encode(root))
+	var vi interface{}
+	if err = Unmarshal(buf.Bytes(), &vi, nil); err == nil || !strings.Contains(err.Error(), "typed pointer") {
+		logT(t, "Expecting an error decoding a cyclic value into interface{}, got: %v", err)
+		t.FailNow()
+	}
+	
+	// without shared pointers, the output is unchanged.
+	buf.Reset()
+	checkErrT(t, NewEncoderEx(buf, &EncoderOptions{SharedRefs: true}).Encode(&node{Name: "x"}))
+	full, _ = Marshal(&node{Name: "x"})
+	checkEqualT(t, buf.Bytes(), full)
+}
+
+func TestNonFinitePolicy(t *testing.T) {
+	v := []interface{}{math.NaN(), math.Inf(1), float32(math.Inf(-1)), 1.5}
+	encode := func(p NonFinitePolicy) ([]byte, error) {
+		buf := new(bytes.Buffer)
+		err := NewEncoderEx(buf, &EncoderOptions{NonFinite: p}).Encode(v)
+		return buf.Bytes(), err
+	}
+	bs, err := encode(NonFinitePassThrough)
+	checkErrT(t, err)
+	if _, err = encode(NonFiniteError); err == nil {
+		logT(t, "Expecting error encoding NaN with NonFiniteError")
+		t.FailNow()
+	}
+	bsNil, err := encode(NonFiniteAsNil)
+	checkErrT(t, err)
+	var v2 []interface{}
+	checkErrT(t, Unmarshal(bsNil, &v2, nil))
+	checkEqualT(t, v2, []interface{}{nil, nil, nil, 1.5})
+	
+	// decoding
+	var fs []float64
+	checkErrT(t, Unmarshal(bs, &fs, nil))
+	checkEqualT(t, math.IsNaN(fs[0]) && math.IsInf(fs[1], 1) && math.IsInf(fs[2], -1), true)
+	checkErrT(t, Unmarshal(bs, &fs, &DecoderOptions{NonFinite: NonFiniteAsNil}))
+	checkEqualT(t, fs, []float64{0, 0, 0, 1.5})
+	if err = Unmarshal(bs, &fs, &DecoderOptions{NonFinite: NonFiniteError}); err == nil {
+		logT(t, "Expecting error decoding NaN with NonFiniteError")
+		t.FailNow()
+	}
+	v2 = nil
+	checkErrT(t, Unmarshal(bs, &v2, &DecoderOptions{NonFinite: NonFiniteAsNil}))
+	checkEqualT(t, v2, []interface{}{nil, nil, nil, 1.5})
+	var st struct { F float32 }
+	stbs, _ := Marshal(map[string]interface{}{"F": float32(math.Inf(1))})
+	st.F = 2
+	checkErrT(t, Unmarshal(stbs, &st, &DecoderOptions{NonFinite: NonFiniteAsNil}))
+	checkEqualT(t, st.F, float32(0))
+}
+
+func TestComplex(t *testing.T) {
+	type cs struct {
+		C128 complex128
+		C64 complex64
+		P *complex128
+	}
+	c := complex(1.5, -2)
+	v := cs{C128: c, C64: complex64(c), P: &c}
+	bs, err := Marshal(v)
+	checkErrT(t, err)
+	var v2 cs
+	checkErrT(t, Unmarshal(bs, &v2, nil))
+	checkEqualT(t, v2, v)
+	var m map[string]interface{}
+	checkErrT(t, Unmarshal(bs, &m, testDecOpts(mapStringIntfTyp, nil, true, true, true)))
+	checkEqualT(t, m["C128"], []interface{}{1.5, -2.0})
+	
+	// as ext
+	x := NewExtRegistry()
+	checkErrT(t, x.AddComplex(5))
+	if err = x.AddComplex(6); err == nil {
+		logT(t, "Expecting error re-registering complex types")
+		t.FailNow()
+	}
+	buf := new(bytes.Buffer)
+	checkErrT(t, NewEncoderEx(buf, &EncoderOptions{Exts: x}).Encode(v))
+	if err = Unmarshal(buf.Bytes(), &v2, nil); err == nil {
+		logT(t, "Expecting error decoding unregistered ext type")
+		t.FailNow()
+	}
+	v2 = cs{}
+	checkErrT(t, Unmarshal(buf.Bytes(), &v2, &DecoderOptions{Exts: x}))
+	checkEqualT(t, v2, v)
+	m = nil
+	checkErrT(t, Unmarshal(buf.Bytes(), &m, &DecoderOptions{Exts: x}))
+	checkEqualT(t, m["C64"], complex(1.5, -2))
+	
+	bs, err = Marshal([]complex128{c})
+	checkErrT(t, err)
+	checkEqualT(t, len(bs), 1 + 1 + 9 + 9)
+	buf.Reset()
+	checkErrT(t, NewEncoderEx(buf, &EncoderOptions{Exts: x}).Encode([]complex128{c}))
+	checkEqualT(t, buf.Len(), 1 + 2 + 16)
+}
+
+func TestBigNumbers(t *testing.T) {
+	type bigs struct {
+		I big.Int
+		PI *big.Int
+		F *big.Float
+	}
+	i, _ := new(big.Int).SetString("-123456789012345678901234567890", 10)
+	f, _ := new(big.Float).SetPrec(200).SetString("3.14159265358979323846264338327950288419716939937510")
+	v := bigs{PI: i, F: f}
+	v.I.SetUint64(math.MaxUint64)
+	v.I.Lsh(&v.I, 10)
+	
+	check := func(v2 bigs, exact bool) {
+		if v2.I.Cmp(&v.I) != 0 || v2.PI.Cmp(v.PI) != 0 || v2.F.Cmp(v.F) != 0 {
+			logT(t, "big numbers do not match: %v, %v, %v", &v2.I, v2.PI, v2.F)
+			t.FailNow()
+		}
+		if exact {
+			checkEqualT(t, v2.F.Prec(), v.F.Prec())
+		}
+	}
+	bs, err := Marshal(&v)
+	checkErrT(t, err)
+	var m map[string]interface{}
+	checkErrT(t, Unmarshal(bs, &m, testDecOpts(mapStringIntfTyp, nil, true, true, true)))
+	checkEqualT(t, m["PI"], "-123456789012345678901234567890")
+	var v2 bigs
+	checkErrT(t, Unmarshal(bs, &v2, nil))
+	checkEqualT(t, v2.F.Text('g', -1), f.Text('g', -1))
+	v2.F = f
+	check(v2, false)
+	v2 = bigs{F: new(big.Float).SetPrec(f.Prec())}
+	checkErrT(t, Unmarshal(bs, &v2, nil))
+	check(v2, true)
+	
+	x := NewExtRegistry()
+	checkErrT(t, x.AddBig(10, 11))
+	buf := new(bytes.Buffer)
+	checkErrT(t, NewEncoderEx(buf, &EncoderOptions{Exts: x}).Encode(v))
+	v2 = bigs{}
+	checkErrT(t, Unmarshal(buf.Bytes(), &v2, &DecoderOptions{Exts: x}))
+	check(v2, true)
+	
+	// numbers decode into big values too.
+	bs, _ = Marshal([]interface{}{-5, uint64(math.MaxUint64), 2.5})
+	var ns []*big.Float
+	checkErrT(t, Unmarshal(bs, &ns, nil))
+	checkEqualT(t, ns[0].String() + " " + ns[1].Text('f', 0) + " " + ns[2].String(), "-5 18446744073709551615 2.5")
+	var is []big.Int
+	if err = Unmarshal(bs, &is, nil); err == nil {
+		logT(t, "Expecting error decoding a float into big.Int")
+		t.FailNow()
+	}
+}
+
+func TestDuration(t *testing.T) {
+	type ds struct {
+		D time.Duration
+		P *time.Duration
+	}
+	dur := 90*time.Minute + 1500*time.Millisecond
+	v := ds{D: dur, P: &dur}
+	encode := func(opts *EncoderOptions) []byte {
+		buf := new(bytes.Buffer)
+		checkErrT(t, NewEncoderEx(buf, opts).Encode(v))
+		return buf.Bytes()
+	}
+	var m map[string]interface{}
+	var v2 ds
+	
+	bs := encode(nil)
+	checkErrT(t, Unmarshal(bs, &m, nil))
+	checkEqualT(t, m["D"], int64(dur))
+	checkErrT(t, Unmarshal(bs, &v2, nil))
+	checkEqualT(t, v2, v)
+	
+	bs = encode(&EncoderOptions{DurationUnit: time.Millisecond})
+	m = nil
+	checkErrT(t, Unmarshal(bs, &m, nil))
+	checkEqualT(t, m["D"], int32(dur / time.Millisecond))
+	v2 = ds{}
+	checkErrT(t, Unmarshal(bs, &v2, &DecoderOptions{DurationUnit: time.Millisecond}))
+	checkEqualT(t, v2, v)
+	
+	bs = encode(&EncoderOptions{DurationAsString: true})
+	m = nil
+	checkErrT(t, Unmarshal(bs, &m, testDecOpts(nil, nil, true, true, true)))
+	checkEqualT(t, m["D"], "1h30m1.5s")
+	v2 = ds{}
+	checkErrT(t, Unmarshal(bs, &v2, nil))
+	checkEqualT(t, v2, v)
+	
+	bs, _ = Marshal(int64(math.MaxInt64 / 2))
+	if err := Unmarshal(bs, &v2.D, &DecoderOptions{DurationUnit: time.Second}); err == nil {
+		logT(t, "Expecting overflow error")
+		t.FailNow()
+	}
+}
+
+func TestNetTypes(t *testing.T) {
+	type nets struct {
+		IP4, IP6 net.IP
+		Net *net.IPNet
+		URL url.URL
+		PURL *url.URL
+	}
+	_, n, _ := net.ParseCIDR("10.1.0.0/16")
+	u, _ := url.Parse("https://user@example.com:8443/a/b?q=1#frag")
+	v := nets{IP4: net.ParseIP("10.1.2.3"), IP6: net.ParseIP("2001:db8::1"), Net: n, URL: *u, PURL: u}
+	bs, err := Marshal(v)
+	checkErrT(t, err)
+	var m map[string]interface{}
+	checkErrT(t, Unmarshal(bs, &m, testDecOpts(nil, nil, false, false, false)))
+	checkEqualT(t, m["IP4"], []byte{10, 1, 2, 3})
+	checkEqualT(t, len(m["IP6"].([]byte)), 16)
+	checkEqualT(t, string(m["Net"].([]byte)), "10.1.0.0/16")
+	checkEqualT(t, string(m["URL"].([]byte)), u.String())
+	
+	var v2 nets
+	checkErrT(t, Unmarshal(bs, &v2, nil))
+	checkEqualT(t, v2.IP4.Equal(v.IP4) && v2.IP6.Equal(v.IP6), true)
+	checkEqualT(t, v2.Net, v.Net)
+	checkEqualT(t, v2.URL, v.URL)
+	checkEqualT(t, v2.PURL, v.PURL)
+	
+	// an IP whose binary form is also a valid text form (here "1::1") keeps its binary meaning.
+	bs, err = Marshal(net.IP{ 49, 58, 58, 49 })
+	checkErrT(t, err)
+	var ipb net.IP
+	checkErrT(t, Unmarshal(bs, &ipb, nil))
+	checkEqualT(t, ipb, net.IP{ 49, 58, 58, 49 })
+	
+	// the text form of an IP is accepted too.
+	bs, _ = Marshal("192.168.0.1")
+	var ip net.IP
+	checkErrT(t, Unmarshal(bs, &ip, nil))
+	checkEqualT(t, ip, net.IP{192, 168, 0, 1})
+	bs, _ = Marshal("not an ip")
+	if err = Unmarshal(bs, &ip, nil); err == nil {
+		logT(t, "Expecting error decoding invalid net.IP")
+		t.FailNow()
+	}
+}
+
+type testTextKey [2]byte
+
+func (k testTextKey) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("%02x%02x", k[0], k[1])), nil
+}
+
+func (k *testTextKey) UnmarshalText(bs []byte) error {
+	_, err := fmt.Sscanf(string(bs), "%02x%02x", &k[0], &k[1])
+	return err
+}
+
+func TestTextMarshalerMapKeys(t *testing.T) {
+	v := map[testTextKey]int{{1, 2}: 12, {0xab, 0xcd}: 34}
+	bs, err := Marshal(v)
+	checkErrT(t, err)
+	var m map[string]int
+	checkErrT(t, Unmarshal(bs, &m, nil))
+	checkEqualT(t, m, map[string]int{"0102": 12, "abcd": 34})
+	var v2 map[testTextKey]int
+	checkErrT(t, Unmarshal(bs, &v2, nil))
+	checkEqualT(t, v2, v)
+	
+	// pointer keys (encoded as text, as *testTextKey has MarshalText) decode into new keys.
+	bs, err = Marshal(map[*testTextKey]int{{1, 2}: 12})
+	checkErrT(t, err)
+	var vp map[*testTextKey]int
+	checkErrT(t, Unmarshal(bs, &vp, nil))
+	checkEqualT(t, len(vp), 1)
+	for k, n := range vp {
+		checkEqualT(t, *k, testTextKey{1, 2})
+		checkEqualT(t, n, 12)
+	}
+	
+	bs, _ = Marshal(map[string]int{"zz": 1})
+	if err = Unmarshal(bs, &v2, nil); err == nil {
+		logT(t, "Expecting UnmarshalText error")
+		t.FailNow()
+	}
+}
+
+func TestFixedArrays(t *testing.T) {
+	type arrs struct {
+		H [32]byte
+		K [4]int16
+	}
+	v := arrs{K: [4]int16{1, -2, 3}}
+	for i := range v.H {
+		v.H[i] = byte(i * 7)
+	}
+	bs, err := Marshal(v)
+	checkErrT(t, err)
+	var m map[string]interface{}
+	checkErrT(t, Unmarshal(bs, &m, testDecOpts(nil, nil, false, false, false)))
+	checkEqualT(t, m["H"], v.H[:])
+	v2 := arrs{K: [4]int16{9, 9, 9, 9}}
+	checkErrT(t, Unmarshal(bs, &v2, nil))
+	checkEqualT(t, v2, v)
+	
+	// unaddressable arrays (in a map or interface{}) encode the same way.
+	bs2, err := Marshal(map[string]interface{}{"H": v.H})
+	checkErrT(t, err)
+	m = nil
+	checkErrT(t, Unmarshal(bs2, &m, testDecOpts(nil, nil, false, false, false)))
+	checkEqualT(t, m["H"], v.H[:])
+	
+	// byte arrays must get exactly their length; others at most their length.
+	var h [32]byte
+	bs, _ = Marshal(v.H[:31])
+	if err = Unmarshal(bs, &h, nil); err == nil {
+		logT(t, "Expecting error decoding 31 bytes into [32]byte")
+		t.FailNow()
+	}
+	var k [2]int16
+	bs, _ = Marshal(v.K)
+	if err = Unmarshal(bs, &k, nil); err == nil {
+		logT(t, "Expecting error decoding 4 elements into [2]int16")
+		t.FailNow()
+	}
+	k2 := [4]int16{5, 5, 5, 5}
+	bs, _ = Marshal([]int16{})
+	checkErrT(t, Unmarshal(bs, &k2, nil))
+	checkEqualT(t, k2, [4]int16{})
+}
+
+func TestUnmarshalNew(t *testing.T) {
+	bs, _ := Marshal(int32(42))
+	var p *int32
+	if err := Unmarshal(bs, p, nil); err == nil {
+		logT(t, "Expecting error unmarshaling into a nil pointer")
+		t.FailNow()
+	}
+	x, err := UnmarshalNew(bs, p, nil)
+	checkErrT(t, err)
+	p = x.(*int32)
+	checkEqualT(t, *p, int32(42))
+	
+	// an existing pointer is decoded into
+	p2 := p
+	x, err = UnmarshalNew(bs, p, nil)
+	checkErrT(t, err)
+	checkEqualT(t, x.(*int32) == p2, true)
+	
+	// nested chains are allocated
+	bs, _ = Marshal([]string{"a", "b"})
+	var pp **[]string
+	x, err = UnmarshalNew(bs, pp, nil)
+	checkErrT(t, err)
+	pp = x.(**[]string)
+	checkEqualT(t, **pp, []string{"a", "b"})
+	
+	if _, err = UnmarshalNew(bs, []string(nil), nil); err == nil {
+		logT(t, "Expecting error for non-pointer")
+		t.FailNow()
+	}
+}
+
+func TestEncodeDecodeMulti(t *testing.T) {
+	buf := new(bytes.Buffer)
+	checkErrT(t, NewEncoder(buf).EncodeMulti(0, uint32(7), "add", []int{1, 2}))
+	var typ int
+	var msgid uint32
+	var method string
+	var params []int
+	dec := NewDecoder(buf, nil)
+	checkErrT(t, dec.DecodeMulti(&typ, &msgid, &method, &params))
+	checkEqualT(t, []interface{}{typ, msgid, method, params}, []interface{}{0, uint32(7), "add", []int{1, 2}})
+	if err := dec.DecodeMulti(&typ); err == nil {
+		logT(t, "Expecting error at end of stream")
+		t.FailNow()
+	}
+}
+
+func TestGenericHelpers(t *testing.T) {
+	type point struct { X, Y int }
+	bs, err := MarshalT(point{1, 2})
+	checkErrT(t, err)
+	p, err := UnmarshalT[point](bs)
+	checkErrT(t, err)
+	checkEqualT(t, p, point{1, 2})
+	pp, err := UnmarshalT[*point](bs)
+	checkErrT(t, err)
+	checkEqualT(t, *pp, point{1, 2})
+	if _, err = UnmarshalT[int](bs); err == nil {
+		logT(t, "Expecting error decoding a map into an int")
+		t.FailNow()
+	}
+	
+	buf := new(bytes.Buffer)
+	checkErrT(t, NewEncoder(buf).EncodeMulti("a", 3))
+	dec := NewDecoder(buf, nil)
+	s, err := DecodeT[string](dec)
+	checkErrT(t, err)
+	i, err := DecodeT[int](dec)
+	checkErrT(t, err)
+	checkEqualT(t, []interface{}{s, i}, []interface{}{"a", 3})
+}
+
+func TestGenerateStructs(t *testing.T) {
+	d1, _ := Marshal(map[string]interface{}{
+		"user_id": 7, "name": "ann", "score": 1, 
+		"tags": []string{"a"}, "addr": map[string]interface{}{"city": "x"},
+		"counts": map[int]string{1: "one"},
+	})
+	d2, _ := Marshal(map[string]interface{}{
+		"user_id": 8, "name": "bob", "score": 2.5, "nick": nil,
+		"tags": []string{}, "addr": map[string]interface{}{"city": "y", "zip": 123},
+		"counts": map[int]string{},
+	})
+	src, err := GenerateStructs("User", d1, d2)
+	checkErrT(t, err)
+	exp := "type User struct {\n" + 
+		"\tAddr   UserAddr         `msgpack:\"addr\"`\n" + 
+		"\tCounts map[int64]string `msgpack:\"counts\"`\n" + 
+		"\tName   string           `msgpack:\"name\"`\n" + 
+		"\tNick   interface{}      `msgpack:\"nick,omitempty\"`\n" + 
+		"\tScore  float64          `msgpack:\"score\"`\n" + 
+		"\tTags   []string         `msgpack:\"tags\"`\n" + 
+		"\tUserID int64            `msgpack:\"user_id\"`\n" + 
+		"}\n\n" + 
+		"type UserAddr struct {\n" + 
+		"\tCity string `msgpack:\"city\"`\n" + 
+		"\tZip  int64  `msgpack:\"zip,omitempty\"`\n" + 
+		"}\n"
+	if string(src) != exp {
+		logT(t, "Generated:\n%s\nExpecting:\n%s", src, exp)
+		t.FailNow()
+	}
+	
+	d3, _ := Marshal([]interface{}{1, "x"})
+	src, err = GenerateStructs("List", d3)
+	checkErrT(t, err)
+	checkEqualT(t, string(src), "type List []interface{}\n")
+	if _, err = GenerateStructs("X", []byte{0xc1}); err == nil {
+		logT(t, "Expecting error for invalid sample")
+		t.FailNow()
+	}
+}
+
+func TestJSONTranscode(t *testing.T) {
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf)
+	checkErrT(t, enc.Encode(map[string]interface{}{"a": []interface{}{1, -2, uint64(math.MaxUint64), 1.5, float32(0.25), true, nil}}))
+	checkErrT(t, enc.Encode("q\"\n\u2028\xff"))
+	checkErrT(t, enc.Encode(map[int]bool{7: true}))
+	buf.Write([]byte{0xc4, 2, 1, 2})                 // bin 8
+	checkErrT(t, enc.WriteExt(5, []byte{9, 9, 9, 9})) // fixext 4
+	
+	out := new(bytes.Buffer)
+	checkErrT(t, ToJSON(out, bytes.NewReader(buf.Bytes())))
+	exp := `{"a":[1,-2,18446744073709551615,1.5,0.25,true,null]}` + "\n" + 
+		`"q\"\n\u2028\ufffd"` + "\n" + 
+		`{"7":true}` + "\n" + 
+		`"AQI="` + "\n" + 
+		`{"$ext":5,"$data":"CQkJCQ=="}` + "\n"
+	checkEqualT(t, out.String(), exp)
+	
+	out.Reset()
+	opts := &JSONOptions{BinAsTagged: true}
+	checkErrT(t, opts.ToJSON(out, bytes.NewReader([]byte{0xc4, 2, 1, 2})))
+	checkEqualT(t, out.String(), `{"$bin":"AQI="}` + "\n")
+	
+	// and back
+	mp := new(bytes.Buffer)
+	js := `{"a":[1,-2,18446744073709551615,1.5,true,null],"b":{}} {"$bin":"AQI="} ` + 
+		`{"$ext":5,"$data":"CQkJCQ=="} {"$ext":5,"x":1} "s"`
+	checkErrT(t, FromJSON(mp, strings.NewReader(js)))
+	dec := NewDecoderBytes(mp.Bytes(), testDecOpts(mapStringIntfTyp, nil, true, true, true))
+	var v interface{}
+	checkErrT(t, dec.Decode(&v))
+	checkEqualT(t, v, map[string]interface{}{
+		"a": []interface{}{int8(1), int8(-2), uint64(math.MaxUint64), 1.5, true, nil}, 
+		"b": map[string]interface{}{},
+	})
+	var bs []byte
+	checkErrT(t, dec.Decode(&bs))
+	checkEqualT(t, bs, []byte{1, 2})
+	xtag, data, err := dec.ReadExt()
+	checkErrT(t, err)
+	checkEqualT(t, xtag, int8(5))
+	checkEqualT(t, data, []byte{9, 9, 9, 9})
+	v = nil
+	checkErrT(t, dec.Decode(&v))
+	checkEqualT(t, v, map[string]interface{}{"$ext": int8(5), "x": int8(1)})
+	
+	// a null second pair is kept.
+	for _, x := range []struct{ js string; v map[string]interface{} }{
+		{ `{"$ext":1,"x":null,"y":2}`, map[string]interface{}{ "$ext": int8(1), "x": nil, "y": int8(2) } },
+		{ `{"$ext":1,"$data":null}`, map[string]interface{}{ "$ext": int8(1), "$data": nil } },
+	} {
+		mp2 := new(bytes.Buffer)
+		checkErrT(t, FromJSON(mp2, strings.NewReader(x.js)))
+		v = nil
+		checkErrT(t, Unmarshal(mp2.Bytes(), &v, testDecOpts(mapStringIntfTyp, nil, true, true, true)))
+		checkEqualT(t, v, x.v)
+	}
+	
+	// round trip through JSON
+	out.Reset()
+	checkErrT(t, ToJSON(out, bytes.NewReader(mp.Bytes())))
+	checkEqualT(t, strings.Count(out.String(), "\n"), 5)
+	
+	if err = ToJSON(out, bytes.NewReader([]byte{0xcb, 0x7f, 0xf8, 0, 0, 0, 0, 0, 1})); err == nil {
+		logT(t, "Expecting error for NaN")
+		t.FailNow()
+	}
+	if err = FromJSON(out, strings.NewReader(`{"a":`)); err == nil {
+		logT(t, "Expecting error for truncated JSON")
+		t.FailNow()
+	}
+	
+	// nesting is limited as when decoding; up to the limit is fine.
+	for _, open := range []string{ "[", `{"a":` } {
+		out.Reset()
+		js := strings.Repeat(open, decMaxDepth + 1)
+		if err = FromJSON(out, strings.NewReader(js)); err == nil || !strings.Contains(err.Error(), "depth") {
+			logT(t, "Expecting max depth error for %v nested %s, got: %v", decMaxDepth + 1, open, err)
+			t.FailNow()
+		}
+	}
+	out.Reset()
+	js = strings.Repeat("[", decMaxDepth) + strings.Repeat("]", decMaxDepth)
+	checkErrT(t, FromJSON(out, strings.NewReader(js)))
+	checkErrT(t, CheckValid(out.Bytes()))
+}
+
+func TestDump(t *testing.T) {
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf)
+	checkErrT(t, enc.Encode(map[string]interface{}{"a": []interface{}{1616, -3.5, nil}}))
+	checkErrT(t, enc.WriteExt(5, []byte{9, 9}))
+	exp := "" + 
+		"000000   17  fixmap len=1\n" + 
+		"000001    2    fixstr len=1 \"a\" key\n" + 
+		"000003   14    fixarray len=3\n" + 
+		"000004    3      int16 1616\n" + 
+		"000007    9      float64 -3.5\n" + 
+		"000010    1      nil\n" + 
+		"000011    4  fixext2 type=5 len=2 0x0909\n"
+	checkEqualT(t, Dump(buf.Bytes()), exp)
+	
+	// a truncated value shows what was read, then the error.
+	s := Dump(buf.Bytes()[:8])
+	if !strings.HasPrefix(s, "000000    ?  fixmap len=1\n") || 
+		!strings.Contains(s, "000004    3      int16 1616\n") || !strings.Contains(s, "error: ") {
+		logT(t, "Unexpected dump of truncated input:\n%s", s)
+		t.FailNow()
+	}
+}
+
+func TestDiff(t *testing.T) {
+	a, err := Marshal(map[string]interface{}{
+		"id": 7, "name": "ann", "tags": []interface{}{"x", "y"}, "gone": true, "f": float32(1.5),
+	})
+	checkErrT(t, err)
+	// same document, with keys in another order and other integer/float encodings.
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf)
+	checkErrT(t, enc.WriteMapHeader(5))
+	for _, v := range []interface{}{"f", 1.5, "gone", true, "tags", []string{"x", "y"}, "name", "ann", "id", uint64(7)} {
+		checkErrT(t, enc.Encode(v))
+	}
+	changes, err := Diff(a, buf.Bytes())
+	checkErrT(t, err)
+	checkEqualT(t, len(changes), 0)
+
+	b, err := Marshal(map[string]interface{}{
+		"id": "7", "name": "bob", "tags": []interface{}{"x"}, "new key": 1, "f": float32(1.5),
+	})
+	checkErrT(t, err)
+	changes, err = Diff(a, b)
+	checkErrT(t, err)
+	got := make(map[string]bool)
+	for _, c := range changes {
+		got[c.String()] = true
+	}
+	checkEqualT(t, got, map[string]bool{
+		`$.id: type changed: 7 => "7"`: true,
+		`$.name: value changed: "ann" => "bob"`: true,
+		`$.tags[1]: removed: "y" => missing`: true,
+		`$.gone: removed: true => missing`: true,
+		`$["new key"]: added: missing => 1`: true,
+	})
+	
+	_, err = Diff(a, b[:len(b)-1])
+	if err == nil {
+		logT(t, "Expected error diffing truncated document")
+		t.FailNow()
+	}
+}
+
+func TestValid(t *testing.T) {
+	b, err := Marshal([]interface{}{map[string]interface{}{"a": 1}, "x", 2.5, nil, []byte{1, 2}})
+	checkErrT(t, err)
+	checkEqualT(t, Valid(b), true)
+	checkErrT(t, CheckValid(b))
+	
+	for i, v := range []struct {
+		b []byte
+		off int64
+	}{
+		{b[:len(b)-1], int64(len(b)-3)}, // truncated []byte (the last value)
+		{[]byte{}, 0},
+		{[]byte{0x92, 0x01, 0xc1}, 2},                  // reserved descriptor
+		{[]byte{0x01, 0x02}, 1},                        // trailing data
+		{[]byte{0xdd, 0xff, 0xff, 0xff, 0xff, 0xc0}, 0}, // array too long for the input
+		{[]byte{0x81, 0xa1, 'a'}, 3},                   // missing map value
+	} {
+		err := CheckValid(v.b)
+		serr, ok := err.(*SyntaxError)
+		if !ok || serr.Offset != v.off || Valid(v.b) {
+			logT(t, "%d: expected SyntaxError at offset %d, got: %v", i, v.off, err)
+			t.FailNow()
+		}
+	}
+}
+
+func TestGetPath(t *testing.T) {
+	doc := map[string]interface{}{
+		"users": []interface{}{
+			map[string]interface{}{"name": "ann", "age": 30},
+			map[string]interface{}{"name": "bob", "tags": map[int]string{-1: "neg", 7: "seven"}},
+		},
+		"n": 1,
+	}
+	b, err := Marshal(doc)
+	checkErrT(t, err)
+	for _, v := range []struct {
+		path []interface{}
+		exp interface{}
+	}{
+		{[]interface{}{"users", 1, "name"}, "bob"},
+		{[]interface{}{"users", uint8(0), []byte("age")}, 30},
+		{[]interface{}{"users", 1, "tags", -1}, "neg"},
+		{[]interface{}{"users", 1, "tags", uint64(7)}, "seven"},
+		{[]interface{}{"n"}, 1},
+		{nil, nil},
+	} {
+		raw, err := GetPath(b, v.path...)
+		checkErrT(t, err)
+		if v.path == nil {
+			checkEqualT(t, []byte(raw), b)
+			continue
+		}
+		var x interface{}
+		checkErrT(t, Unmarshal(raw, &x, testDecOpts(nil, nil, false, false, false)))
+		if s, ok := x.([]byte); ok {
+			x = string(s)
+		}
+		// compare integers by value, whatever their decoded width
+		checkEqualT(t, fmt.Sprint(x), fmt.Sprint(v.exp))
+	}
+	for _, path := range [][]interface{}{
+		{"nope"}, {"users", 2}, {"users", -1}, {"users", "0"}, {"n", "x"}, {"users", 0, "name", 0},
+	} {
+		if _, err = GetPath(b, path...); !errors.Is(err, ErrPathNotFound) {
+			logT(t, "path %v: expected ErrPathNotFound, got: %v", path, err)
+			t.FailNow()
+		}
+	}
+	if _, err = GetPath(b[:len(b)-1], "zzz"); err == nil || errors.Is(err, ErrPathNotFound) {
+		logT(t, "expected decoding error for truncated document, got: %v", err)
+		t.FailNow()
+	}
+}
+
+func TestSetDeletePath(t *testing.T) {
+	b, err := Marshal(map[string]interface{}{"a": []interface{}{1, 2}, "b": map[string]interface{}{"c": "x"}})
+	checkErrT(t, err)
+	enc := func(v interface{}) Raw {
+		bs, err := Marshal(v)
+		checkErrT(t, err)
+		return bs
+	}
+	dec := func(bs []byte) (v interface{}) {
+		checkErrT(t, CheckValid(bs))
+		checkErrT(t, Unmarshal(bs, &v, testDecOpts(nil, nil, true, true, true)))
+		return
+	}
+	b0 := append([]byte(nil), b...)
+	
+	b2, err := SetPath(b, enc("yy"), "b", "c")
+	checkErrT(t, err)
+	checkEqualT(t, fmt.Sprint(dec(b2)), "map[a:[1 2] b:map[c:yy]]")
+	checkEqualT(t, len(b2), len(b) + 1)
+	b2, err = SetPath(b2, enc(true), "b", "d")
+	checkErrT(t, err)
+	b2, err = SetPath(b2, enc(3), "a", 2)
+	checkErrT(t, err)
+	b2, err = SetPath(b2, enc(-1), "a", 0)
+	checkErrT(t, err)
+	checkEqualT(t, fmt.Sprint(dec(b2)), "map[a:[-1 2 3] b:map[c:yy d:true]]")
+	
+	b2, err = DeletePath(b2, "b", "c")
+	checkErrT(t, err)
+	b2, err = DeletePath(b2, "a", 1)
+	checkErrT(t, err)
+	checkEqualT(t, fmt.Sprint(dec(b2)), "map[a:[-1 3] b:map[d:true]]")
+	b2, err = DeletePath(b2, "a")
+	checkErrT(t, err)
+	checkEqualT(t, fmt.Sprint(dec(b2)), "map[b:map[d:true]]")
+	checkEqualT(t, b, b0) // not modified
+	
+	// growing a container past 15 elements changes its header.
+	b2 = enc([]int{})
+	for i := 0; i < 20; i++ {
+		b2, err = SetPath(b2, enc(i), i)
+		checkErrT(t, err)
+	}
+	checkEqualT(t, b2[0], byte(0xdc))
+	checkEqualT(t, fmt.Sprint(dec(b2)), fmt.Sprint([]int{0,1,2,3,4,5,6,7,8,9,10,11,12,13,14,15,16,17,18,19}))
+	
+	if _, err = SetPath(b, enc(1), "a", 3); !errors.Is(err, ErrPathNotFound) {
+		logT(t, "expected ErrPathNotFound, got: %v", err)
+		t.FailNow()
+	}
+	if _, err = SetPath(b, enc(1), "x", "y"); !errors.Is(err, ErrPathNotFound) {
+		logT(t, "expected ErrPathNotFound, got: %v", err)
+		t.FailNow()
+	}
+	if _, err = DeletePath(b, "a", 2); !errors.Is(err, ErrPathNotFound) {
+		logT(t, "expected ErrPathNotFound, got: %v", err)
+		t.FailNow()
+	}
+	if _, err = SetPath(b, Raw{0xc1}, "a"); err == nil {
+		logT(t, "expected error setting invalid value")
+		t.FailNow()
+	}
+}
+
+func TestValue(t *testing.T) {
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf)
+	checkErrT(t, enc.WriteMapHeader(3))
+	checkErrT(t, enc.EncodeMulti("users", []interface{}{map[string]interface{}{"name": "ann"}}, "f", float32(1.5), 7, []byte("seven")))
+	b := buf.Bytes()
+	
+	v, err := ParseValue(b)
+	checkErrT(t, err)
+	checkEqualT(t, v.Type(), MapType)
+	checkEqualT(t, v.Len(), 3)
+	name, ok := v.Path("users", 0, "name").Str()
+	checkEqualT(t, ok, true)
+	checkEqualT(t, name, "ann")
+	f, _ := v.Get("f").Float()
+	checkEqualT(t, f, 1.5)
+	checkEqualT(t, v.Get(uint8(7)).Type(), StrType)
+	checkEqualT(t, v.Path("users", 1) == nil && v.Get("nope") == nil && v.Path("f", 0) == nil, true)
+	
+	// an unmodified Value encodes as it was read (float32, map order, etc).
+	b2, err := v.Encode()
+	checkErrT(t, err)
+	checkEqualT(t, b2, b)
+	
+	checkErrT(t, v.Path("users", 0).Set("age", NewInt(30)))
+	checkErrT(t, v.Get("users").Append(NewStr("x"), NewBin([]byte{1}), NewExt(5, []byte{9})))
+	checkEqualT(t, v.Delete("f"), true)
+	checkEqualT(t, v.Delete("f"), false)
+	checkErrT(t, v.Set(7, NewNil()))
+	checkEqualT(t, v.Len(), 2)
+	if err = v.Get(7).Set("a", NewNil()); err == nil {
+		logT(t, "expected error setting a key of a non-map")
+		t.FailNow()
+	}
+	checkEqualT(t, v.String(), `{"users":[{"name":"ann","age":30},"x","AQ==",{"$ext":5,"$data":"CQ=="}],"7":null}`)
+	
+	// a Value works as a struct field, and through Decode/Encode.
+	type T struct {
+		ID int
+		Doc Value
+	}
+	b2, err = Marshal(T{1, v})
+	checkErrT(t, err)
+	var t2 T
+	checkErrT(t, Unmarshal(b2, &t2, nil))
+	checkEqualT(t, t2.Doc.String(), v.String())
+	checkEqualT(t, t2.Doc.Get("users").Index(2).Type(), BinType)
+	
+	m := t2.Doc.Interface().(map[interface{}]interface{})
+	x, ok := m[int64(7)]
+	checkEqualT(t, ok && x == nil, true)
+	checkEqualT(t, m["users"].([]interface{})[0], map[string]interface{}{"name": "ann", "age": int64(30)})
+	
+	v, err = ValueOf([]int{1, -2})
+	checkErrT(t, err)
+	checkEqualT(t, v.Interface(), []interface{}{int64(1), int64(-2)})
+}
+
+func TestDynamicMA(t *testing.T) {
+	b, err := Marshal(M{
+		"id": 7, "big": uint64(math.MaxUint64), "neg": -3, "name": "ann", "ok": true, "f": 2.5,
+		"user": M{"tags": A{"x", 1, M{"k": "v"}}},
+	})
+	checkErrT(t, err)
+	var m M
+	checkErrT(t, Unmarshal(b, &m, nil))
+	
+	id, ok := m.GetInt64("id")
+	checkEqualT(t, id == 7 && ok, true)
+	_, ok = m.GetInt64("big")
+	checkEqualT(t, ok, false)
+	ui, ok := m.GetUint64("big")
+	checkEqualT(t, ui == math.MaxUint64 && ok, true)
+	_, ok = m.GetUint64("neg")
+	checkEqualT(t, ok, false)
+	f, ok := m.GetFloat64("id")
+	checkEqualT(t, f == 7 && ok, true)
+	f, _ = m.GetFloat64("f")
+	checkEqualT(t, f, 2.5)
+	s, ok := m.GetString("name")
+	checkEqualT(t, s == "ann" && ok, true)
+	_, ok = m.GetString("id")
+	checkEqualT(t, ok, false)
+	bo, ok := m.GetBool("ok")
+	checkEqualT(t, bo && ok, true)
+	
+	tags := m.GetMap("user").GetArray("tags")
+	checkEqualT(t, tags.Len(), 3)
+	s, _ = tags.GetString(0)
+	checkEqualT(t, s, "x")
+	i, _ := tags.GetInt64(1)
+	checkEqualT(t, i, int64(1))
+	s, ok = tags.GetMap(2).GetString("k")
+	checkEqualT(t, s == "v" && ok, true)
+	
+	// missing and mistyped values are nil-safe.
+	_, ok = m.GetMap("nope").GetArray("x").GetMap(5).GetString("y")
+	checkEqualT(t, ok, false)
+	checkEqualT(t, m.GetMap("name") == nil && tags.GetArray(-1) == nil, true)
+}
+
+func TestForEachMapEntry(t *testing.T) {
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf)
+	checkErrT(t, enc.WriteMapHeader(3))
+	checkErrT(t, enc.EncodeMulti("a", []int{1, 2}, "b", "x", 7, nil))
+	checkErrT(t, enc.Encode("after"))
+	
+	for _, zeroCopy := range []bool{false, true} {
+		for _, d := range []*Decoder{
+			NewDecoderBytes(buf.Bytes(), &DecoderOptions{ZeroCopy: zeroCopy}),
+			NewDecoder(bytes.NewReader(buf.Bytes()), nil),
+		} {
+			var keys []string
+			var vals []interface{}
+			checkErrT(t, d.ForEachMapEntry(func(key []byte, val Raw) error {
+				keys = append(keys, fmt.Sprintf("%x", key))
+				var v interface{}
+				err := Unmarshal(val, &v, testDecOpts(nil, nil, true, true, true))
+				vals = append(vals, v)
+				return err
+			}))
+			checkEqualT(t, keys, []string{"61", "62", "07"})
+			checkEqualT(t, fmt.Sprint(vals), "[[1 2] x <nil>]")
+			var s string
+			checkErrT(t, d.Decode(&s))
+			checkEqualT(t, s, "after")
+		}
+	}
+	
+	// an error from fn stops the iteration.
+	errStop := errors.New("stop")
+	var n int
+	err := NewDecoderBytes(buf.Bytes(), nil).ForEachMapEntry(func(key []byte, val Raw) error {
+		n++
+		return errStop
+	})
+	checkEqualT(t, err == errStop && n == 1, true)
+	if err = NewDecoderBytes([]byte{0x91, 0x01}, nil).ForEachMapEntry(nil); err == nil {
+		logT(t, "expected error iterating over an array")
+		t.FailNow()
+	}
+}
+
+func TestLazyIndex(t *testing.T) {
+	type rec struct {
+		N int
+		Data []byte
+	}
+	recs := make([]interface{}, 500)
+	for i := range recs {
+		recs[i] = rec{i, bytes.Repeat([]byte{byte(i)}, i * 10 + 1)}
+	}
+	buf := new(bytes.Buffer)
+	buf.WriteString("prefix")
+	enc := NewEncoder(buf)
+	checkErrT(t, enc.WriteMapHeader(2))
+	checkErrT(t, enc.EncodeMulti("recs", recs, "n", len(recs)))
+	r := bytes.NewReader(buf.Bytes())
+	
+	x, err := NewLazyIndex(r, 6, nil)
+	checkErrT(t, err)
+	checkEqualT(t, x.Type(), MapType)
+	checkEqualT(t, x.Len(), 2)
+	checkEqualT(t, x.End(), int64(buf.Len()))
+	var k string
+	checkErrT(t, x.DecodeKey(1, &k))
+	checkEqualT(t, k, "n")
+	i, err := x.Find("recs")
+	checkErrT(t, err)
+	checkEqualT(t, i, 0)
+	i, err = x.Find("nope")
+	checkEqualT(t, i, -1)
+	
+	x2, err := x.Sub(0)
+	checkErrT(t, err)
+	checkEqualT(t, x2.Len(), len(recs))
+	for _, j := range []int{499, 0, 250} {
+		var v rec
+		checkErrT(t, x2.Decode(j, &v))
+		checkEqualT(t, v, recs[j])
+		raw, err := x2.Raw(j)
+		checkErrT(t, err)
+		b, _ := Marshal(recs[j])
+		checkEqualT(t, []byte(raw), b)
+	}
+	if err = x2.Decode(500, new(rec)); err == nil {
+		logT(t, "expected error decoding out-of-range element")
+		t.FailNow()
+	}
+	if _, err = x.Sub(1); err == nil {
+		logT(t, "expected error indexing a non-container")
+		t.FailNow()
+	}
+	// a truncated document (even within skipped data) is an error.
+	bs := buf.Bytes()
+	if _, err = NewLazyIndex(bytes.NewReader(bs[:len(bs)-300]), 6, nil); err == nil {
+		logT(t, "expected error indexing truncated document")
+		t.FailNow()
+	}
+}
+
+func TestChecksumFrames(t *testing.T) {
+	buf := new(bytes.Buffer)
+	ce := NewChecksumEncoder(buf, nil, nil)
+	for i := 0; i < 3; i++ {
+		checkErrT(t, ce.Encode(map[string]interface{}{"n": i, "s": "hello"}))
+	}
+	bs := buf.Bytes()
+	
+	cd := NewChecksumDecoder(bytes.NewReader(bs), nil, nil)
+	for i := 0; i < 3; i++ {
+		var m map[string]interface{}
+		checkErrT(t, cd.Decode(&m))
+		checkEqualT(t, fmt.Sprint(m["n"]), fmt.Sprint(i))
+	}
+	if err := cd.Decode(new(interface{})); err != io.EOF {
+		logT(t, "expected io.EOF, got: %v", err)
+		t.FailNow()
+	}
+	
+	// corrupt a byte of the second message.
+	fl := len(bs) / 3
+	bs2 := append([]byte(nil), bs...)
+	bs2[fl + 7] ^= 0x20
+	cd = NewChecksumDecoder(bytes.NewReader(bs2), nil, nil)
+	_, err := cd.DecodeRaw()
+	checkErrT(t, err)
+	_, err = cd.DecodeRaw()
+	if cerr, ok := err.(*CorruptionError); !ok || cerr.Offset != int64(fl) {
+		logT(t, "expected CorruptionError at offset %d, got: %v", fl, err)
+		t.FailNow()
+	}
+	// a corrupt length, and a truncated frame.
+	bs2 = append([]byte{0x7f}, bs[1:]...)
+	if _, err = NewChecksumDecoder(bytes.NewReader(bs2), nil, nil).DecodeRaw(); err == nil {
+		logT(t, "expected error for corrupt length")
+		t.FailNow()
+	}
+	if _, err = NewChecksumDecoder(bytes.NewReader(bs[:fl-1]), nil, nil).DecodeRaw(); err != io.ErrUnexpectedEOF {
+		logT(t, "expected io.ErrUnexpectedEOF, got: %v", err)
+		t.FailNow()
+	}
+}
+
+func TestCompressedStreams(t *testing.T) {
+	big := strings.Repeat("all work and no play ", 500)
+	for _, tr := range []StreamTransform{FlateTransform{}, GzipTransform{Level: 9}} {
+		buf := new(bytes.Buffer)
+		ce := NewCompressedEncoder(buf, tr, nil)
+		ce.MinSize = 64
+		checkErrT(t, ce.Encode(big))
+		checkErrT(t, ce.Encode("small"))
+		checkErrT(t, ce.Encode([]string{big, big}))
+		if buf.Len() > len(big) / 4 {
+			logT(t, "%T: expected compressed stream, got %d bytes", tr, buf.Len())
+			t.FailNow()
+		}
+		
+		cd := NewCompressedDecoder(bytes.NewReader(buf.Bytes()), tr, nil)
+		var s string
+		var ss []string
+		checkErrT(t, cd.Decode(&s))
+		checkEqualT(t, s, big)
+		checkErrT(t, cd.Decode(&s))
+		checkEqualT(t, s, "small")
+		checkErrT(t, cd.Decode(&ss))
+		checkEqualT(t, ss, []string{big, big})
+		if err := cd.Decode(&s); err != io.EOF {
+			logT(t, "expected io.EOF, got: %v", err)
+			t.FailNow()
+		}
+	}
+	// MaxDecoded guards against decompression bombs.
+	buf := new(bytes.Buffer)
+	checkErrT(t, NewCompressedEncoder(buf, FlateTransform{}, nil).Encode(big))
+	if _, err := NewCompressedDecoder(buf, FlateTransform{MaxDecoded: 1000}, nil).DecodeRaw(); err == nil {
+		logT(t, "expected error decoding message larger than MaxDecoded")
+		t.FailNow()
+	}
+}
+
+func TestDatagrams(t *testing.T) {
+	_, err := MarshalDatagram(strings.Repeat("x", DefaultDatagramLimit), 0)
+	if err == nil {
+		logT(t, "expected error marshaling datagram over the limit")
+		t.FailNow()
+	}
+	
+	c1, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("udp unavailable: %v", err)
+	}
+	defer c1.Close()
+	c2, err := net.ListenPacket("udp", "127.0.0.1:0")
+	checkErrT(t, err)
+	defer c2.Close()
+	c1.SetDeadline(time.Now().Add(5 * time.Second))
+	
+	checkErrT(t, WriteDatagram(c2, c1.LocalAddr(), map[string]int{"cpu": 42}, 0))
+	checkErrT(t, WriteDatagram(c2, c1.LocalAddr(), strings.Repeat("y", 100), 0))
+	_, err = c2.WriteTo([]byte{0x92, 0x01}, c1.LocalAddr()) // a truncated value
+	checkErrT(t, err)
+	
+	buf := make([]byte, 64)
+	var m map[string]int
+	addr, err := ReadDatagram(c1, buf, &m, nil)
+	checkErrT(t, err)
+	checkEqualT(t, addr.String(), c2.LocalAddr().String())
+	checkEqualT(t, m, map[string]int{"cpu": 42})
+	var s string
+	if _, err = ReadDatagram(c1, buf, &s, nil); err != ErrDatagramTruncated {
+		logT(t, "expected ErrDatagramTruncated, got: %v", err)
+		t.FailNow()
+	}
+	if _, err = ReadDatagram(c1, buf, new(interface{}), nil); err == nil {
+		logT(t, "expected error reading a partial value")
+		t.FailNow()
+	}
+}
+
+type testRpcDur struct{}
+
+func (testRpcDur) Nanos(d time.Duration, res *int64) error { *res = int64(d); return nil }
+
+func TestRPCCodecEx(t *testing.T) {
+	encOpts := &EncoderOptions{DurationUnit: time.Millisecond}
+	decOpts := &DecoderOptions{DurationUnit: time.Millisecond}
+	for _, custom := range []bool{false, true} {
+		newCodec := NewRPCCodecEx
+		if custom {
+			newCodec = NewCustomRPCCodecEx
+		}
+		srv := rpc.NewServer()
+		checkErrT(t, srv.RegisterName("Dur", testRpcDur{}))
+		c1, c2 := net.Pipe()
+		go srv.ServeCodec(newCodec(c1, encOpts, decOpts))
+		cl := rpc.NewClientWithCodec(newCodec(c2, encOpts, nil))
+		var n int64
+		checkErrT(t, cl.Call("Dur.Nanos", 1500*time.Millisecond, &n))
+		// the duration crossed the wire as 1500 (ms), and the server read it back as ms.
+		checkEqualT(t, n, int64(1500*time.Millisecond))
+		cl.Close()
+	}
+}
+
+type testRpcSum struct{}
+
+func (testRpcSum) Add(args []int, res *int) error { 
+	for _, a := range args {
+		*res += a
+	}
+	return nil 
+}
+
+func TestSpecRpc(t *testing.T) {
+	srv := rpc.NewServer()
+	checkErrT(t, srv.RegisterName("Sum", testRpcSum{}))
+	checkErrT(t, srv.Register(testRpcInt))
+
+	// go client to go server
+	c1, c2 := net.Pipe()
+	go srv.ServeCodec(NewSpecRPCServerCodec(c1, nil))
+	cl := rpc.NewClientWithCodec(NewSpecRPCClientCodec(c2, nil))
+	var up, sum int
+	checkErrT(t, cl.Call("TestRpcInt.Update", 7, &up))
+	checkEqualT(t, up, 7)
+	checkErrT(t, cl.Call("Sum.Add", []int{1, 2, 3}, &sum))
+	checkEqualT(t, sum, 6)
+	if err := cl.Call("Sum.Nope", 1, &sum); err == nil || !strings.Contains(err.Error(), "Nope") {
+		logT(t, "expected error for unknown method. Got: %v", err)
+		t.FailNow()
+	}
+	cl.Close()
+
+	// a foreign msgpack-rpc client, calling add(2, 3, 4) and sending the exact wire format.
+	c1, c2 = net.Pipe()
+	go srv.ServeCodec(NewSpecRPCServerCodec(c1, nil))
+	defer c2.Close()
+	go func() {
+		NewEncoder(c2).Encode([]interface{}{0, 9, "Sum.Add", []interface{}{2, 3, 4}})
+	}()
+	var resp []interface{}
+	checkErrT(t, NewDecoder(c2, testDecOpts(nil, nil, true, true, true)).Decode(&resp))
+	checkEqualT(t, fmt.Sprint(resp), "[1 9 <nil> 9]")
+	go func() {
+		NewEncoder(c2).Encode([]interface{}{0, 10, "Sum.Nope", []interface{}{1}})
+	}()
+	resp = nil
+	checkErrT(t, NewDecoder(c2, testDecOpts(nil, nil, true, true, true)).Decode(&resp))
+	if len(resp) != 4 || resp[2] == nil || resp[3] != nil {
+		logT(t, "expected error response. Got: %v", resp)
+		t.FailNow()
+	}
+}
+
+func TestSpecRpcNotify(t *testing.T) {
+	type note struct {
+		method string
+		params Raw
+	}
+	srvNotes, clNotes := make(chan note, 4), make(chan note, 4)
+	srv := rpc.NewServer()
+	checkErrT(t, srv.RegisterName("Sum", testRpcSum{}))
+	c1, c2 := net.Pipe()
+	sc := NewSpecRPCCodecOpts(c1, &RPCOptions{
+		OnNotify: func(method string, params Raw) { srvNotes <- note{method, params} },
+	})
+	go srv.ServeCodec(sc)
+	cc := NewSpecRPCCodecOpts(c2, &RPCOptions{
+		OnNotify: func(method string, params Raw) { clNotes <- note{method, params} },
+	})
+	cl := rpc.NewClientWithCodec(cc)
+	defer cl.Close()
+
+	checkErrT(t, cc.(RPCNotifier).Notify("event", "started", 3))
+	checkErrT(t, cc.(RPCNotifier).Notify("ping"))
+	var sum int
+	checkErrT(t, cl.Call("Sum.Add", []int{4, 5}, &sum))
+	checkEqualT(t, sum, 9)
+	n := <-srvNotes
+	var params []interface{}
+	checkErrT(t, Unmarshal(n.params, &params, testDecOpts(nil, nil, true, true, true)))
+	checkEqualT(t, n.method, "event")
+	checkEqualT(t, fmt.Sprint(params), "[started 3]")
+	n = <-srvNotes
+	checkEqualT(t, n.method, "ping")
+	checkEqualT(t, []byte(n.params), []byte{0x90})
+
+	// notifications from the server side reach the client's hook, between responses.
+	checkErrT(t, sc.(RPCNotifier).Notify("tick", 1))
+	sum = 0
+	checkErrT(t, cl.Call("Sum.Add", []int{1}, &sum))
+	checkEqualT(t, sum, 1)
+	n = <-clNotes
+	checkEqualT(t, n.method, "tick")
+	checkEqualT(t, len(srvNotes), 0)
+}
+
+func TestRPCClient(t *testing.T) {
+	c1, c2 := net.Pipe()
+	notes := make(chan string, 1)
+	cl := NewRPCClient(c2, &RPCOptions{ OnNotify: func(method string, params Raw) { notes <- method } })
+	defer cl.Close()
+
+	// a msgpack-rpc server which answers pairs of calls in reverse order.
+	go func() {
+		dec, enc := NewDecoder(c1, testDecOpts(nil, nil, true, true, true)), NewEncoder(c1)
+		// readReq skips the notifications (e.g. cancelling the calls which hang).
+		readReq := func(m *[]interface{}) error {
+			for {
+				*m = nil
+				if err := dec.Decode(m); err != nil || len(*m) == 4 {
+					return err
+				}
+			}
+		}
+		for {
+			var m1, m2 []interface{}
+			if readReq(&m1) != nil || readReq(&m2) != nil {
+				return
+			}
+			enc.Encode([]interface{}{2, "tick", []interface{}{}})
+			for _, m := range [][]interface{}{m2, m1} {
+				switch params := m[3].([]interface{}); m[2] {
+				case "add":
+					enc.Encode([]interface{}{1, m[1], nil, reflect.ValueOf(params[0]).Int() + reflect.ValueOf(params[1]).Int()})
+				case "hang":
+				default:
+					enc.Encode([]interface{}{1, m[1], "no method " + m[2].(string), nil})
+				}
+			}
+		}
+	}()
+	ctx := context.Background()
+	type reply struct {
+		res RPCResult
+		err error
+	}
+	call := func(method string, args ...interface{}) chan reply {
+		ch := make(chan reply, 1)
+		go func() {
+			res, err := cl.Call(ctx, method, args...)
+			ch <- reply{res, err}
+		}()
+		return ch
+	}
+	r1 := call("add", 1, 2)
+	time.Sleep(10 * time.Millisecond) // so calls are sent in order
+	r2 := call("nope")
+	rep := <-r1
+	checkErrT(t, rep.err)
+	var sum int
+	checkErrT(t, rep.res.Decode(&sum))
+	checkEqualT(t, sum, 3)
+	rep = <-r2
+	if rerr, ok := rep.err.(*RPCError); !ok || !strings.Contains(rerr.Error(), "no method nope") {
+		logT(t, "expected *RPCError. Got: %T, %v", rep.err, rep.err)
+		t.FailNow()
+	}
+	checkEqualT(t, <-notes, "tick")
+
+	// a call whose context is done returns its error.
+	tctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	r1 = call("add", 10, 20)
+	if _, err := cl.Call(tctx, "hang"); err != context.DeadlineExceeded {
+		logT(t, "expected context.DeadlineExceeded. Got: %v", err)
+		t.FailNow()
+	}
+	rep = <-r1
+	checkErrT(t, rep.err)
+	checkErrT(t, rep.res.Decode(&sum))
+	checkEqualT(t, sum, 30)
+
+	// pending calls fail when the client is closed.
+	r1 = call("hang")
+	time.Sleep(10 * time.Millisecond)
+	cl.Close()
+	checkEqualT(t, (<-r1).err, ErrRPCClosed)
+	if _, err := cl.Call(ctx, "add", 1, 1); err != ErrRPCClosed {
+		logT(t, "expected ErrRPCClosed. Got: %v", err)
+		t.FailNow()
+	}
+}
+
+func TestRPCServer(t *testing.T) {
+	srv := NewRPCServer(nil)
+	notes := make(chan string, 1)
+	release := make(chan bool)
+	checkErrT(t, srv.Register("add", func(a, b int) (int, error) { return a + b, nil }))
+	checkErrT(t, srv.Register("sum", func(prefix string, xs ...int) string { 
+		for _, x := range xs {
+			prefix += strconv.Itoa(x)
+		}
+		return prefix
+	}))
+	checkErrT(t, srv.Register("fail", func(ctx context.Context) error { return errors.New("failed") }))
+	checkErrT(t, srv.Register("log", func(s string) { notes <- s }))
+	checkErrT(t, srv.Register("slow", func() int { <-release; return 1 }))
+	checkErrT(t, srv.Register("boom", func() { panic("boom") }))
+	srv.Handle("len", func(ctx context.Context, params *Decoder) (interface{}, error) {
+		return params.ReadArrayHeader()
+	})
+	if err := srv.Register("bad", func() (int, int) { return 0, 0 }); err == nil {
+		logT(t, "expected error registering a function with 2 non-error results")
+		t.FailNow()
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	checkErrT(t, err)
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- srv.Serve(ln) }()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	checkErrT(t, err)
+	cl := NewRPCClient(conn, nil)
+	defer cl.Close()
+	ctx := context.Background()
+
+	var i int
+	var s string
+	res, err := cl.Call(ctx, "add", 2, 3)
+	checkErrT(t, err)
+	checkErrT(t, res.Decode(&i))
+	checkEqualT(t, i, 5)
+	res, err = cl.Call(ctx, "sum", "x", 1, 2, 3)
+	checkErrT(t, err)
+	checkErrT(t, Unmarshal(res.Raw, &s, testDecOpts(nil, nil, true, true, true)))
+	checkEqualT(t, s, "x123")
+	res, err = cl.Call(ctx, "len", 1, "a", nil)
+	checkErrT(t, err)
+	checkErrT(t, res.Decode(&i))
+	checkEqualT(t, i, 3)
+	checkErrT(t, cl.Notify("log", "hello"))
+	checkEqualT(t, <-notes, "hello")
+	for _, c := range []struct{ method string; args []interface{}; msg string }{
+		{"fail", nil, "failed"},
+		{"boom", nil, "panic: boom"},
+		{"nope", nil, "unknown method: nope"},
+		{"add", []interface{}{1}, "expecting 2 params"},
+		{"add", []interface{}{1, "x"}, "param 1"},
+	} {
+		_, err = cl.Call(ctx, c.method, c.args...)
+		if _, ok := err.(*RPCError); !ok || !strings.Contains(err.Error(), c.msg) {
+			logT(t, "%s: expected *RPCError containing %q. Got: %v", c.method, c.msg, err)
+			t.FailNow()
+		}
+	}
+
+	// Shutdown waits for the call in progress to respond.
+	slow := make(chan error, 1)
+	go func() {
+		res, err := cl.Call(ctx, "slow")
+		if err == nil {
+			err = res.Decode(&i)
+		}
+		slow <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	shut := make(chan error, 1)
+	go func() { shut <- srv.Shutdown(ctx) }()
+	checkEqualT(t, <-serveErr, ErrRPCClosed)
+	// new calls are refused while shutting down.
+	if _, err = cl.Call(ctx, "add", 1, 1); err == nil || !strings.Contains(err.Error(), "shutting down") {
+		logT(t, "expected shutting down error. Got: %v", err)
+		t.FailNow()
+	}
+	close(release)
+	checkErrT(t, <-slow)
+	checkEqualT(t, i, 1)
+	checkErrT(t, <-shut)
+	if _, err = cl.Call(ctx, "add", 1, 1); err == nil {
+		logT(t, "expected error after shutdown")
+		t.FailNow()
+	}
+}
+
+func TestRPCDeadlines(t *testing.T) {
+	// a server which never responds to "hang", reading calls until told to stop reading.
+	c1, c2 := net.Pipe()
+	stopReading := make(chan bool)
+	go func() {
+		dec, enc := NewDecoder(c1, testDecOpts(nil, nil, true, true, true)), NewEncoder(c1)
+		for {
+			select {
+			case <-stopReading:
+				return
+			default:
+			}
+			var m []interface{}
+			if dec.Decode(&m) != nil {
+				return
+			}
+			if m[2] == "ok" {
+				enc.Encode([]interface{}{1, m[1], nil, "ok"})
+			}
+		}
+	}()
+	cl := NewRPCClient(c2, nil)
+	defer cl.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	if _, err := cl.Call(ctx, "hang"); err != context.DeadlineExceeded {
+		logT(t, "expected context.DeadlineExceeded. Got: %v", err)
+		t.FailNow()
+	}
+	// the read deadline has expired, but the connection is still usable.
+	time.Sleep(10 * time.Millisecond)
+	ctx2, cancel2 := context.WithTimeout(context.Background(), time.Second)
+	defer cancel2()
+	res, err := cl.Call(ctx2, "ok")
+	checkErrT(t, err)
+	checkEqualT(t, res.Raw, Raw{0xa2, 'o', 'k'})
+
+	// a server which does not read makes the write time out, and the connection fail.
+	close(stopReading)
+	cl.Call(ctx2, "ok") // unblock the server so it sees stopReading
+	ctx3, cancel3 := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel3()
+	if _, err = cl.Call(ctx3, "ok"); err != context.DeadlineExceeded {
+		logT(t, "expected context.DeadlineExceeded on write. Got: %v", err)
+		t.FailNow()
+	}
+	if _, err = cl.Call(ctx2, "ok"); err != context.DeadlineExceeded {
+		logT(t, "expected connection to have failed. Got: %v", err)
+		t.FailNow()
+	}
+
+	// CallContext bounds a net/rpc call.
+	srv := rpc.NewServer()
+	checkErrT(t, srv.RegisterName("Slow", new(testRpcSlow)))
+	c1, c2 = net.Pipe()
+	go srv.ServeCodec(NewRPCServerCodec(c1, nil))
+	rcl := rpc.NewClientWithCodec(NewRPCClientCodec(c2, nil))
+	defer rcl.Close()
+	ctx4, cancel4 := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel4()
+	var n int
+	if err = CallContext(ctx4, rcl, "Slow.Sleep", 1000, &n); err != context.DeadlineExceeded {
+		logT(t, "expected context.DeadlineExceeded from CallContext. Got: %v", err)
+		t.FailNow()
+	}
+	checkErrT(t, CallContext(context.Background(), rcl, "Slow.Sleep", 1, &n))
+	checkEqualT(t, n, 1)
+}
+
+type testRpcSlow struct{}
+
+func (*testRpcSlow) Sleep(ms int, res *int) error { 
+	time.Sleep(time.Duration(ms) * time.Millisecond)
+	*res = ms
+	return nil 
+}
+
+type testCountWriter struct {
+	net.Conn
+	writes int32
+}
+
+func (c *testCountWriter) Write(b []byte) (int, error) {
+	atomic.AddInt32(&c.writes, 1)
+	return c.Conn.Write(b)
+}
+
+func TestRPCBatch(t *testing.T) {
+	srv := NewRPCServer(nil)
+	release := make(chan bool)
+	notes := make(chan int, 1)
+	checkErrT(t, srv.Register("add", func(a, b int) int { return a + b }))
+	checkErrT(t, srv.Register("slow", func() int { <-release; return 0 }))
+	checkErrT(t, srv.Register("note", func(i int) { notes <- i }))
+	c1, c2 := net.Pipe()
+	go srv.ServeConn(c1)
+	cw := &testCountWriter{Conn: c2}
+	cl := NewRPCClient(cw, nil)
+	defer cl.Close()
+	ctx := context.Background()
+
+	b := cl.NewBatch()
+	slow := b.Call("slow")
+	var calls []*RPCCall
+	for i := 0; i < 10; i++ {
+		calls = append(calls, b.Call("add", i, i))
+	}
+	b.Notify("note", 7)
+	checkEqualT(t, b.Len(), 12)
+	checkErrT(t, b.Send(ctx))
+	checkEqualT(t, b.Len(), 0)
+	checkEqualT(t, atomic.LoadInt32(&cw.writes), int32(1))
+	// responses are delivered as they arrive, though the slow call has not responded.
+	for i, call := range calls {
+		res, err := call.Wait(ctx)
+		checkErrT(t, err)
+		var n int
+		checkErrT(t, res.Decode(&n))
+		checkEqualT(t, n, 2*i)
+	}
+	checkEqualT(t, <-notes, 7)
+	tctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := slow.Wait(tctx); err != context.DeadlineExceeded {
+		logT(t, "expected context.DeadlineExceeded. Got: %v", err)
+		t.FailNow()
+	}
+	close(release)
+	_, err := slow.Wait(ctx)
+	checkErrT(t, err)
+
+	// a batch sent on a closed client fails its calls.
+	cl.Close()
+	b.Call("add", 1, 2)
+	call := b.Call("add", 1, 2)
+	if err = b.Send(ctx); err != ErrRPCClosed {
+		logT(t, "expected ErrRPCClosed. Got: %v", err)
+		t.FailNow()
+	}
+	_, err = call.Wait(ctx)
+	checkEqualT(t, err, ErrRPCClosed)
+}
+
+func TestReconnectClient(t *testing.T) {
+	srv := rpc.NewServer()
+	checkErrT(t, srv.RegisterName("Slow", new(testRpcSlow)))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	checkErrT(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go srv.ServeCodec(NewRPCServerCodec(conn, nil))
+		}
+	}()
+	var mu sync.Mutex
+	var conns []net.Conn
+	var failDials, reconnects int
+	dial := func(ctx context.Context) (*rpc.Client, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failDials > 0 {
+			failDials--
+			return nil, errors.New("dial failed")
+		}
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return nil, err
+		}
+		conns = append(conns, conn)
+		return rpc.NewClientWithCodec(NewRPCClientCodec(conn, nil)), nil
+	}
+	breakConn := func(after time.Duration) {
+		time.Sleep(after)
+		mu.Lock()
+		conns[len(conns)-1].Close()
+		mu.Unlock()
+	}
+	c := NewReconnectClient(dial, &RetryPolicy{MinBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond})
+	c.OnReconnect = func(*rpc.Client) error { reconnects++; return nil }
+	defer c.Close()
+	ctx := context.Background()
+	var n int
+	checkErrT(t, c.Call(ctx, "Slow.Sleep", 1, &n))
+	checkEqualT(t, n, 1)
+
+	// a call on a connection which failed while idle is resent on a new one.
+	breakConn(0)
+	time.Sleep(10 * time.Millisecond) // for the rpc.Client to see it
+	checkErrT(t, c.Call(ctx, "Slow.Sleep", 2, &n))
+	checkEqualT(t, n, 2)
+	checkEqualT(t, reconnects, 1)
+
+	// a call which was sent is only retried if idempotent.
+	go breakConn(20 * time.Millisecond)
+	if err = c.Call(ctx, "Slow.Sleep", 100, &n); err == nil {
+		logT(t, "expected error for non-idempotent call on a failed connection")
+		t.FailNow()
+	}
+	go breakConn(20 * time.Millisecond)
+	checkErrT(t, c.Call(IdempotentContext(ctx), "Slow.Sleep", 100, &n))
+	checkEqualT(t, n, 100)
+
+	// dials are retried, up to MaxAttempts.
+	ictx := IdempotentContext(ctx)
+	breakConn(0)
+	mu.Lock()
+	failDials = 1
+	mu.Unlock()
+	checkErrT(t, c.Call(ictx, "Slow.Sleep", 3, &n))
+	checkEqualT(t, n, 3)
+	breakConn(0)
+	mu.Lock()
+	failDials = 2
+	mu.Unlock()
+	if err = c.Call(ictx, "Slow.Sleep", 4, &n); err == nil || err.Error() != "dial failed" {
+		logT(t, "expected dial error. Got: %v", err)
+		t.FailNow()
+	}
+	c.Close()
+	checkEqualT(t, c.Call(ctx, "Slow.Sleep", 4, &n), rpc.ErrShutdown)
+}
+
+func TestRPCPool(t *testing.T) {
+	srv := NewRPCServer(nil)
+	release := make(chan bool)
+	checkErrT(t, srv.Register("add", func(a, b int) int { return a + b }))
+	checkErrT(t, srv.Register("slow", func() int { <-release; return 1 }))
+	var mu sync.Mutex
+	var conns []net.Conn
+	dial := func(ctx context.Context) (io.ReadWriteCloser, error) {
+		c1, c2 := net.Pipe()
+		go srv.ServeConn(c1)
+		mu.Lock()
+		conns = append(conns, c2)
+		mu.Unlock()
+		return c2, nil
+	}
+	numDials := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(conns)
+	}
+	checks := 0
+	p := NewRPCPool(dial, &RPCPoolOptions{
+		MaxOpen: 2, 
+		HealthCheck: func(ctx context.Context, c *RPCClient) error {
+			checks++
+			_, err := c.Call(ctx, "add", 0, 0)
+			return err
+		},
+	})
+	defer p.Close()
+	ctx := context.Background()
+	add := func(a, b int) int {
+		res, err := p.Call(ctx, "add", a, b)
+		checkErrT(t, err)
+		var n int
+		checkErrT(t, res.Decode(&n))
+		return n
+	}
+	checkEqualT(t, add(1, 2), 3)
+	checkEqualT(t, add(2, 2), 4)
+	checkEqualT(t, numDials(), 1)
+	checkEqualT(t, checks, 1)
+
+	// a slow call holds its connection, but not the others.
+	slow := make(chan error, 1)
+	go func() {
+		_, err := p.Call(ctx, "slow")
+		slow <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	checkEqualT(t, add(3, 3), 6)
+	checkEqualT(t, numDials(), 2)
+	// MaxOpen connections are open: Get waits for one to be put back.
+	c1, err := p.Get(ctx)
+	checkErrT(t, err)
+	tctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err = p.Get(tctx); err != context.DeadlineExceeded {
+		logT(t, "expected context.DeadlineExceeded. Got: %v", err)
+		t.FailNow()
+	}
+	got := make(chan *RPCClient, 1)
+	go func() {
+		c, err := p.Get(ctx)
+		checkErrT(t, err)
+		got <- c
+	}()
+	time.Sleep(10 * time.Millisecond)
+	p.Put(c1)
+	checkEqualT(t, <-got == c1, true)
+	// a client whose connection failed is not reused: its slot goes to a new connection.
+	mu.Lock()
+	conns[len(conns)-1].Close()
+	mu.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	p.Put(c1)
+	checkEqualT(t, add(4, 4), 8)
+	checkEqualT(t, numDials(), 3)
+	close(release)
+	checkErrT(t, <-slow)
+	open, idle := p.Len()
+	checkEqualT(t, open, 2)
+	checkEqualT(t, idle, 2)
+
+	p.Close()
+	open, idle = p.Len()
+	checkEqualT(t, open, 0)
+	checkEqualT(t, idle, 0)
+	if _, err = p.Get(ctx); err != ErrRPCClosed {
+		logT(t, "expected ErrRPCClosed. Got: %v", err)
+		t.FailNow()
+	}
+}
+
+func TestRPCHeartbeat(t *testing.T) {
+	hb := &RPCOptions{HeartbeatInterval: 10 * time.Millisecond}
+	ctx := context.Background()
+	srv := NewRPCServer(nil)
+	checkErrT(t, srv.Register("add", func(a, b int) int { return a + b }))
+	notes := make(chan string, 10)
+	onNotify := func(method string, params Raw) { notes <- method }
+
+	// the pongs of a live peer keep an idle connection alive.
+	c1, c2 := net.Pipe()
+	go srv.ServeConn(c1)
+	cl := NewRPCClient(c2, &RPCOptions{HeartbeatInterval: 10 * time.Millisecond, OnNotify: onNotify})
+	time.Sleep(100 * time.Millisecond)
+	_, err := cl.Call(ctx, "add", 1, 2)
+	checkErrT(t, err)
+	cl.Close()
+
+	// a peer which sends nothing is detected as dead.
+	c1, c2 = net.Pipe()
+	go io.Copy(ioutil.Discard, c1)
+	cl = NewRPCClient(c2, hb)
+	_, err = cl.Call(ctx, "add", 1, 2)
+	checkEqualT(t, err, ErrRPCDeadPeer)
+	c1.Close()
+
+	// the same with the spec net/rpc codecs.
+	rsrv := rpc.NewServer()
+	checkErrT(t, rsrv.RegisterName("Sum", testRpcSum{}))
+	c1, c2 = net.Pipe()
+	go rsrv.ServeCodec(NewSpecRPCServerCodec(c1, nil))
+	rcl := rpc.NewClientWithCodec(NewSpecRPCCodecOpts(c2, &RPCOptions{HeartbeatInterval: 10 * time.Millisecond, OnNotify: onNotify}))
+	time.Sleep(100 * time.Millisecond)
+	var sum int
+	checkErrT(t, rcl.Call("Sum.Add", []int{1, 2}, &sum))
+	checkEqualT(t, sum, 3)
+	rcl.Close()
+
+	c1, c2 = net.Pipe()
+	go io.Copy(ioutil.Discard, c2)
+	served := make(chan bool)
+	go func() {
+		rsrv.ServeCodec(NewSpecRPCCodecOpts(c1, hb))
+		served <- true
+	}()
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		logT(t, "expected ServeCodec to return for a dead peer")
+		t.FailNow()
+	}
+	c2.Close()
+	// heartbeats are not passed to OnNotify.
+	checkEqualT(t, len(notes), 0)
+}
+
+func TestRPCInterceptors(t *testing.T) {
+	var mu sync.Mutex
+	var events []string
+	logEvent := func(format string, args ...interface{}) {
+		mu.Lock()
+		events = append(events, fmt.Sprintf(format, args...))
+		mu.Unlock()
+	}
+	tracer := func(name string) RPCInterceptor {
+		return RPCInterceptor{
+			WriteRequest: func(r *rpc.Request, body interface{}, next func(*rpc.Request, interface{}) error) error {
+				logEvent("%s: write %s", name, r.ServiceMethod)
+				return next(r, body)
+			},
+			ReadResponseHeader: func(r *rpc.Response, next func(*rpc.Response) error) error {
+				err := next(r)
+				logEvent("%s: read response %s", name, r.ServiceMethod)
+				return err
+			},
+		}
+	}
+	// server side: route an alias, and count responses.
+	var responses int32
+	server := RPCInterceptor{
+		ReadRequestHeader: func(r *rpc.Request, next func(*rpc.Request) error) error {
+			err := next(r)
+			if r.ServiceMethod == "add" {
+				r.ServiceMethod = "Sum.Add"
+			}
+			return err
+		},
+		WriteResponse: func(r *rpc.Response, body interface{}, next func(*rpc.Response, interface{}) error) error {
+			atomic.AddInt32(&responses, 1)
+			return next(r, body)
+		},
+	}
+	srv := rpc.NewServer()
+	checkErrT(t, srv.RegisterName("Sum", testRpcSum{}))
+	c1, c2 := net.Pipe()
+	go srv.ServeCodec(InterceptRPCServerCodec(NewRPCServerCodec(c1, nil), server))
+	cl := rpc.NewClientWithCodec(InterceptRPCClientCodec(NewRPCClientCodec(c2, nil), tracer("outer"), RPCInterceptor{}, tracer("inner")))
+	var sum int
+	checkErrT(t, cl.Call("add", []int{1, 2}, &sum))
+	checkEqualT(t, sum, 3)
+	cl.Close()
+	checkEqualT(t, atomic.LoadInt32(&responses), int32(1))
+	// (the client reads again after the response, until it is closed)
+	mu.Lock()
+	got := append([]string(nil), events[:4]...)
+	mu.Unlock()
+	checkEqualT(t, got, []string{
+		"outer: write add", "inner: write add", 
+		"inner: read response Sum.Add", "outer: read response Sum.Add", 
+	})
+
+	// interceptors of a spec codec made with RPCOptions; a hook may fail the call.
+	c1, c2 = net.Pipe()
+	go srv.ServeCodec(NewSpecRPCServerCodec(c1, nil))
+	deny := RPCInterceptor{
+		WriteRequest: func(r *rpc.Request, body interface{}, next func(*rpc.Request, interface{}) error) error {
+			if strings.HasPrefix(r.ServiceMethod, "Admin.") {
+				return errors.New("denied")
+			}
+			return next(r, body)
+		},
+	}
+	cc := NewSpecRPCCodecOpts(c2, &RPCOptions{Interceptors: []RPCInterceptor{deny}})
+	cl = rpc.NewClientWithCodec(cc)
+	defer cl.Close()
+	checkErrT(t, cl.Call("Sum.Add", []int{2, 2}, &sum))
+	checkEqualT(t, sum, 4)
+	checkErrT(t, cc.(RPCNotifier).Notify("event"))
+	if err := cl.Call("Admin.Reset", 1, &sum); err == nil || err.Error() != "denied" {
+		logT(t, "expected denied error. Got: %v", err)
+		t.FailNow()
+	}
+}
+
+func TestRPCMetadata(t *testing.T) {
+	srv := NewRPCServer(nil)
+	notes := make(chan RPCMetadata, 1)
+	checkErrT(t, srv.Register("whoami", func(ctx context.Context) (string, error) {
+		md := RPCMetadataFromContext(ctx)
+		SetRPCResponseMetadata(ctx, "served-by", "test")
+		if md["tenant"] == "" {
+			return "", errors.New("no tenant")
+		}
+		return md["tenant"], nil
+	}))
+	checkErrT(t, srv.Register("note", func(ctx context.Context) { notes <- RPCMetadataFromContext(ctx) }))
+	c1, c2 := net.Pipe()
+	go srv.ServeConn(c1)
+	cl := NewRPCClient(c2, nil)
+	defer cl.Close()
+
+	ctx := ContextWithRPCMetadata(context.Background(), RPCMetadata{"tenant": "acme"})
+	res, err := cl.Call(ctx, "whoami")
+	checkErrT(t, err)
+	var s string
+	checkErrT(t, res.Decode(&s))
+	checkEqualT(t, s, "acme")
+	checkEqualT(t, res.Metadata, RPCMetadata{"served-by": "test"})
+	_, err = cl.Call(context.Background(), "whoami")
+	if rerr, ok := err.(*RPCError); !ok || rerr.Metadata["served-by"] != "test" {
+		logT(t, "expected *RPCError with metadata. Got: %#v", err)
+		t.FailNow()
+	}
+	checkErrT(t, cl.NotifyContext(ctx, "note"))
+	checkEqualT(t, <-notes, RPCMetadata{"tenant": "acme"})
+
+	// with the spec net/rpc codecs, through interceptors.
+	rsrv := rpc.NewServer()
+	checkErrT(t, rsrv.RegisterName("Sum", testRpcSum{}))
+	c1, c2 = net.Pipe()
+	sc := NewSpecRPCCodecOpts(c1, nil)
+	smd := sc.(RPCMetadataCodec)
+	var seen RPCMetadata
+	go rsrv.ServeCodec(InterceptRPCServerCodec(sc, RPCInterceptor{
+		ReadRequestHeader: func(r *rpc.Request, next func(*rpc.Request) error) error {
+			err := next(r)
+			if err == nil {
+				seen = smd.Metadata(r.Seq)
+			}
+			return err
+		},
+		WriteResponse: func(r *rpc.Response, body interface{}, next func(*rpc.Response, interface{}) error) error {
+			smd.SetMetadata(r.Seq, RPCMetadata{"trace-id": seen["trace-id"] + "-done"})
+			return next(r, body)
+		},
+	}))
+	cc := NewSpecRPCCodecOpts(c2, nil)
+	cmd := cc.(RPCMetadataCodec)
+	var got RPCMetadata
+	cc = InterceptRPCCodec(cc, RPCInterceptor{
+		WriteRequest: func(r *rpc.Request, body interface{}, next func(*rpc.Request, interface{}) error) error {
+			cmd.SetMetadata(r.Seq, RPCMetadata{"trace-id": "t1"})
+			return next(r, body)
+		},
+		ReadResponseHeader: func(r *rpc.Response, next func(*rpc.Response) error) error {
+			err := next(r)
+			got = cmd.Metadata(r.Seq)
+			return err
+		},
+	})
+	rcl := rpc.NewClientWithCodec(cc)
+	defer rcl.Close()
+	var sum int
+	checkErrT(t, rcl.Call("Sum.Add", []int{1, 2, 3}, &sum))
+	checkEqualT(t, sum, 6)
+	checkEqualT(t, seen, RPCMetadata{"trace-id": "t1"})
+	checkEqualT(t, got, RPCMetadata{"trace-id": "t1-done"})
+}
+
+func TestRPCStructuredErrors(t *testing.T) {
+	errNotFound := errors.New("not found")
+	reg := new(RPCErrorRegistry)
+	reg.Register(404, errNotFound)
+	opts := &RPCOptions{Errors: reg}
+	srv := NewRPCServer(opts)
+	checkErrT(t, srv.Register("get", func(id int) (string, error) {
+		switch id {
+		case 1:
+			return "", fmt.Errorf("user %d: %w", id, errNotFound)
+		case 2:
+			return "", &RPCCodeError{Code: 429, Message: "slow down", Data: map[string]int{"retry": 5}}
+		}
+		return "", errors.New("plain")
+	}))
+	c1, c2 := net.Pipe()
+	go srv.ServeConn(c1)
+	cl := NewRPCClient(c2, opts)
+	defer cl.Close()
+	ctx := context.Background()
+
+	_, err := cl.Call(ctx, "get", 1)
+	if !errors.Is(err, errNotFound) {
+		logT(t, "expected error matching errNotFound. Got: %v", err)
+		t.FailNow()
+	}
+	rerr := err.(*RPCError)
+	checkEqualT(t, rerr.Code, 404)
+	checkEqualT(t, rerr.Message, "user 1: not found")
+	checkEqualT(t, err.Error(), "msgpack-rpc: remote error: user 1: not found (code 404)")
+
+	_, err = cl.Call(ctx, "get", 2)
+	rerr = err.(*RPCError)
+	checkEqualT(t, rerr.Code, 429)
+	checkEqualT(t, rerr.Message, "slow down")
+	checkEqualT(t, rerr.Unwrap(), nil)
+	var data map[string]int
+	checkErrT(t, Unmarshal(rerr.Data, &data, nil))
+	checkEqualT(t, data["retry"], 5)
+
+	_, err = cl.Call(ctx, "get", 3)
+	rerr = err.(*RPCError)
+	checkEqualT(t, rerr.Code, 0)
+	checkEqualT(t, rerr.Message, "plain")
+	checkEqualT(t, errors.Is(err, errNotFound), false)
+
+	// a client with another registry does not map the code.
+	c1, c2 = net.Pipe()
+	go srv.ServeConn(c1)
+	cl2 := NewRPCClient(c2, nil)
+	defer cl2.Close()
+	_, err = cl2.Call(ctx, "get", 1)
+	checkEqualT(t, errors.Is(err, errNotFound), false)
+	checkEqualT(t, err.(*RPCError).Code, 404)
+
+	// the spec net/rpc codec formats a structured error.
+	c1, c2 = net.Pipe()
+	go srv.ServeConn(c1)
+	rcl := rpc.NewClientWithCodec(NewSpecRPCClientCodec(c2, nil))
+	defer rcl.Close()
+	var s string
+	checkEqualT(t, rcl.Call("get", 2, &s), rpc.ServerError("slow down (code 429)"))
+}
+
+// testTLSConfigs returns a server config with a self-signed certificate, and a client config trusting it.
+func testTLSConfigs(t *testing.T) (server, client *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	checkErrT(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+		KeyUsage: x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(crand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	checkErrT(t, err)
+	cert, err := x509.ParseCertificate(der)
+	checkErrT(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	server = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	client = &tls.Config{RootCAs: pool}
+	return
+}
+
+func TestRPCDialTLS(t *testing.T) {
+	srv := rpc.NewServer()
+	checkErrT(t, srv.RegisterName("Sum", testRpcSum{}))
+	serverConfig, clientConfig := testTLSConfigs(t)
+	ln, err := ListenTLS("tcp", "127.0.0.1:0", serverConfig)
+	checkErrT(t, err)
+	defer ln.Close()
+	opts := &RPCOptions{Protocol: RPCSpecProtocol}
+	go ServeRPC(ln, srv, opts)
+
+	cc, err := DialTLS("tcp", ln.Addr().String(), clientConfig, opts)
+	checkErrT(t, err)
+	cl := rpc.NewClientWithCodec(cc)
+	var sum int
+	checkErrT(t, cl.Call("Sum.Add", []int{1, 2}, &sum))
+	checkEqualT(t, sum, 3)
+	cl.Close()
+
+	// a client offering another protocol with ALPN is rejected.
+	other := clientConfig.Clone()
+	other.NextProtos = []string{"h2"}
+	if _, err = DialTLS("tcp", ln.Addr().String(), other, opts); err == nil {
+		logT(t, "expected error negotiating another ALPN protocol")
+		t.FailNow()
+	}
+	// an untrusted server is rejected.
+	if _, err = DialTLS("tcp", ln.Addr().String(), nil, opts); err == nil {
+		logT(t, "expected certificate error")
+		t.FailNow()
+	}
+
+	// plain TCP, with the basic protocol.
+	ln2, err := net.Listen("tcp", "127.0.0.1:0")
+	checkErrT(t, err)
+	defer ln2.Close()
+	go ServeRPC(ln2, srv, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	cc, err = Dial(ctx, "tcp", ln2.Addr().String(), nil)
+	checkErrT(t, err)
+	cl = rpc.NewClientWithCodec(cc)
+	defer cl.Close()
+	checkErrT(t, cl.Call("Sum.Add", []int{4, 5}, &sum))
+	checkEqualT(t, sum, 9)
+}
+
+func TestRPCUnixAndPipe(t *testing.T) {
+	rsrv := rpc.NewServer()
+	checkErrT(t, rsrv.RegisterName("Sum", testRpcSum{}))
+	dir, err := ioutil.TempDir("", "msgpack-rpc")
+	checkErrT(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rpc.sock")
+	// a stale socket file is removed.
+	stale, err := net.Listen("unix", path)
+	checkErrT(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	ln, err := ListenUnix(path)
+	checkErrT(t, err)
+	defer ln.Close()
+	opts := &RPCOptions{Protocol: RPCSpecProtocol}
+	go ServeRPC(ln, rsrv, opts)
+	cc, err := DialUnix(context.Background(), path, opts)
+	checkErrT(t, err)
+	cl := rpc.NewClientWithCodec(cc)
+	var sum int
+	checkErrT(t, cl.Call("Sum.Add", []int{1, 2}, &sum))
+	checkEqualT(t, sum, 3)
+	cl.Close()
+
+	cc, sc := NewPipeRPCCodecs(opts)
+	go rsrv.ServeCodec(sc)
+	cl = rpc.NewClientWithCodec(cc)
+	checkErrT(t, cl.Call("Sum.Add", []int{3, 4}, &sum))
+	checkEqualT(t, sum, 7)
+	cl.Close()
+
+	srv := NewRPCServer(nil)
+	checkErrT(t, srv.Register("add", func(a, b int) int { return a + b }))
+	pcl := srv.PipeClient(nil)
+	defer pcl.Close()
+	res, err := pcl.Call(context.Background(), "add", 5, 6)
+	checkErrT(t, err)
+	checkErrT(t, res.Decode(&sum))
+	checkEqualT(t, sum, 11)
+}
+
+// testWSConn is an in-memory WebSocketConn, which checks that each message sent is one msgpack value.
+type testWSConn struct {
+	in <-chan []byte
+	out chan<- []byte
+	done chan struct{}
+	once *sync.Once
+	bad *int32 // number of messages sent which were not exactly one value
+}
+
+func newTestWSConns() (a, b testWSConn) {
+	c1, c2 := make(chan []byte, 16), make(chan []byte, 16)
+	done, once, bad := make(chan struct{}), new(sync.Once), new(int32)
+	return testWSConn{c1, c2, done, once, bad}, testWSConn{c2, c1, done, once, bad}
+}
+
+func (c testWSConn) ReadMessage() (int, []byte, error) {
+	select {
+	case b := <-c.in:
+		return WebSocketBinaryMessage, b, nil
+	case <-c.done:
+		return 0, nil, io.EOF
+	}
+}
+
+func (c testWSConn) WriteMessage(typ int, b []byte) error {
+	if typ != WebSocketBinaryMessage || !Valid(b) {
+		atomic.AddInt32(c.bad, 1)
+	}
+	select {
+	case c.out <- append([]byte(nil), b...):
+		return nil
+	case <-c.done:
+		return io.ErrClosedPipe
+	}
+}
+
+func (c testWSConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return nil
+}
+
+func TestRPCWebSocket(t *testing.T) {
+	rsrv := rpc.NewServer()
+	checkErrT(t, rsrv.RegisterName("Sum", testRpcSum{}))
+	for _, p := range []RPCProtocol{ RPCBasicProtocol, RPCCustomProtocol, RPCSpecProtocol } {
+		a, b := newTestWSConns()
+		go rsrv.ServeCodec(NewWebSocketRPCCodec(b, &RPCOptions{Protocol: p}))
+		cl := rpc.NewClientWithCodec(NewWebSocketRPCCodec(a, &RPCOptions{Protocol: p}))
+		var sum int
+		checkErrT(t, cl.Call("Sum.Add", []int{1, 2, 3}, &sum))
+		checkEqualT(t, sum, 6)
+		cl.Close()
+		checkEqualT(t, atomic.LoadInt32(a.bad), int32(0))
+	}
+
+	srv := NewRPCServer(nil)
+	checkErrT(t, srv.Register("echo", func(s string) string { return s }))
+	a, b := newTestWSConns()
+	go srv.ServeConn(NewWebSocketRPCConn(b))
+	cl := NewRPCClient(NewWebSocketRPCConn(a), nil)
+	defer cl.Close()
+	big := strings.Repeat("x", 100000)
+	res, err := cl.Call(context.Background(), "echo", big)
+	checkErrT(t, err)
+	var s string
+	checkErrT(t, res.Decode(&s))
+	checkEqualT(t, s, big)
+	checkEqualT(t, atomic.LoadInt32(a.bad), int32(0))
+
+	// values written in parts, or several in one write, are each sent as one message.
+	a, b = newTestWSConns()
+	wc := NewWebSocketRPCConn(a)
+	bs, err := Marshal([]interface{}{ "abc", 1, big })
+	checkErrT(t, err)
+	bs2, err := Marshal(true)
+	checkErrT(t, err)
+	for _, p := range [][]byte{ bs[:1], bs[1:10], append(bs[10:], bs2...) } {
+		_, err = wc.Write(p)
+		checkErrT(t, err)
+	}
+	m1, _, _ := b.ReadMessage()
+	m2, _, _ := b.ReadMessage()
+	checkEqualT(t, m1, WebSocketBinaryMessage)
+	checkEqualT(t, m2, WebSocketBinaryMessage)
+	checkEqualT(t, atomic.LoadInt32(a.bad), int32(0))
+	select {
+	case <-b.in:
+		logT(t, "expected two messages, got three")
+		t.FailNow()
+	default:
+	}
+	_, err = wc.Write([]byte{ 0xc1 })
+	if err == nil {
+		logT(t, "expected an error writing an invalid value")
+		t.FailNow()
+	}
+}
+
+func TestRPCStream(t *testing.T) {
+	srv := NewRPCServer(nil)
+	srv.HandleStream("count", func(ctx context.Context, params *Decoder, send func(interface{}) error) error {
+		var n int
+		if _, err := params.ReadArrayHeader(); err != nil {
+			return err
+		}
+		if err := params.Decode(&n); err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			if err := send(i); err != nil {
+				return err
+			}
+		}
+		if n < 0 {
+			return errors.New("negative count")
+		}
+		return nil
+	})
+	cl := srv.PipeClient(nil)
+	defer cl.Close()
+	ctx := context.Background()
+	st, err := cl.CallStream(ctx, "count", 1000)
+	checkErrT(t, err)
+	var n int
+	for st.Next() {
+		var i int
+		checkErrT(t, st.Decode(&i))
+		checkEqualT(t, i, n)
+		n++
+	}
+	checkErrT(t, st.Err())
+	checkEqualT(t, n, 1000)
+	if st.Next() {
+		logT(t, "expected no result after the end of the stream")
+		t.FailNow()
+	}
+
+	st, err = cl.CallStream(ctx, "count", -1)
+	checkErrT(t, err)
+	for st.Next() {
+	}
+	if _, ok := st.Err().(*RPCError); !ok {
+		logT(t, "expected an *RPCError, got: %v", st.Err())
+		t.FailNow()
+	}
+
+	// a stream closed early discards the rest, and the connection stays usable.
+	st, err = cl.CallStream(ctx, "count", 100)
+	checkErrT(t, err)
+	if !st.Next() {
+		logT(t, "expected a result: %v", st.Err())
+		t.FailNow()
+	}
+	st.Close()
+	cctx, cancel := context.WithCancel(ctx)
+	st, err = cl.CallStream(cctx, "count", 3)
+	checkErrT(t, err)
+	for n = 0; st.Next(); n++ {
+	}
+	checkErrT(t, st.Err())
+	checkEqualT(t, n, 3)
+	cancel()
+	st, err = cl.CallStream(cctx, "count", 3)
+	if err != context.Canceled {
+		logT(t, "expected context.Canceled, got: %v", err)
+		t.FailNow()
+	}
+
+	// called as a plain call, a streaming method sends its results, then a nil result.
+	res, err := cl.Call(ctx, "count", 2)
+	checkErrT(t, err)
+	checkEqualT(t, []byte(res.Raw), []byte{ 0xc0 })
+}
+
+func TestRPCMaxMessageSize(t *testing.T) {
+	srv := NewRPCServer(&RPCOptions{MaxRequestSize: 1024})
+	checkErrT(t, srv.Register("echo", func(s string) string { return s }))
+	ctx := context.Background()
+	cl := srv.PipeClient(&RPCOptions{MaxResponseSize: 2048})
+	defer cl.Close()
+	_, err := cl.Call(ctx, "echo", strings.Repeat("x", 1000))
+	checkErrT(t, err)
+	// the server drops a connection sending too large a request.
+	_, err = cl.Call(ctx, "echo", strings.Repeat("x", 1100))
+	if err == nil {
+		logT(t, "expected an error for too large a request")
+		t.FailNow()
+	}
+
+	// a message claiming a huge string is rejected before it is allocated.
+	c1, c2 := net.Pipe()
+	go srv.ServeConn(c1)
+	go c2.Write([]byte{ 0x94, 0x00, 0x01, 0xa4, 'e', 'c', 'h', 'o', 0x91, 0xdb, 0x7f, 0xff, 0xff, 0xff })
+	c2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = c2.Read(make([]byte, 1)); err != io.EOF {
+		logT(t, "expected the server to close the connection, got: %v", err)
+		t.FailNow()
+	}
+	c2.Close()
+
+	// the client rejects too large a response.
+	srv2 := NewRPCServer(nil)
+	checkErrT(t, srv2.Register("echo", func(s string) string { return s }))
+	cl = srv2.PipeClient(&RPCOptions{MaxResponseSize: 2048})
+	defer cl.Close()
+	_, err = cl.Call(ctx, "echo", strings.Repeat("x", 3000))
+	if err != ErrRPCMessageTooLarge {
+		logT(t, "expected ErrRPCMessageTooLarge, got: %v", err)
+		t.FailNow()
+	}
+
+	// and so does a codec.
+	rsrv := rpc.NewServer()
+	checkErrT(t, rsrv.RegisterName("Sum", testRpcSum{}))
+	for _, p := range []RPCProtocol{ RPCBasicProtocol, RPCCustomProtocol, RPCSpecProtocol } {
+		cc, sc := NewPipeRPCCodecs(&RPCOptions{Protocol: p, MaxRequestSize: 64})
+		go rsrv.ServeCodec(sc)
+		rcl := rpc.NewClientWithCodec(cc)
+		var sum int
+		checkErrT(t, rcl.Call("Sum.Add", []int{1, 2}, &sum))
+		if err = rcl.Call("Sum.Add", make([]int, 100), &sum); err == nil {
+			logT(t, "protocol %v: expected an error for too large a request", p)
+			t.FailNow()
+		}
+		rcl.Close()
+	}
+}
+
+// testCycleReader reads b over and over.
+type testCycleReader struct {
+	b []byte
+	i int
+}
+
+func (r *testCycleReader) Read(p []byte) (n int, err error) {
+	n = copy(p, r.b[r.i:])
+	r.i = (r.i + n) % len(r.b)
+	return
+}
+
+func TestRPCCodecReuse(t *testing.T) {
+	msg, err := Marshal([]interface{}{ 0, 1, "Sum.Add", []interface{}{ []int{ 1, 2, 3 } } })
+	checkErrT(t, err)
+	conn := struct {
+		io.Reader
+		io.Writer
+		io.Closer
+	}{ &testCycleReader{b: msg}, ioutil.Discard, ioutil.NopCloser(nil) }
+	sc := NewSpecRPCServerCodec(conn, nil)
+	var req rpc.Request
+	args := make([]int, 0, 3)
+	allocs := testing.AllocsPerRun(100, func() {
+		checkErrT(t, sc.ReadRequestHeader(&req))
+		checkErrT(t, sc.ReadRequestBody(&args))
+		checkErrT(t, sc.WriteResponse(&rpc.Response{ ServiceMethod: req.ServiceMethod, Seq: req.Seq }, 6))
+	})
+	checkEqualT(t, args, []int{ 1, 2, 3 })
+	// the method name, and the boxing of the messages, but no buffers or decoders.
+	if allocs > 5 {
+		logT(t, "expected at most 5 allocations per call, got %v", allocs)
+		t.FailNow()
+	}
+}
+
+func TestRPCMethodNames(t *testing.T) {
+	for _, v := range [][2]string{ {"User.GetUser", "get_user"}, {"GetUser", "get_user"}, 
+		{"Conn.ReadHTTPHeader", "read_http_header"}, {"Sum.Add2", "add2"}, {"ID", "id"} } {
+		checkEqualT(t, RPCSnakeCaseMethod(v[0]), v[1])
+	}
+	toSum := RPCServiceMethod("Sum")
+	checkEqualT(t, toSum("add"), "Sum.Add")
+	checkEqualT(t, toSum("read_http_header"), "Sum.ReadHttpHeader")
+	checkEqualT(t, toSum("Other.Add"), "Other.Add")
+
+	// a net/rpc client calling a server with snake_case names.
+	srv := NewRPCServer(nil)
+	checkErrT(t, srv.Register("add", func(xs []int) (n int) {
+		for _, x := range xs {
+			n += x
+		}
+		return
+	}))
+	c1, c2 := net.Pipe()
+	go srv.ServeConn(c1)
+	var events []string
+	cl := rpc.NewClientWithCodec(NewRPCCodecOpts(c2, &RPCOptions{ Protocol: RPCSpecProtocol, 
+		MethodNameOut: RPCSnakeCaseMethod, 
+		Interceptors: []RPCInterceptor{ { WriteRequest: func(r *rpc.Request, body interface{}, next func(*rpc.Request, interface{}) error) error {
+			events = append(events, r.ServiceMethod)
+			return next(r, body)
+		} } },
+	}))
+	var sum int
+	checkErrT(t, cl.Call("Sum.Add", []int{1, 2, 3}, &sum))
+	checkEqualT(t, sum, 6)
+	checkEqualT(t, events, []string{ "Sum.Add" })
+	cl.Close()
+
+	// a net/rpc server called with snake_case names.
+	rsrv := rpc.NewServer()
+	checkErrT(t, rsrv.RegisterName("Sum", testRpcSum{}))
+	c1, c2 = net.Pipe()
+	go rsrv.ServeCodec(NewRPCCodecOpts(c1, &RPCOptions{ Protocol: RPCSpecProtocol, MethodNameIn: toSum }))
+	rcl := NewRPCClient(c2, nil)
+	defer rcl.Close()
+	res, err := rcl.Call(context.Background(), "add", []int{4, 5})
+	checkErrT(t, err)
+	checkErrT(t, res.Decode(&sum))
+	checkEqualT(t, sum, 9)
+}
+
+type testRPCStats struct {
+	mu sync.Mutex
+	started, completed []string
+	errs int
+	read, written, encoded, decoded int64
+}
+
+func (s *testRPCStats) CallStarted(method string) {
+	s.mu.Lock()
+	s.started = append(s.started, method)
+	s.mu.Unlock()
+}
+
+func (s *testRPCStats) CallCompleted(method string, d time.Duration, err error) {
+	s.mu.Lock()
+	s.completed = append(s.completed, method)
+	if err != nil {
+		s.errs++
+	}
+	s.mu.Unlock()
+}
+
+func (s *testRPCStats) BytesRead(n int) { atomic.AddInt64(&s.read, int64(n)) }
+func (s *testRPCStats) BytesWritten(n int) { atomic.AddInt64(&s.written, int64(n)) }
+func (s *testRPCStats) Encoded(d time.Duration) { atomic.AddInt64(&s.encoded, 1) }
+func (s *testRPCStats) Decoded(d time.Duration) { atomic.AddInt64(&s.decoded, 1) }
+
+func TestRPCStats(t *testing.T) {
+	rsrv := rpc.NewServer()
+	checkErrT(t, rsrv.RegisterName("Sum", testRpcSum{}))
+	var cs, ss testRPCStats
+	c1, c2 := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		rsrv.ServeCodec(NewRPCCodecOpts(c1, &RPCOptions{ Protocol: RPCSpecProtocol, Stats: &ss }))
+		close(done)
+	}()
+	cl := rpc.NewClientWithCodec(NewRPCCodecOpts(c2, &RPCOptions{ Protocol: RPCSpecProtocol, Stats: &cs }))
+	var sum int
+	checkErrT(t, cl.Call("Sum.Add", []int{1, 2}, &sum))
+	if err := cl.Call("Sum.Nope", []int{1}, &sum); err == nil {
+		logT(t, "expected an error calling an unknown method")
+		t.FailNow()
+	}
+	cl.Close()
+	<-done
+	for _, s := range []*testRPCStats{ &cs, &ss } {
+		// the server may report a call completed after the client sees its response.
+		sort.Strings(s.completed)
+		checkEqualT(t, s.started, []string{ "Sum.Add", "Sum.Nope" })
+		checkEqualT(t, s.completed, []string{ "Sum.Add", "Sum.Nope" })
+		checkEqualT(t, s.errs, 1)
+		checkEqualT(t, s.encoded, int64(2))
+	}
+	checkEqualT(t, cs.decoded, int64(1))
+	checkEqualT(t, ss.decoded, int64(1)) // the unknown method's body is discarded
+	checkEqualT(t, cs.written, ss.read)
+	checkEqualT(t, cs.read, ss.written)
+	if cs.written == 0 || cs.read == 0 {
+		logT(t, "expected bytes read and written, got %v and %v", cs.read, cs.written)
+		t.FailNow()
+	}
+
+	// an RPCClient and RPCServer.
+	cs, ss = testRPCStats{}, testRPCStats{}
+	srv := NewRPCServer(&RPCOptions{ Stats: &ss })
+	checkErrT(t, srv.Register("add", func(a, b int) int { return a + b }))
+	rcl := srv.PipeClient(&RPCOptions{ Stats: &cs })
+	ctx := context.Background()
+	_, err := rcl.Call(ctx, "add", 1, 2)
+	checkErrT(t, err)
+	_, err = rcl.Call(ctx, "nope")
+	if _, ok := err.(*RPCError); !ok {
+		logT(t, "expected an *RPCError, got: %v", err)
+		t.FailNow()
+	}
+	rcl.Close()
+	srv.Shutdown(ctx)
+	for _, s := range []*testRPCStats{ &cs, &ss } {
+		s.mu.Lock()
+		sort.Strings(s.completed)
+		checkEqualT(t, s.started, []string{ "add", "nope" })
+		checkEqualT(t, s.completed, []string{ "add", "nope" })
+		checkEqualT(t, s.errs, 1)
+		s.mu.Unlock()
+		if atomic.LoadInt64(&s.encoded) != 2 || atomic.LoadInt64(&s.read) == 0 || atomic.LoadInt64(&s.written) == 0 {
+			logT(t, "expected 2 messages encoded, and bytes read and written: %+v", s)
+			t.FailNow()
+		}
+	}
+}
+
+func TestGracefulRPCServerCodec(t *testing.T) {
+	rsrv := rpc.NewServer()
+	checkErrT(t, rsrv.RegisterName("Slow", new(testRpcSlow)))
+	for _, p := range []RPCProtocol{ RPCBasicProtocol, RPCSpecProtocol } {
+		opts := &RPCOptions{ Protocol: p }
+		c1, c2 := net.Pipe()
+		sc := NewGracefulRPCServerCodec(c1, opts)
+		go rsrv.ServeCodec(sc)
+		cl := rpc.NewClientWithCodec(NewRPCCodecOpts(c2, opts))
+		var n int
+		call := cl.Go("Slow.Sleep", 50, &n, nil)
+		time.Sleep(10 * time.Millisecond)
+		ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+		checkErrT(t, sc.Shutdown(ctx))
+		cancel()
+		// the call in progress gets its response, and the connection is then closed.
+		<-call.Done
+		checkErrT(t, call.Error)
+		checkEqualT(t, n, 50)
+		if err := cl.Call("Slow.Sleep", 1, &n); err == nil {
+			logT(t, "protocol %v: expected an error calling after shutdown", p)
+			t.FailNow()
+		}
+		cl.Close()
+	}
+
+	// shutting down times out.
+	c1, c2 := net.Pipe()
+	sc := NewGracefulRPCServerCodec(c1, nil)
+	go rsrv.ServeCodec(sc)
+	cl := rpc.NewClientWithCodec(NewRPCClientCodec(c2, nil))
+	defer cl.Close()
+	var n int
+	call := cl.Go("Slow.Sleep", 1000, &n, nil)
+	time.Sleep(10 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 20 * time.Millisecond)
+	defer cancel()
+	if err := sc.Shutdown(ctx); err != context.DeadlineExceeded {
+		logT(t, "expected context.DeadlineExceeded, got: %v", err)
+		t.FailNow()
+	}
+	<-call.Done
+	if call.Error == nil {
+		logT(t, "expected the call to fail")
+		t.FailNow()
+	}
+}
+
+func TestRPCCancel(t *testing.T) {
+	srv := NewRPCServer(nil)
+	started, stopped := make(chan bool, 1), make(chan error, 1)
+	srv.Handle("wait", func(ctx context.Context, params *Decoder) (interface{}, error) {
+		started <- true
+		<-ctx.Done()
+		stopped <- ctx.Err()
+		return nil, ctx.Err()
+	})
+	cl := srv.PipeClient(nil)
+	defer cl.Close()
+	waitStopped := func() {
+		select {
+		case err := <-stopped:
+			checkEqualT(t, err, context.Canceled)
+		case <-time.After(5 * time.Second):
+			logT(t, "handler was not cancelled")
+			t.FailNow()
+		}
+	}
+
+	// the client cancelling a call cancels the handler's context.
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		_, err := cl.Call(ctx, "wait")
+		errs <- err
+	}()
+	<-started
+	cancel()
+	checkEqualT(t, <-errs, context.Canceled)
+	waitStopped()
+
+	// so does closing a stream early.
+	st, err := cl.CallStream(context.Background(), "wait")
+	checkErrT(t, err)
+	<-started
+	st.Close()
+	waitStopped()
+
+	// and the connection being closed.
+	go cl.Call(context.Background(), "wait")
+	<-started
+	cl.Close()
+	waitStopped()
+}
+
+func TestRPCOutOfOrder(t *testing.T) {
+	type orphan struct {
+		msgid uint64
+		rerr, result string
+	}
+	orphans := make(chan orphan, 4)
+	opts := &RPCOptions{ OnOrphanResponse: func(msgid uint64, rerr, result Raw) {
+		orphans <- orphan{ msgid, string(rerr), string(result) }
+	} }
+	// server answers each pair of calls in reverse order, then again (and to an unknown msgid).
+	server := func(c net.Conn) {
+		dec, enc := NewDecoder(c, testDecOpts(nil, nil, true, true, true)), NewEncoder(c)
+		for {
+			var m1, m2 []interface{}
+			if dec.Decode(&m1) != nil || dec.Decode(&m2) != nil {
+				return
+			}
+			for _, m := range [][]interface{}{ m2, m1, m1 } {
+				params := m[3].([]interface{})
+				enc.Encode([]interface{}{ 1, m[1], nil, params[0] })
+			}
+			enc.Encode([]interface{}{ 1, 12345, "gone", nil })
+		}
+	}
+	checkOrphan := func(msgid uint64, rerr, result interface{}) {
+		o := <-orphans
+		checkEqualT(t, o.msgid, msgid)
+		var want string
+		if rerr != nil {
+			bs, err := Marshal(rerr)
+			checkErrT(t, err)
+			want = string(bs)
+		}
+		checkEqualT(t, o.rerr, want)
+		bs, err := Marshal(result)
+		checkErrT(t, err)
+		checkEqualT(t, o.result, string(bs))
+	}
+
+	// net/rpc with a spec codec.
+	c1, c2 := net.Pipe()
+	go server(c1)
+	codec := NewSpecRPCCodecOpts(c2, opts)
+	cl := rpc.NewClientWithCodec(codec)
+	var s1, s2 string
+	call1 := cl.Go("Echo", "a", &s1, nil)
+	time.Sleep(10 * time.Millisecond) // so calls are sent in order
+	call2 := cl.Go("Echo", "b", &s2, nil)
+	checkErrT(t, (<-call1.Done).Error)
+	checkErrT(t, (<-call2.Done).Error)
+	checkEqualT(t, s1, "a")
+	checkEqualT(t, s2, "b")
+	checkOrphan(0, nil, "a") // net/rpc seqs start at 0
+	checkOrphan(12345, "gone", nil)
+
+	// a msgid in use is not reused when the seq wraps around.
+	err := codec.WriteRequest(&rpc.Request{ ServiceMethod: "Echo", Seq: 1<<32 }, "c")
+	checkErrT(t, err)
+	checkEqualT(t, codec.WriteRequest(&rpc.Request{ ServiceMethod: "Echo", Seq: 2<<32 }, "d"), ErrRPCMsgidInUse)
+	cl.Close()
+
+	// an RPCClient.
+	c1, c2 = net.Pipe()
+	go server(c1)
+	rcl := NewRPCClient(c2, opts)
+	defer rcl.Close()
+	ctx := context.Background()
+	type reply struct {
+		res RPCResult
+		err error
+	}
+	call := func(arg string) chan reply {
+		ch := make(chan reply, 1)
+		go func() {
+			res, err := rcl.Call(ctx, "echo", arg)
+			ch <- reply{ res, err }
+		}()
+		time.Sleep(10 * time.Millisecond)
+		return ch
+	}
+	// the msgids wrap around, skipping one still in use.
+	wrap := func() {
+		rcl.mu.Lock()
+		rcl.seq = math.MaxUint32
+		rcl.mu.Unlock()
+	}
+	wrap()
+	r1 := call("a") // msgid 0
+	wrap()
+	r2 := call("b") // msgid 1
+	for _, x := range []struct {
+		ch chan reply
+		s string
+	}{ { r1, "a" }, { r2, "b" } } {
+		rep := <-x.ch
+		checkErrT(t, rep.err)
+		var s string
+		checkErrT(t, rep.res.Decode(&s))
+		checkEqualT(t, s, x.s)
+	}
+	checkOrphan(0, nil, "a")
+	checkOrphan(12345, "gone", nil)
+	r1, r2 = call("c"), call("d")
+	checkErrT(t, (<-r1).err)
+	checkErrT(t, (<-r2).err)
+	checkOrphan(2, nil, "c")
+	checkOrphan(12345, "gone", nil)
+}
+
+func TestHTTPHelpers(t *testing.T) {
+	type point struct {
+		X, Y int
+		Name string
+	}
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p point
+		if err := DecodeRequest(r, &p); err != nil {
+			code := http.StatusBadRequest
+			if err == ErrUnsupportedMediaType {
+				code = http.StatusUnsupportedMediaType
+			}
+			w.WriteHeader(code)
+			return
+		}
+		p.X, p.Y = p.Y, p.X
+		NegotiateResponse(w, r)
+		checkErrT(t, WriteResponse(w, http.StatusCreated, &p))
+	})
+	mp, err := Marshal(&point{ 1, 2, "a" })
+	checkErrT(t, err)
+	for _, x := range []struct {
+		contentType, accept string
+		body []byte
+		code int
+		respType string
+	}{
+		{ "", "", mp, http.StatusCreated, MsgpackContentType },
+		{ "application/msgpack", "application/json", mp, http.StatusCreated, "application/json" },
+		{ "application/json; charset=utf-8", "", []byte(`{"X": 1, "Y": 2, "Name": "a"}`), http.StatusCreated, MsgpackContentType },
+		{ "application/x-msgpack", "application/json;q=0.5, application/msgpack", mp, http.StatusCreated, MsgpackContentType },
+		{ "application/msgpack", "application/*;q=0.9, application/json", mp, http.StatusCreated, "application/json" },
+		{ "application/msgpack", "*/*, application/msgpack;q=0.1", mp, http.StatusCreated, "application/json" },
+		{ "application/msgpack", "text/html", mp, http.StatusCreated, MsgpackContentType },
+		{ "text/plain", "", []byte("x"), http.StatusUnsupportedMediaType, "" },
+		{ "application/json", "", []byte("{"), http.StatusBadRequest, "" },
+	} {
+		r := httptest.NewRequest("POST", "/", bytes.NewReader(x.body))
+		if x.contentType != "" {
+			r.Header.Set("Content-Type", x.contentType)
+		}
+		if x.accept != "" {
+			r.Header.Set("Accept", x.accept)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		checkEqualT(t, w.Code, x.code)
+		if x.code != http.StatusCreated {
+			continue
+		}
+		checkEqualT(t, w.Header().Get("Content-Type"), x.respType)
+		checkEqualT(t, w.Header().Get("Content-Length"), strconv.Itoa(w.Body.Len()))
+		var p point
+		if x.respType == "application/json" {
+			checkErrT(t, json.Unmarshal(w.Body.Bytes(), &p))
+		} else {
+			checkErrT(t, Unmarshal(w.Body.Bytes(), &p, nil))
+		}
+		checkEqualT(t, p, point{ 2, 1, "a" })
+	}
+
+	// a value which cannot be encoded leaves the response unwritten.
+	w := httptest.NewRecorder()
+	if err = WriteResponse(w, http.StatusOK, make(chan int)); err == nil {
+		logT(t, "expected an error encoding a chan")
+		t.FailNow()
+	}
+	checkEqualT(t, w.Header().Get("Content-Type"), "")
+}
+
+func TestSQLValue(t *testing.T) {
+	type settings struct {
+		Theme string
+		Tags []string
+		Data []byte
+	}
+	in := NewSQLValue(settings{ "dark", []string{ "a", "b" }, []byte{ 1, 2 } })
+	var _ driver.Valuer = in
+	var _ sql.Scanner = &in
+	dv, err := in.Value()
+	checkErrT(t, err)
+	bs, ok := dv.([]byte)
+	checkEqualT(t, ok, true)
+	var out SQLValue[settings]
+	checkErrT(t, out.Scan(bs))
+	checkEqualT(t, out, in)
+	// the driver may reuse the bytes it scanned from.
+	for i := range bs {
+		bs[i] = 0
+	}
+	checkEqualT(t, out, in)
+	dv, err = in.Value()
+	checkErrT(t, err)
+	out = SQLValue[settings]{}
+	checkErrT(t, out.Scan(string(dv.([]byte))))
+	checkEqualT(t, out, in)
+
+	// NULL
+	checkErrT(t, out.Scan(nil))
+	checkEqualT(t, out, SQLValue[settings]{})
+	dv, err = out.Value()
+	checkErrT(t, err)
+	checkEqualT(t, dv, nil)
+
+	if err = out.Scan(int64(1)); err == nil {
+		logT(t, "expected an error scanning an int64")
+		t.FailNow()
+	}
+	if err = out.Scan([]byte{ 0xc1 }); err == nil || out.Valid {
+		logT(t, "expected an error scanning an invalid blob. Got: %v, %v", err, out.Valid)
+		t.FailNow()
+	}
+}
+
+func TestCodec(t *testing.T) {
+	type userV1 struct {
+		Name string
+	}
+	type user struct {
+		First, Last string
+		Tags []string
+	}
+	c := &Codec{ Encoder: &EncoderOptions{ NilSliceAsEmpty: true } }
+	bs, err := c.Marshal(&user{ First: "a", Last: "b" })
+	checkErrT(t, err)
+	var u user
+	checkErrT(t, c.Unmarshal(bs, &u))
+	checkEqualT(t, u, user{ First: "a", Last: "b" })
+	bs2, err := Marshal(&user{ "a", "b", []string{} })
+	checkErrT(t, err)
+	checkEqualT(t, bs, bs2)
+
+	// versioned blobs: an old one is upgraded, one of an unknown version fails.
+	v1 := &Codec{ Version: 1 }
+	old, err := v1.Marshal(&userV1{ "c d" })
+	checkErrT(t, err)
+	checkEqualT(t, old[0], byte(1))
+	c = &Codec{ Decoder: &DecoderOptions{ ReplaceExisting: true }, Version: 2 }
+	checkEqualT(t, c.Unmarshal(old, &u), error(&CodecVersionError{ Version: 1, Want: 2 }))
+	checkEqualT(t, c.Unmarshal(nil, &u), error(&CodecVersionError{ Want: 2 }))
+	c.Upgrade = func(version byte, data []byte, v interface{}) (err error) {
+		if version != 1 {
+			return &CodecVersionError{ Version: version, Want: 2 }
+		}
+		var u1 userV1
+		if err = Unmarshal(data, &u1, nil); err != nil {
+			return
+		}
+		*v.(*user) = user{ First: strings.Fields(u1.Name)[0], Last: strings.Fields(u1.Name)[1] }
+		return
+	}
+	checkErrT(t, c.Unmarshal(old, &u))
+	checkEqualT(t, u, user{ First: "c", Last: "d" })
+	bs, err = c.Marshal(&user{ "e", "f", nil })
+	checkErrT(t, err)
+	checkEqualT(t, bs[0], byte(2))
+	checkErrT(t, c.Unmarshal(bs, &u))
+	checkEqualT(t, u, user{ First: "e", Last: "f" })
+
+	// pooling: fewer allocations than encoding and decoding afresh.
+	unpooled := testing.AllocsPerRun(100, func() {
+		var buf bytes.Buffer
+		buf.WriteByte(2)
+		NewEncoderEx(&buf, c.Encoder).Encode(&u)
+		bs = append([]byte(nil), buf.Bytes()...)
+		NewDecoderBytes(bs[1:], c.Decoder).Decode(&u)
+	})
+	allocs := testing.AllocsPerRun(100, func() {
+		bs, _ = c.Marshal(&u)
+		c.Unmarshal(bs, &u)
+	})
+	if allocs >= unpooled {
+		logT(t, "expected fewer allocations than %v per Marshal/Unmarshal. Got: %v", unpooled, allocs)
+		t.FailNow()
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			in := user{ First: strconv.Itoa(i), Tags: []string{ "x" } }
+			for j := 0; j < 100; j++ {
+				bs, err := c.Marshal(&in)
+				checkErrT(t, err)
+				var out user
+				checkErrT(t, c.Unmarshal(bs, &out))
+				checkEqualT(t, out, in)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestTypeRegistry(t *testing.T) {
+	type named struct {
+		A int
+	}
+	type holder struct {
+		V interface{}
+		N named
+		Vs []interface{}
+		M map[string]interface{}
+	}
+	types := NewTypeRegistry()
+	checkErrT(t, types.Register("named", named{}))
+	checkErrT(t, types.Register("pnamed", &named{}))
+	checkErrT(t, types.Register("named", named{}))
+	if err := types.Register("named", 1); err == nil {
+		logT(t, "expected an error registering a name again")
+		t.FailNow()
+	}
+	if err := types.Register("other", named{}); err == nil {
+		logT(t, "expected an error registering a type again")
+		t.FailNow()
+	}
+	if err := NewExtRegistry().Add(reflect.TypeOf(0), ExtTyped, encComplexExt, decComplexExt); err == nil {
+		logT(t, "expected an error adding the reserved ext type ExtTyped")
+		t.FailNow()
+	}
+
+	in := holder{ 
+		V: &named{ 1 }, 
+		N: named{ 2 }, 
+		Vs: []interface{}{ named{ 3 }, "x" }, 
+		M: map[string]interface{}{ "a": named{ 4 } },
+	}
+	var buf bytes.Buffer
+	checkErrT(t, NewEncoderEx(&buf, &EncoderOptions{ Types: types }).Encode(&in))
+	var out holder
+	checkErrT(t, NewDecoder(bytes.NewReader(buf.Bytes()), &DecoderOptions{ Types: types }).Decode(&out))
+	checkEqualT(t, out.V, in.V)
+	checkEqualT(t, out.N, in.N)
+	checkEqualT(t, out.Vs[0], in.Vs[0])
+	checkEqualT(t, out.M["a"], in.M["a"])
+
+	// without the registry, the named value cannot be decoded into an interface, 
+	// but it can be into its type.
+	var out2 holder
+	if err := NewDecoderBytes(buf.Bytes(), nil).Decode(&out2); err == nil {
+		logT(t, "expected an error decoding a named type without a TypeRegistry")
+		t.FailNow()
+	}
+	bs, err := Marshal(&in.V)
+	checkErrT(t, err)
+	buf.Reset()
+	checkErrT(t, NewEncoderEx(&buf, &EncoderOptions{ Types: types }).Encode([]interface{}{ &named{ 5 } }))
+	var ns []named
+	checkErrT(t, Unmarshal(buf.Bytes(), &ns, nil))
+	checkEqualT(t, ns, []named{ { 5 } })
+	// a value not held in an interface is encoded as usual.
+	buf.Reset()
+	checkErrT(t, NewEncoderEx(&buf, &EncoderOptions{ Types: types }).Encode(in.V))
+	checkEqualT(t, buf.Bytes(), bs)
+}
+
+func TestCBOR(t *testing.T) {
+	toCBOR := func(o *CBOROptions, v interface{}) string {
+		bs, err := Marshal(v)
+		checkErrT(t, err)
+		var buf bytes.Buffer
+		checkErrT(t, o.MsgpackToCBOR(&buf, bytes.NewReader(bs)))
+		return hex.EncodeToString(buf.Bytes())
+	}
+	fromCBOR := func(o *CBOROptions, h string) (v interface{}, err error) {
+		bs, _ := hex.DecodeString(h)
+		var buf bytes.Buffer
+		if err = o.CBORToMsgpack(&buf, bytes.NewReader(bs)); err == nil {
+			err = Unmarshal(buf.Bytes(), &v, testDecOpts(nil, nil, true, true, true))
+		}
+		return
+	}
+	// examples from RFC 8949, Appendix A.
+	for _, x := range []struct {
+		v interface{}
+		cbor string
+	}{
+		{ 0, "00" }, { 24, "1818" }, { 1000, "1903e8" }, { uint64(18446744073709551615), "1bffffffffffffffff" },
+		{ -1, "20" }, { -1000, "3903e7" }, { 1.5, "fb3ff8000000000000" }, { float32(100000), "fa47c35000" },
+		{ true, "f5" }, { nil, "f6" }, { "a", "6161" }, { "\u00fc", "62c3bc" }, { []byte{ 0xff }, "41ff" },
+		{ []interface{}{ 1, []int{ 2, 3 } }, "8201820203" }, { map[string]int{ "a": 1 }, "a1616101" },
+	} {
+		checkEqualT(t, toCBOR(nil, x.v), x.cbor)
+		v, err := fromCBOR(nil, x.cbor)
+		checkErrT(t, err)
+		// compare the values (ints may come back with another width or signedness).
+		bs, _ := Marshal(x.v)
+		var v0 interface{}
+		checkErrT(t, Unmarshal(bs, &v0, testDecOpts(nil, nil, true, true, true)))
+		checkEqualT(t, fmt.Sprint(v), fmt.Sprint(v0))
+	}
+	for _, x := range []struct {
+		cbor string
+		v interface{}
+	}{
+		{ "f93c00", float32(1) }, { "f97bff", float32(65504) }, { "f90001", float32(5.960464477539063e-8) }, 
+		{ "f9fc00", float32(math.Inf(-1)) }, { "f7", nil }, { "c11a514b67b0", uint32(1363896240) },
+		{ "9f018202039f0405ffff", []interface{}{ int8(1), []interface{}{ int8(2), int8(3) }, []interface{}{ int8(4), int8(5) } } },
+		{ "7f657374726561646d696e67ff", "streaming" },
+		{ "bf61610161629f0203ffff", map[interface{}]interface{}{ "a": int8(1), "b": []interface{}{ int8(2), int8(3) } } },
+	} {
+		v, err := fromCBOR(nil, x.cbor)
+		checkErrT(t, err)
+		checkEqualT(t, fmt.Sprintf("%T %v", v, v), fmt.Sprintf("%T %v", x.v, x.v))
+	}
+	// (5a10000000 is a truncated byte string claiming 256MB)
+	for _, h := range []string{ "ff", "3bffffffffffffffff", "f0", "9f01", "7f4161ff", "bf01ff", "1c", "5a10000000" } {
+		if _, err := fromCBOR(nil, h); err == nil {
+			logT(t, "expected an error transcoding CBOR %s", h)
+			t.FailNow()
+		}
+	}
+	// nesting deeper than decMaxDepth is an error both ways, not a stack overflow
+	deep := bytes.Repeat([]byte{ 0x91 }, decMaxDepth + 1)
+	if err := MsgpackToCBOR(io.Discard, bytes.NewReader(deep)); err == nil {
+		logT(t, "expected an error transcoding msgpack nested %d deep", len(deep))
+		t.FailNow()
+	}
+	deep = bytes.Repeat([]byte{ 0x81 }, decMaxDepth + 1)
+	if err := CBORToMsgpack(io.Discard, bytes.NewReader(deep)); err == nil {
+		logT(t, "expected an error transcoding CBOR nested %d deep", len(deep))
+		t.FailNow()
+	}
+
+	// ext values and tags
+	var ext bytes.Buffer
+	e := NewEncoder(&ext)
+	e.writeExtHeader(5, 3)
+	e.writeb(3, []byte("abc"))
+	var buf bytes.Buffer
+	checkErrT(t, MsgpackToCBOR(&buf, bytes.NewReader(ext.Bytes())))
+	checkEqualT(t, hex.EncodeToString(buf.Bytes()), "da4d50000543616263")
+	var back bytes.Buffer
+	checkErrT(t, CBORToMsgpack(&back, &buf))
+	checkEqualT(t, back.Bytes(), ext.Bytes())
+	o := &CBOROptions{ 
+		ExtToTag: func(xtag int8) (uint64, bool) { return 40000 + uint64(xtag), xtag == 5 },
+		TagToExt: func(tag uint64) (int8, bool) { return int8(tag - 40000), tag == 40005 },
+	}
+	buf.Reset()
+	checkErrT(t, o.MsgpackToCBOR(&buf, bytes.NewReader(ext.Bytes())))
+	checkEqualT(t, hex.EncodeToString(buf.Bytes()), "d99c4543616263")
+	back.Reset()
+	checkErrT(t, o.CBORToMsgpack(&back, &buf))
+	checkEqualT(t, back.Bytes(), ext.Bytes())
+	if _, err := fromCBOR(o, "d99c4501"); err == nil {
+		logT(t, "expected an error transcoding a tag translated to an ext, which is not of a byte string")
+		t.FailNow()
+	}
+}
+
+type testHookLevel int
+
+func (l *testHookLevel) UnmarshalText(b []byte) error {
+	switch string(b) {
+	case "low":
+		*l = 1
+	case "high":
+		*l = 2
+	default:
+		return fmt.Errorf("unknown level: %q", b)
+	}
+	return nil
+}
+
+func TestDecodeHooks(t *testing.T) {
+	type out struct {
+		When time.Time
+		Level testHookLevel
+		Color string
+		Ratio float64
+		N int
+	}
+	in := map[string]interface{}{ 
+		"When": "2012-06-01T10:20:30Z", "Level": "high", "Color": 2, "Ratio": 3, "N": 7,
+	}
+	bs, err := Marshal(in)
+	checkErrT(t, err)
+	colors := func(from ValueType, to reflect.Type, data interface{}) (interface{}, error) {
+		if i, ok := data.(int64); ok && to.Kind() == reflect.String {
+			return []string{ "red", "green", "blue" }[i], nil
+		}
+		return data, nil
+	}
+	hooks := []DecodeHook{ StringToTimeHook(time.RFC3339), TextUnmarshalerHook, colors }
+	var v out
+	checkErrT(t, NewDecoderBytes(bs, &DecoderOptions{ DecodeHooks: hooks }).Decode(&v))
+	checkEqualT(t, v, out{ time.Date(2012, 6, 1, 10, 20, 30, 0, time.UTC), 2, "blue", 3, 7 })
+	
+	// hooks apply to the elements of []string and map[string]string too.
+	dec := func(in, out interface{}) {
+		bs, err := Marshal(in)
+		checkErrT(t, err)
+		checkErrT(t, NewDecoderBytes(bs, &DecoderOptions{ DecodeHooks: hooks }).Decode(out))
+	}
+	var ss []string
+	dec([]int{ 1, 2 }, &ss)
+	checkEqualT(t, ss, []string{ "green", "blue" })
+	var ms map[string]string
+	dec(map[string]int{ "a": 1 }, &ms)
+	checkEqualT(t, ms, map[string]string{ "a": "green" })
+	var vs struct{ Colors []string }
+	dec(map[string]interface{}{ "Colors": []int{ 0, 2 } }, &vs)
+	checkEqualT(t, vs.Colors, []string{ "red", "blue" })
+	
+	// without hooks (or with none handling a value), mismatched values cannot be decoded.
+	if err = Unmarshal(bs, &v, nil); err == nil {
+		logT(t, "expected an error decoding mismatched values without hooks")
+		t.FailNow()
+	}
+	if err = NewDecoderBytes(bs, &DecoderOptions{ DecodeHooks: hooks[:2] }).Decode(&v); err == nil {
+		logT(t, "expected an error decoding an int into a string with no hook for it")
+		t.FailNow()
+	}
+	// hook errors are returned.
+	bs, err = Marshal(map[string]interface{}{ "Level": "medium" })
+	checkErrT(t, err)
+	if err = NewDecoderBytes(bs, &DecoderOptions{ DecodeHooks: hooks }).Decode(&v); err == nil || 
+		!strings.Contains(err.Error(), "unknown level") {
+		logT(t, "expected the hook error, got: %v", err)
+		t.FailNow()
+	}
+}
+
+type testLifecycle struct {
+	Items []int
+	Count int `msgpack:"-"`
+	Total int
+}
+
+func (l *testLifecycle) BeforeMsgpackEncode() error {
+	l.Total = 0
+	for _, i := range l.Items {
+		l.Total += i
+	}
+	return nil
+}
+
+func (l *testLifecycle) AfterMsgpackDecode() error {
+	l.Count = len(l.Items)
+	if l.Total < 0 {
+		return errors.New("negative total")
+	}
+	return nil
+}
+
+func TestLifecycleCallbacks(t *testing.T) {
+	// called on addressable and non-addressable (copied) structs, and nested ones.
+	in := testLifecycle{ Items: []int{ 1, 2, 3 } }
+	for _, v := range []interface{}{ in, &in, []testLifecycle{ in }, map[string]testLifecycle{ "a": in } } {
+		bs, err := Marshal(v)
+		checkErrT(t, err)
+		var m interface{}
+		checkErrT(t, Unmarshal(bs, &m, testDecOpts(nil, nil, true, true, true)))
+		checkEqualT(t, strings.Contains(fmt.Sprint(m), "Total:6"), true)
+	}
+	bs, err := Marshal([]testLifecycle{ in })
+	checkErrT(t, err)
+	var out []testLifecycle
+	checkErrT(t, Unmarshal(bs, &out, nil))
+	checkEqualT(t, out, []testLifecycle{ { []int{ 1, 2, 3 }, 3, 6 } })
+	
+	bs, err = Marshal(map[string]interface{}{ "Total": -1 })
+	checkErrT(t, err)
+	var out2 testLifecycle
+	if err = Unmarshal(bs, &out2, nil); err == nil || !strings.Contains(err.Error(), "negative total") {
+		logT(t, "expected the AfterMsgpackDecode error, got: %v", err)
+		t.FailNow()
+	}
+}
+
+func TestFieldDefaults(t *testing.T) {
+	type opts struct {
+		Name string `msgpack:"name,default=anon, the"`
+		Retries int `msgpack:",default=3"`
+		Ratio *float64 `msgpack:",default=0.5"`
+		Timeout time.Duration `msgpack:",omitempty,default=1m30s"`
+		Addr net.IP `msgpack:",default=127.0.0.1"`
+		On bool `msgpack:",default=true"`
+		N int
+	}
+	bs, err := Marshal(map[string]interface{}{ "Retries": 0, "N": 2 })
+	checkErrT(t, err)
+	var v opts
+	checkErrT(t, Unmarshal(bs, &v, nil))
+	half := 0.5
+	checkEqualT(t, v, opts{ "anon, the", 0, &half, 90 * time.Second, net.ParseIP("127.0.0.1"), true, 2 })
+	
+	// without ReplaceExisting, only zero fields are defaulted.
+	v = opts{ Name: "x", On: false, N: 5 }
+	checkErrT(t, Unmarshal(bs, &v, nil))
+	checkEqualT(t, v.Name, "x")
+	checkEqualT(t, v.On, true)
+	v.Name = "x"
+	checkErrT(t, NewDecoderBytes(bs, &DecoderOptions{ ReplaceExisting: true }).Decode(&v))
+	checkEqualT(t, v.Name, "anon, the")
+	
+	// omitempty zero values come back as the default.
+	bs, err = Marshal(opts{ Timeout: 0 })
+	checkErrT(t, err)
+	v = opts{}
+	checkErrT(t, Unmarshal(bs, &v, nil))
+	checkEqualT(t, v.Timeout, 90 * time.Second)
+	
+	type bad struct {
+		M map[string]int `msgpack:",default=x"`
+	}
+	var b bad
+	if err = Unmarshal([]byte{ 0x80 }, &b, nil); err == nil || !strings.Contains(err.Error(), "Invalid default") {
+		logT(t, "expected an invalid default error, got: %v", err)
+		t.FailNow()
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	type userV1 struct {
+		Name string
+		Age string
+	}
+	type userV2 struct {
+		_struct bool `msgpack:",version=2"`
+		Name string
+		Age int
+	}
+	type user struct {
+		_struct bool `msgpack:",version=3"`
+		First, Last string
+		Age int
+	}
+	migs := NewMigrations()
+	checkErrT(t, migs.Add(user{}, 1, func(m map[string]interface{}) (err error) {
+		m["Age"], err = strconv.Atoi(m["Age"].(string))
+		return
+	}))
+	checkErrT(t, migs.Add(&user{}, 2, func(m map[string]interface{}) error {
+		parts := strings.SplitN(m["Name"].(string), " ", 2)
+		m["First"], m["Last"] = parts[0], parts[1]
+		delete(m, "Name")
+		return nil
+	}))
+	if err := migs.Add(user{}, 3, func(map[string]interface{}) error { return nil }); err == nil {
+		logT(t, "expected an error adding a migration from the current version")
+		t.FailNow()
+	}
+	
+	want := user{ First: "Ada", Last: "Lovelace", Age: 36 }
+	opts := &DecoderOptions{ Migrations: migs }
+	for _, in := range []interface{}{ 
+		userV1{ "Ada Lovelace", "36" }, userV2{ Name: "Ada Lovelace", Age: 36 }, want,
+	} {
+		bs, err := Marshal([]interface{}{ in })
+		checkErrT(t, err)
+		var out []user
+		checkErrT(t, NewDecoderBytes(bs, opts).Decode(&out))
+		checkEqualT(t, out, []user{ want })
+	}
+	
+	// the version is encoded, and newer versions are rejected.
+	bs, err := Marshal(want)
+	checkErrT(t, err)
+	var m map[string]interface{}
+	checkErrT(t, Unmarshal(bs, &m, nil))
+	checkEqualT(t, m[SchemaVersionKey], int8(3))
+	var old userV2
+	migs2 := NewMigrations()
+	checkErrT(t, migs2.Add(old, 1, func(map[string]interface{}) error { return nil }))
+	if err = NewDecoderBytes(bs, &DecoderOptions{ Migrations: migs2 }).Decode(&old); err == nil {
+		logT(t, "expected an error decoding a newer version")
+		t.FailNow()
+	}
+}
+
+type testValidated struct {
+	Qty int
+}
+
+var errTestQty = errors.New("qty must be positive")
+
+func (v *testValidated) Validate() error {
+	if v.Qty <= 0 {
+		return errTestQty
+	}
+	return nil
+}
+
+func TestValidate(t *testing.T) {
+	bs, err := Marshal(map[string]interface{}{ "a": testValidated{ 2 }, "b": testValidated{ 0 } })
+	checkErrT(t, err)
+	var v map[string]testValidated
+	checkErrT(t, Unmarshal(bs, &v, nil))
+	checkEqualT(t, v["b"], testValidated{ 0 })
+	
+	err = NewDecoderBytes(bs, &DecoderOptions{ Validate: true }).Decode(&v)
+	var verr *ValidationError
+	if !errors.As(err, &verr) || !errors.Is(err, errTestQty) {
+		logT(t, "expected a ValidationError, got: %v", err)
+		t.FailNow()
+	}
+	checkEqualT(t, verr.Type, reflect.TypeOf(testValidated{}))
+	
+	bs, err = Marshal([]testValidated{ { 1 }, { 3 } })
+	checkErrT(t, err)
+	var vs []*testValidated
+	checkErrT(t, NewDecoderBytes(bs, &DecoderOptions{ Validate: true }).Decode(&vs))
+	checkEqualT(t, vs[1].Qty, 3)
+}
+
+func TestSortMapKeys(t *testing.T) {
+	type named string
+	vs := []interface{}{ 
+		map[string]interface{}{ "b": 2, "a": map[string]string{ "z": "", "y": "", "x": "" }, "c": 3, "ab": 4 },
+		map[named]int{ "b": 2, "a": 1, "c": 3, "é": 5, "B": 0 },
+	}
+	wants := []string{ 
+		"84a16183a178a0a179a0a17aa0a2616204a16202a16303",
+		"85a14200a16101a16202a16303a2c3a905",
+	}
+	for i, v := range vs {
+		for j := 0; j < 4; j++ {
+			var buf bytes.Buffer
+			checkErrT(t, NewEncoderEx(&buf, &EncoderOptions{ SortMapKeys: true }).Encode(v))
+			checkEqualT(t, hex.EncodeToString(buf.Bytes()), wants[i])
+		}
+	}
+}
+
+func TestFieldNameMapper(t *testing.T) {
+	for _, c := range [][3]string{ 
+		{ "UserID", "user_id", "userID" }, { "HTTPServer", "http_server", "httpServer" }, 
+		{ "ID", "id", "id" }, { "Field1", "field1", "field1" }, { "A", "a", "a" }, { "ÉtéX", "été_x", "étéX" },
+	} {
+		checkEqualT(t, SnakeCase(c[0]), c[1])
+		checkEqualT(t, CamelCase(c[0]), c[2])
+	}
+	
+	type rec struct {
+		UserID int
+		FirstName string `msgpack:",omitempty"`
+		Nick string `msgpack:"Handle"`
+	}
+	in := rec{ 7, "Ada", "ada" }
+	var buf bytes.Buffer
+	checkErrT(t, NewEncoderEx(&buf, &EncoderOptions{ FieldNameMapper: SnakeCase }).Encode([]rec{ in, in }))
+	var m []map[string]interface{}
+	checkErrT(t, Unmarshal(buf.Bytes(), &m, nil))
+	checkEqualT(t, m[1], map[string]interface{}{ "user_id": int8(7), "first_name": "Ada", "Handle": "ada" })
+	
+	var out []rec
+	checkErrT(t, NewDecoderBytes(buf.Bytes(), &DecoderOptions{ FieldNameMapper: SnakeCase }).Decode(&out))
+	checkEqualT(t, out, []rec{ in, in })
+	// without the mapper, only the tagged field is decoded.
+	var out2 []rec
+	checkErrT(t, Unmarshal(buf.Bytes(), &out2, nil))
+	checkEqualT(t, out2[0], rec{ Nick: "ada" })
+}
+
+type testPoint struct {
+	X, Y int16
+}
+
+func TestFieldExtTag(t *testing.T) {
+	type rec struct {
+		When time.Time `msgpack:",ext=42"`
+		At *testPoint `msgpack:"at,ext=0x10"`
+		Nil *time.Time `msgpack:",ext=42"`
+	}
+	exts := NewExtRegistry()
+	checkErrT(t, exts.Add(reflect.TypeOf(testPoint{}), 5, 
+		func(rv reflect.Value) ([]byte, error) {
+			p := rv.Interface().(testPoint)
+			return []byte{ byte(p.X), byte(p.Y) }, nil
+		}, 
+		func(rv reflect.Value, bs []byte) error {
+			rv.Set(reflect.ValueOf(testPoint{ int16(bs[0]), int16(bs[1]) }))
+			return nil
+		}))
+	when := time.Date(2012, 6, 1, 10, 20, 30, 0, time.UTC)
+	whenBs, err := when.MarshalBinary()
+	checkErrT(t, err)
+	in := rec{ When: when, At: &testPoint{ 3, 4 } }
+	var buf bytes.Buffer
+	checkErrT(t, NewEncoderEx(&buf, &EncoderOptions{ Exts: exts }).Encode(in))
+	// the field's ext type is used, not the one its type is registered with.
+	checkEqualT(t, hex.EncodeToString(buf.Bytes()), 
+		"83a45768656ec7" + fmt.Sprintf("%02x", len(whenBs)) + "2a" + hex.EncodeToString(whenBs) + 
+		"a26174d5100304a34e696cc0")
+	
+	var out rec
+	checkErrT(t, NewDecoderBytes(buf.Bytes(), &DecoderOptions{ Exts: exts }).Decode(&out))
+	checkEqualT(t, out.When.Equal(when), true)
+	checkEqualT(t, *out.At, testPoint{ 3, 4 })
+	checkEqualT(t, out.Nil, (*time.Time)(nil))
+	
+	// without the registry, the field's type has no binary form.
+	if err = Unmarshal(buf.Bytes(), &out, nil); err == nil || !strings.Contains(err.Error(), "no binary form") {
+		logT(t, "expected an error decoding a field without a binary form, got: %v", err)
+		t.FailNow()
+	}
+	// values encoded before the field was tagged still decode.
+	bs, err := Marshal(map[string]interface{}{ "When": when })
+	checkErrT(t, err)
+	out = rec{}
+	checkErrT(t, Unmarshal(bs, &out, nil))
+	checkEqualT(t, out.When.Equal(when), true)
+}
+
+func TestFieldStringTag(t *testing.T) {
+	type rec struct {
+		N int64 `msgpack:"n,string"`
+		U *uint8 `msgpack:",string,omitempty"`
+		F float32 `msgpack:",string"`
+		B bool `msgpack:",string"`
+		D time.Duration `msgpack:",string"`
+		S string `msgpack:",string"`
+		L []int `msgpack:",string"`
+	}
+	u := uint8(200)
+	in := rec{ -42, &u, 1.1, true, 90 * time.Second, "x", []int{ 1 } }
+	bs, err := Marshal(in)
+	checkErrT(t, err)
+	var m map[string]interface{}
+	checkErrT(t, Unmarshal(bs, &m, nil))
+	checkEqualT(t, m, map[string]interface{}{ 
+		"n": "-42", "U": "200", "F": "1.1", "B": "true", "D": "1m30s", "S": "x", "L": []interface{}{ int8(1) },
+	})
+	var out rec
+	checkErrT(t, Unmarshal(bs, &out, nil))
+	checkEqualT(t, out, in)
+	
+	// values of the field's type decode too, and bad strings fail.
+	bs, err = Marshal(map[string]interface{}{ "n": 7 })
+	checkErrT(t, err)
+	out = rec{}
+	checkErrT(t, Unmarshal(bs, &out, nil))
+	checkEqualT(t, out.N, int64(7))
+	bs, err = Marshal(map[string]interface{}{ "B": "nope" })
+	checkErrT(t, err)
+	if err = Unmarshal(bs, &out, nil); err == nil || !strings.Contains(err.Error(), "Field B") {
+		logT(t, "expected an error parsing a bad bool string, got: %v", err)
+		t.FailNow()
+	}
+}
+
+func TestSetsAsArrays(t *testing.T) {
+	type rec struct {
+		Tags map[string]struct{} `msgpack:",set"`
+		IDs map[int]struct{}
+	}
+	in := rec{ 
+		Tags: map[string]struct{}{ "b": {}, "a": {}, "c": {} }, 
+		IDs: map[int]struct{}{ 2: {} },
+	}
+	bs, err := Marshal(in)
+	checkErrT(t, err)
+	checkEqualT(t, hex.EncodeToString(bs)[:10], "82a4546167")
+	var m map[string]interface{}
+	checkErrT(t, Unmarshal(bs, &m, nil))
+	checkEqualT(t, len(m["Tags"].([]interface{})), 3)
+	checkEqualT(t, len(m["IDs"].(map[interface{}]interface{})), 1)
+	var out rec
+	checkErrT(t, Unmarshal(bs, &out, nil))
+	checkEqualT(t, out, in)
+	
+	var buf bytes.Buffer
+	checkErrT(t, NewEncoderEx(&buf, &EncoderOptions{ SetsAsArrays: true, SortMapKeys: true }).Encode(in))
+	checkEqualT(t, hex.EncodeToString(buf.Bytes()), "82a45461677393a161a162a163a349447391" + "02")
+	out = rec{}
+	checkErrT(t, Unmarshal(buf.Bytes(), &out, nil))
+	checkEqualT(t, out, in)
+}
+
+type testShape interface {
+	Area() float64
+}
+
+type testCircle struct {
+	R float64
+}
+
+func (c testCircle) Area() float64 { return 3 * c.R * c.R }
+
+type testSquare struct {
+	S float64
+}
+
+func (s *testSquare) Area() float64 { return s.S * s.S }
+
+func TestFieldTypeHints(t *testing.T) {
+	type drawing struct {
+		Outline testShape `msgpack:",typeof=testCircle"`
+		Fill testShape `msgpack:",typeof=*testSquare"`
+		Other interface{}
+		Missing testShape
+	}
+	in := drawing{ testCircle{ 2 }, &testSquare{ 3 }, "x", nil }
+	bs, err := Marshal(in)
+	checkErrT(t, err)
+	var out drawing
+	checkErrT(t, NewDecoderBytes(bs, &DecoderOptions{ 
+		FieldTypes: TypeHints(testCircle{}, &testSquare{}),
+	}).Decode(&out))
+	checkEqualT(t, out, in)
+	
+	// a resolver can pick types by field.
+	type pair struct {
+		A, B interface{}
+	}
+	bs, err = Marshal(pair{ testCircle{ 1 }, testSquare{ 2 } })
+	checkErrT(t, err)
+	var p pair
+	checkErrT(t, NewDecoderBytes(bs, &DecoderOptions{ 
+		FieldTypes: func(st reflect.Type, field, hint string) reflect.Type {
+			if field == "B" {
+				return reflect.TypeOf(testSquare{})
+			}
+			return nil
+		},
+	}).Decode(&p))
+	checkEqualT(t, p.B, interface{}(testSquare{ 2 }))
+	checkEqualT(t, p.A, interface{}(map[interface{}]interface{}{ "R": float64(1) }))
+	
+	// without a resolver, the shapes cannot be decoded.
+	bs, err = Marshal(in)
+	checkErrT(t, err)
+	var out2 drawing
+	if err = Unmarshal(bs, &out2, nil); err == nil {
+		logT(t, "expected an error decoding into interface fields without a resolver")
+		t.FailNow()
+	}
+}
+
+func TestHandle(t *testing.T) {
+	exts := NewExtRegistry()
+	checkErrT(t, exts.AddComplex(7))
+	h := &Handle{ 
+		Exts: exts, 
+		Encoder: &EncoderOptions{ FieldNameMapper: SnakeCase }, 
+		Decoder: &DecoderOptions{ FieldNameMapper: SnakeCase },
+	}
+	type rec struct {
+		UserID int
+		Coord complex128
+	}
+	var wg sync.WaitGroup
+	for j := 0; j < 8; j++ {
+		wg.Add(1)
+		go func(j int) {
+			defer wg.Done()
+			in := rec{ j, complex(float64(j), 1) }
+			bs, err := h.Marshal(in)
+			checkErrT(t, err)
+			var out rec
+			checkErrT(t, h.Unmarshal(bs, &out))
+			checkEqualT(t, out, in)
+		}(j)
+	}
+	wg.Wait()
+	// the mapped names are computed once, for all Encoders and Decoders of the Handle.
+	names := h.tc.loadNames(reflect.TypeOf(rec{}))
+	checkEqualT(t, string(names[0]), "user_id")
+	checkEqualT(t, h.tc.loadFields(reflect.TypeOf(rec{}))["coord"].name, "Coord")
+	
+	bs, err := h.Marshal(rec{ Coord: 1i })
+	checkErrT(t, err)
+	var m map[string]interface{}
+	checkErrT(t, Unmarshal(bs, &m, &DecoderOptions{ Exts: exts }))
+	checkEqualT(t, m, map[string]interface{}{ "user_id": int8(0), "coord": 1i })
+	// the Handle's options are copied on first use.
+	h.Encoder.FieldNameMapper = nil
+	bs2, err := h.Marshal(rec{ Coord: 1i })
+	checkErrT(t, err)
+	checkEqualT(t, bs2, bs)
+}
+
+func TestSyncEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	se := NewSyncEncoderEx(&buf, nil)
+	var wg sync.WaitGroup
+	for j := 0; j < 8; j++ {
+		wg.Add(1)
+		go func(j int) {
+			defer wg.Done()
+			for k := 0; k < 50; k++ {
+				checkErrT(t, se.EncodeMulti(j, strings.Repeat("x", 100 + j)))
+				checkErrT(t, se.Do(func(e *Encoder) error {
+					e.WriteArrayHeader(2)
+					e.WriteInt64(int64(j))
+					return e.WriteInt64(int64(k))
+				}))
+			}
+		}(j)
+	}
+	wg.Wait()
+	dec := NewDecoderBytes(buf.Bytes(), nil)
+	for n := 0; dec.More(); n++ {
+		var v interface{}
+		checkErrT(t, dec.Decode(&v))
+		if a, ok := v.([]interface{}); ok {
+			checkEqualT(t, len(a), 2)
+			continue
+		}
+		j := int(reflect.ValueOf(v).Int())
+		var s string
+		checkErrT(t, dec.Decode(&s))
+		checkEqualT(t, len(s), 100 + j)
+	}
+	
+	// race builds catch an Encoder (or Decoder) in use by another goroutine.
+	if raceEnabled {
+		e := NewEncoder(&buf)
+		e.g.enter("Encoder")
+		func() {
+			defer func() {
+				x := recover()
+				checkEqualT(t, fmt.Sprint(x), "msgpack: concurrent use of Encoder (see SyncEncoder)")
+			}()
+			e.Encode(1)
+		}()
+		e.g.exit()
+		checkErrT(t, e.Encode(1))
+	}
+}
+
+// testFlushWriter counts the writes to it, failing after fail bytes (if > 0).
+type testFlushWriter struct {
+	writes, n, fail int
+}
+
+func (w *testFlushWriter) Write(bs []byte) (int, error) {
+	if w.fail > 0 && w.n + len(bs) > w.fail {
+		return 0, errors.New("disk full")
+	}
+	w.writes++
+	w.n += len(bs)
+	return len(bs), nil
+}
+
+func TestEncoderBuffering(t *testing.T) {
+	v := map[string]interface{}{ "a": []interface{}{ 1, "two", 3.0 }, "b": true }
+	bs, err := Marshal(v)
+	checkErrT(t, err)
+	
+	// one write per Encode, or per small write when unbuffered.
+	var w testFlushWriter
+	e := NewEncoder(&w)
+	checkErrT(t, e.Encode(v))
+	checkErrT(t, e.Encode(v))
+	checkEqualT(t, w, testFlushWriter{ writes: 2, n: 2 * len(bs) })
+	w = testFlushWriter{}
+	checkErrT(t, NewEncoderEx(&w, &EncoderOptions{ Unbuffered: true }).Encode(v))
+	checkEqualT(t, w.n, len(bs))
+	if w.writes < 5 {
+		logT(t, "expected many writes unbuffered, got: %d", w.writes)
+		t.FailNow()
+	}
+	
+	// with DeferFlush, nothing is written until Flush.
+	w = testFlushWriter{}
+	e = NewEncoderEx(&w, &EncoderOptions{ DeferFlush: true })
+	for j := 0; j < 10; j++ {
+		checkErrT(t, e.WriteInt64(int64(j)))
+	}
+	checkErrT(t, e.Encode(v))
+	checkEqualT(t, w.writes, 0)
+	checkErrT(t, e.Flush())
+	checkEqualT(t, w, testFlushWriter{ writes: 1, n: 10 + len(bs) })
+	
+	// a writer error is returned by the call which wrote the data.
+	w = testFlushWriter{ fail: len(bs) + 1 }
+	e = NewEncoder(&w)
+	checkErrT(t, e.Encode(v))
+	if err = e.Encode(v); err == nil || !strings.Contains(err.Error(), "disk full") {
+		logT(t, "expected the write error from Encode, got: %v", err)
+		t.FailNow()
+	}
+	if err = e.Flush(); err == nil {
+		logT(t, "expected the write error from Flush")
+		t.FailNow()
+	}
+}
+
+func TestEncoderTee(t *testing.T) {
+	v := map[string]interface{}{ "a": []interface{}{ 1, "two", 3.0, true } }
+	bs, err := Marshal(v)
+	checkErrT(t, err)
+	
+	// the tee receives the stream as written, buffered or not, including deferred containers.
+	for _, unbuf := range []bool{ false, true } {
+		var b, tee bytes.Buffer
+		var w testFlushWriter
+		e := NewEncoderEx(&b, &EncoderOptions{ Tee: io.MultiWriter(&tee, &w), Unbuffered: unbuf })
+		checkErrT(t, e.Encode(v))
+		checkErrT(t, e.BeginArray())
+		checkErrT(t, e.WriteString("x"))
+		checkErrT(t, e.EndArray())
+		checkEqualT(t, tee.Bytes(), b.Bytes())
+		checkEqualT(t, b.Bytes()[:len(bs)], bs)
+		if !unbuf && w.writes != 2 {
+			logT(t, "expected one write to the tee per call, got: %d", w.writes)
+			t.FailNow()
+		}
+	}
+	
+	// an error from the tee fails the call.
+	var b bytes.Buffer
+	err = NewEncoderEx(&b, &EncoderOptions{ Tee: &testFlushWriter{ fail: 1 } }).Encode(v)
+	if err == nil || !strings.Contains(err.Error(), "disk full") {
+		logT(t, "expected the tee's write error, got: %v", err)
+		t.FailNow()
+	}
+}
+
+type testStatsCollector []Stats
+
+func (c *testStatsCollector) CollectStats(s Stats) {
+	*c = append(*c, s)
+}
+
+func TestStats(t *testing.T) {
+	v := []interface{}{ 1, "abc", []interface{}{ true, nil, 2.5 }, map[string]interface{}{ "k": []byte("xyzzy") } }
+	var c testStatsCollector
+	var b bytes.Buffer
+	e := NewEncoderEx(&b, &EncoderOptions{ Stats: &c })
+	checkErrT(t, e.Encode(v))
+	checkErrT(t, e.WriteInt64(7)) // not an Encode: not collected
+	checkErrT(t, e.Encode(-1))
+	bs := b.Bytes()
+	
+	var s Stats
+	s.Bytes = int64(len(bs)) - 2
+	s.Counts[ArrayType], s.Counts[MapType] = 2, 1
+	s.Counts[IntType], s.Counts[StrType], s.Counts[BoolType], s.Counts[NilType] = 1, 3, 1, 1
+	s.Counts[FloatType] = 1 // a []byte is encoded as str
+	s.MaxDepth, s.ArrayElems, s.MapEntries, s.MaxArrayLen, s.MaxMapLen, s.MaxBytesLen = 2, 7, 1, 4, 1, 5
+	var s2 Stats
+	s2.Bytes, s2.Counts[IntType] = 1, 1
+	checkEqualT(t, []Stats(c), []Stats{ s, s2 })
+	checkEqualT(t, StatsOf(bs[:s.Bytes]), s)
+	
+	// decoding collects the same, from a byte slice or a reader.
+	var dc testStatsCollector
+	for _, d := range []*Decoder{ 
+		NewDecoderBytes(bs, &DecoderOptions{ Stats: &dc }),
+		NewDecoder(bytes.NewReader(bs), &DecoderOptions{ Stats: &dc }),
+	} {
+		var v2 interface{}
+		var i int
+		checkErrT(t, d.Decode(&v2))
+		checkErrT(t, d.Decode(&i))
+		checkErrT(t, d.Decode(&i))
+	}
+	checkEqualT(t, []Stats(dc), []Stats{ s, s2, s2, s, s2, s2 })
+	
+	// nothing is collected for a failed decode.
+	dc = nil
+	var i int
+	if err := NewDecoderBytes(bs, &DecoderOptions{ Stats: &dc }).Decode(&i); err == nil {
+		logT(t, "expected an error decoding an array into an int")
+		t.FailNow()
+	}
+	checkEqualT(t, len(dc), 0)
+}
+
+type testTraceItem struct {
+	Name string
+	Tags map[string]int
+}
+
+type testTraceDoc struct {
+	ID uint16
+	Items []testTraceItem
+}
+
+func TestDecoderTrace(t *testing.T) {
+	// {"Items": [{"Name": "a", "Tags": {"x": 1}}]}, with its keys in that order.
+	bs := []byte{ 0x81, 0xa5, 'I', 't', 'e', 'm', 's', 0x91, 0x82, 0xa4, 'N', 'a', 'm', 'e', 0xa1, 'a', 
+		0xa4, 'T', 'a', 'g', 's', 0x81, 0xa1, 'x', 1 }
+	var evs []string
+	trace := func(ev TraceEvent) { evs = append(evs, ev.String()) }
+	var v testTraceDoc
+	checkErrT(t, NewDecoderBytes(bs, &DecoderOptions{ Trace: trace }).Decode(&v))
+	checkEqualT(t, evs, []string{
+		"$: map at offset 0 into msgpack.testTraceDoc",
+		"$.Items: array at offset 7 into []msgpack.testTraceItem",
+		"$.Items[0]: map at offset 8 into msgpack.testTraceItem",
+		"$.Items[0].Name: str at offset 14 into string",
+		"$.Items[0].Tags: map at offset 21 into map[string]int",
+		"$.Items[0].Tags.x: int at offset 24 into int",
+	})
+	
+	// the last event locates a failure.
+	bs, err := Marshal(map[string]interface{}{ "ID": 1, "Items": []interface{}{ map[string]interface{}{ "Tags": map[string]interface{}{ "y": "bad" } } } })
+	checkErrT(t, err)
+	evs = nil
+	if err = NewDecoderBytes(bs, &DecoderOptions{ Trace: trace }).Decode(&testTraceDoc{}); err == nil {
+		logT(t, "expected an error decoding a string into an int")
+		t.FailNow()
+	}
+	if ev := evs[len(evs)-1]; !strings.HasPrefix(ev, "$.Items[0].Tags.y: str at offset") {
+		logT(t, "unexpected last event: %s", ev)
+		t.FailNow()
+	}
+}
+
+func TestPartialResults(t *testing.T) {
+	type rec struct { A int }
+	// 4 records, the third of which is corrupt.
+	bs, err := Marshal([]interface{}{ map[string]interface{}{ "A": 1 }, map[string]interface{}{ "A": 2 } })
+	checkErrT(t, err)
+	bs = append(bs, 0xc1, 0x81, 0xa1, 'A', 4)
+	bs[0] += 2
+	o := &DecoderOptions{ PartialResults: true }
+	var pe *PartialError
+	
+	var v []rec
+	err = NewDecoderBytes(bs, o).Decode(&v)
+	if !errors.As(err, &pe) {
+		logT(t, "expected a PartialError, got: %v", err)
+		t.FailNow()
+	}
+	checkEqualT(t, v, []rec{ {1}, {2} })
+	checkEqualT(t, []int64{ int64(pe.Decoded), pe.Offset }, []int64{ 2, 9 })
+	
+	// an array keeps its prefix, and zeroes the rest.
+	a := [4]rec{ {7}, {7}, {7}, {7} }
+	err = NewDecoderBytes(bs, o).Decode(&a)
+	checkEqualT(t, errors.As(err, &pe), true)
+	checkEqualT(t, a, [4]rec{ {1}, {2} })
+	
+	// a nil interface, from a stream, of a struct field.
+	var vi interface{}
+	err = NewDecoder(bytes.NewReader(bs), o).Decode(&vi)
+	checkEqualT(t, errors.As(err, &pe), true)
+	checkEqualT(t, len(vi.([]interface{})), 2)
+	var vs struct { Recs []rec }
+	bs2, err := Marshal(map[string]interface{}{ "Recs": Raw(bs) })
+	checkErrT(t, err)
+	err = NewDecoderBytes(bs2, o).Decode(&vs)
+	checkEqualT(t, errors.As(err, &pe), true)
+	checkEqualT(t, vs.Recs, []rec{ {1}, {2} })
+	
+	// a map keeps the entries decoded.
+	bs, err = Marshal(map[string]interface{}{ "a": 1 })
+	checkErrT(t, err)
+	bs = append(bs[:len(bs):len(bs)], 0xa1, 'b', 0xc1)
+	bs[0]++
+	m := map[string]int{}
+	err = NewDecoderBytes(bs, o).Decode(&m)
+	checkEqualT(t, errors.As(err, &pe), true)
+	checkEqualT(t, m, map[string]int{ "a": 1 })
+	checkEqualT(t, pe.Offset, int64(4))
+	
+	// without the option, the error is as usual.
+	vs.Recs = nil
+	if err = NewDecoderBytes(bs2, nil).Decode(&vs); err == nil || errors.As(err, &pe) {
+		logT(t, "expected a plain error, got: %v", err)
+		t.FailNow()
+	}
+}
+
+func TestInvalidUTF8(t *testing.T) {
+	bs, err := Marshal(map[string]interface{}{ "caf\xe9": []interface{}{ "na\xefve" } })
+	checkErrT(t, err)
+	dam := &SimpleDecoderContainerResolver{ BytesStringSliceElement: true, MapType: mapStringIntfTyp }
+	for _, o := range []DecoderOptions{ {}, { ZeroCopy: true }, { InternMapKeys: 8 } } {
+		var v map[string][]string
+		checkErrT(t, NewDecoderBytes(bs, &o).Decode(&v))
+		checkEqualT(t, v, map[string][]string{ "caf\xe9": { "na\xefve" } })
+		
+		o.InvalidUTF8 = UTF8Replace
+		v = nil
+		checkErrT(t, NewDecoderBytes(bs, &o).Decode(&v))
+		checkEqualT(t, v, map[string][]string{ "caf\ufffd": { "na\ufffdve" } })
+		var vi interface{}
+		o.ContainerResolver = dam
+		checkErrT(t, NewDecoderBytes(bs, &o).Decode(&vi))
+		checkEqualT(t, vi, map[string]interface{}{ "caf\ufffd": []interface{}{ "na\ufffdve" } })
+		
+		o.InvalidUTF8 = UTF8Error
+		if err = NewDecoderBytes(bs, &o).Decode(&v); err == nil || !strings.Contains(err.Error(), "UTF-8") {
+			logT(t, "expected an invalid UTF-8 error, got: %v", err)
+			t.FailNow()
+		}
+	}
+	
+	// []byte values are left alone.
+	var b []byte
+	checkErrT(t, NewDecoderBytes([]byte("\xa2\xff\xfe"), &DecoderOptions{ InvalidUTF8: UTF8Error }).Decode(&b))
+	checkEqualT(t, b, []byte{ 0xff, 0xfe })
+}
+
+func TestRawToString(t *testing.T) {
+	// {"s": ["a", bin "b"], bin "k": "c", "r": raw16 "d"}
+	bs := []byte{ 0x83, 0xa1, 's', 0x92, 0xd9, 1, 'a', 0xc4, 1, 'b', 0xc4, 1, 'k', 0xa1, 'c', 
+		0xa1, 'r', 0xda, 0, 1, 'd' }
+	var v interface{}
+	checkErrT(t, NewDecoderBytes(bs, &DecoderOptions{ RawToString: true }).Decode(&v))
+	checkEqualT(t, v, map[interface{}]interface{}{ 
+		"s": []interface{}{ "a", []byte("b") }, "k": "c", "r": "d",
+	})
+	
+	// regardless of the ContainerResolver.
+	v = nil
+	o := &DecoderOptions{ RawToString: true, ContainerResolver: testDecOpts(mapStringIntfTyp, nil, false, false, false) }
+	checkErrT(t, NewDecoderBytes(bs, o).Decode(&v))
+	checkEqualT(t, v, map[string]interface{}{ 
+		"s": []interface{}{ "a", []byte("b") }, "k": "c", "r": "d",
+	})
+	
+	// by default, the ContainerResolver decides for both alike.
+	v = nil
+	checkErrT(t, NewDecoderBytes(bs, nil).Decode(&v))
+	checkEqualT(t, v.(map[interface{}]interface{})["s"], []interface{}{ "a", "b" })
+	v = nil
+	checkErrT(t, NewDecoderBytes(bs, testDecOpts(nil, nil, false, false, false)).Decode(&v))
+	checkEqualT(t, v.(map[interface{}]interface{})["s"], []interface{}{ []byte("a"), []byte("b") })
+}
+
+func TestPythonCompatPreset(t *testing.T) {
+	// as msgpack.packb([b"\x01", "x" * 40, 200, 1.5, -1, {"k": b""}]) (msgpack-python 1.0)
+	exp := append([]byte{ 0x96, 0xc4, 1, 1, 0xd9, 40 }, strings.Repeat("x", 40)...)
+	exp = append(exp, 0xcc, 200, 0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0, 0xff, 0x81, 0xa1, 'k', 0xc4, 0)
+	v := []interface{}{ []byte{1}, strings.Repeat("x", 40), 200, float32(1.5), -1, map[string][]byte{ "k": {} } }
+	var b bytes.Buffer
+	checkErrT(t, NewEncoderEx(&b, new(EncoderOptions).PresetPythonCompat()).Encode(v))
+	checkEqualT(t, b.Bytes(), exp)
+	
+	var v2 interface{}
+	checkErrT(t, NewDecoderBytes(exp, new(DecoderOptions).PresetPythonCompat()).Decode(&v2))
+	checkEqualT(t, v2, []interface{}{ []byte{1}, strings.Repeat("x", 40), uint8(200), 1.5, int8(-1),
+		map[interface{}]interface{}{ "k": []byte{} } })
+	
+	// the encoding decodes as usual without the preset.
+	var v3 struct { S string; I int64 }
+	checkErrT(t, Unmarshal([]byte{ 0x82, 0xa1, 'S', 0xd9, 1, 'x', 0xa1, 'I', 0xcc, 200 }, &v3, nil))
+	checkEqualT(t, []interface{}{ v3.S, v3.I }, []interface{}{ "x", int64(200) })
+}
+
+// checkNoRuntimeErr fails if err is a runtime error (e.g. an index out of range)
+// recovered by the library, instead of a proper error.
+func checkNoRuntimeErr(t *testing.T, err error) {
+	var rerr runtime.Error
+	if errors.As(err, &rerr) {
+		logT(t, "runtime error: %v", err)
+		t.FailNow()
+	}
+}
+
+// FuzzUnmarshal feeds arbitrary input to the decoder (and the other functions reading 
+// encoded data), which must only ever return errors.
+func FuzzUnmarshal(f *testing.F) {
+	for _, v := range table {
+		if bs, err := Marshal(v); err == nil {
+			f.Add(bs)
+		}
+	}
+	f.Add([]byte{ 0xdd, 0xff, 0xff, 0xff, 0xff })
+	f.Add([]byte{ 0xc6, 0xff, 0xff, 0xff, 0xff })
+	f.Fuzz(func(t *testing.T, bs []byte) {
+		var v interface{}
+		err := Unmarshal(bs, &v, nil)
+		checkNoRuntimeErr(t, err)
+		if err == nil {
+			_, err = Marshal(v)
+			checkErrT(t, err)
+		}
+		var ts TestStruc
+		checkNoRuntimeErr(t, Unmarshal(bs, &ts, nil))
+		var vv Value
+		checkNoRuntimeErr(t, Unmarshal(bs, &vv, nil))
+		var m map[string]interface{}
+		checkNoRuntimeErr(t, NewDecoder(bytes.NewReader(bs), &DecoderOptions{ MaxContainerLen: 1 << 16 }).Decode(&m))
+		checkNoRuntimeErr(t, CheckValid(bs))
+		_, err = Diff(bs, bs)
+		checkNoRuntimeErr(t, err)
+		checkNoRuntimeErr(t, ToJSON(io.Discard, bytes.NewReader(bs)))
+		_, err = GetPath(bs, 0, "a")
+		checkNoRuntimeErr(t, err)
+		Dump(bs)
+		StatsOf(bs)
+		checkNoRuntimeErr(t, MsgpackToCBOR(io.Discard, bytes.NewReader(bs)))
+		checkNoRuntimeErr(t, CBORToMsgpack(io.Discard, bytes.NewReader(bs)))
+	})
+}
+
+// FuzzDecodeStream feeds arbitrary input to decoders reading from an io.Reader with default options 
+// (so no MaxContainerLen), as the RPC codecs and DecodeRequest do.
+func FuzzDecodeStream(f *testing.F) {
+	for _, v := range table {
+		if bs, err := Marshal(v); err == nil {
+			f.Add(bs)
+		}
+	}
+	f.Add([]byte{ 0xdd, 0x7f, 0xff, 0xff, 0xff })
+	f.Add([]byte{ 0xdf, 0x7f, 0xff, 0xff, 0xff })
+	f.Add([]byte{ 0xc6, 0x7f, 0xff, 0xff, 0xff })
+	f.Add([]byte{ 0x81, 0xa1, 'R', 0xc6, 0x7f, 0xff, 0xff, 0xff })
+	f.Fuzz(func(t *testing.T, bs []byte) {
+		dec := func() *Decoder { return NewDecoder(bytes.NewReader(bs), nil) }
+		var v interface{}
+		checkNoRuntimeErr(t, dec().Decode(&v))
+		var ts TestStruc
+		checkNoRuntimeErr(t, dec().Decode(&ts))
+		var vv Value
+		checkNoRuntimeErr(t, dec().Decode(&vv))
+		var vr struct{ R Raw }
+		checkNoRuntimeErr(t, dec().Decode(&vr))
+		var is []int
+		checkNoRuntimeErr(t, dec().Decode(&is))
+		d := dec()
+		for d.More() {
+			_, err := d.DecodeRaw()
+			if checkNoRuntimeErr(t, err); err != nil {
+				break
+			}
+		}
+	})
+}
+
+func TestDecodeStreamLengths(t *testing.T) {
+	// a corrupt (huge) length in a stream fails once the stream ends, without allocating for it.
+	for _, bs := range [][]byte{ 
+		{ 0xdd, 0x7f, 0xff, 0xff, 0xff }, { 0xdf, 0x7f, 0xff, 0xff, 0xff }, { 0xc6, 0x7f, 0xff, 0xff, 0xff }, 
+		{ 0x81, 0xa1, 'R', 0xc6, 0x7f, 0xff, 0xff, 0xff },
+	} {
+		var m0, m1 runtime.MemStats
+		runtime.ReadMemStats(&m0)
+		var v interface{}
+		err1 := NewDecoder(bytes.NewReader(bs), nil).Decode(&v)
+		var vv Value
+		err2 := NewDecoder(bytes.NewReader(bs), nil).Decode(&vv)
+		var vr struct{ R Raw }
+		err3 := NewDecoder(bytes.NewReader(bs), nil).Decode(&vr)
+		_, err4 := NewDecoder(bytes.NewReader(bs), nil).DecodeRaw()
+		runtime.ReadMemStats(&m1)
+		if err1 == nil || err2 == nil || err3 == nil || err4 == nil {
+			logT(t, "Expecting errors decoding truncated %x, got: %v, %v, %v, %v", bs, err1, err2, err3, err4)
+			t.FailNow()
+		}
+		if n := m1.TotalAlloc - m0.TotalAlloc; n > 64 << 20 {
+			logT(t, "Decoding truncated %x allocated %d bytes", bs, n)
+			t.FailNow()
+		}
+	}
+	
+	// large containers still decode from a stream as from a byte slice.
+	in := make([]interface{}, 5000)
+	for i := range in {
+		in[i] = map[string]interface{}{ "i": int64(i), "s": []string{ "a", strconv.Itoa(i) } }
+	}
+	bs, err := Marshal(in)
+	checkErrT(t, err)
+	var v1, v2 interface{}
+	checkErrT(t, Unmarshal(bs, &v1, nil))
+	checkErrT(t, NewDecoder(bytes.NewReader(bs), nil).Decode(&v2))
+	checkEqualT(t, v2, v1)
+	ints := make([]int, 3000)
+	for i := range ints {
+		ints[i] = i
+	}
+	bs, err = Marshal(ints)
+	checkErrT(t, err)
+	is := []int{ -1, -2 }
+	checkErrT(t, NewDecoder(bytes.NewReader(bs), nil).Decode(&is))
+	checkEqualT(t, is, ints)
+	var vv Value
+	checkErrT(t, NewDecoder(bytes.NewReader(bs), nil).Decode(&vv))
+	checkEqualT(t, vv.Len(), 3000)
+}
+
 // comment out for now
 func TestRpcAll(t *testing.T) {
 	testRpc(t, true, true, true, true)
@@ -613,8 +5456,9 @@ func TestPythonGenStreams(t *testing.T) {
 			failT(t)
 			continue
 		}
-		dec := NewDecoder(bytes.NewBuffer(bss),
-			testDecOpts(mapStringIntfTyp, nil, true, true, true))
+		dec := NewDecoder(bytes.NewBuffer(bss), (&DecoderOptions{ 
+			ContainerResolver: testDecOpts(mapStringIntfTyp, nil, true, true, true),
+		}).PresetPythonCompat())
 		var v1 interface{}
 		if err = dec.Decode(&v1); err != nil {
 			logT(t, "-------- Error decoding stream: %d: Err: %v", i, err)
@@ -635,7 +5479,7 @@ func TestPythonGenStreams(t *testing.T) {
 			failT(t)
 		}
 		bsb := new(bytes.Buffer)
-		if err = NewEncoder(bsb).Encode(v1); err != nil {
+		if err = NewEncoderEx(bsb, (&EncoderOptions{ SortMapKeys: true }).PresetPythonCompat()).Encode(v1); err != nil {
 			logT(t, "Error encoding to stream: %d: Err: %v", i, err)
 			failT(t)
 			continue
@@ -0,0 +1,115 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+import (
+	"net"
+	"net/url"
+	"reflect"
+)
+
+var (
+	ipTyp = reflect.TypeOf(net.IP(nil))
+	ipNetTyp = reflect.TypeOf(net.IPNet{})
+	urlTyp = reflect.TypeOf(url.URL{})
+)
+
+// encodeIP encodes a net.IP as raw bytes: 4 for an IPv4 address, else 16.
+func (e *Encoder) encodeIP(ip net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	e.encRawBytes(ip)
+}
+
+// encodeNetValue encodes a net.IPNet as a CIDR string (e.g. "10.1.0.0/16"), 
+// and a url.URL as its string form.
+func (e *Encoder) encodeNetValue(rv reflect.Value) {
+	switch x := rv.Interface().(type) {
+	case net.IPNet:
+		e.encString(x.String())
+	case url.URL:
+		e.encString(x.String())
+	}
+}
+
+// decodeIP decodes raw bytes into a net.IP: either its 4 or 16 byte form, 
+// or its text form (e.g. "10.1.2.3" or "::1"). 4 or 16 bytes are always taken as the 
+// binary form, which encodeIP writes (e.g. 49.58.58.49 is the bytes "1::1").
+func (d *Decoder) decodeIP(bd byte, containerLen int, rv reflect.Value) {
+	if containerLen < 0 {
+		containerLen = d.readContainerLen(bd, false, ContainerRawBytes)
+	}
+	if containerLen == 0 {
+		rv.Set(reflect.Zero(ipTyp))
+		return
+	}
+	bs := d.readBytes(containerLen)
+	var ip net.IP
+	if len(bs) == net.IPv4len || len(bs) == net.IPv6len {
+		ip = net.IP(bs)
+	} else if ip = net.ParseIP(string(bs)); ip == nil {
+		d.err("Invalid net.IP: %q", bs)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	rv.Set(reflect.ValueOf(ip))
+}
+
+// decodeNetValue decodes a string into a net.IPNet or url.URL (see encodeNetValue).
+func (d *Decoder) decodeNetValue(bd byte, containerLen int, rv reflect.Value) {
+	if containerLen < 0 {
+		containerLen = d.readContainerLen(bd, false, ContainerRawBytes)
+	}
+	s := d.readString(containerLen)
+	if rv.Type() == urlTyp {
+		u, err := url.Parse(s)
+		if err != nil {
+			d.err("Invalid url.URL: %v", err)
+		}
+		rv.Set(reflect.ValueOf(*u))
+		return
+	}
+	ip, n, err := net.ParseCIDR(s)
+	if err != nil {
+		d.err("Invalid net.IPNet: %v", err)
+	}
+	// keep the host part, which ParseCIDR masks out of n.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		n.IP = ip4
+	} else {
+		n.IP = ip
+	}
+	rv.Set(reflect.ValueOf(*n))
+}
+
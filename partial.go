@@ -0,0 +1,88 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// PartialError is returned by Decode, with DecoderOptions.PartialResults, when decoding 
+// an array or map failed partway. The elements (or entries) decoded before the failure 
+// are kept in the result: a slice is truncated to them, and the rest of an array is zeroed.
+type PartialError struct {
+	Decoded int   // number of elements (or map entries) decoded and kept
+	Offset int64  // input offset of the element which failed
+	Err error
+}
+
+func (e *PartialError) Error() string {
+	return fmt.Sprintf("%v (after %d elements, at offset %d)", e.Err, e.Decoded, e.Offset)
+}
+
+func (e *PartialError) Unwrap() error {
+	return e.Err
+}
+
+// beginPartial reports whether a container being decoded should keep a partial result 
+// if it fails: only the outermost array or map being decoded does (see endPartial).
+func (d *Decoder) beginPartial() bool {
+	if !d.o.PartialResults || d.inPartial {
+		return false
+	}
+	d.inPartial = true
+	return true
+}
+
+// endPartial is deferred when beginPartial returns true. If decoding the container rv failed
+// at its element n (which starts at offset off), it keeps the elements before it, 
+// and panics with a PartialError.
+func (d *Decoder) endPartial(rv reflect.Value, n *int, off *int64) {
+	d.inPartial = false
+	x := recover()
+	if x == nil {
+		return
+	}
+	var err error
+	panicToErrT(x, &err)
+	switch rv.Kind() {
+	case reflect.Slice:
+		rv.SetLen(*n)
+	case reflect.Array:
+		rvzero := reflect.Zero(rv.Type().Elem())
+		for j := *n; j < rv.Len(); j++ {
+			rv.Index(j).Set(rvzero)
+		}
+	}
+	panic(&PartialError{Decoded: *n, Offset: *off, Err: err})
+}
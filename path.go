@@ -0,0 +1,265 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// ErrPathNotFound is returned (wrapped) when a path does not exist in a document.
+var ErrPathNotFound = errors.New("msgpack: path not found")
+
+// GetPath returns the encoding of the value at path within the document b, 
+// without decoding anything else. The returned Raw aliases b.
+// 
+// Each element of path is either an array index (any integer type), or a map key. 
+// A string or []byte matches a str or bin key with the same bytes. Integer, float, 
+// bool and nil keys match keys of the same value (as in Diff). Other keys are never matched.
+// For example, given {"users": [{"name": "ann"}]}, GetPath(b, "users", 0, "name") returns
+// the encoding of "ann".
+// 
+// If a key or index is missing, or an intermediate value is not a container,
+// GetPath returns an error wrapping ErrPathNotFound. 
+func GetPath(b []byte, path ...interface{}) (v Raw, err error) {
+	defer panicToErr(&err)
+	d := NewDecoderBytes(b, &DecoderOptions{ZeroCopy: true})
+	off, end := d.findPath(path)
+	return b[off:end:end], nil
+}
+
+// findPath returns the start and end offsets of the value at path.
+func (d *Decoder) findPath(path []interface{}) (off, end int64) {
+	d.walkPath(path)
+	off = d.r.numread()
+	d.skip(0, true)
+	return off, d.r.numread()
+}
+
+// walkPath advances to the value at path, or panics with ErrPathNotFound.
+func (d *Decoder) walkPath(path []interface{}) {
+	for i, p := range path {
+		if _, ok := d.enterPath(p); !ok {
+			panic(pathNotFound(path[:i+1]))
+		}
+	}
+}
+
+func pathNotFound(path []interface{}) error {
+	return fmt.Errorf("%w: %s", ErrPathNotFound, pathString(path))
+}
+
+// pathStep describes the container entered by enterPath.
+type pathStep struct {
+	vt ValueType    // ArrayType or MapType (else the value is not a container)
+	hdr, hdrEnd int64 // offsets of the container header
+	l int           // number of elements (entries, for a map)
+	entry int64     // offset of the element found (of its key, for a map; the decoder is left at the value), 
+	                // or of the end of the container if the key/index (= l) is not present. -1 otherwise.
+}
+
+// enterPath advances to the element of the next value identified by p (an index or key), 
+// or returns false if the value is not a container with that element.
+func (d *Decoder) enterPath(p interface{}) (s pathStep, ok bool) {
+	s.hdr, s.entry = d.r.numread(), -1
+	bd := d.readn1()
+	switch s.vt = descValueType(bd); s.vt {
+	case ArrayType:
+		s.l = d.readContainerLen(bd, false, ContainerList)
+		s.hdrEnd = d.r.numread()
+		rv := reflect.ValueOf(p)
+		var i int
+		switch rv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if rv.Int() < 0 || rv.Int() > int64(s.l) {
+				return
+			}
+			i = int(rv.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			if rv.Uint() > uint64(s.l) {
+				return
+			}
+			i = int(rv.Uint())
+		default:
+			return
+		}
+		for j := i; j > 0; j-- {
+			d.skip(0, true)
+		}
+		s.entry, ok = d.r.numread(), i < s.l
+	case MapType:
+		s.l = d.readContainerLen(bd, false, ContainerMap)
+		s.hdrEnd = d.r.numread()
+		pk := pathKey(p)
+		for i := 0; i < s.l; i++ {
+			s.entry = d.r.numread()
+			var k diffNode
+			d.parseDiffNode(nil, &k)
+			if pathKeyMatch(pk, &k) {
+				ok = true
+				return
+			}
+			d.skip(0, true)
+		}
+		s.entry = d.r.numread()
+	}
+	return
+}
+
+// SetPath returns a copy of the document b, with the value at path set to v
+// (a single encoded value). Only the bytes of that value, and (when an element is added) 
+// the header of its container, are rewritten; b is not modified.
+// 
+// path is as for GetPath. If its last element is a key missing from its map, the entry 
+// is appended to the map (the key is encoded as by Marshal). An array element can be 
+// appended by using the array length as the last index. An empty path replaces the whole document.
+// Otherwise, if the path does not exist, SetPath returns an error wrapping ErrPathNotFound.
+func SetPath(b []byte, v Raw, path ...interface{}) (b2 []byte, err error) {
+	if err = CheckValid(v); err != nil {
+		return
+	}
+	if len(path) == 0 {
+		return append([]byte(nil), v...), nil
+	}
+	defer panicToErr(&err)
+	d := NewDecoderBytes(b, &DecoderOptions{ZeroCopy: true})
+	last := path[len(path)-1]
+	d.walkPath(path[:len(path)-1])
+	s, ok := d.enterPath(last)
+	switch {
+	case ok:
+		off := d.r.numread()
+		d.skip(0, true)
+		return spliceDoc(b, s, s.l, off, d.r.numread(), v), nil
+	case s.entry < 0:
+		panic(pathNotFound(path))
+	}
+	ins := []byte(v)
+	if s.vt == MapType {
+		var key []byte
+		if key, err = Marshal(last); err != nil {
+			return
+		}
+		ins = append(key, v...)
+	}
+	return spliceDoc(b, s, s.l+1, s.entry, s.entry, ins), nil
+}
+
+// DeletePath returns a copy of the document b, with the map entry or array element
+// at path removed. Only the header of its container is rewritten; b is not modified.
+// 
+// path is as for GetPath, and must not be empty. If it does not exist, DeletePath 
+// returns an error wrapping ErrPathNotFound.
+func DeletePath(b []byte, path ...interface{}) (b2 []byte, err error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("%v: DeletePath: empty path", msgTagDec)
+	}
+	defer panicToErr(&err)
+	d := NewDecoderBytes(b, &DecoderOptions{ZeroCopy: true})
+	d.walkPath(path[:len(path)-1])
+	s, ok := d.enterPath(path[len(path)-1])
+	if !ok {
+		panic(pathNotFound(path))
+	}
+	d.skip(0, true)
+	return spliceDoc(b, s, s.l-1, s.entry, d.r.numread(), nil), nil
+}
+
+// spliceDoc returns a copy of b with b[off:end] replaced by v, and the header of 
+// the container described by s rewritten for l elements (if that changed).
+func spliceDoc(b []byte, s pathStep, l int, off, end int64, v []byte) []byte {
+	hdr := bytes.NewBuffer(make([]byte, 0, 5))
+	if l == s.l {
+		hdr.Write(b[s.hdr:s.hdrEnd])
+	} else if e := NewEncoder(hdr); s.vt == MapType {
+		e.writeContainerLen(ContainerMap, l)
+	} else {
+		e.writeContainerLen(ContainerList, l)
+	}
+	b2 := make([]byte, 0, int64(len(b)) - (end - off) + int64(len(v)) + 4)
+	b2 = append(b2, b[:s.hdr]...)
+	b2 = append(b2, hdr.Bytes()...)
+	b2 = append(b2, b[s.hdrEnd:off]...)
+	b2 = append(b2, v...)
+	return append(b2, b[end:]...)
+}
+
+// pathKey normalizes a path element to the form of a parsed scalar (see diffNode).
+func pathKey(p interface{}) interface{} {
+	rv := reflect.ValueOf(p)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if i := rv.Int(); i < 0 {
+			return i
+		}
+		return uint64(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return rv.Uint()
+	case reflect.Float32, reflect.Float64:
+		return rv.Float()
+	case reflect.String:
+		return rv.String()
+	case reflect.Slice:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			return rv.Bytes()
+		}
+	}
+	return p
+}
+
+func pathKeyMatch(pk interface{}, k *diffNode) bool {
+	switch kv := k.v.(type) {
+	case string:
+		switch pv := pk.(type) {
+		case string:
+			return pv == kv
+		case []byte:
+			return string(pv) == kv
+		}
+	case []byte:
+		switch pv := pk.(type) {
+		case string:
+			return pv == string(kv)
+		case []byte:
+			return bytes.Equal(pv, kv)
+		}
+	case nil:
+		return pk == nil && k.vt == NilType
+	case bool, int64, uint64, float64:
+		return pk == kv
+	}
+	return false
+}
+
@@ -0,0 +1,56 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+// PresetPythonCompat configures o to encode as msgpack-python (1.0 and later) packs by default 
+// (use_bin_type=True, use_single_float=False), and returns o, e.g. 
+// 
+//   enc := NewEncoderEx(w, new(EncoderOptions).PresetPythonCompat())
+// 
+// []byte values are encoded as bin, strings as str (using str8), floats as float64, 
+// and non-negative integers in the uint formats.
+func (o *EncoderOptions) PresetPythonCompat() *EncoderOptions {
+	o.UseBinType = true
+	o.PositiveIntAsUint = true
+	o.Float32AsFloat64 = true
+	return o
+}
+
+// PresetPythonCompat configures o to decode as msgpack-python (1.0 and later) unpacks by default
+// (raw=False), and returns o: str values are decoded into interface{} values as strings, 
+// bin values as []byte, and strings must be valid UTF-8.
+func (o *DecoderOptions) PresetPythonCompat() *DecoderOptions {
+	o.RawToString = true
+	o.InvalidUTF8 = UTF8Error
+	return o
+}
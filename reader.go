@@ -0,0 +1,314 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+// A Decoder reads through a decReader. Implementations only ever hand out bytes
+// which belong to the value being decoded. The only look-ahead allowed is a single
+// byte (readn1 followed by unreadn1), which is kept by the decReader itself and 
+// is returned by buffered() until consumed. 
+// 
+// This guarantees the Decoder never over-reads the underlying stream, so it can share
+// a connection with other protocol logic (see Decoder.Buffered).
+
+import (
+	"io"
+	"io/ioutil"
+)
+
+type decReader interface {
+	// readFull reads exactly len(bs) bytes into bs. 
+	// It follows the io.ReadFull contract for errors.
+	readFull(bs []byte) (n int, err error)
+	readn1() (b byte, err error)
+	// skip consumes n bytes without copying them anywhere.
+	skip(n int) (err error)
+	// unreadn1 pushes back the last byte returned by readn1.
+	unreadn1()
+	// numread returns the number of bytes consumed so far.
+	numread() int64
+	// buffered returns bytes read from the source but not yet consumed.
+	buffered() []byte
+}
+
+// ioDecReader reads from an io.Reader, never asking it for more than is needed.
+type ioDecReader struct {
+	r   io.Reader
+	n   int64
+	ub  [1]byte  // unread byte
+	hub bool     // has unread byte
+}
+
+// bytesDecReader reads from a byte slice.
+type bytesDecReader struct {
+	b []byte
+	c int        // cursor
+}
+
+// readerAtDecReader reads from an io.ReaderAt, through a window of buffered bytes. 
+// As the source is random-access, reading ahead is harmless, and skip just moves the offset.
+// Offsets (numread) are offsets in the source.
+type readerAtDecReader struct {
+	r   io.ReaderAt
+	pos int64   // offset of the next byte
+	w   []byte  // window: the bytes from offset wo
+	wo  int64
+	buf []byte
+}
+
+// recDecReader records all bytes consumed through it (used to capture Raw values).
+type recDecReader struct {
+	decReader
+	bs []byte
+}
+
+func (z *ioDecReader) readFull(bs []byte) (n int, err error) {
+	if len(bs) == 0 {
+		return
+	}
+	if z.hub {
+		bs[0] = z.ub[0]
+		z.hub = false
+		n = 1
+	}
+	if n < len(bs) {
+		var n2 int
+		n2, err = io.ReadFull(z.r, bs[n:])
+		n += n2
+		if err == io.EOF && n > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	z.n += int64(n)
+	return
+}
+
+func (z *ioDecReader) readn1() (b byte, err error) {
+	if _, err = z.readFull(z.ub[:]); err == nil {
+		b = z.ub[0]
+	}
+	return
+}
+
+func (z *ioDecReader) skip(n int) (err error) {
+	if n > 0 && z.hub {
+		z.hub = false
+		z.n++
+		n--
+	}
+	if n > 0 {
+		var n2 int64
+		n2, err = io.CopyN(ioutil.Discard, z.r, int64(n))
+		z.n += n2
+		if err == io.EOF && n2 > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	return
+}
+
+func (z *ioDecReader) unreadn1() {
+	z.hub = true
+	z.n--
+}
+
+func (z *ioDecReader) numread() int64 {
+	return z.n
+}
+
+func (z *ioDecReader) buffered() []byte {
+	if z.hub {
+		return z.ub[:]
+	}
+	return nil
+}
+
+func (z *bytesDecReader) readFull(bs []byte) (n int, err error) {
+	if len(bs) == 0 {
+		return
+	}
+	n = copy(bs, z.b[z.c:])
+	z.c += n
+	if n == 0 {
+		err = io.EOF
+	} else if n < len(bs) {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+func (z *bytesDecReader) readn1() (b byte, err error) {
+	if z.c >= len(z.b) {
+		err = io.EOF
+		return
+	}
+	b = z.b[z.c]
+	z.c++
+	return
+}
+
+func (z *bytesDecReader) skip(n int) (err error) {
+	if n > len(z.b) - z.c {
+		if z.c == len(z.b) {
+			err = io.EOF
+		} else {
+			err = io.ErrUnexpectedEOF
+		}
+		z.c = len(z.b)
+		return
+	}
+	z.c += n
+	return
+}
+
+func (z *bytesDecReader) unreadn1() {
+	z.c--
+}
+
+func (z *bytesDecReader) numread() int64 {
+	return int64(z.c)
+}
+
+func (z *bytesDecReader) buffered() []byte {
+	return z.b[z.c:]
+}
+
+func (z *recDecReader) readFull(bs []byte) (n int, err error) {
+	n, err = z.decReader.readFull(bs)
+	z.bs = append(z.bs, bs[:n]...)
+	return
+}
+
+func (z *recDecReader) readn1() (b byte, err error) {
+	if b, err = z.decReader.readn1(); err == nil {
+		z.bs = append(z.bs, b)
+	}
+	return
+}
+
+// skip records the n bytes skipped, growing the record in chunks as they are read 
+// (as Decoder.readChunked does), so a corrupt length cannot allocate much more than the source holds.
+func (z *recDecReader) skip(n int) (err error) {
+	for c := readChunkLen; n > 0 && err == nil; c *= 2 {
+		if c > n {
+			c = n
+		}
+		l := len(z.bs)
+		if cap(z.bs) - l < c {
+			bs2 := make([]byte, l, 2*l + c)
+			copy(bs2, z.bs)
+			z.bs = bs2
+		}
+		var m int
+		m, err = z.decReader.readFull(z.bs[l:l+c])
+		z.bs = z.bs[:l+m]
+		n -= m
+	}
+	return
+}
+
+func (z *recDecReader) unreadn1() {
+	z.decReader.unreadn1()
+	z.bs = z.bs[:len(z.bs)-1]
+}
+
+const readerAtWindow = 4096
+
+func (z *readerAtDecReader) readFull(bs []byte) (n int, err error) {
+	for n < len(bs) && err == nil {
+		if i := z.pos - z.wo; i >= 0 && i < int64(len(z.w)) {
+			n2 := copy(bs[n:], z.w[i:])
+			n += n2
+			z.pos += int64(n2)
+		} else if len(bs) - n >= readerAtWindow {
+			var n2 int
+			n2, err = z.r.ReadAt(bs[n:], z.pos)
+			n += n2
+			z.pos += int64(n2)
+		} else {
+			err = z.fill()
+		}
+	}
+	if n == len(bs) {
+		err = nil
+	} else if err == io.EOF && n > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+// fill reads the window at the current offset.
+func (z *readerAtDecReader) fill() (err error) {
+	if z.buf == nil {
+		z.buf = make([]byte, readerAtWindow)
+	}
+	n, err := z.r.ReadAt(z.buf, z.pos)
+	z.w, z.wo = z.buf[:n], z.pos
+	if n > 0 {
+		err = nil
+	} else if err == nil {
+		err = io.ErrNoProgress
+	}
+	return
+}
+
+func (z *readerAtDecReader) readn1() (b byte, err error) {
+	if i := z.pos - z.wo; i >= 0 && i < int64(len(z.w)) {
+		z.pos++
+		return z.w[i], nil
+	}
+	if err = z.fill(); err == nil {
+		b = z.w[0]
+		z.pos++
+	}
+	return
+}
+
+func (z *readerAtDecReader) skip(n int) (err error) {
+	z.pos += int64(n)
+	return
+}
+
+func (z *readerAtDecReader) unreadn1() {
+	z.pos--
+}
+
+func (z *readerAtDecReader) numread() int64 {
+	return z.pos
+}
+
+func (z *readerAtDecReader) buffered() []byte {
+	if i := z.pos - z.wo; i >= 0 && i < int64(len(z.w)) {
+		return z.w[i:]
+	}
+	return nil
+}
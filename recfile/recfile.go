@@ -0,0 +1,234 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+/*
+Package recfile implements a seekable file format for many msgpack records, 
+with constant-time access to record N.
+
+A file is laid out as:
+    header: "MPRF" and a version (4 bytes, big-endian)
+    records: the msgpack encoding of each record, back to back
+    index: the offset of each record (8 bytes each, big-endian)
+    footer: the offset of the index and the number of records (8 bytes each), then "MPRFEND!"
+
+A Reader reads the footer, then only the index entries and records it is asked for, 
+so files need not fit in memory.
+*/
+package recfile
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ugorji/go-msgpack"
+)
+
+const (
+	version = 1
+	headerLen = 8
+	footerLen = 24
+)
+
+var (
+	headerMagic = []byte("MPRF")
+	footerMagic = []byte("MPRFEND!")
+)
+
+// Writer writes a record file. Records are encoded by a msgpack.Encoder as they are 
+// appended; the index is kept in memory (8 bytes per record) until Close.
+type Writer struct {
+	cw countWriter
+	enc *msgpack.Encoder
+	offs []uint64
+	closed bool
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (n int, err error) {
+	n, err = c.w.Write(p)
+	c.n += int64(n)
+	return
+}
+
+// NewWriter writes the file header to w, and returns a Writer for appending records.
+// opts configures the encoding of records (and may be nil).
+func NewWriter(w io.Writer, opts *msgpack.EncoderOptions) (rw *Writer, err error) {
+	rw = &Writer{cw: countWriter{w: w}}
+	rw.enc = msgpack.NewEncoderEx(&rw.cw, opts)
+	var hdr [headerLen]byte
+	copy(hdr[:], headerMagic)
+	binary.BigEndian.PutUint32(hdr[4:], version)
+	if _, err = rw.cw.Write(hdr[:]); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Append encodes v as the next record.
+func (rw *Writer) Append(v interface{}) (err error) {
+	if rw.closed {
+		return errors.New("recfile: Append after Close")
+	}
+	// the offset is only known once the previous records are out of the Encoder's buffer 
+	// (which, with EncoderOptions.DeferFlush, they may not be).
+	if err = rw.enc.Flush(); err != nil {
+		return
+	}
+	off := rw.cw.n
+	if err = rw.enc.Encode(v); err != nil {
+		return
+	}
+	rw.offs = append(rw.offs, uint64(off))
+	return
+}
+
+// Len returns the number of records appended so far.
+func (rw *Writer) Len() int { return len(rw.offs) }
+
+// Close writes the index and footer. It does not close the underlying writer.
+func (rw *Writer) Close() (err error) {
+	if rw.closed {
+		return
+	}
+	rw.closed = true
+	if err = rw.enc.Flush(); err != nil {
+		return
+	}
+	indexOff := rw.cw.n
+	buf := make([]byte, 0, 8 * 1024)
+	for _, off := range rw.offs {
+		buf = binary.BigEndian.AppendUint64(buf, off)
+		if len(buf) == cap(buf) {
+			if _, err = rw.cw.Write(buf); err != nil {
+				return
+			}
+			buf = buf[:0]
+		}
+	}
+	buf = binary.BigEndian.AppendUint64(buf, uint64(indexOff))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(len(rw.offs)))
+	buf = append(buf, footerMagic...)
+	_, err = rw.cw.Write(buf)
+	return
+}
+
+// Reader reads a record file through an io.ReaderAt (such as an *os.File).
+type Reader struct {
+	r io.ReaderAt
+	dam msgpack.DecoderContainerResolver
+	indexOff int64
+	n int
+}
+
+// NewReader checks the header and footer of the record file in r (of the given size), 
+// and returns a Reader of its records. dam is used to decode records (as for msgpack.NewDecoder).
+func NewReader(r io.ReaderAt, size int64, dam msgpack.DecoderContainerResolver) (rr *Reader, err error) {
+	if size < headerLen + footerLen {
+		return nil, errors.New("recfile: file too short")
+	}
+	var hdr [headerLen]byte
+	var ftr [footerLen]byte
+	if err = readAt(r, hdr[:], 0); err != nil {
+		return
+	}
+	if err = readAt(r, ftr[:], size - footerLen); err != nil {
+		return
+	}
+	if string(hdr[:4]) != string(headerMagic) || string(ftr[16:]) != string(footerMagic) {
+		return nil, errors.New("recfile: not a record file")
+	}
+	if v := binary.BigEndian.Uint32(hdr[4:]); v != version {
+		return nil, fmt.Errorf("recfile: unsupported version %d", v)
+	}
+	indexOff, n := binary.BigEndian.Uint64(ftr[:8]), binary.BigEndian.Uint64(ftr[8:16])
+	if indexOff < headerLen || n > uint64(size) / 8 || indexOff + 8*n != uint64(size - footerLen) {
+		return nil, errors.New("recfile: corrupt footer")
+	}
+	return &Reader{r: r, dam: dam, indexOff: int64(indexOff), n: int(n)}, nil
+}
+
+// Len returns the number of records.
+func (rr *Reader) Len() int { return rr.n }
+
+// Raw returns the encoding of record i.
+func (rr *Reader) Raw(i int) (bs msgpack.Raw, err error) {
+	if i < 0 || i >= rr.n {
+		return nil, fmt.Errorf("recfile: record %d out of range (%d records)", i, rr.n)
+	}
+	var x [16]byte
+	k := 16
+	if i == rr.n - 1 {
+		k = 8
+	}
+	if err = readAt(rr.r, x[:k], rr.indexOff + 8*int64(i)); err != nil {
+		return
+	}
+	off, end := binary.BigEndian.Uint64(x[:8]), uint64(rr.indexOff)
+	if k == 16 {
+		end = binary.BigEndian.Uint64(x[8:])
+	}
+	if off < headerLen || off > end || end > uint64(rr.indexOff) {
+		return nil, fmt.Errorf("recfile: corrupt index entry for record %d", i)
+	}
+	bs = make(msgpack.Raw, end - off)
+	if err = readAt(rr.r, bs, int64(off)); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Decode decodes record i into v.
+func (rr *Reader) Decode(i int, v interface{}) (err error) {
+	bs, err := rr.Raw(i)
+	if err != nil {
+		return
+	}
+	return msgpack.Unmarshal(bs, v, rr.dam)
+}
+
+// readAt reads len(bs) bytes at off (ReadAt may return io.EOF with them, at the end of r).
+func readAt(r io.ReaderAt, bs []byte, off int64) error {
+	if n, err := r.ReadAt(bs, off); n < len(bs) {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return nil
+}
+
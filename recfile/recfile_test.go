@@ -0,0 +1,91 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package recfile
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ugorji/go-msgpack"
+)
+
+func TestRecfile(t *testing.T) {
+	type rec struct {
+		N int
+		Tags []string
+	}
+	const n = 3000
+	var bs []byte
+	// records are indexed at their offsets in the file, however the Encoder buffers them.
+	for _, opts := range []*msgpack.EncoderOptions{nil, {DeferFlush: true}} {
+		var buf bytes.Buffer
+		w, err := NewWriter(&buf, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < n; i++ {
+			if err = w.Append(rec{i, []string{"a", "b"}[:i%3%2+1]}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		bs = buf.Bytes()
+		
+		r, err := NewReader(bytes.NewReader(bs), int64(len(bs)), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Len() != n {
+			t.Fatalf("expected %d records, got %d", n, r.Len())
+		}
+		for _, i := range []int{n - 1, 0, 1234} {
+			var v rec
+			if err = r.Decode(i, &v); err != nil {
+				t.Fatal(err)
+			}
+			if v.N != i || len(v.Tags) != i%3%2+1 {
+				t.Fatalf("record %d: got %v", i, v)
+			}
+		}
+		if _, err = r.Raw(n); err == nil {
+			t.Fatal("expected error reading record out of range")
+		}
+	}
+	
+	// truncated (or otherwise damaged) files are rejected.
+	if _, err := NewReader(bytes.NewReader(bs[:len(bs)-1]), int64(len(bs)-1), nil); err == nil {
+		t.Fatal("expected error opening truncated file")
+	}
+}
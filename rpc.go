@@ -36,6 +36,11 @@ An RPC Client and Server Codec is implemented, so that msgpack can be used
 with the standard net/rpc package. It supports both a basic net/rpc serialization,
 and the custom format defined at http://wiki.msgpack.org/display/MSGPACK/RPC+specification
 
+The custom codec sends the net/rpc argument as the params element as is. 
+The spec codec (NewSpecRPCClientCodec, etc) instead follows the msgpack-rpc protocol exactly, 
+with params always an array, so it interoperates with the msgpack-rpc implementations 
+for other languages (python, ruby, c++, ...).
+
 */
 package msgpack
 
@@ -44,12 +49,25 @@ import (
 	"strings"
 	"net/rpc"
 	"io"
+	"sync"
+	"context"
+	"time"
+	"bytes"
+	"errors"
+	"math"
 )
 
 type rpcCodec struct {
 	rwc       io.ReadWriteCloser
 	dec       *Decoder
-	enc       *Encoder
+	enc       *Encoder // encodes into wbuf
+	wbuf      *bytes.Buffer
+	bdec      *Decoder // decodes values read whole (e.g. params), re-used for each
+	reuseRead bool // buffers of values read whole can be re-used (see reuse)
+	dam       DecoderContainerResolver
+	maxRequest int64 // see RPCOptions.MaxRequestSize
+	maxResponse int64
+	stats RPCStats // if set (see RPCOptions.Stats)
 }
 
 type basicRpcCodec struct {
@@ -60,12 +78,142 @@ type customRpcCodec struct {
 	rpcCodec
 }
 
+type specRpcCodec struct {
+	rpcCodec
+	params Raw // params of the request last read, until its body is read
+	result Raw // result of the response last read, if read with its header (when followed by metadata)
+	rerr Raw // error of the response last read
+	mdmu sync.Mutex // guards mdOut and mdIn
+	mdOut map[uint64]RPCMetadata // metadata to send, by seq
+	mdIn map[uint64]RPCMetadata // metadata received, by seq
+	onNotify func(method string, params Raw)
+	onOrphan func(msgid uint64, rerr, result Raw)
+	hb *rpcHeartbeat
+	wmu sync.Mutex // serializes writes, as notifications are written outside of net/rpc
+	smu sync.Mutex // guards seqs
+	seqs map[uint32]uint64 // net/rpc seq of the calls awaiting a response, by msgid
+}
+
+// RPCOptions configures an rpc codec.
+type RPCOptions struct {
+	// Protocol is the protocol of the codecs made by NewRPCCodecOpts (and Dial, etc).
+	Protocol RPCProtocol
+	// Encoder and Decoder configure the encoding and decoding of messages (either may be nil).
+	Encoder *EncoderOptions
+	Decoder *DecoderOptions
+	// OnNotify, if set, is called with each msgpack-rpc notification ([2, method, params]) 
+	// received by a spec codec or an RPCClient, from the goroutine reading the connection 
+	// (so it should hand off any lengthy work). No response is sent for a notification.
+	// If nil, notifications are discarded.
+	OnNotify func(method string, params Raw)
+	// HeartbeatInterval, if set, makes a spec codec, RPCClient or RPCServer connection 
+	// send a ping (a notification, answered by a pong) at this interval, so an idle connection 
+	// is kept alive (e.g. through a NAT or firewall). The pings and pongs are handled internally,
+	// and not passed to OnNotify or the handlers.
+	HeartbeatInterval time.Duration
+	// HeartbeatTimeout is how long without reading anything from the peer (not even a pong) 
+	// it takes for a connection with heartbeats to be considered dead, and closed (3 intervals if zero).
+	HeartbeatTimeout time.Duration
+	// Interceptors are run around the methods of a codec made by NewSpecRPCCodecOpts 
+	// (see InterceptRPCCodec).
+	Interceptors []RPCInterceptor
+	// Errors maps error codes to Go errors for an RPCClient or RPCServer (RPCErrors if nil).
+	Errors *RPCErrorRegistry
+	// MaxRequestSize, if > 0, limits the size in bytes of each message read by a server 
+	// (a call or notification), and MaxResponseSize that of each message read by a client 
+	// (a response or notification). A message claiming more (e.g. by the length of a string or array) 
+	// fails with ErrRPCMessageTooLarge as soon as it is read, before anything is allocated for it, 
+	// and the connection is closed.
+	MaxRequestSize int
+	MaxResponseSize int
+	// MethodNameOut maps the name of each call written by a client codec (the net/rpc "Service.Method") 
+	// to the name sent, and MethodNameIn maps the name of each call read by a server codec 
+	// to the net/rpc name, for peers with other naming schemes (e.g. "get_user"). 
+	// See RPCSnakeCaseMethod and RPCServiceMethod. They apply to the codecs made by NewRPCCodecOpts 
+	// (within the Interceptors, which see the net/rpc names).
+	MethodNameOut func(string) string
+	MethodNameIn func(string) string
+	// Stats, if set, receives measurements of the calls, bytes and (en|de)coding 
+	// of a codec made by NewRPCCodecOpts, an RPCClient or an RPCServer.
+	Stats RPCStats
+	// OnOrphanResponse, if set, is called with each response read by a spec codec or an RPCClient 
+	// whose msgid matches no call waiting for one (e.g. a second response to a call, 
+	// or a late response to an RPCClient call whose context is done), from the goroutine reading 
+	// the connection. rerr is nil if the response has no error. Such responses are otherwise dropped.
+	// Responses which come out of order are matched to their calls by msgid, as usual.
+	OnOrphanResponse func(msgid uint64, rerr, result Raw)
+}
+
+// ErrRPCMessageTooLarge is the error of a connection which read a message larger than 
+// RPCOptions.MaxRequestSize (or MaxResponseSize).
+var ErrRPCMessageTooLarge = errors.New("msgpack-rpc: message too large")
+
+// ErrRPCMsgidInUse is the error of a call by a spec codec whose msgid (the net/rpc seq, 
+// which wraps around at 2^32 on the wire) is that of a call still waiting for its response.
+var ErrRPCMsgidInUse = errors.New("msgpack-rpc: msgid in use by a call still waiting for its response")
+
+// RPCNotifier is implemented by the spec rpc codecs, to send msgpack-rpc notifications:
+// one-way messages ([2, method, params]) for which the peer sends no response.
+// 
+// Sample Usage:
+//   codec := msgpack.NewSpecRPCClientCodec(conn, nil)
+//   client := rpc.NewClientWithCodec(codec)
+//   err = codec.(msgpack.RPCNotifier).Notify("log", "started", 1)
+type RPCNotifier interface {
+	Notify(method string, params ...interface{}) error
+}
+
+// RPCCodec is a codec usable from both the client and the server side of net/rpc.
+type RPCCodec interface {
+	rpc.ClientCodec
+	rpc.ServerCodec
+}
+
 func newRPCCodec(conn io.ReadWriteCloser, opts DecoderContainerResolver) (rpcCodec) {
+	return newRPCCodecEx(conn, nil, opts)
+}
+
+func newRPCCodecEx(conn io.ReadWriteCloser, encOpts *EncoderOptions, dam DecoderContainerResolver) (rpcCodec) {
+	wbuf := new(bytes.Buffer)
+	o, _ := dam.(*DecoderOptions)
 	return rpcCodec{
 		rwc: conn,
-		dec: NewDecoder(conn, opts),
-		enc: NewEncoder(conn),
+		dec: NewDecoder(conn, dam),
+		enc: NewEncoderEx(wbuf, encOpts),
+		wbuf: wbuf,
+		bdec: NewDecoderBytes(nil, dam),
+		reuseRead: o == nil || !o.ZeroCopy,
+		dam: dam,
+	}
+}
+
+// rpcReuseLimit is the capacity beyond which a codec does not keep a buffer for re-use, 
+// so one large message does not pin its memory for the life of the connection.
+const rpcReuseLimit = 64 << 10
+
+// reuse returns the storage of bs (emptied) for the next value read whole, 
+// unless values decoded from bs may alias it (with DecoderOptions.ZeroCopy), or it is too large.
+func (c *rpcCodec) reuse(bs Raw) Raw {
+	if !c.reuseRead || cap(bs) > rpcReuseLimit {
+		return nil
 	}
+	return bs[:0]
+}
+
+func newRPCCodecOpts(conn io.ReadWriteCloser, opts *RPCOptions) (c rpcCodec) {
+	c = newRPCCodecEx(withRPCStats(conn, opts.Stats), opts.Encoder, decOptsResolver(opts.Decoder))
+	c.maxRequest, c.maxResponse = int64(opts.MaxRequestSize), int64(opts.MaxResponseSize)
+	c.stats = opts.Stats
+	return
+}
+
+// decOptsResolver returns decOpts as a DecoderContainerResolver, 
+// making sure a nil *DecoderOptions becomes a nil interface.
+func decOptsResolver(decOpts *DecoderOptions) DecoderContainerResolver {
+	if decOpts == nil {
+		return nil
+	}
+	return decOpts
 }
 
 // NewRPCClientCodec uses basic msgpack serialization for rpc communication from client side.
@@ -96,25 +244,135 @@ func NewCustomRPCServerCodec(conn io.ReadWriteCloser, opts DecoderContainerResol
 	return &customRpcCodec{ newRPCCodec(conn, opts) }
 }
 	
+// NewRPCCodecEx uses basic msgpack serialization for rpc communication, 
+// configured by encOpts and decOpts (either of which may be nil), 
+// just as NewEncoderEx and NewDecoder are. 
+// The returned codec can be used from either the client or the server side.
+func NewRPCCodecEx(conn io.ReadWriteCloser, encOpts *EncoderOptions, decOpts *DecoderOptions) (RPCCodec) {
+	return &basicRpcCodec{ newRPCCodecEx(conn, encOpts, decOptsResolver(decOpts)) }
+}
+
+// NewCustomRPCCodecEx is like NewRPCCodecEx, but uses the custom protocol 
+// defined at http://wiki.msgpack.org/display/MSGPACK/RPC+specification
+func NewCustomRPCCodecEx(conn io.ReadWriteCloser, encOpts *EncoderOptions, decOpts *DecoderOptions) (RPCCodec) {
+	return &customRpcCodec{ newRPCCodecEx(conn, encOpts, decOptsResolver(decOpts)) }
+}
+
+// NewSpecRPCClientCodec uses the msgpack-rpc protocol for rpc communication from the client side.
+// A call is sent as [0, msgid, method, params], where params is a 1-element array 
+// holding the net/rpc argument. 
+func NewSpecRPCClientCodec(conn io.ReadWriteCloser, opts DecoderContainerResolver) (rpc.ClientCodec) {
+	return &specRpcCodec{ rpcCodec: newRPCCodec(conn, opts) }
+}
+
+// NewSpecRPCServerCodec uses the msgpack-rpc protocol for rpc communication from the server side.
+// The response to a call is sent as [1, msgid, error, result]. 
+// 
+// A call from a msgpack-rpc client whose params hold a single value decodes that value 
+// into the net/rpc argument. Any other params (e.g. f(a, b) sent as [a, b]) are decoded 
+// as a whole into the argument, which should then be a slice or array type.
+func NewSpecRPCServerCodec(conn io.ReadWriteCloser, opts DecoderContainerResolver) (rpc.ServerCodec) {
+	return &specRpcCodec{ rpcCodec: newRPCCodec(conn, opts) }
+}
+
+// NewSpecRPCCodecEx is like NewRPCCodecEx, but uses the msgpack-rpc protocol 
+// (see NewSpecRPCClientCodec and NewSpecRPCServerCodec).
+func NewSpecRPCCodecEx(conn io.ReadWriteCloser, encOpts *EncoderOptions, decOpts *DecoderOptions) (RPCCodec) {
+	return &specRpcCodec{ rpcCodec: newRPCCodecEx(conn, encOpts, decOptsResolver(decOpts)) }
+}
+
+// NewSpecRPCCodecOpts is like NewSpecRPCCodecEx, but configured by opts (which may be nil).
+func NewSpecRPCCodecOpts(conn io.ReadWriteCloser, opts *RPCOptions) (RPCCodec) {
+	if opts == nil {
+		opts = &RPCOptions{}
+	}
+	c := &specRpcCodec{ 
+		rpcCodec: newRPCCodecOpts(conn, opts), 
+		onNotify: opts.OnNotify,
+		onOrphan: opts.OnOrphanResponse,
+	}
+	c.hb = startHeartbeat(opts, func() error { return c.Notify(rpcPing) }, func() { c.rwc.Close() })
+	if in := opts.interceptors(); len(in) > 0 {
+		return InterceptRPCCodec(c, in...)
+	}
+	return c
+}
+
+// CallContext calls serviceMethod on an rpc.Client (e.g. one using a codec from this package), 
+// waiting for it to complete or for ctx to be done, whichever is first.
+// If ctx is done first, it returns ctx.Err() (e.g. context.DeadlineExceeded): 
+// net/rpc has no way to cancel a call, so its reply is still decoded into reply 
+// if it comes later (and reply should not be reused).
+func CallContext(ctx context.Context, client *rpc.Client, serviceMethod string, args interface{}, reply interface{}) error {
+	call := client.Go(serviceMethod, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // /////////////// RPC Codec Shared Methods ///////////////////
+// write encodes objs, and writes them to the connection with a single Write 
+// (so a message-oriented transport, e.g. a WebSocket, sends each message in one frame, 
+// and a value which fails to encode is not written at all).
 func (c *rpcCodec) write(objs ...interface{}) (err error) {
-	for _, obj := range objs {
-		if err = c.enc.Encode(obj); err != nil {
-			return
-		}
+	c.wbuf.Reset()
+	t := c.startTimer()
+	if err = c.enc.EncodeMulti(objs...); err != nil {
+		return
+	}
+	if c.stats != nil {
+		c.stats.Encoded(time.Since(t))
+	}
+	_, err = c.rwc.Write(c.wbuf.Bytes())
+	if c.wbuf.Cap() > rpcReuseLimit {
+		*c.wbuf = bytes.Buffer{}
 	}
 	return
 }
 
-func (c *rpcCodec) read(objs ...interface{}) (err error) {
-	for _, obj := range objs {
-		if err = c.dec.Decode(obj); err != nil {
-			return
-		}
+// startMessage starts the reading of a message: a request (or a response), 
+// limited to maxRequest (or maxResponse) bytes.
+func (c *rpcCodec) startMessage(request bool) {
+	if request {
+		c.dec.setLimit(c.maxRequest, ErrRPCMessageTooLarge)
+	} else {
+		c.dec.setLimit(c.maxResponse, ErrRPCMessageTooLarge)
+	}
+}
+
+// startTimer returns the time now, if there are stats to time things for.
+func (c *rpcCodec) startTimer() (t time.Time) {
+	if c.stats != nil {
+		t = time.Now()
 	}
 	return
 }
 
+// decodeBody decodes a body into v with d, reporting the time taken to the stats (if any).
+func (c *rpcCodec) decodeBody(d *Decoder, v interface{}) (err error) {
+	t := c.startTimer()
+	if err = d.Decode(v); err == nil && c.stats != nil {
+		c.stats.Decoded(time.Since(t))
+	}
+	return
+}
+
+// closeIfTooLarge closes the connection if err is ErrRPCMessageTooLarge: the rest of the message 
+// is left unread, so nothing more can be read from the connection.
+func (c *rpcCodec) closeIfTooLarge(err error) error {
+	if err == ErrRPCMessageTooLarge {
+		c.rwc.Close()
+	}
+	return err
+}
+
+func (c *rpcCodec) read(objs ...interface{}) (err error) {
+	return c.dec.DecodeMulti(objs...)
+}
+
 // maybeEOF is used to possibly return EOF for functions (e.g. ReadXXXHeader) that
 // should return EOF if underlying connection was closed.
 // This is important because rpc uses goroutines on clients (to support sync and async models)
@@ -128,6 +386,9 @@ func (c *rpcCodec) maybeEOF(err error) (errx error) {
 		return nil
 	}
 	// defer func() { fmt.Printf("maybeEOF: orig: %T, %v, returning: %T, %v\n", err, err, errx, errx) }()
+	if err == ErrRPCMessageTooLarge {
+		return c.closeIfTooLarge(err)
+	}
 	if err == io.EOF || err == io.ErrUnexpectedEOF {
 		return io.EOF
 	} 
@@ -152,7 +413,7 @@ func (c *rpcCodec) Close() error {
 }
 
 func (c *rpcCodec) ReadResponseBody(body interface{}) error {
-	return c.dec.Decode(body)
+	return c.closeIfTooLarge(c.decodeBody(c.dec, body))
 }
 
 // /////////////// Basic RPC Codec ///////////////////
@@ -165,14 +426,16 @@ func (c *basicRpcCodec) WriteResponse(r *rpc.Response, body interface{}) error {
 }
 
 func (c *basicRpcCodec) ReadRequestBody(body interface{}) error {
-	return c.dec.Decode(body)
+	return c.closeIfTooLarge(c.decodeBody(c.dec, body))
 }
 
 func (c *basicRpcCodec) ReadResponseHeader(r *rpc.Response) error {
+	c.startMessage(false)
 	return c.maybeEOF(c.dec.Decode(r))
 }
 
 func (c *basicRpcCodec) ReadRequestHeader(r *rpc.Request) error {
+	c.startMessage(true)
 	return c.maybeEOF(c.dec.Decode(r))
 }
 
@@ -186,7 +449,7 @@ func (c *customRpcCodec) WriteResponse(r *rpc.Response, body interface{}) error
 }
 
 func (c *customRpcCodec) ReadRequestBody(body interface{}) error {
-	return c.dec.Decode(body)
+	return c.closeIfTooLarge(c.decodeBody(c.dec, body))
 }
 
 func (c *customRpcCodec) ReadResponseHeader(r *rpc.Response) error {
@@ -201,19 +464,16 @@ func (c *customRpcCodec) parseCustomHeader(expectTypeByte byte, msgid *uint64, m
 
 	// We read the response header by hand 
 	// so that the body can be decoded on its own from the stream at a later time.
+	c.startMessage(expectTypeByte == 0)
 
-	bs := make([]byte, 1)
-	n, err := c.rwc.Read(bs)
+	// Read through the decoder (not c.rwc), so any byte it has buffered is not lost.
+	bd, err := c.dec.r.readn1()
 	if err != nil {
 		return 
 	}
-	if n != 1 {
-		err = fmt.Errorf("Couldn't read array descriptor: No bytes read")
-		return
-	}
 	const fia byte = 0x94 //four item array descriptor value
-	if bs[0] != fia {
-		err = fmt.Errorf("Unexpected value for array descriptor: Expecting %v. Received %v", fia, bs[0])
+	if bd != fia {
+		err = fmt.Errorf("Unexpected value for array descriptor: Expecting %v. Received %v", fia, bd)
 		return
 	}
 	var b byte
@@ -239,6 +499,303 @@ func (c *customRpcCodec) writeCustomBody(typeByte byte, msgid uint64, methodOrEr
 		}
 	}
 	r2 := []interface{}{ typeByte, uint32(msgid), moe, body }
-	return c.enc.Encode(r2)
+	return c.write(r2)
+}
+
+// /////////////// Spec RPC Codec ///////////////////
+func (c *specRpcCodec) Close() error {
+	c.hb.stop()
+	return c.rwc.Close()
+}
+
+func (c *specRpcCodec) WriteRequest(r *rpc.Request, body interface{}) (err error) {
+	md := c.takeMetadata(r.Seq, false)
+	msgid := uint32(r.Seq)
+	c.smu.Lock()
+	if _, ok := c.seqs[msgid]; ok {
+		c.smu.Unlock()
+		return ErrRPCMsgidInUse
+	}
+	if c.seqs == nil {
+		c.seqs = make(map[uint32]uint64)
+	}
+	c.seqs[msgid] = r.Seq
+	c.smu.Unlock()
+	if err = c.writeSpec(withMetadata([]interface{}{ 0, msgid, r.ServiceMethod, []interface{}{ body } }, md)); err != nil {
+		c.smu.Lock()
+		delete(c.seqs, msgid)
+		c.smu.Unlock()
+	}
+	return
+}
+
+// callSeq returns (and forgets) the net/rpc seq of the call waiting for the response msgid.
+func (c *specRpcCodec) callSeq(msgid uint64) (seq uint64, ok bool) {
+	if msgid > math.MaxUint32 {
+		return
+	}
+	c.smu.Lock()
+	if seq, ok = c.seqs[uint32(msgid)]; ok {
+		delete(c.seqs, uint32(msgid))
+	}
+	c.smu.Unlock()
+	return
+}
+
+// orphan reads the rest of a response of l elements, whose msgid matches no call, 
+// and passes it to the OnOrphanResponse hook (if any).
+func (c *specRpcCodec) orphan(l int, msgid uint64, rerr Raw) (err error) {
+	if c.onOrphan == nil {
+		for i := 3; i < l; i++ {
+			if err = c.dec.Skip(); err != nil {
+				return
+			}
+		}
+		return
+	}
+	result, err := c.dec.DecodeRaw()
+	if err != nil {
+		return
+	}
+	if l == 5 {
+		if err = c.dec.Skip(); err != nil {
+			return
+		}
+	}
+	if len(rerr) == 1 && rerr[0] == 0xc0 {
+		rerr = nil
+	}
+	c.onOrphan(msgid, append(Raw(nil), rerr...), result)
+	return
+}
+
+func (c *specRpcCodec) SetMetadata(seq uint64, md RPCMetadata) {
+	c.mdmu.Lock()
+	if c.mdOut == nil {
+		c.mdOut = make(map[uint64]RPCMetadata)
+	}
+	c.mdOut[seq] = md
+	c.mdmu.Unlock()
+}
+
+func (c *specRpcCodec) Metadata(seq uint64) RPCMetadata {
+	c.mdmu.Lock()
+	defer c.mdmu.Unlock()
+	return c.mdIn[seq]
+}
+
+// takeMetadata removes and returns the metadata to send with seq 
+// (and removes that received with it, for a response).
+func (c *specRpcCodec) takeMetadata(seq uint64, response bool) (md RPCMetadata) {
+	c.mdmu.Lock()
+	md = c.mdOut[seq]
+	delete(c.mdOut, seq)
+	if response {
+		delete(c.mdIn, seq)
+	}
+	c.mdmu.Unlock()
+	return
+}
+
+// readMetadata reads the metadata at the end of a message of l elements (if any), 
+// recording it as received with seq. 
+func (c *specRpcCodec) readMetadata(l int, seq uint64, response bool) (err error) {
+	var md RPCMetadata
+	if l == 5 {
+		if err = c.dec.Decode(&md); err != nil {
+			return
+		}
+	}
+	c.mdmu.Lock()
+	if response {
+		// only the metadata of the response last read is kept.
+		c.mdIn = nil
+	}
+	if md != nil {
+		if c.mdIn == nil {
+			c.mdIn = make(map[uint64]RPCMetadata)
+		}
+		c.mdIn[seq] = md
+	}
+	c.mdmu.Unlock()
+	return
+}
+
+// Notify sends a notification, with params as the positional parameters.
+func (c *specRpcCodec) Notify(method string, params ...interface{}) error {
+	if params == nil {
+		params = []interface{}{}
+	}
+	return c.writeSpec([]interface{}{ 2, method, params })
+}
+
+func (c *specRpcCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	var rerr interface{}
+	if r.Error != "" {
+		rerr, body = r.Error, nil
+	}
+	return c.writeSpec(withMetadata([]interface{}{ 1, uint32(r.Seq), rerr, body }, c.takeMetadata(r.Seq, true)))
+}
+
+func (c *specRpcCodec) writeSpec(msg []interface{}) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.write(msg)
+}
+
+func (c *specRpcCodec) ReadRequestHeader(r *rpc.Request) (err error) {
+	defer func() { err = c.closeIfTooLarge(err) }()
+	l, err := c.readSpecHeader(0, &r.Seq)
+	if err = c.maybeEOF(err); err != nil {
+		return
+	}
+	if r.ServiceMethod, err = c.dec.ReadString(); err != nil {
+		return
+	}
+	if c.params, err = c.dec.decodeRawAppend(c.reuse(c.params)); err != nil {
+		return
+	}
+	return c.readMetadata(l, r.Seq, false)
+}
+
+func (c *specRpcCodec) ReadRequestBody(body interface{}) (err error) {
+	params := c.params
+	c.params = c.reuse(params)
+	if body == nil {
+		return
+	}
+	d := c.bdec
+	d.resetBytes(params)
+	if l, err := d.ReadArrayHeader(); err != nil {
+		return err
+	} else if l != 1 {
+		d.resetBytes(params)
+	}
+	return c.decodeBody(d, body)
+}
+
+func (c *specRpcCodec) ReadResponseHeader(r *rpc.Response) (err error) {
+	defer func() { err = c.closeIfTooLarge(err) }()
+	// responses may come in any order: each is matched to its call by msgid. 
+	// Those matching no call are skipped.
+	var l int
+	for {
+		var msgid uint64
+		l, err = c.readSpecHeader(1, &msgid)
+		if err = c.maybeEOF(err); err != nil {
+			return
+		}
+		if c.rerr, err = c.dec.decodeRawAppend(c.reuse(c.rerr)); err != nil {
+			return
+		}
+		var ok bool
+		if r.Seq, ok = c.callSeq(msgid); ok {
+			break
+		}
+		if err = c.orphan(l, msgid, c.rerr); err != nil {
+			return
+		}
+	}
+	rerr := c.rerr
+	// msgpack-rpc allows any object as the error, so we stringify whatever we are sent
+	// (a structured error as "message (code N)").
+	if len(rerr) != 1 || rerr[0] != 0xc0 {
+		e := RPCErrors.newRPCError(rerr, nil)
+		if r.Error = e.Message; e.structured {
+			r.Error = fmt.Sprintf("%s (code %d)", e.Message, e.Code)
+		}
+		if r.Error == "" {
+			r.Error = "msgpack-rpc: empty error"
+		}
+	}
+	// the result comes before the metadata, so it is read now (and decoded by ReadResponseBody).
+	c.result = c.reuse(c.result)
+	if l == 5 {
+		if c.result, err = c.dec.decodeRawAppend(c.result); err != nil {
+			return
+		}
+	}
+	return c.readMetadata(l, r.Seq, true)
+}
+
+func (c *specRpcCodec) ReadResponseBody(body interface{}) error {
+	if result := c.result; len(result) > 0 {
+		c.result = c.reuse(result)
+		if body == nil {
+			return nil
+		}
+		c.bdec.resetBytes(result)
+		return c.decodeBody(c.bdec, body)
+	}
+	if body == nil {
+		return c.closeIfTooLarge(c.dec.Skip())
+	}
+	return c.closeIfTooLarge(c.decodeBody(c.dec, body))
 }
 
+// readSpecHeader reads the start of a 4-element msgpack-rpc message (up to the msgid), 
+// checking that it is of type expectType. It returns the number of elements 
+// (5 if the message ends with metadata).
+// Notifications read on the way are passed to the OnNotify hook.
+func (c *specRpcCodec) readSpecHeader(expectType uint64, msgid *uint64) (l int, err error) {
+	var typ uint64
+	for {
+		c.startMessage(expectType == 0)
+		if l, err = c.dec.ReadArrayHeader(); err != nil {
+			return
+		}
+		c.hb.seen()
+		if typ, err = c.dec.ReadUint64(); err != nil {
+			return
+		}
+		if typ != 2 {
+			break
+		}
+		if l != 3 && l != 4 {
+			return l, fmt.Errorf("%s: msgpack-rpc: expecting a 3-element notification. Received %v elements", msgTagDec, l)
+		}
+		if err = c.readNotify(); err != nil {
+			return
+		}
+		// the metadata of a notification is not used.
+		if l == 4 {
+			if err = c.dec.Skip(); err != nil {
+				return
+			}
+		}
+	}
+	if l != 4 && l != 5 {
+		return l, fmt.Errorf("%s: msgpack-rpc: expecting a 4-element array. Received %v elements", msgTagDec, l)
+	}
+	if typ != expectType {
+		return l, fmt.Errorf("%s: msgpack-rpc: expecting message type %v. Received %v", msgTagDec, expectType, typ)
+	}
+	*msgid, err = c.dec.ReadUint64()
+	return
+}
+
+func (c *specRpcCodec) readNotify() (err error) {
+	method, err := c.dec.ReadString()
+	if err != nil {
+		return
+	}
+	switch method {
+	case rpcPing:
+		// answered from another goroutine, so the reading goroutine never waits on a write.
+		if err = c.dec.Skip(); err == nil {
+			go c.Notify(rpcPong)
+		}
+		return
+	case rpcPong:
+		return c.dec.Skip()
+	}
+	if c.onNotify == nil {
+		return c.dec.Skip()
+	}
+	params, err := c.dec.DecodeRaw()
+	if err != nil {
+		return
+	}
+	c.onNotify(method, params)
+	return
+}
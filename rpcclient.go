@@ -0,0 +1,641 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrRPCClosed is returned for calls on an RPCClient (or RPCServer) which has been closed.
+var ErrRPCClosed = errors.New("msgpack-rpc: connection is closed")
+
+// RPCClient is a msgpack-rpc client, independent of net/rpc. 
+// Calls take any number of positional parameters (sent as the params array), 
+// so it can call msgpack-rpc services in any language, whatever their method signatures.
+// 
+// Calls may be made concurrently. Responses are matched to calls by msgid, 
+// so a server may respond out of order.
+// 
+// If conn has deadlines (e.g. a net.Conn), the deadline of the context of a call 
+// bounds the writing of the call, and the wait for a response: while idle between responses, 
+// the read deadline is that of the earliest call pending. So a hung server fails its calls
+// with context.DeadlineExceeded, and does not block the reading of the connection forever.
+// 
+// Sample Usage:
+//   conn, err := net.Dial("tcp", "localhost:18800")
+//   client := msgpack.NewRPCClient(conn, nil)
+//   defer client.Close()
+//   res, err := client.Call(ctx, "add", 1, 2)
+//   var sum int
+//   err = res.Decode(&sum)
+type RPCClient struct {
+	conn io.ReadWriteCloser
+	opts RPCOptions
+	dam DecoderContainerResolver
+	errs *RPCErrorRegistry
+	br *bufio.Reader
+	dec *Decoder
+	dl rpcDeadliner // conn, if it has deadlines
+	hb *rpcHeartbeat
+
+	wmu sync.Mutex // guards the writing of a message
+	wbuf bytes.Buffer
+	enc *Encoder
+
+	mu sync.Mutex // guards the fields below
+	seq uint32
+	pending map[uint32]*rpcCall
+	err error // set once the connection has failed or been closed
+	reading bool // a message is being read (so the read deadline must not be set)
+	rdeadline time.Time // read deadline last set
+}
+
+type rpcCall struct {
+	ch chan rpcReply
+	deadline time.Time // zero if none
+	stream *RPCStream // for a streaming call
+	method string
+	start time.Time // if there are stats (see RPCOptions.Stats)
+}
+
+// rpcDeadliner is implemented by connections with deadlines (e.g. a net.Conn).
+type rpcDeadliner interface {
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+type rpcReply struct {
+	result Raw
+	rerr Raw // error object sent by the server, if not nil
+	md RPCMetadata
+	err error // local error (e.g. connection failed)
+}
+
+// RPCResult is the result of a call made with an RPCClient.
+type RPCResult struct {
+	// Raw is the msgpack encoding of the result.
+	Raw Raw
+	// Metadata is the metadata sent back with the result (if any).
+	Metadata RPCMetadata
+	dam DecoderContainerResolver
+}
+
+// Decode decodes the result into v, using the decoder options of the client.
+func (r RPCResult) Decode(v interface{}) error {
+	return Unmarshal(r.Raw, v, r.dam)
+}
+
+// RPCError is the error returned for a call which the server responded to with an error.
+type RPCError struct {
+	// Value is the msgpack encoding of the error object sent by the server 
+	// (usually a string, but msgpack-rpc allows any object).
+	Value Raw
+	// Metadata is the metadata sent back with the error (if any).
+	Metadata RPCMetadata
+	// Code, Message and Data are those of a structured error (see RPCCodeError). 
+	// For any other error, Message is the error string (or the error object as JSON).
+	Code int
+	Message string
+	Data Raw
+	structured bool
+	err error // registered for Code
+}
+
+func (e *RPCError) Error() string {
+	if e.structured {
+		return fmt.Sprintf("msgpack-rpc: remote error: %s (code %d)", e.Message, e.Code)
+	}
+	return "msgpack-rpc: remote error: " + e.Message
+}
+
+// Unwrap returns the error registered for the code of a structured error (see RPCErrorRegistry), or nil.
+func (e *RPCError) Unwrap() error {
+	return e.err
+}
+
+// NewRPCClient returns an RPCClient making calls over conn, configured by opts (which may be nil).
+// opts.OnNotify receives notifications sent by the server.
+// 
+// The client reads from conn in its own goroutine, until conn fails or the client is closed.
+func NewRPCClient(conn io.ReadWriteCloser, opts *RPCOptions) (c *RPCClient) {
+	c = &RPCClient{pending: make(map[uint32]*rpcCall)}
+	if opts != nil {
+		c.opts = *opts
+	}
+	conn = withRPCStats(conn, c.opts.Stats)
+	c.conn = conn
+	c.dl, _ = conn.(rpcDeadliner)
+	c.dam = decOptsResolver(c.opts.Decoder)
+	if c.errs = c.opts.Errors; c.errs == nil {
+		c.errs = RPCErrors
+	}
+	c.br = bufio.NewReader(conn)
+	c.dec = NewDecoder(c.br, c.dam)
+	c.enc = NewEncoderEx(&c.wbuf, c.opts.Encoder)
+	c.hb = startHeartbeat(&c.opts, func() error { return c.Notify(rpcPing) }, func() { 
+		c.fail(ErrRPCDeadPeer)
+		conn.Close()
+	})
+	go c.readLoop()
+	return
+}
+
+// Call calls method with args as the positional parameters, and waits for its result.
+// 
+// If ctx is done first, Call returns ctx.Err(): the server is told to cancel the call 
+// (see RPCHandler), and the response, if it comes, is discarded.
+// If the deadline of ctx passes while the call is being written, the connection fails 
+// (as a message may have been partly written).
+// An error response from the server is returned as an *RPCError.
+func (c *RPCClient) Call(ctx context.Context, method string, args ...interface{}) (res RPCResult, err error) {
+	if args == nil {
+		args = []interface{}{}
+	}
+	deadline, _ := ctx.Deadline()
+	msgid, ch, err := c.register(method, deadline)
+	if err != nil {
+		return
+	}
+	if err = c.write(ctx, withMetadata([]interface{}{ 0, msgid, method, args }, outMetadata(ctx))); err != nil {
+		c.forget(msgid, err)
+		return
+	}
+	select {
+	case r := <-ch:
+		res, err = c.result(r)
+	case <-ctx.Done():
+		err = ctx.Err()
+		c.forget(msgid, err)
+		c.cancel(msgid)
+	}
+	return
+}
+
+// RPCBatch collects calls and notifications, to send them all in a single write.
+// 
+// Sample Usage:
+//   b := client.NewBatch()
+//   c1 := b.Call("add", 1, 2)
+//   c2 := b.Call("add", 3, 4)
+//   err = b.Send(ctx)
+//   res, err := c1.Wait(ctx)
+type RPCBatch struct {
+	c *RPCClient
+	msgs [][]interface{}
+	calls []*RPCCall
+}
+
+// RPCCall is a call sent in an RPCBatch. Its response is delivered as soon as it arrives,
+// independently of the other calls in the batch.
+type RPCCall struct {
+	// Method is the method called.
+	Method string
+	c *RPCClient
+	msgid uint32
+	ch chan rpcReply
+	done bool
+	res RPCResult
+	err error
+}
+
+// NewBatch returns an empty RPCBatch for c.
+func (c *RPCClient) NewBatch() *RPCBatch {
+	return &RPCBatch{c: c}
+}
+
+// Call adds a call of method (with args as the positional parameters) to the batch.
+// The returned RPCCall gets its result once the batch is sent.
+func (b *RPCBatch) Call(method string, args ...interface{}) *RPCCall {
+	if args == nil {
+		args = []interface{}{}
+	}
+	call := &RPCCall{ Method: method, c: b.c }
+	b.msgs = append(b.msgs, []interface{}{ 0, nil, method, args })
+	b.calls = append(b.calls, call)
+	return call
+}
+
+// Notify adds a notification to the batch.
+func (b *RPCBatch) Notify(method string, args ...interface{}) {
+	if args == nil {
+		args = []interface{}{}
+	}
+	b.msgs = append(b.msgs, []interface{}{ 2, method, args })
+	b.calls = append(b.calls, nil)
+}
+
+// Len returns the number of calls and notifications in the batch.
+func (b *RPCBatch) Len() int {
+	return len(b.msgs)
+}
+
+// Send writes all calls and notifications of the batch in a single write, and empties the batch. 
+// The deadline of ctx (if any) bounds the write, and the wait for each response.
+// If Send fails, the calls of the batch fail with its error.
+func (b *RPCBatch) Send(ctx context.Context) (err error) {
+	msgs, calls := b.msgs, b.calls
+	b.msgs, b.calls = nil, nil
+	deadline, _ := ctx.Deadline()
+	for i, call := range calls {
+		if call == nil {
+			continue
+		}
+		if call.msgid, call.ch, err = b.c.register(call.Method, deadline); err != nil {
+			break
+		}
+		msgs[i][1] = call.msgid
+	}
+	if md := outMetadata(ctx); len(md) > 0 {
+		for i := range msgs {
+			msgs[i] = append(msgs[i], md)
+		}
+	}
+	if err == nil {
+		err = b.c.write(ctx, msgs...)
+	}
+	if err != nil {
+		for _, call := range calls {
+			if call != nil {
+				if call.ch != nil {
+					b.c.forget(call.msgid, err)
+				}
+				call.done, call.err = true, err
+			}
+		}
+	}
+	return
+}
+
+// Wait waits for the result of the call, or for ctx to be done (when it returns ctx.Err(), 
+// and the call can be waited for again). It returns the same result each time once it has one.
+// 
+// Wait must not be called before the batch is sent, nor concurrently.
+func (call *RPCCall) Wait(ctx context.Context) (res RPCResult, err error) {
+	if !call.done {
+		select {
+		case r := <-call.ch:
+			call.done = true
+			call.res, call.err = call.c.result(r)
+		case <-ctx.Done():
+			return res, ctx.Err()
+		}
+	}
+	return call.res, call.err
+}
+
+// register allocates a msgid for a call of method, and records it as pending.
+func (c *RPCClient) register(method string, deadline time.Time) (msgid uint32, ch chan rpcReply, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err = c.err; err != nil {
+		return
+	}
+	// msgids wrap around: one still in use (by a call waiting for long) is skipped.
+	for {
+		c.seq++
+		if _, ok := c.pending[c.seq]; !ok {
+			break
+		}
+	}
+	msgid = c.seq
+	ch = make(chan rpcReply, 1)
+	call := &rpcCall{ ch: ch, deadline: deadline, method: method }
+	if c.opts.Stats != nil {
+		call.start = time.Now()
+		c.opts.Stats.CallStarted(method)
+	}
+	c.pending[msgid] = call
+	c.updateReadDeadline()
+	return
+}
+
+// completed reports to the stats (if any) that call has completed with err.
+func (c *RPCClient) completed(call *rpcCall, err error) {
+	if c.opts.Stats != nil {
+		c.opts.Stats.CallCompleted(call.method, time.Since(call.start), err)
+	}
+}
+
+// result returns the result of a call from its reply.
+func (c *RPCClient) result(r rpcReply) (res RPCResult, err error) {
+	if r.err != nil {
+		err = r.err
+	} else if r.rerr != nil {
+		err = c.errs.newRPCError(r.rerr, r.md)
+	} else {
+		res = RPCResult{ Raw: r.result, Metadata: r.md, dam: c.dam }
+	}
+	return
+}
+
+// Notify sends a notification: a call of method (with args as the positional parameters) 
+// for which the server sends no response.
+func (c *RPCClient) Notify(method string, args ...interface{}) (err error) {
+	if args == nil {
+		args = []interface{}{}
+	}
+	c.mu.Lock()
+	err = c.err
+	c.mu.Unlock()
+	if err != nil {
+		return
+	}
+	return c.write(context.Background(), []interface{}{ 2, method, args })
+}
+
+// NotifyContext is like Notify, but the deadline of ctx (if any) bounds the writing of the notification,
+// and the metadata of ctx (see ContextWithRPCMetadata) is sent with it.
+func (c *RPCClient) NotifyContext(ctx context.Context, method string, args ...interface{}) (err error) {
+	if args == nil {
+		args = []interface{}{}
+	}
+	c.mu.Lock()
+	err = c.err
+	c.mu.Unlock()
+	if err != nil {
+		return
+	}
+	return c.write(ctx, withMetadata([]interface{}{ 2, method, args }, outMetadata(ctx)))
+}
+
+// Close closes the connection. Calls waiting for a response return ErrRPCClosed.
+func (c *RPCClient) Close() error {
+	c.hb.stop()
+	c.fail(ErrRPCClosed)
+	return c.conn.Close()
+}
+
+// write encodes msgs and writes them to the connection in a single write, 
+// by the deadline of ctx.
+func (c *RPCClient) write(ctx context.Context, msgs ...[]interface{}) (err error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	c.wbuf.Reset()
+	var t time.Time
+	if c.opts.Stats != nil {
+		t = time.Now()
+	}
+	for _, msg := range msgs {
+		if err = c.enc.Encode(msg); err != nil {
+			return
+		}
+	}
+	if c.opts.Stats != nil {
+		c.opts.Stats.Encoded(time.Since(t))
+	}
+	deadline, ok := ctx.Deadline()
+	if ok && c.dl != nil {
+		c.dl.SetWriteDeadline(deadline)
+		defer c.dl.SetWriteDeadline(time.Time{})
+	}
+	if _, err = c.conn.Write(c.wbuf.Bytes()); err != nil {
+		if ok && isTimeout(err) {
+			err = context.DeadlineExceeded
+		}
+		c.fail(err)
+	}
+	return
+}
+
+// updateReadDeadline sets the read deadline to that of the earliest call pending (if any),
+// unless a message is being read. It must be called with c.mu held.
+func (c *RPCClient) updateReadDeadline() {
+	if c.dl == nil || c.reading {
+		return
+	}
+	var deadline time.Time
+	for _, call := range c.pending {
+		if !call.deadline.IsZero() && (deadline.IsZero() || call.deadline.Before(deadline)) {
+			deadline = call.deadline
+		}
+	}
+	if !deadline.Equal(c.rdeadline) {
+		c.rdeadline = deadline
+		c.dl.SetReadDeadline(deadline)
+	}
+}
+
+// expire fails the pending calls whose deadline has passed.
+func (c *RPCClient) expire() {
+	now := time.Now()
+	for msgid, call := range c.pending {
+		if !call.deadline.IsZero() && !call.deadline.After(now) {
+			call.ch <- rpcReply{ err: context.DeadlineExceeded }
+			delete(c.pending, msgid)
+			c.completed(call, context.DeadlineExceeded)
+		}
+	}
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// broken says whether the client can no longer be used (its connection has failed, or it is closed).
+func (c *RPCClient) broken() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err != nil
+}
+
+// cancel tells the server to cancel the call msgid (which has been forgotten), in the background.
+func (c *RPCClient) cancel(msgid uint32) {
+	if !c.broken() {
+		go c.Notify(rpcCancel, msgid)
+	}
+}
+
+// forget stops waiting for the response to msgid, as the call failed with err.
+func (c *RPCClient) forget(msgid uint32, err error) {
+	c.mu.Lock()
+	if call := c.pending[msgid]; call != nil {
+		delete(c.pending, msgid)
+		c.completed(call, err)
+	}
+	c.updateReadDeadline()
+	c.mu.Unlock()
+}
+
+// fail records err as the reason the client can no longer be used (unless one is recorded already),
+// and fails all pending calls with it.
+func (c *RPCClient) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	for msgid, call := range c.pending {
+		call.ch <- rpcReply{ err: err }
+		delete(c.pending, msgid)
+		c.completed(call, err)
+	}
+}
+
+func (c *RPCClient) readLoop() {
+	for {
+		// wait for a message, by the earliest deadline of the pending calls.
+		// A timeout here leaves the stream intact, so the connection stays usable.
+		_, err := c.br.Peek(1)
+		c.mu.Lock()
+		if err != nil && isTimeout(err) {
+			c.expire()
+			c.rdeadline = time.Time{}
+			c.dl.SetReadDeadline(c.rdeadline)
+			c.updateReadDeadline()
+			c.mu.Unlock()
+			continue
+		}
+		// no deadline while reading a message, as a timeout would leave it partly read.
+		c.reading = true
+		if c.dl != nil && !c.rdeadline.IsZero() {
+			c.rdeadline = time.Time{}
+			c.dl.SetReadDeadline(c.rdeadline)
+		}
+		c.mu.Unlock()
+		if err == nil {
+			err = c.readMessage()
+		}
+		c.mu.Lock()
+		c.reading = false
+		c.updateReadDeadline()
+		c.mu.Unlock()
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				err = ErrRPCClosed
+			}
+			c.hb.stop()
+			c.fail(err)
+			c.conn.Close()
+			return
+		}
+	}
+}
+
+// readMessage reads a response or notification, and delivers it.
+func (c *RPCClient) readMessage() (err error) {
+	c.dec.setLimit(int64(c.opts.MaxResponseSize), ErrRPCMessageTooLarge)
+	l, err := c.dec.ReadArrayHeader()
+	if err != nil {
+		return
+	}
+	c.hb.seen()
+	typ, err := c.dec.ReadUint64()
+	if err != nil {
+		return
+	}
+	switch {
+	case typ == 1 && (l == 4 || l == 5):
+		var msgid uint64
+		var r rpcReply
+		if msgid, err = c.dec.ReadUint64(); err != nil {
+			return
+		}
+		if r.rerr, err = c.dec.DecodeRaw(); err != nil {
+			return
+		}
+		if r.result, err = c.dec.DecodeRaw(); err != nil {
+			return
+		}
+		if l == 5 {
+			if err = c.dec.Decode(&r.md); err != nil {
+				return
+			}
+		}
+		if len(r.rerr) == 1 && r.rerr[0] == 0xc0 {
+			r.rerr = nil
+		}
+		var call *rpcCall
+		if msgid <= math.MaxUint32 {
+			c.mu.Lock()
+			call = c.pending[uint32(msgid)]
+			delete(c.pending, uint32(msgid))
+			c.mu.Unlock()
+		}
+		// a response to a call no longer waiting (e.g. its context is done) is passed to OnOrphanResponse.
+		if call == nil {
+			if c.opts.OnOrphanResponse != nil {
+				c.opts.OnOrphanResponse(msgid, r.rerr, r.result)
+			}
+		} else {
+			if c.opts.Stats != nil {
+				var cerr error
+				if r.rerr != nil {
+					cerr = c.errs.newRPCError(r.rerr, r.md)
+				}
+				c.completed(call, cerr)
+			}
+			call.ch <- r
+		}
+	case typ == 2 && (l == 3 || l == 4):
+		var method string
+		var params Raw
+		if method, err = c.dec.ReadString(); err != nil {
+			return
+		}
+		if params, err = c.dec.DecodeRaw(); err != nil {
+			return
+		}
+		// the metadata of a notification is not used.
+		if l == 4 {
+			if err = c.dec.Skip(); err != nil {
+				return
+			}
+		}
+		switch {
+		case method == rpcPing:
+			go c.Notify(rpcPong)
+		case method == rpcPong:
+		case method == rpcChunk:
+			c.chunk(params)
+		case c.opts.OnNotify != nil:
+			c.opts.OnNotify(method, params)
+		}
+	default:
+		err = fmt.Errorf("%s: msgpack-rpc: unexpected message (type %v, %v elements)", msgTagDec, typ, l)
+	}
+	return
+}
@@ -0,0 +1,208 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"os"
+)
+
+// RPCProtocol selects the serialization of the codecs made by NewRPCCodecOpts.
+type RPCProtocol int
+
+const (
+	// RPCBasicProtocol is the basic net/rpc serialization (as NewRPCClientCodec).
+	RPCBasicProtocol RPCProtocol = iota
+	// RPCCustomProtocol is the custom msgpack-rpc like format (as NewCustomRPCClientCodec).
+	RPCCustomProtocol
+	// RPCSpecProtocol is the msgpack-rpc protocol (as NewSpecRPCClientCodec).
+	RPCSpecProtocol
+)
+
+// RPCALPNProtocol is the protocol name negotiated (with TLS ALPN) by DialTLS and ListenTLS, 
+// unless the tls.Config lists its own (in NextProtos).
+const RPCALPNProtocol = "msgpack-rpc"
+
+// NewRPCCodecOpts returns a codec for conn using opts.Protocol (and the rest of opts, which may be nil).
+// Notifications, heartbeats and metadata are only supported by RPCSpecProtocol.
+func NewRPCCodecOpts(conn io.ReadWriteCloser, opts *RPCOptions) (c RPCCodec) {
+	if opts == nil {
+		opts = &RPCOptions{}
+	}
+	switch opts.Protocol {
+	case RPCSpecProtocol:
+		return NewSpecRPCCodecOpts(conn, opts)
+	case RPCCustomProtocol:
+		c = &customRpcCodec{ newRPCCodecOpts(conn, opts) }
+	default:
+		c = &basicRpcCodec{ newRPCCodecOpts(conn, opts) }
+	}
+	if in := opts.interceptors(); len(in) > 0 {
+		c = InterceptRPCCodec(c, in...)
+	}
+	return
+}
+
+// Dial connects to addr on the named network, returning a codec for the connection 
+// (see NewRPCCodecOpts) ready for rpc.NewClientWithCodec. ctx bounds the dialing.
+func Dial(ctx context.Context, network, addr string, opts *RPCOptions) (c RPCCodec, err error) {
+	conn, err := new(net.Dialer).DialContext(ctx, network, addr)
+	if err != nil {
+		return
+	}
+	return NewRPCCodecOpts(conn, opts), nil
+}
+
+// DialTLS is like Dial, but connects over TLS (configured by config, which may be nil), 
+// negotiating RPCALPNProtocol with ALPN (unless config lists other protocols in NextProtos). 
+// It fails if the server negotiates another protocol. 
+func DialTLS(network, addr string, config *tls.Config, opts *RPCOptions) (c RPCCodec, err error) {
+	return DialTLSContext(context.Background(), network, addr, config, opts)
+}
+
+// DialTLSContext is like DialTLS, with ctx bounding the dialing and the TLS handshake.
+func DialTLSContext(ctx context.Context, network, addr string, config *tls.Config, opts *RPCOptions) (c RPCCodec, err error) {
+	config = rpcTLSConfig(config)
+	conn, err := (&tls.Dialer{ Config: config }).DialContext(ctx, network, addr)
+	if err != nil {
+		return
+	}
+	tconn := conn.(*tls.Conn)
+	if err = checkALPN(tconn, config); err != nil {
+		tconn.Close()
+		return
+	}
+	return NewRPCCodecOpts(tconn, opts), nil
+}
+
+// DialUnix connects to the Unix domain socket at path (see Dial).
+func DialUnix(ctx context.Context, path string, opts *RPCOptions) (RPCCodec, error) {
+	return Dial(ctx, "unix", path, opts)
+}
+
+// ListenUnix listens on the Unix domain socket at path, for use with ServeRPC (or RPCServer.Serve).
+// A stale socket file at path (left by a process which did not close its listener) is removed first.
+// The socket file is removed when the listener is closed.
+func ListenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+		} else {
+			os.Remove(path)
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// NewPipeRPCCodecs returns a client codec and a server codec (see NewRPCCodecOpts),
+// connected to each other in memory (with net.Pipe), e.g. for tests or in-process services.
+//
+// Sample Usage:
+//   cc, sc := msgpack.NewPipeRPCCodecs(nil)
+//   go srv.ServeCodec(sc)
+//   client := rpc.NewClientWithCodec(cc)
+func NewPipeRPCCodecs(opts *RPCOptions) (client, server RPCCodec) {
+	c1, c2 := net.Pipe()
+	return NewRPCCodecOpts(c1, opts), NewRPCCodecOpts(c2, opts)
+}
+
+// ListenTLS listens on addr for TLS connections (configured by config, which must have a certificate),
+// offering RPCALPNProtocol with ALPN (unless config lists other protocols in NextProtos).
+func ListenTLS(network, addr string, config *tls.Config) (net.Listener, error) {
+	return tls.Listen(network, addr, rpcTLSConfig(config))
+}
+
+// AcceptRPC waits for the next connection on ln, returning a codec for it 
+// (see NewRPCCodecOpts) ready for rpc.Server.ServeCodec. 
+// A TLS connection is handshaken first, and dropped (and the next accepted) if that fails, 
+// e.g. if the client offers none of the protocols of the listener with ALPN.
+func AcceptRPC(ln net.Listener, opts *RPCOptions) (c RPCCodec, err error) {
+	for {
+		var conn net.Conn
+		if conn, err = ln.Accept(); err != nil {
+			return
+		}
+		if tconn, ok := conn.(*tls.Conn); ok {
+			if err = tconn.Handshake(); err != nil {
+				tconn.Close()
+				continue
+			}
+		}
+		return NewRPCCodecOpts(conn, opts), nil
+	}
+}
+
+// ServeRPC accepts connections on ln (see AcceptRPC), and serves each with srv 
+// in its own goroutine, until ln fails.
+func ServeRPC(ln net.Listener, srv *rpc.Server, opts *RPCOptions) error {
+	for {
+		c, err := AcceptRPC(ln, opts)
+		if err != nil {
+			return err
+		}
+		go srv.ServeCodec(c)
+	}
+}
+
+// rpcTLSConfig returns a copy of config (or an empty config) listing RPCALPNProtocol if it lists no protocol.
+func rpcTLSConfig(config *tls.Config) *tls.Config {
+	if config == nil {
+		config = new(tls.Config)
+	} else {
+		config = config.Clone()
+	}
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = []string{ RPCALPNProtocol }
+	}
+	return config
+}
+
+// checkALPN checks that the protocol negotiated on conn is one of those of config.
+// A server not using ALPN negotiates no protocol, which is accepted.
+func checkALPN(conn *tls.Conn, config *tls.Config) error {
+	p := conn.ConnectionState().NegotiatedProtocol
+	if p == "" {
+		return nil
+	}
+	for _, q := range config.NextProtos {
+		if p == q {
+			return nil
+		}
+	}
+	return fmt.Errorf("msgpack-rpc: unexpected ALPN protocol negotiated: %q", p)
+}
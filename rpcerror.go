@@ -0,0 +1,146 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// RPCCodeError is a structured error, which an RPCServer sends as a map 
+// {"code": Code, "message": Message, "data": Data} (data omitted if nil), 
+// and an RPCClient returns as an *RPCError with the same Code, Message and Data.
+// A handler returns it (or an error wrapping it) to send a structured error.
+type RPCCodeError struct {
+	Code int
+	Message string
+	Data interface{}
+}
+
+func (e *RPCCodeError) Error() string {
+	return fmt.Sprintf("%s (code %d)", e.Message, e.Code)
+}
+
+// rpcErrorOut is the encoding of a structured error.
+type rpcErrorOut struct {
+	Code int `msgpack:"code"`
+	Message string `msgpack:"message"`
+	Data interface{} `msgpack:"data,omitempty"`
+}
+
+// rpcErrorIn is the decoding of a structured error.
+type rpcErrorIn struct {
+	Code *int `msgpack:"code"`
+	Message string `msgpack:"message"`
+	Data Raw `msgpack:"data"`
+}
+
+// RPCErrorRegistry maps error codes to Go errors (typically sentinel errors), 
+// so they survive a trip over the wire: 
+// an RPCServer sends an error matching (errors.Is) a registered error as a structured error with its code, 
+// and an RPCClient returns an *RPCError with that code, which matches (errors.Is) the registered error.
+// 
+// Sample Usage:
+//   var ErrNotFound = errors.New("not found")
+//   func init() { msgpack.RPCErrors.Register(404, ErrNotFound) }
+//   // server: return fmt.Errorf("user %d: %w", id, ErrNotFound)
+//   // client: if errors.Is(err, ErrNotFound) { ... }
+type RPCErrorRegistry struct {
+	mu sync.RWMutex
+	codes []rpcErrorCode
+}
+
+type rpcErrorCode struct {
+	code int
+	err error
+}
+
+// RPCErrors is the registry used by RPCClient and RPCServer, unless RPCOptions.Errors is set.
+var RPCErrors = new(RPCErrorRegistry)
+
+// Register maps code to err (replacing any mapping of code).
+func (r *RPCErrorRegistry) Register(code int, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, x := range r.codes {
+		if x.code == code {
+			r.codes[i].err = err
+			return
+		}
+	}
+	r.codes = append(r.codes, rpcErrorCode{code, err})
+}
+
+// Lookup returns the error mapped to code, or nil.
+func (r *RPCErrorRegistry) Lookup(code int) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, x := range r.codes {
+		if x.code == code {
+			return x.err
+		}
+	}
+	return nil
+}
+
+// encode returns the object to send for err: a structured error if err is (or wraps) 
+// an *RPCCodeError or a registered error, else its string.
+func (r *RPCErrorRegistry) encode(err error) interface{} {
+	var ce *RPCCodeError
+	if errors.As(err, &ce) {
+		return rpcErrorOut{ ce.Code, ce.Message, ce.Data }
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, x := range r.codes {
+		if errors.Is(err, x.err) {
+			return rpcErrorOut{ x.code, err.Error(), nil }
+		}
+	}
+	return err.Error()
+}
+
+// newRPCError returns the error for the error object v sent by a server.
+func (r *RPCErrorRegistry) newRPCError(v Raw, md RPCMetadata) (e *RPCError) {
+	e = &RPCError{ Value: v, Metadata: md }
+	var x rpcErrorIn
+	if Unmarshal(v, &x, nil) == nil && x.Code != nil {
+		e.Code, e.Message, e.Data = *x.Code, x.Message, x.Data
+		e.structured = true
+		e.err = r.Lookup(e.Code)
+	} else if Unmarshal(v, &e.Message, nil) != nil {
+		e.Message = rawString(v)
+	}
+	return
+}
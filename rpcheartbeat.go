@@ -0,0 +1,106 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Heartbeats are msgpack-rpc notifications with reserved method names: 
+// a ping is answered by a pong. A peer which does not know them ignores them, 
+// as msgpack-rpc peers ignore unknown notifications.
+const (
+	rpcPing = "$ping"
+	rpcPong = "$pong"
+)
+
+// ErrRPCDeadPeer is the error of calls pending on a connection closed because 
+// the peer sent nothing (not even a heartbeat) within RPCOptions.HeartbeatTimeout.
+var ErrRPCDeadPeer = errors.New("msgpack-rpc: peer is not responding")
+
+// rpcHeartbeat sends pings on a connection, and detects a dead peer.
+type rpcHeartbeat struct {
+	last int64 // time (UnixNano) a message was last read
+	done chan struct{}
+	once sync.Once
+}
+
+// startHeartbeat starts sending pings (with ping) every opts.HeartbeatInterval, 
+// and calls dead if nothing is seen for opts.HeartbeatTimeout. 
+// It returns nil if heartbeats are not configured.
+func startHeartbeat(opts *RPCOptions, ping func() error, dead func()) (h *rpcHeartbeat) {
+	if opts.HeartbeatInterval <= 0 {
+		return nil
+	}
+	timeout := opts.HeartbeatTimeout
+	if timeout <= 0 {
+		timeout = 3 * opts.HeartbeatInterval
+	}
+	h = &rpcHeartbeat{ last: time.Now().UnixNano(), done: make(chan struct{}) }
+	go func() {
+		t := time.NewTicker(opts.HeartbeatInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-h.done:
+				return
+			case now := <-t.C:
+				if now.Sub(time.Unix(0, atomic.LoadInt64(&h.last))) >= timeout {
+					h.stop()
+					dead()
+					return
+				}
+				if ping() != nil {
+					return
+				}
+			}
+		}
+	}()
+	return
+}
+
+// seen records that a message was read from the peer. 
+func (h *rpcHeartbeat) seen() {
+	if h != nil {
+		atomic.StoreInt64(&h.last, time.Now().UnixNano())
+	}
+}
+
+func (h *rpcHeartbeat) stop() {
+	if h != nil {
+		h.once.Do(func() { close(h.done) })
+	}
+}
@@ -0,0 +1,184 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+import (
+	"errors"
+	"net/rpc"
+)
+
+// RPCInterceptor holds hooks run around the methods of an rpc codec, 
+// e.g. for logging, metrics, authentication or tracing. 
+// Each hook is passed next, which it calls to run the rest of the chain (and the codec method itself), 
+// and may act before or after it, change its arguments, or return an error without calling it.
+// Nil hooks are skipped.
+// 
+// The client side hooks are WriteRequest and ReadResponseHeader, 
+// and the server side hooks are ReadRequestHeader and WriteResponse.
+// 
+// Sample Usage:
+//   logCalls := msgpack.RPCInterceptor{
+//       WriteRequest: func(r *rpc.Request, body interface{}, next func(*rpc.Request, interface{}) error) error {
+//           log.Printf("calling %s (seq %d)", r.ServiceMethod, r.Seq)
+//           return next(r, body)
+//       },
+//   }
+//   codec := msgpack.InterceptRPCClientCodec(msgpack.NewRPCClientCodec(conn, nil), logCalls)
+type RPCInterceptor struct {
+	WriteRequest func(r *rpc.Request, body interface{}, next func(r *rpc.Request, body interface{}) error) error
+	ReadResponseHeader func(r *rpc.Response, next func(r *rpc.Response) error) error
+	ReadRequestHeader func(r *rpc.Request, next func(r *rpc.Request) error) error
+	WriteResponse func(r *rpc.Response, body interface{}, next func(r *rpc.Response, body interface{}) error) error
+}
+
+type interceptedRpcCodec struct {
+	cc rpc.ClientCodec
+	sc rpc.ServerCodec
+	in []RPCInterceptor
+}
+
+// InterceptRPCClientCodec returns a codec running the client side hooks of in around c
+// (the first in being the outermost).
+func InterceptRPCClientCodec(c rpc.ClientCodec, in ...RPCInterceptor) rpc.ClientCodec {
+	return &interceptedRpcCodec{ cc: c, in: in }
+}
+
+// InterceptRPCServerCodec returns a codec running the server side hooks of in around c
+// (the first in being the outermost).
+func InterceptRPCServerCodec(c rpc.ServerCodec, in ...RPCInterceptor) rpc.ServerCodec {
+	return &interceptedRpcCodec{ sc: c, in: in }
+}
+
+// InterceptRPCCodec returns a codec running the hooks of in around c (the first in being the outermost).
+// The returned codec is an RPCNotifier and an RPCMetadataCodec, which work through c 
+// (if c is one).
+func InterceptRPCCodec(c RPCCodec, in ...RPCInterceptor) RPCCodec {
+	return &interceptedRpcCodec{ cc: c, sc: c, in: in }
+}
+
+func (c *interceptedRpcCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	var next func(i int, r *rpc.Request, body interface{}) error
+	next = func(i int, r *rpc.Request, body interface{}) error {
+		for ; i < len(c.in); i++ {
+			if h := c.in[i].WriteRequest; h != nil {
+				return h(r, body, func(r *rpc.Request, body interface{}) error { return next(i+1, r, body) })
+			}
+		}
+		return c.cc.WriteRequest(r, body)
+	}
+	return next(0, r, body)
+}
+
+func (c *interceptedRpcCodec) ReadResponseHeader(r *rpc.Response) error {
+	var next func(i int, r *rpc.Response) error
+	next = func(i int, r *rpc.Response) error {
+		for ; i < len(c.in); i++ {
+			if h := c.in[i].ReadResponseHeader; h != nil {
+				return h(r, func(r *rpc.Response) error { return next(i+1, r) })
+			}
+		}
+		return c.cc.ReadResponseHeader(r)
+	}
+	return next(0, r)
+}
+
+func (c *interceptedRpcCodec) ReadResponseBody(body interface{}) error {
+	return c.cc.ReadResponseBody(body)
+}
+
+func (c *interceptedRpcCodec) ReadRequestHeader(r *rpc.Request) error {
+	var next func(i int, r *rpc.Request) error
+	next = func(i int, r *rpc.Request) error {
+		for ; i < len(c.in); i++ {
+			if h := c.in[i].ReadRequestHeader; h != nil {
+				return h(r, func(r *rpc.Request) error { return next(i+1, r) })
+			}
+		}
+		return c.sc.ReadRequestHeader(r)
+	}
+	return next(0, r)
+}
+
+func (c *interceptedRpcCodec) ReadRequestBody(body interface{}) error {
+	return c.sc.ReadRequestBody(body)
+}
+
+func (c *interceptedRpcCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	var next func(i int, r *rpc.Response, body interface{}) error
+	next = func(i int, r *rpc.Response, body interface{}) error {
+		for ; i < len(c.in); i++ {
+			if h := c.in[i].WriteResponse; h != nil {
+				return h(r, body, func(r *rpc.Response, body interface{}) error { return next(i+1, r, body) })
+			}
+		}
+		return c.sc.WriteResponse(r, body)
+	}
+	return next(0, r, body)
+}
+
+// Notify sends a notification through the wrapped codec, if it is an RPCNotifier.
+func (c *interceptedRpcCodec) Notify(method string, params ...interface{}) error {
+	if n, ok := c.cc.(RPCNotifier); ok {
+		return n.Notify(method, params...)
+	}
+	return errors.New("msgpack-rpc: codec does not support notifications")
+}
+
+// SetMetadata sets metadata through the wrapped codec, if it is an RPCMetadataCodec.
+func (c *interceptedRpcCodec) SetMetadata(seq uint64, md RPCMetadata) {
+	if m, ok := c.codec().(RPCMetadataCodec); ok {
+		m.SetMetadata(seq, md)
+	}
+}
+
+// Metadata returns metadata from the wrapped codec, if it is an RPCMetadataCodec.
+func (c *interceptedRpcCodec) Metadata(seq uint64) RPCMetadata {
+	if m, ok := c.codec().(RPCMetadataCodec); ok {
+		return m.Metadata(seq)
+	}
+	return nil
+}
+
+func (c *interceptedRpcCodec) codec() interface{} {
+	if c.cc != nil {
+		return c.cc
+	}
+	return c.sc
+}
+
+func (c *interceptedRpcCodec) Close() error {
+	if c.cc != nil {
+		return c.cc.Close()
+	}
+	return c.sc.Close()
+}
@@ -0,0 +1,119 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+import (
+	"context"
+	"sync"
+)
+
+// RPCMetadata is per-call metadata (e.g. a trace id, an auth token, or a tenant), 
+// carried alongside the method and params of a call, and back with its response.
+// 
+// It is sent as an extra element at the end of a message: [0, msgid, method, params, metadata],
+// [1, msgid, error, result, metadata] or [2, method, params, metadata], only when not empty, 
+// so peers not using metadata see standard msgpack-rpc messages.
+type RPCMetadata map[string]string
+
+// RPCMetadataCodec is implemented by the spec rpc codecs, to give access to metadata 
+// from interceptors (see RPCInterceptor), which know the Seq of a request or response.
+// 
+// Sample Usage:
+//   codec := msgpack.NewSpecRPCCodecOpts(conn, nil)
+//   mdc := codec.(msgpack.RPCMetadataCodec)
+//   codec = msgpack.InterceptRPCCodec(codec, msgpack.RPCInterceptor{
+//       WriteRequest: func(r *rpc.Request, body interface{}, next func(*rpc.Request, interface{}) error) error {
+//           mdc.SetMetadata(r.Seq, msgpack.RPCMetadata{"trace-id": newTraceId()})
+//           return next(r, body)
+//       },
+//   })
+type RPCMetadataCodec interface {
+	// SetMetadata sets the metadata to send with the request (client side) 
+	// or response (server side) with the given seq, when it is written.
+	SetMetadata(seq uint64, md RPCMetadata)
+	// Metadata returns the metadata received with the request with the given seq (server side, 
+	// until its response is written), or with the response last read (client side).
+	Metadata(seq uint64) RPCMetadata
+}
+
+type rpcOutMDKey struct{}
+type rpcInMDKey struct{}
+
+// rpcCallMD holds the metadata of a call handled by an RPCServer.
+type rpcCallMD struct {
+	in RPCMetadata
+	mu sync.Mutex
+	out RPCMetadata
+}
+
+// ContextWithRPCMetadata returns a context carrying md, to send with the calls 
+// (and notifications) made with it by an RPCClient.
+func ContextWithRPCMetadata(ctx context.Context, md RPCMetadata) context.Context {
+	return context.WithValue(ctx, rpcOutMDKey{}, md)
+}
+
+// RPCMetadataFromContext returns the metadata received with the call whose handler 
+// (registered with an RPCServer) was passed ctx.
+func RPCMetadataFromContext(ctx context.Context) RPCMetadata {
+	if x, _ := ctx.Value(rpcInMDKey{}).(*rpcCallMD); x != nil {
+		return x.in
+	}
+	return nil
+}
+
+// SetRPCResponseMetadata sets a metadata entry to send back with the response of the call 
+// whose handler (registered with an RPCServer) was passed ctx. Otherwise, it does nothing.
+func SetRPCResponseMetadata(ctx context.Context, key, value string) {
+	if x, _ := ctx.Value(rpcInMDKey{}).(*rpcCallMD); x != nil {
+		x.mu.Lock()
+		if x.out == nil {
+			x.out = make(RPCMetadata)
+		}
+		x.out[key] = value
+		x.mu.Unlock()
+	}
+}
+
+// outMetadata returns the metadata to send with a call made with ctx.
+func outMetadata(ctx context.Context) RPCMetadata {
+	md, _ := ctx.Value(rpcOutMDKey{}).(RPCMetadata)
+	return md
+}
+
+// withMetadata appends md to msg, if md is not empty.
+func withMetadata(msg []interface{}, md RPCMetadata) []interface{} {
+	if len(md) > 0 {
+		msg = append(msg, md)
+	}
+	return msg
+}
@@ -0,0 +1,128 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+import (
+	"net/rpc"
+	"strings"
+	"unicode"
+)
+
+// rpcMethodNames returns an interceptor mapping method names with out (on the client side)
+// and in (on the server side), either of which may be nil. See RPCOptions.MethodNameOut.
+func rpcMethodNames(out, in func(string) string) (ri RPCInterceptor) {
+	if out != nil {
+		ri.WriteRequest = func(r *rpc.Request, body interface{}, next func(*rpc.Request, interface{}) error) error {
+			r2 := *r
+			r2.ServiceMethod = out(r.ServiceMethod)
+			return next(&r2, body)
+		}
+	}
+	if in != nil {
+		ri.ReadRequestHeader = func(r *rpc.Request, next func(*rpc.Request) error) (err error) {
+			if err = next(r); err == nil {
+				r.ServiceMethod = in(r.ServiceMethod)
+			}
+			return
+		}
+	}
+	return
+}
+
+// interceptors returns the interceptors of opts, followed by those reporting to opts.Stats 
+// and mapping method names (if set), which so see the net/rpc names and the names sent.
+func (opts *RPCOptions) interceptors() []RPCInterceptor {
+	if opts.Stats == nil && opts.MethodNameOut == nil && opts.MethodNameIn == nil {
+		return opts.Interceptors
+	}
+	in := make([]RPCInterceptor, 0, len(opts.Interceptors) + 2)
+	in = append(in, opts.Interceptors...)
+	if opts.Stats != nil {
+		in = append(in, rpcStatsInterceptor(opts.Stats))
+	}
+	if opts.MethodNameOut != nil || opts.MethodNameIn != nil {
+		in = append(in, rpcMethodNames(opts.MethodNameOut, opts.MethodNameIn))
+	}
+	return in
+}
+
+// RPCSnakeCaseMethod maps a net/rpc method name to a snake_case name, without the service:
+// e.g. "User.GetUser" (or "GetUser") to "get_user", and "Conn.ReadHTTPHeader" to "read_http_header".
+// It suits RPCOptions.MethodNameOut of a client calling a peer which names its methods so 
+// (e.g. one written in Python).
+func RPCSnakeCaseMethod(serviceMethod string) string {
+	name := serviceMethod[strings.LastIndex(serviceMethod, ".") + 1:]
+	rs := []rune(name)
+	var b strings.Builder
+	for i, r := range rs {
+		if unicode.IsUpper(r) {
+			// a word starts at an upper case letter after a lower case one (or a digit), 
+			// or before a lower case one at the end of an acronym (the "H" of "HTTPHeader").
+			if i > 0 && (!unicode.IsUpper(rs[i-1]) || i+1 < len(rs) && unicode.IsLower(rs[i+1])) {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// RPCServiceMethod returns a mapping from a snake_case method name to a method of service:
+// e.g. for service "User", from "get_user" to "User.GetUser". It is the inverse of RPCSnakeCaseMethod, 
+// except for acronyms ("read_http_header" maps to "ReadHttpHeader"), and suits 
+// RPCOptions.MethodNameIn of a server called by a peer which names methods so. 
+// A name which already has a service (e.g. "User.GetUser") is left as it is.
+func RPCServiceMethod(service string) func(string) string {
+	return func(name string) string {
+		if strings.Contains(name, ".") {
+			return name
+		}
+		var b strings.Builder
+		b.WriteString(service)
+		b.WriteByte('.')
+		upper := true
+		for _, r := range name {
+			if r == '_' {
+				upper = true
+				continue
+			}
+			if upper {
+				r = unicode.ToUpper(r)
+				upper = false
+			}
+			b.WriteRune(r)
+		}
+		return b.String()
+	}
+}
@@ -0,0 +1,258 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// RPCPoolOptions configures an RPCPool.
+type RPCPoolOptions struct {
+	// RPC configures each client of the pool (and may be nil).
+	RPC *RPCOptions
+	// MaxOpen limits the number of connections open (in use or idle) at a time. 
+	// Zero means no limit. When it is reached, Get waits for a client to be put back.
+	MaxOpen int
+	// MaxIdle is the number of idle connections kept for reuse (2 if zero, none if negative).
+	MaxIdle int
+	// HealthCheck, if set, is called on an idle client before it is reused, if it has been idle 
+	// for HealthCheckAfter or longer. If it returns an error, the client is closed (and another used).
+	// A client whose connection has failed is never reused, whether this is set or not.
+	HealthCheck func(ctx context.Context, c *RPCClient) error
+	HealthCheckAfter time.Duration
+}
+
+// RPCPool manages a pool of RPCClient connections to a msgpack-rpc endpoint. 
+// Each call checks out a client for itself, so a large (or slow) response 
+// does not hold up the calls on other connections.
+// 
+// Sample Usage:
+//   pool := msgpack.NewRPCPool(func(ctx context.Context) (io.ReadWriteCloser, error) {
+//       return (&net.Dialer{}).DialContext(ctx, "tcp", "localhost:18800")
+//   }, &msgpack.RPCPoolOptions{MaxOpen: 8})
+//   defer pool.Close()
+//   res, err := pool.Call(ctx, "add", 1, 2)
+type RPCPool struct {
+	dial func(ctx context.Context) (io.ReadWriteCloser, error)
+	opts RPCPoolOptions
+
+	mu sync.Mutex // guards the fields below
+	idle []rpcIdle
+	numOpen int
+	waiters []chan *RPCClient // Gets waiting for a client (nil to dial one)
+	closed bool
+}
+
+type rpcIdle struct {
+	c *RPCClient
+	since time.Time
+}
+
+// NewRPCPool returns an RPCPool, which opens connections with dial. opts may be nil.
+func NewRPCPool(dial func(ctx context.Context) (io.ReadWriteCloser, error), opts *RPCPoolOptions) (p *RPCPool) {
+	p = &RPCPool{dial: dial}
+	if opts != nil {
+		p.opts = *opts
+	}
+	if p.opts.MaxIdle == 0 {
+		p.opts.MaxIdle = 2
+	}
+	return
+}
+
+// Call checks out a client, calls method on it (see RPCClient.Call), and puts it back.
+func (p *RPCPool) Call(ctx context.Context, method string, args ...interface{}) (res RPCResult, err error) {
+	c, err := p.Get(ctx)
+	if err != nil {
+		return
+	}
+	defer p.Put(c)
+	return c.Call(ctx, method, args...)
+}
+
+// Get checks out a client, reusing an idle one or dialing a new one, 
+// and waiting for one to be put back if MaxOpen clients are open.
+// The client must be put back (with Put) once done with.
+func (p *RPCPool) Get(ctx context.Context) (c *RPCClient, err error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, ErrRPCClosed
+		}
+		if n := len(p.idle); n > 0 {
+			x := p.idle[n-1]
+			p.idle = p.idle[:n-1]
+			p.mu.Unlock()
+			if p.healthy(ctx, x) {
+				return x.c, nil
+			}
+			p.discard(x.c)
+			continue
+		}
+		if p.opts.MaxOpen <= 0 || p.numOpen < p.opts.MaxOpen {
+			p.numOpen++
+			p.mu.Unlock()
+			return p.open(ctx)
+		}
+		ch := make(chan *RPCClient, 1)
+		p.waiters = append(p.waiters, ch)
+		p.mu.Unlock()
+		select {
+		case c = <-ch:
+		case <-ctx.Done():
+			p.mu.Lock()
+			for i, w := range p.waiters {
+				if w == ch {
+					p.waiters = append(p.waiters[:i], p.waiters[i+1:]...)
+					break
+				}
+			}
+			p.mu.Unlock()
+			// a client may have been handed over meanwhile: pass it on.
+			select {
+			case c = <-ch:
+				if c != nil {
+					p.Put(c)
+				} else {
+					p.release()
+				}
+			default:
+			}
+			return nil, ctx.Err()
+		}
+		if c == nil {
+			// a connection was closed, and its slot handed over to us.
+			return p.open(ctx)
+		}
+		if c == rpcPoolClosed {
+			return nil, ErrRPCClosed
+		}
+		return
+	}
+}
+
+// rpcPoolClosed is handed to the Gets waiting when the pool is closed.
+var rpcPoolClosed = &RPCClient{}
+
+// Put puts back a client checked out with Get. 
+// It is kept for reuse, unless its connection has failed (or too many are idle already).
+func (p *RPCPool) Put(c *RPCClient) {
+	if c.broken() {
+		p.discard(c)
+		return
+	}
+	p.mu.Lock()
+	if !p.closed {
+		if len(p.waiters) > 0 {
+			ch := p.waiters[0]
+			p.waiters = p.waiters[1:]
+			p.mu.Unlock()
+			ch <- c
+			return
+		}
+		if len(p.idle) < p.opts.MaxIdle {
+			p.idle = append(p.idle, rpcIdle{c, time.Now()})
+			p.mu.Unlock()
+			return
+		}
+	}
+	p.mu.Unlock()
+	p.discard(c)
+}
+
+// Len returns the number of connections open (in use or idle), and the number idle.
+func (p *RPCPool) Len() (open, idle int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.numOpen, len(p.idle)
+}
+
+// Close closes the idle connections, and those put back from now on. 
+// Gets waiting (and later ones) fail with ErrRPCClosed.
+func (p *RPCPool) Close() error {
+	p.mu.Lock()
+	idle, waiters := p.idle, p.waiters
+	p.idle, p.waiters, p.closed = nil, nil, true
+	p.mu.Unlock()
+	for _, x := range idle {
+		p.discard(x.c)
+	}
+	for _, ch := range waiters {
+		ch <- rpcPoolClosed
+	}
+	return nil
+}
+
+// open dials a new client, in a slot already counted in numOpen.
+func (p *RPCPool) open(ctx context.Context) (c *RPCClient, err error) {
+	conn, err := p.dial(ctx)
+	if err != nil {
+		p.release()
+		return
+	}
+	return NewRPCClient(conn, p.opts.RPC), nil
+}
+
+func (p *RPCPool) healthy(ctx context.Context, x rpcIdle) bool {
+	if x.c.broken() {
+		return false
+	}
+	if p.opts.HealthCheck != nil && time.Since(x.since) >= p.opts.HealthCheckAfter {
+		return p.opts.HealthCheck(ctx, x.c) == nil
+	}
+	return true
+}
+
+// discard closes c, releasing its slot.
+func (p *RPCPool) discard(c *RPCClient) {
+	c.Close()
+	p.release()
+}
+
+// release releases a slot of numOpen, handing it to a waiting Get (if any) to dial with.
+func (p *RPCPool) release() {
+	p.mu.Lock()
+	if len(p.waiters) > 0 && !p.closed {
+		ch := p.waiters[0]
+		p.waiters = p.waiters[1:]
+		p.mu.Unlock()
+		ch <- nil
+		return
+	}
+	p.numOpen--
+	p.mu.Unlock()
+}
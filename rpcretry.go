@@ -0,0 +1,198 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+import (
+	"context"
+	"math/rand"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// RetryPolicy says how a ReconnectClient retries calls.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts made for a call (3 if zero).
+	MaxAttempts int
+	// MinBackoff and MaxBackoff bound the wait before each retry (50ms and 5s if zero).
+	// The wait doubles with each retry, with some jitter.
+	MinBackoff, MaxBackoff time.Duration
+	// Idempotent, if set, says which methods are idempotent (see ReconnectClient).
+	Idempotent func(serviceMethod string) bool
+}
+
+// ReconnectClient wraps an rpc.Client, re-dialing transparently when its connection fails.
+// 
+// A call which fails because of the connection is retried (on a new connection) 
+// if it was not sent, or if it is idempotent: its method is marked as such by the policy, 
+// or its context by IdempotentContext. Other calls, which the server may have run, 
+// return their error. Errors returned by the server (rpc.ServerError) are never retried.
+// 
+// Sample Usage:
+//   c := msgpack.NewReconnectClient(func(ctx context.Context) (*rpc.Client, error) {
+//       conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", "localhost:5555")
+//       if err != nil {
+//           return nil, err
+//       }
+//       return rpc.NewClientWithCodec(msgpack.NewRPCClientCodec(conn, nil)), nil
+//   }, nil)
+//   err = c.Call(ctx, "Arith.Multiply", args, &reply)
+type ReconnectClient struct {
+	dial func(ctx context.Context) (*rpc.Client, error)
+	policy RetryPolicy
+	// OnReconnect, if set, is called with each new client after the first 
+	// (e.g. to authenticate again), before it is used. If it returns an error, 
+	// the client is closed, and the attempt fails with the error.
+	OnReconnect func(c *rpc.Client) error
+
+	mu sync.Mutex // guards the fields below
+	cl *rpc.Client
+	dialed bool // a client has been dialed before
+	closed bool
+}
+
+type idempotentKey struct{}
+
+// IdempotentContext returns a context marking a call made with it as idempotent, 
+// so a ReconnectClient may retry it even after it was sent.
+func IdempotentContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, idempotentKey{}, true)
+}
+
+// NewReconnectClient returns a ReconnectClient getting its clients from dial, 
+// and retrying calls per policy (which may be nil).
+// No connection is made until the first call.
+func NewReconnectClient(dial func(ctx context.Context) (*rpc.Client, error), policy *RetryPolicy) (c *ReconnectClient) {
+	c = &ReconnectClient{dial: dial}
+	if policy != nil {
+		c.policy = *policy
+	}
+	if c.policy.MaxAttempts <= 0 {
+		c.policy.MaxAttempts = 3
+	}
+	if c.policy.MinBackoff <= 0 {
+		c.policy.MinBackoff = 50 * time.Millisecond
+	}
+	if c.policy.MaxBackoff <= 0 {
+		c.policy.MaxBackoff = 5 * time.Second
+	}
+	return
+}
+
+// Call calls serviceMethod (see CallContext), re-dialing and retrying as needed.
+func (c *ReconnectClient) Call(ctx context.Context, serviceMethod string, args interface{}, reply interface{}) (err error) {
+	idempotent, _ := ctx.Value(idempotentKey{}).(bool)
+	if !idempotent && c.policy.Idempotent != nil {
+		idempotent = c.policy.Idempotent(serviceMethod)
+	}
+	backoff := c.policy.MinBackoff
+	for attempt := 1; ; attempt++ {
+		var cl *rpc.Client
+		if cl, err = c.client(ctx); err == nil {
+			err = CallContext(ctx, cl, serviceMethod, args, reply)
+			if _, ok := err.(rpc.ServerError); ok || err == nil || ctx.Err() != nil {
+				return
+			}
+			c.drop(cl)
+			// net/rpc returns ErrShutdown for a call it did not send.
+			if err != rpc.ErrShutdown && !idempotent {
+				return
+			}
+		}
+		if c.isClosed() || ctx.Err() != nil || attempt >= c.policy.MaxAttempts {
+			return
+		}
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2) + 1))
+		if backoff *= 2; backoff > c.policy.MaxBackoff {
+			backoff = c.policy.MaxBackoff
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// Close closes the current client (if any). Later calls fail with rpc.ErrShutdown.
+func (c *ReconnectClient) Close() (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	if c.cl != nil {
+		err = c.cl.Close()
+		c.cl = nil
+	}
+	return
+}
+
+// client returns the current client, dialing one if there is none.
+func (c *ReconnectClient) client(ctx context.Context) (cl *rpc.Client, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, rpc.ErrShutdown
+	}
+	if c.cl != nil {
+		return c.cl, nil
+	}
+	if cl, err = c.dial(ctx); err != nil {
+		return
+	}
+	if c.dialed && c.OnReconnect != nil {
+		if err = c.OnReconnect(cl); err != nil {
+			cl.Close()
+			return nil, err
+		}
+	}
+	c.cl, c.dialed = cl, true
+	return
+}
+
+// drop closes cl, so the next call dials a new client (unless another call did so already).
+func (c *ReconnectClient) drop(cl *rpc.Client) {
+	c.mu.Lock()
+	if c.cl == cl {
+		c.cl = nil
+	}
+	c.mu.Unlock()
+	cl.Close()
+}
+
+func (c *ReconnectClient) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
@@ -0,0 +1,528 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// RPCHandler handles a msgpack-rpc call (or notification). 
+// params reads the positional parameters: the params array, from its header.
+// For a notification, the result and error are discarded. 
+// An error is sent as its string, or as a structured error (see RPCCodeError and RPCErrorRegistry).
+// ctx carries the metadata of the call (see RPCMetadataFromContext and SetRPCResponseMetadata).
+// It is done when the connection is closed, or the client cancels the call 
+// (e.g. as the context of RPCClient.Call is done), so a handler can stop work nobody will receive.
+type RPCHandler func(ctx context.Context, params *Decoder) (result interface{}, err error)
+
+// RPCServer is a msgpack-rpc server, independent of net/rpc. 
+// Methods are registered under any name (e.g. "add", or "get_user"), 
+// and take any number of positional parameters.
+// 
+// Each call is handled in its own goroutine, so calls on a connection are handled concurrently
+// (and their responses may be sent out of order, as msgpack-rpc allows).
+// 
+// Sample Usage:
+//   srv := msgpack.NewRPCServer(nil)
+//   srv.Register("add", func(a, b int) (int, error) { return a + b, nil })
+//   ln, err := net.Listen("tcp", ":18800")
+//   go srv.Serve(ln)
+//   ...
+//   srv.Shutdown(ctx)
+type RPCServer struct {
+	opts RPCOptions
+	dam DecoderContainerResolver
+	errs *RPCErrorRegistry
+
+	mu sync.Mutex // guards the fields below
+	methods map[string]RPCHandler
+	listeners map[net.Listener]struct{}
+	conns map[*rpcServerConn]struct{}
+	shutdown bool
+
+	calls sync.WaitGroup // calls in progress
+}
+
+type rpcServerConn struct {
+	s *RPCServer
+	conn io.ReadWriteCloser
+	dec *Decoder
+	hb *rpcHeartbeat
+	ctx context.Context // done when the connection is closed
+
+	cmu sync.Mutex // guards cancels
+	cancels map[uint64]context.CancelFunc // of the calls in progress, by msgid
+
+	wmu sync.Mutex // guards the fields below
+	wbuf bytes.Buffer // responses not yet written
+	enc *Encoder
+	flushing bool // a goroutine is writing wbuf
+	wgen uint64 // number of times wbuf has been taken for writing
+	wcond *sync.Cond // signalled when wbuf is taken for writing
+	werr error // set once a write has failed
+}
+
+var errRPCShutdown = errors.New("msgpack-rpc: server is shutting down")
+
+// rpcCancel is the reserved method of a notification cancelling a call: its params are [msgid]. 
+// A peer which does not know it ignores it (see rpcPing).
+const rpcCancel = "$cancel"
+
+var (
+	ctxTyp = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorTyp = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// NewRPCServer returns an RPCServer configured by opts (which may be nil).
+// opts.OnNotify is not used: notifications are handled by the registered methods.
+func NewRPCServer(opts *RPCOptions) (s *RPCServer) {
+	s = &RPCServer{
+		methods: make(map[string]RPCHandler),
+		listeners: make(map[net.Listener]struct{}),
+		conns: make(map[*rpcServerConn]struct{}),
+	}
+	if opts != nil {
+		s.opts = *opts
+	}
+	s.dam = decOptsResolver(s.opts.Decoder)
+	if s.errs = s.opts.Errors; s.errs == nil {
+		s.errs = RPCErrors
+	}
+	return
+}
+
+// Handle registers h as the handler for method (replacing any registered already).
+func (s *RPCServer) Handle(method string, h RPCHandler) {
+	s.mu.Lock()
+	s.methods[method] = h
+	s.mu.Unlock()
+}
+
+// Register registers the function fn as method. 
+// 
+// fn may take a context.Context as its first argument. Its other arguments are decoded 
+// from the positional parameters in turn (a variadic fn takes any extra parameters).
+// It returns nothing, a result, an error, or a result and an error.
+// 
+// For example:
+//   srv.Register("add", func(a, b int) (int, error) { return a + b, nil })
+func (s *RPCServer) Register(method string, fn interface{}) (err error) {
+	h, err := rpcFuncHandler(reflect.ValueOf(fn))
+	if err != nil {
+		return fmt.Errorf("msgpack-rpc: Register %s: %v", method, err)
+	}
+	s.Handle(method, h)
+	return
+}
+
+// rpcFuncHandler returns an RPCHandler calling the function fn (see Register).
+func rpcFuncHandler(fn reflect.Value) (h RPCHandler, err error) {
+	ft := fn.Type()
+	if ft.Kind() != reflect.Func {
+		return nil, fmt.Errorf("expecting a function. Got: %v", ft)
+	}
+	withCtx := ft.NumIn() > 0 && ft.In(0) == ctxTyp
+	var hasResult, hasErr bool
+	switch ft.NumOut() {
+	case 0:
+	case 1:
+		hasErr = ft.Out(0) == errorTyp
+		hasResult = !hasErr
+	case 2:
+		if ft.Out(1) != errorTyp {
+			return nil, fmt.Errorf("expecting the 2nd result to be an error. Got: %v", ft)
+		}
+		hasResult, hasErr = true, true
+	default:
+		return nil, fmt.Errorf("expecting at most 2 results. Got: %v", ft)
+	}
+	h = func(ctx context.Context, params *Decoder) (result interface{}, err error) {
+		l, err := params.ReadArrayHeader()
+		if err != nil {
+			return
+		}
+		args := make([]reflect.Value, 0, ft.NumIn())
+		if withCtx {
+			args = append(args, reflect.ValueOf(ctx))
+		}
+		n := ft.NumIn() - len(args)
+		if l != n && !(ft.IsVariadic() && l >= n - 1) {
+			return nil, fmt.Errorf("msgpack-rpc: expecting %d params. Received %d", n, l)
+		}
+		for i := 0; i < l; i++ {
+			var at reflect.Type
+			if j := len(args); ft.IsVariadic() && j >= ft.NumIn() - 1 {
+				at = ft.In(ft.NumIn() - 1).Elem()
+			} else {
+				at = ft.In(j)
+			}
+			av := reflect.New(at)
+			if err = params.DecodeValue(av); err != nil {
+				return nil, fmt.Errorf("msgpack-rpc: param %d: %v", i, err)
+			}
+			args = append(args, av.Elem())
+		}
+		out := fn.Call(args)
+		if hasErr {
+			if e := out[len(out)-1]; !e.IsNil() {
+				err = e.Interface().(error)
+			}
+		}
+		if hasResult {
+			result = out[0].Interface()
+		}
+		return
+	}
+	return
+}
+
+// Serve accepts connections from ln, and serves each in its own goroutine (see ServeConn),
+// until ln fails or the server is shut down (when it returns ErrRPCClosed).
+func (s *RPCServer) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.shutdown {
+		s.mu.Unlock()
+		return ErrRPCClosed
+	}
+	s.listeners[ln] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, ln)
+		s.mu.Unlock()
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			shutdown := s.shutdown
+			s.mu.Unlock()
+			if shutdown {
+				return ErrRPCClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn serves calls and notifications read from conn, until conn fails 
+// or the server is closed. It closes conn before returning.
+// 
+// conn is read through a buffer, so a burst of pipelined calls takes few reads.
+func (s *RPCServer) ServeConn(conn io.ReadWriteCloser) {
+	conn = withRPCStats(conn, s.opts.Stats)
+	sc := &rpcServerConn{s: s, conn: conn, dec: NewDecoder(bufio.NewReader(conn), s.dam), 
+		cancels: make(map[uint64]context.CancelFunc)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sc.ctx = ctx
+	sc.enc = NewEncoderEx(&sc.wbuf, s.opts.Encoder)
+	sc.wcond = sync.NewCond(&sc.wmu)
+	s.mu.Lock()
+	if s.shutdown {
+		s.mu.Unlock()
+		conn.Close()
+		return
+	}
+	s.conns[sc] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, sc)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	sc.hb = startHeartbeat(&s.opts, func() error { return sc.writeMessage([]interface{}{ 2, rpcPing, []interface{}{} }) }, 
+		func() { conn.Close() })
+	defer sc.hb.stop()
+	for sc.readRequest() == nil {
+	}
+}
+
+// PipeClient returns an RPCClient (configured by opts, which may be nil) connected to s in memory
+// (with net.Pipe), e.g. for tests or in-process services. Closing the client ends the connection.
+func (s *RPCServer) PipeClient(opts *RPCOptions) *RPCClient {
+	c1, c2 := net.Pipe()
+	go s.ServeConn(c1)
+	return NewRPCClient(c2, opts)
+}
+
+// Shutdown gracefully shuts down the server: it stops accepting connections, 
+// responds to new calls with an error, and waits for the calls in progress to respond
+// (or for ctx to be done) before closing all connections.
+func (s *RPCServer) Shutdown(ctx context.Context) (err error) {
+	s.mu.Lock()
+	s.shutdown = true
+	for ln := range s.listeners {
+		ln.Close()
+	}
+	s.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		s.calls.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	s.Close()
+	return
+}
+
+// Close closes the server at once: its listeners and all connections. 
+// The contexts of the calls in progress are done, and their responses are lost.
+func (s *RPCServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shutdown = true
+	for ln := range s.listeners {
+		ln.Close()
+	}
+	for sc := range s.conns {
+		sc.conn.Close()
+	}
+	return nil
+}
+
+// readRequest reads a call or notification, and starts handling it.
+func (sc *rpcServerConn) readRequest() (err error) {
+	sc.dec.setLimit(int64(sc.s.opts.MaxRequestSize), ErrRPCMessageTooLarge)
+	l, err := sc.dec.ReadArrayHeader()
+	if err != nil {
+		return
+	}
+	sc.hb.seen()
+	typ, err := sc.dec.ReadUint64()
+	if err != nil {
+		return
+	}
+	var msgid uint64
+	switch {
+	case typ == 0 && (l == 4 || l == 5):
+		if msgid, err = sc.dec.ReadUint64(); err != nil {
+			return
+		}
+		l--
+	case typ == 2 && (l == 3 || l == 4):
+	default:
+		return fmt.Errorf("%s: msgpack-rpc: unexpected message (type %v, %v elements)", msgTagDec, typ, l)
+	}
+	method, err := sc.dec.ReadString()
+	if err != nil {
+		return
+	}
+	params, err := sc.dec.DecodeRaw()
+	if err != nil {
+		return
+	}
+	md := new(rpcCallMD)
+	if l == 4 {
+		if err = sc.dec.Decode(&md.in); err != nil {
+			return
+		}
+	}
+	if typ == 2 {
+		switch method {
+		case rpcPing:
+			go sc.writeMessage([]interface{}{ 2, rpcPong, []interface{}{} })
+			return
+		case rpcPong:
+			return
+		case rpcCancel:
+			sc.cancel(params)
+			return
+		}
+	}
+	s := sc.s
+	s.mu.Lock()
+	h, shutdown := s.methods[method], s.shutdown
+	if !shutdown {
+		s.calls.Add(1)
+	}
+	s.mu.Unlock()
+	var start time.Time
+	if typ == 0 && s.opts.Stats != nil {
+		start = time.Now()
+		s.opts.Stats.CallStarted(method)
+	}
+	if shutdown {
+		if typ == 0 {
+			sc.writeResponse(msgid, nil, errRPCShutdown, nil)
+			sc.completed(method, start, errRPCShutdown)
+		}
+		return
+	}
+	ctx := context.WithValue(sc.ctx, rpcInMDKey{}, md)
+	var cancel context.CancelFunc
+	if typ == 0 {
+		ctx, cancel = context.WithCancel(context.WithValue(ctx, rpcStreamKey{}, &rpcStreamOut{ sc: sc, msgid: msgid }))
+		sc.cmu.Lock()
+		sc.cancels[msgid] = cancel
+		sc.cmu.Unlock()
+	}
+	go func() {
+		defer s.calls.Done()
+		result, err := sc.call(ctx, h, method, params)
+		if typ == 0 {
+			sc.cmu.Lock()
+			delete(sc.cancels, msgid)
+			sc.cmu.Unlock()
+			cancel()
+			md.mu.Lock()
+			out := md.out
+			md.mu.Unlock()
+			sc.writeResponse(msgid, result, err, out)
+			sc.completed(method, start, err)
+		}
+	}()
+	return
+}
+
+// cancel cancels the context of the call whose msgid is in params (of a cancel notification).
+func (sc *rpcServerConn) cancel(params Raw) {
+	d := NewDecoderBytes(params, nil)
+	if l, err := d.ReadArrayHeader(); err != nil || l != 1 {
+		return
+	}
+	msgid, err := d.ReadUint64()
+	if err != nil {
+		return
+	}
+	sc.cmu.Lock()
+	cancel := sc.cancels[msgid]
+	sc.cmu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// completed reports to the stats (if any) that a call of method started at start has completed with err.
+func (sc *rpcServerConn) completed(method string, start time.Time, err error) {
+	if stats := sc.s.opts.Stats; stats != nil {
+		stats.CallCompleted(method, time.Since(start), err)
+	}
+}
+
+// call calls h, returning any panic as an error.
+func (sc *rpcServerConn) call(ctx context.Context, h RPCHandler, method string, params Raw) (result interface{}, err error) {
+	if h == nil {
+		return nil, fmt.Errorf("msgpack-rpc: unknown method: %s", method)
+	}
+	defer func() {
+		if x := recover(); x != nil {
+			err = fmt.Errorf("msgpack-rpc: %s: panic: %v", method, x)
+		}
+	}()
+	return h(ctx, NewDecoderBytes(params, sc.s.dam))
+}
+
+// writeResponse queues a response. Responses queued while one goroutine writes 
+// are written together by it in its next write, so a burst of pipelined calls 
+// is answered in a few writes, rather than one per call.
+func (sc *rpcServerConn) writeResponse(msgid uint64, result interface{}, err error, md RPCMetadata) {
+	sc.wmu.Lock()
+	if err == nil {
+		err = sc.encode(withMetadata([]interface{}{ 1, msgid, nil, result }, md))
+	}
+	if err != nil {
+		if sc.encode(withMetadata([]interface{}{ 1, msgid, sc.s.errs.encode(err), nil }, md)) != nil {
+			// e.g. the data of a structured error cannot be encoded
+			sc.encode(withMetadata([]interface{}{ 1, msgid, err.Error(), nil }, md))
+		}
+	}
+	sc.flush()
+}
+
+// writeMessage queues any other message (see writeResponse).
+func (sc *rpcServerConn) writeMessage(msg []interface{}) (err error) {
+	sc.wmu.Lock()
+	err = sc.encode(msg)
+	sc.flush()
+	return
+}
+
+// encode queues msg, or nothing if it fails. It must be called with sc.wmu held.
+func (sc *rpcServerConn) encode(msg []interface{}) (err error) {
+	n := sc.wbuf.Len()
+	var t time.Time
+	if sc.s.opts.Stats != nil {
+		t = time.Now()
+	}
+	if err = sc.enc.Encode(msg); err != nil {
+		sc.wbuf.Truncate(n)
+	} else if sc.s.opts.Stats != nil {
+		sc.s.opts.Stats.Encoded(time.Since(t))
+	}
+	return
+}
+
+// flush writes the queued messages, unless another goroutine is doing so already
+// (when it writes them in its next write). It must be called with sc.wmu held, and releases it.
+func (sc *rpcServerConn) flush() {
+	defer sc.wmu.Unlock()
+	if sc.flushing {
+		return
+	}
+	sc.flushing = true
+	var buf []byte
+	for sc.wbuf.Len() > 0 {
+		buf = append(buf[:0], sc.wbuf.Bytes()...)
+		sc.wbuf.Reset()
+		sc.wgen++
+		sc.wcond.Broadcast()
+		sc.wmu.Unlock()
+		_, err := sc.conn.Write(buf)
+		sc.wmu.Lock()
+		if err != nil {
+			sc.conn.Close()
+			sc.wbuf.Reset()
+			sc.werr = err
+		}
+	}
+	sc.flushing = false
+}
@@ -0,0 +1,151 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+import (
+	"context"
+	"io"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// GracefulRPCServerCodec is a server codec for net/rpc which can be shut down gracefully 
+// (see Shutdown), so a restart does not drop the responses to calls already being handled.
+// 
+// Sample Usage:
+//   codec := msgpack.NewGracefulRPCServerCodec(conn, opts)
+//   go srv.ServeCodec(codec)
+//   ...
+//   ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+//   err = codec.Shutdown(ctx)
+type GracefulRPCServerCodec struct {
+	rpc.ServerCodec
+	dl rpcDeadliner // the connection, if it has deadlines
+
+	mu sync.Mutex // guards the fields below
+	pending map[uint64]int // calls read and not yet responded to, by seq
+	shutdown bool
+	idle chan struct{} // closed once shutting down with no call pending
+
+	closeOnce sync.Once
+	closeErr error
+}
+
+// NewGracefulRPCServerCodec returns a GracefulRPCServerCodec for conn, using the codec made by 
+// NewRPCCodecOpts(conn, opts).
+func NewGracefulRPCServerCodec(conn io.ReadWriteCloser, opts *RPCOptions) *GracefulRPCServerCodec {
+	c := &GracefulRPCServerCodec{ ServerCodec: NewRPCCodecOpts(conn, opts), pending: make(map[uint64]int) }
+	c.dl, _ = conn.(rpcDeadliner)
+	return c
+}
+
+// Shutdown shuts the codec down gracefully: it stops reading calls, waits for the responses 
+// to the calls read already to be written (or for ctx to be done, when it returns ctx.Err()), 
+// then closes the connection.
+// 
+// A call being read when Shutdown starts is still served if it is read whole. 
+// Reading is interrupted at once if the connection has deadlines (e.g. a net.Conn); 
+// otherwise the connection is only closed once the responses are written, 
+// so a call read in the meantime is served too.
+func (c *GracefulRPCServerCodec) Shutdown(ctx context.Context) (err error) {
+	c.mu.Lock()
+	if !c.shutdown {
+		c.shutdown = true
+		c.idle = make(chan struct{})
+		if len(c.pending) == 0 {
+			close(c.idle)
+		}
+	}
+	idle := c.idle
+	c.mu.Unlock()
+	if c.dl != nil {
+		c.dl.SetReadDeadline(time.Now())
+	}
+	select {
+	case <-idle:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	c.Close()
+	return
+}
+
+func (c *GracefulRPCServerCodec) ReadRequestHeader(r *rpc.Request) (err error) {
+	c.mu.Lock()
+	shutdown := c.shutdown
+	c.mu.Unlock()
+	if shutdown {
+		return io.EOF
+	}
+	err = c.ServerCodec.ReadRequestHeader(r)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		if c.shutdown {
+			// reading was interrupted by Shutdown.
+			err = io.EOF
+		}
+		return
+	}
+	c.pending[r.Seq]++
+	return
+}
+
+func (c *GracefulRPCServerCodec) WriteResponse(r *rpc.Response, body interface{}) (err error) {
+	err = c.ServerCodec.WriteResponse(r, body)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// a response to an invalid request has no call pending.
+	if n, ok := c.pending[r.Seq]; ok {
+		if n > 1 {
+			c.pending[r.Seq] = n - 1
+		} else {
+			delete(c.pending, r.Seq)
+		}
+	}
+	if c.shutdown && len(c.pending) == 0 {
+		select {
+		case <-c.idle:
+		default:
+			close(c.idle)
+		}
+	}
+	return
+}
+
+// Close closes the connection (once: net/rpc closes the codec too, when it stops serving it).
+func (c *GracefulRPCServerCodec) Close() error {
+	c.closeOnce.Do(func() { c.closeErr = c.ServerCodec.Close() })
+	return c.closeErr
+}
@@ -0,0 +1,178 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+import (
+	"io"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// RPCStats receives measurements from the rpc codecs, RPCClients and RPCServers it is set on 
+// (see RPCOptions.Stats), e.g. to export them as metrics. Its methods are called concurrently,
+// and should return quickly.
+// 
+// The calls in flight are those started and not yet completed.
+type RPCStats interface {
+	// CallStarted is called when a call is written by a client, or read by a server.
+	CallStarted(method string)
+	// CallCompleted is called when a call completes: when its response is read by a client 
+	// (or it fails, or the caller stops waiting), or written by a server. 
+	// d is the time since it started, and err its error (nil if it succeeded).
+	CallCompleted(method string, d time.Duration, err error)
+	// BytesRead and BytesWritten are called with the number of bytes of each read 
+	// and write of the connection.
+	BytesRead(n int)
+	BytesWritten(n int)
+	// Encoded is called with the time taken to encode each message written.
+	Encoded(d time.Duration)
+	// Decoded is called with the time taken by a codec to decode the body of each request 
+	// or response (an RPCClient or RPCServer leaves that to the application).
+	Decoded(d time.Duration)
+}
+
+type rpcStatsConn struct {
+	io.ReadWriteCloser
+	stats RPCStats
+}
+
+type rpcStatsDeadlineConn struct {
+	rpcStatsConn
+	rpcDeadliner
+}
+
+// withRPCStats returns conn, reporting the bytes read and written to stats (if not nil).
+// Its deadlines (if any) are kept.
+func withRPCStats(conn io.ReadWriteCloser, stats RPCStats) io.ReadWriteCloser {
+	if stats == nil {
+		return conn
+	}
+	c := rpcStatsConn{conn, stats}
+	if dl, ok := conn.(rpcDeadliner); ok {
+		return rpcStatsDeadlineConn{c, dl}
+	}
+	return c
+}
+
+func (c rpcStatsConn) Read(p []byte) (n int, err error) {
+	if n, err = c.ReadWriteCloser.Read(p); n > 0 {
+		c.stats.BytesRead(n)
+	}
+	return
+}
+
+func (c rpcStatsConn) Write(p []byte) (n int, err error) {
+	if n, err = c.ReadWriteCloser.Write(p); n > 0 {
+		c.stats.BytesWritten(n)
+	}
+	return
+}
+
+type rpcStatsStart struct {
+	method string
+	t time.Time
+}
+
+// rpcStatsInterceptor returns an interceptor reporting the calls through a codec to stats.
+func rpcStatsInterceptor(stats RPCStats) RPCInterceptor {
+	var mu sync.Mutex
+	out := make(map[uint64]rpcStatsStart) // calls written, by seq
+	in := make(map[uint64]rpcStatsStart) // calls read, by seq
+	return RPCInterceptor{
+		WriteRequest: func(r *rpc.Request, body interface{}, next func(*rpc.Request, interface{}) error) (err error) {
+			s := rpcStatsStart{ r.ServiceMethod, time.Now() }
+			stats.CallStarted(s.method)
+			mu.Lock()
+			out[r.Seq] = s
+			mu.Unlock()
+			if err = next(r, body); err != nil {
+				mu.Lock()
+				delete(out, r.Seq)
+				mu.Unlock()
+				stats.CallCompleted(s.method, time.Since(s.t), err)
+			}
+			return
+		},
+		ReadResponseHeader: func(r *rpc.Response, next func(*rpc.Response) error) (err error) {
+			err = next(r)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				// net/rpc fails all calls pending.
+				for seq, s := range out {
+					delete(out, seq)
+					stats.CallCompleted(s.method, time.Since(s.t), err)
+				}
+				return
+			}
+			if s, ok := out[r.Seq]; ok {
+				delete(out, r.Seq)
+				stats.CallCompleted(s.method, time.Since(s.t), rpcResponseError(r.Error))
+			}
+			return
+		},
+		ReadRequestHeader: func(r *rpc.Request, next func(*rpc.Request) error) (err error) {
+			if err = next(r); err == nil {
+				stats.CallStarted(r.ServiceMethod)
+				mu.Lock()
+				in[r.Seq] = rpcStatsStart{ r.ServiceMethod, time.Now() }
+				mu.Unlock()
+			}
+			return
+		},
+		WriteResponse: func(r *rpc.Response, body interface{}, next func(*rpc.Response, interface{}) error) (err error) {
+			err = next(r, body)
+			mu.Lock()
+			s, ok := in[r.Seq]
+			delete(in, r.Seq)
+			mu.Unlock()
+			if ok {
+				cerr := rpcResponseError(r.Error)
+				if cerr == nil {
+					cerr = err
+				}
+				stats.CallCompleted(s.method, time.Since(s.t), cerr)
+			}
+			return
+		},
+	}
+}
+
+// rpcResponseError returns the error of a net/rpc response (nil if none).
+func rpcResponseError(s string) error {
+	if s == "" {
+		return nil
+	}
+	return rpc.ServerError(s)
+}
@@ -0,0 +1,241 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// A streaming call sends its results as chunks: msgpack-rpc notifications with a reserved 
+// method name, and the params [msgid, result]. The response to the call (with a nil result) 
+// marks the end of the stream, or carries its error.
+const rpcChunk = "$chunk"
+
+// RPCStreamHandler handles a call of a streaming method (see RPCServer.HandleStream).
+// It sends each result with send, as soon as it has it, and returns when it has sent them all
+// (or with an error, which ends the stream with it). send fails if the connection has failed, 
+// the call is cancelled (when ctx is done), or v cannot be encoded. It must not be called once the handler has returned.
+type RPCStreamHandler func(ctx context.Context, params *Decoder, send func(v interface{}) error) error
+
+type rpcStreamKey struct{}
+
+// rpcStreamOut is where a streaming call sends its results.
+type rpcStreamOut struct {
+	sc *rpcServerConn
+	msgid uint64
+}
+
+// HandleStream registers h as the handler for the streaming method (replacing any registered already).
+// The results are sent one at a time as h produces them, so a large result 
+// (e.g. the rows of a query) need not be held in memory whole, by the server or the client. 
+// A slow client slows h down: send waits while results sent before are still being written.
+// 
+// A streaming method is called with RPCClient.CallStream. Called as a notification, it fails.
+func (s *RPCServer) HandleStream(method string, h RPCStreamHandler) {
+	s.Handle(method, func(ctx context.Context, params *Decoder) (interface{}, error) {
+		out, _ := ctx.Value(rpcStreamKey{}).(*rpcStreamOut)
+		if out == nil {
+			return nil, errors.New("msgpack-rpc: streaming method called as a notification")
+		}
+		return nil, h(ctx, params, func(v interface{}) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return out.sc.writeChunk(out.msgid, v)
+		})
+	})
+}
+
+// RPCStream iterates over the results of a streaming call (see RPCClient.CallStream).
+// Results are queued as they arrive, until read with Next.
+// 
+// Sample Usage:
+//   st, err := client.CallStream(ctx, "rows", "select ...")
+//   defer st.Close()
+//   for st.Next() {
+//     var row Row
+//     err = st.Decode(&row)
+//   }
+//   err = st.Err()
+type RPCStream struct {
+	c *RPCClient
+	ctx context.Context
+	msgid uint32
+	ch chan rpcReply // the response, which ends the stream
+	cur Raw
+	done bool
+	err error
+
+	mu sync.Mutex // guards chunks
+	chunks []Raw
+	more chan struct{} // signalled when a chunk is queued
+}
+
+// CallStream calls the streaming method with args as the positional parameters, 
+// and returns an RPCStream over its results. ctx bounds the whole stream.
+func (c *RPCClient) CallStream(ctx context.Context, method string, args ...interface{}) (st *RPCStream, err error) {
+	if args == nil {
+		args = []interface{}{}
+	}
+	deadline, _ := ctx.Deadline()
+	msgid, ch, err := c.register(method, deadline)
+	if err != nil {
+		return
+	}
+	st = &RPCStream{ c: c, ctx: ctx, msgid: msgid, ch: ch, more: make(chan struct{}, 1) }
+	c.mu.Lock()
+	if call := c.pending[msgid]; call != nil {
+		call.stream = st
+	}
+	c.mu.Unlock()
+	if err = c.write(ctx, withMetadata([]interface{}{ 0, msgid, method, args }, outMetadata(ctx))); err != nil {
+		c.forget(msgid, err)
+		return nil, err
+	}
+	return
+}
+
+// Next waits for the next result, and says whether there is one (to read with Decode or Raw). 
+// Once it returns false, the stream has ended: Err says whether it ended with an error.
+func (st *RPCStream) Next() bool {
+	st.cur = nil
+	for {
+		st.mu.Lock()
+		if len(st.chunks) > 0 {
+			st.cur = st.chunks[0]
+			st.chunks[0] = nil
+			st.chunks = st.chunks[1:]
+			st.mu.Unlock()
+			return true
+		}
+		st.mu.Unlock()
+		if st.done {
+			return false
+		}
+		select {
+		case <-st.more:
+		case r := <-st.ch:
+			// the chunks sent before the response have all been queued: return them first.
+			st.done = true
+			_, st.err = st.c.result(r)
+		case <-st.ctx.Done():
+			st.Close()
+			st.err = st.ctx.Err()
+		}
+	}
+}
+
+// Raw returns the msgpack encoding of the current result.
+func (st *RPCStream) Raw() Raw {
+	return st.cur
+}
+
+// Decode decodes the current result into v, using the decoder options of the client.
+func (st *RPCStream) Decode(v interface{}) error {
+	return Unmarshal(st.cur, v, st.c.dam)
+}
+
+// Err returns the error which ended the stream (nil if it ended normally, or has not ended).
+// A remote error is an *RPCError.
+func (st *RPCStream) Err() error {
+	return st.err
+}
+
+// Close stops receiving the results: those still to come are discarded, 
+// and the server is told to cancel the call (see RPCHandler).
+func (st *RPCStream) Close() {
+	if st.done {
+		return
+	}
+	st.done = true
+	st.c.forget(st.msgid, context.Canceled)
+	st.c.cancel(st.msgid)
+	st.mu.Lock()
+	st.chunks = nil
+	st.mu.Unlock()
+}
+
+// chunk queues a result received for a streaming call (params is [msgid, result]).
+// Chunks of unknown calls (e.g. closed streams), and malformed ones, are dropped.
+func (c *RPCClient) chunk(params Raw) {
+	d := NewDecoderBytes(params, nil)
+	if l, err := d.ReadArrayHeader(); err != nil || l != 2 {
+		return
+	}
+	msgid, err := d.ReadUint64()
+	if err != nil {
+		return
+	}
+	v, err := d.DecodeRaw()
+	if err != nil {
+		return
+	}
+	c.mu.Lock()
+	var st *RPCStream
+	if call := c.pending[uint32(msgid)]; call != nil {
+		st = call.stream
+	}
+	c.mu.Unlock()
+	if st == nil {
+		return
+	}
+	st.mu.Lock()
+	st.chunks = append(st.chunks, v)
+	st.mu.Unlock()
+	select {
+	case st.more <- struct{}{}:
+	default:
+	}
+}
+
+// writeChunk queues a result of a streaming call. Unlike writeResponse, it waits until 
+// the results queued before are being written, so a handler streaming faster than 
+// the connection is slowed to its pace (rather than queuing its results without bound).
+func (sc *rpcServerConn) writeChunk(msgid uint64, v interface{}) (err error) {
+	sc.wmu.Lock()
+	if err = sc.werr; err == nil {
+		err = sc.encode([]interface{}{ 2, rpcChunk, []interface{}{ msgid, v } })
+	}
+	if err != nil {
+		sc.wmu.Unlock()
+		return
+	}
+	for gen := sc.wgen; sc.flushing && sc.wgen == gen && sc.werr == nil; {
+		sc.wcond.Wait()
+	}
+	err = sc.werr
+	sc.flush()
+	return
+}
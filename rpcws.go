@@ -0,0 +1,147 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// WebSocketBinaryMessage is the message type of a binary data message (the opcode in RFC 6455),
+// as used by WebSocketConn. It is the same as websocket.BinaryMessage of github.com/gorilla/websocket.
+const WebSocketBinaryMessage = 2
+
+// WebSocketConn is the part of a WebSocket connection used to run msgpack rpc over it
+// (see NewWebSocketRPCConn). It is implemented by *websocket.Conn of github.com/gorilla/websocket, 
+// and is easily adapted from other WebSocket packages, so this package does not depend on any.
+type WebSocketConn interface {
+	// ReadMessage returns the type and the data of the next message received.
+	ReadMessage() (messageType int, p []byte, err error)
+	// WriteMessage sends data as a single message of the given type (without retaining data).
+	WriteMessage(messageType int, data []byte) error
+	Close() error
+}
+
+type wsRpcConn struct {
+	ws WebSocketConn
+	rbuf []byte // rest of the last message received
+	wmu sync.Mutex
+	wbuf []byte // written, but not a whole msgpack value yet
+}
+
+type wsRpcDeadlineConn struct {
+	*wsRpcConn
+	rpcDeadliner
+}
+
+// NewWebSocketRPCConn adapts a WebSocket connection to the io.ReadWriteCloser 
+// used by the rpc codecs, RPCClient and RPCServer, so msgpack rpc can run over a WebSocket 
+// (e.g. for browser clients, or through proxies which only allow HTTP(S)).
+// 
+// Each msgpack value is sent in a binary message of its own (so a msgpack-rpc message, 
+// and for the basic codec a header or a body, is one frame), whether it is written 
+// whole or in parts. Received messages are read as a stream, so a peer may send 
+// several values in one message, or one value across messages. Receiving a text message is an error.
+// 
+// Read must not be called concurrently (as with any connection used by a codec); Write may be.
+// If ws has deadlines (e.g. SetReadDeadline), they are available on the returned connection.
+// 
+// Sample Usage:
+//   ws, _, err := websocket.DefaultDialer.Dial("wss://example.com/rpc", nil)
+//   client := msgpack.NewRPCClient(msgpack.NewWebSocketRPCConn(ws), nil)
+//   ...
+//   // on the server, in an http.Handler:
+//   ws, err := upgrader.Upgrade(w, r, nil)
+//   srv.ServeConn(msgpack.NewWebSocketRPCConn(ws))
+func NewWebSocketRPCConn(ws WebSocketConn) io.ReadWriteCloser {
+	c := &wsRpcConn{ws: ws}
+	if dl, ok := ws.(rpcDeadliner); ok {
+		return wsRpcDeadlineConn{c, dl}
+	}
+	return c
+}
+
+// NewWebSocketRPCCodec returns a codec (see NewRPCCodecOpts) running over a WebSocket connection
+// (see NewWebSocketRPCConn).
+func NewWebSocketRPCCodec(ws WebSocketConn, opts *RPCOptions) RPCCodec {
+	return NewRPCCodecOpts(NewWebSocketRPCConn(ws), opts)
+}
+
+func (c *wsRpcConn) Read(p []byte) (n int, err error) {
+	for len(c.rbuf) == 0 {
+		var typ int
+		if typ, c.rbuf, err = c.ws.ReadMessage(); err != nil {
+			return
+		}
+		if typ != WebSocketBinaryMessage {
+			c.rbuf = nil
+			return 0, fmt.Errorf("%s: websocket: received a message of type %d, not binary", msgTagDec, typ)
+		}
+	}
+	n = copy(p, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return
+}
+
+func (c *wsRpcConn) Write(p []byte) (n int, err error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.wbuf = append(c.wbuf, p...)
+	var i int
+	for i < len(c.wbuf) {
+		d := NewDecoderBytes(c.wbuf[i:], nil)
+		if err = d.Skip(); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				// the rest of the value is still to be written
+				err = nil
+				break
+			}
+			c.wbuf = c.wbuf[:0]
+			return 
+		}
+		j := i + int(d.InputOffset())
+		if err = c.ws.WriteMessage(WebSocketBinaryMessage, c.wbuf[i:j]); err != nil {
+			c.wbuf = c.wbuf[:0]
+			return
+		}
+		i = j
+	}
+	c.wbuf = c.wbuf[:copy(c.wbuf, c.wbuf[i:])]
+	return len(p), nil
+}
+
+func (c *wsRpcConn) Close() error {
+	return c.ws.Close()
+}
@@ -0,0 +1,77 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+import (
+	"reflect"
+	"sort"
+)
+
+var emptyStructTyp = reflect.TypeOf(struct{}{})
+
+// isSetType says whether rt is a set-shaped map: one with struct{} values.
+func isSetType(rt reflect.Type) bool {
+	return rt.Kind() == reflect.Map && rt.Elem() == emptyStructTyp
+}
+
+// encodeSet encodes the keys of the set-shaped map rv as an array (see EncoderOptions.SetsAsArrays).
+func (e *Encoder) encodeSet(rv reflect.Value) {
+	if rv.IsNil() && !e.o.NilMapAsEmpty {
+		e.encNil()
+		return
+	}
+	mks := rv.MapKeys()
+	if e.o.SortMapKeys && rv.Type().Key().Kind() == reflect.String {
+		sort.Slice(mks, func(i, j int) bool { return mks[i].String() < mks[j].String() })
+	}
+	e.writeContainerLen(ContainerList, len(mks))
+	for _, mk := range mks {
+		e.encodeValue(mk)
+	}
+}
+
+// decodeSet decodes an array of containerLen keys into the set-shaped map rv.
+func (d *Decoder) decodeSet(containerLen int, rv reflect.Value) {
+	rvtype := rv.Type()
+	if rv.IsNil() {
+		rv.Set(reflect.MakeMapWithSize(rvtype, containerLen))
+	} else if d.o.ReplaceExisting {
+		rv.Clear()
+	}
+	rvv := reflect.Zero(emptyStructTyp)
+	for j := 0; j < containerLen; j++ {
+		rvk := reflect.New(rvtype.Key()).Elem()
+		rvk = d.decodeValueT(0, -1, true, rvk, true, true, false)
+		rv.SetMapIndex(rvk, rvv)
+	}
+}
@@ -0,0 +1,236 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+)
+
+// Ext types used when encoding with EncoderOptions.SharedRefs.
+// Applications using ext types of their own must not re-use these.
+const (
+	// ExtSharedDef wraps the first occurrence of a shared pointer: 
+	// its data is the reference id (a msgpack uint) followed by the encoded value.
+	ExtSharedDef int8 = 126
+	// ExtSharedRef replaces each later occurrence: its data is the reference id.
+	ExtSharedRef int8 = 127
+)
+
+type sharedRefKey struct {
+	p uintptr
+	t reflect.Type // a struct and its first field share an address
+}
+
+type sharedRef struct {
+	n int        // occurrences in the value being encoded
+	id int       // assigned on the first occurrence, if n > 1
+	written bool
+}
+
+// countSharedRefs walks rv, counting the occurrences of each pointer.
+// The contents of a pointer are only walked on its first occurrence (so cycles terminate), 
+// as are those of a map or slice (walked records them). Nesting is limited as when encoding (see enterRef).
+func (e *Encoder) countSharedRefs(rv reflect.Value, walked map[encRef]struct{}) {
+	switch rv.Kind() {
+	case reflect.Ptr:
+		if rv.IsNil() {
+			return
+		}
+		k := sharedRefKey{rv.Pointer(), rv.Type()}
+		if r := e.refs[k]; r != nil {
+			r.n++
+			return
+		}
+		e.refs[k] = &sharedRef{n: 1}
+		ref, tracked := e.enterRef(rv, 0)
+		e.countSharedRefs(rv.Elem(), walked)
+		e.exitRef(ref, tracked)
+	case reflect.Interface:
+		if !rv.IsNil() {
+			e.countSharedRefs(rv.Elem(), walked)
+		}
+	case reflect.Struct:
+		if rv.Type() == timeTyp {
+			return
+		}
+		for _, si := range getStructFieldInfos(rv.Type()).sis {
+			e.countSharedRefs(si.field(rv), walked)
+		}
+	case reflect.Array:
+		if !canHoldRefs(rv.Type().Elem()) {
+			return
+		}
+		for j := 0; j < rv.Len(); j++ {
+			e.countSharedRefs(rv.Index(j), walked)
+		}
+	case reflect.Slice, reflect.Map:
+		if rv.IsNil() || !canHoldRefs(rv.Type().Elem()) {
+			return
+		}
+		ref := encRef{rv.Pointer(), rv.Len()}
+		if _, ok := walked[ref]; ok {
+			return
+		}
+		walked[ref] = struct{}{}
+		ref, tracked := e.enterRef(rv, ref.l)
+		if rv.Kind() == reflect.Slice {
+			for j := 0; j < rv.Len(); j++ {
+				e.countSharedRefs(rv.Index(j), walked)
+			}
+		} else {
+			for _, mk := range rv.MapKeys() {
+				e.countSharedRefs(rv.MapIndex(mk), walked)
+			}
+		}
+		e.exitRef(ref, tracked)
+	}
+}
+
+func canHoldRefs(rt reflect.Type) bool {
+	switch rt.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Struct, reflect.Slice, reflect.Array, reflect.Map:
+		return true
+	}
+	return false
+}
+
+// encodeSharedPtr encodes a non-nil pointer counted by countSharedRefs.
+// It returns false if the pointer is not shared, so should be encoded as usual.
+func (e *Encoder) encodeSharedPtr(rv reflect.Value) bool {
+	r := e.refs[sharedRefKey{rv.Pointer(), rv.Type()}]
+	if r == nil || r.n < 2 {
+		return false
+	}
+	if r.written {
+		w := e.w
+		buf := new(bytes.Buffer)
+		e.w = buf
+		e.inExt++
+		e.encUint(uint64(r.id))
+		e.inExt--
+		e.w = w
+		e.writeExtHeader(ExtSharedRef, buf.Len())
+		e.writeb(buf.Len(), buf.Bytes())
+		return true
+	}
+	r.id, r.written = e.numRefs, true
+	e.numRefs++
+	// the ext length must be written first, so encode the value into a buffer.
+	w := e.w
+	buf := new(bytes.Buffer)
+	e.w = buf
+	e.inExt++
+	e.encUint(uint64(r.id))
+	e.encodeValue(rv.Elem())
+	e.inExt--
+	e.w = w
+	e.writeExtHeader(ExtSharedDef, buf.Len())
+	e.writeb(buf.Len(), buf.Bytes())
+	return true
+}
+
+// endSharedRefs is deferred by EncodeValue when encoding with SharedRefs.
+// It restores the writer (which a failed encode may have left swapped for a buffer).
+func (e *Encoder) endSharedRefs(w io.Writer) {
+	e.w = w
+	e.refs = nil
+	e.numRefs = 0
+}
+
+// decodeSharedRef decodes an ExtSharedDef or ExtSharedRef value (whose header was read) into rv.
+// It returns the value to set a nil interface{} to, as decodeValue does.
+func (d *Decoder) decodeSharedRef(xtag int8, rv reflect.Value) (wasNilIntf bool, rvn reflect.Value) {
+	bd := d.readn1()
+	_, ui := d.decodeInteger(bd, false)
+	rk := rv.Kind()
+	wasNilIntf = rk == reflect.Interface && rv.IsNil()
+	rvn = rv
+	
+	if xtag == ExtSharedRef {
+		ref, ok := d.refs[ui]
+		if !ok {
+			d.err("Unknown shared reference id: %v", ui)
+		}
+		if !ref.IsValid() {
+			d.err("Shared reference id: %v refers back into the value being decoded into interface{} " + 
+				"(cyclic values need typed pointer targets)", ui)
+		}
+		switch {
+		case ref.Type().AssignableTo(rv.Type()):
+			rv.Set(ref)
+		case ref.Kind() == reflect.Ptr && ref.Type().Elem().AssignableTo(rv.Type()):
+			rv.Set(ref.Elem())
+		default:
+			d.err("Cannot decode shared reference of type: %v into: %v", ref.Type(), rv.Type())
+		}
+		if wasNilIntf {
+			rvn = rv.Elem()
+		}
+		return
+	}
+	
+	if d.refs == nil {
+		d.refs = make(map[uint64]reflect.Value)
+	}
+	switch {
+	case rk == reflect.Ptr:
+		// register before decoding the contents, so references back to it (cycles) resolve.
+		if rv.IsNil() {
+			rv.Set(reflect.New(rv.Type().Elem()))
+		}
+		d.refs[ui] = rv.Elem().Addr()
+		d.decodeValue(0, -1, true, rv.Elem())
+	case wasNilIntf:
+		// the value only exists once decoded, so references back to it (cycles) cannot resolve: 
+		// register it as pending until then.
+		d.refs[ui] = reflect.Value{}
+		var v interface{}
+		rvi := reflect.ValueOf(&v).Elem()
+		d.decodeValueT(0, -1, true, rvi, true, true, true)
+		d.refs[ui] = rvi.Elem()
+		rv.Set(rvi)
+		rvn = rv.Elem()
+	default:
+		if rv.CanAddr() {
+			d.refs[ui] = rv.Addr()
+		}
+		d.decodeValue(0, -1, true, rv)
+		if !rv.CanAddr() {
+			d.refs[ui] = rv
+		}
+	}
+	return
+}
+
@@ -0,0 +1,91 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+import (
+	"database/sql/driver"
+	"fmt"
+)
+
+// SQLValue holds a value of type T stored in a database column as a msgpack blob 
+// (e.g. a Postgres bytea or a MySQL BLOB column). It implements driver.Valuer and sql.Scanner, 
+// so a structured column round-trips without per-type code.
+// 
+// A NULL column scans as the zero value of T (and Valid false); 
+// a SQLValue which is not Valid is stored as NULL.
+// 
+// Sample Usage:
+//   v := msgpack.NewSQLValue(Settings{Theme: "dark"})
+//   _, err = db.Exec("UPDATE users SET settings = $1 WHERE id = $2", v, id)
+//   var s msgpack.SQLValue[Settings]
+//   err = db.QueryRow("SELECT settings FROM users WHERE id = $1", id).Scan(&s)
+//   theme := s.V.Theme
+type SQLValue[T any] struct {
+	V T
+	Valid bool // false for a NULL column
+}
+
+// NewSQLValue returns a (Valid) SQLValue holding v.
+func NewSQLValue[T any](v T) SQLValue[T] {
+	return SQLValue[T]{ V: v, Valid: true }
+}
+
+// Value implements driver.Valuer, encoding V as msgpack (or NULL if not Valid).
+func (v SQLValue[T]) Value() (driver.Value, error) {
+	if !v.Valid {
+		return nil, nil
+	}
+	return MarshalT(v.V)
+}
+
+// Scan implements sql.Scanner, decoding a msgpack blob (as []byte or string) into V. 
+// The decoded value does not alias src.
+func (v *SQLValue[T]) Scan(src interface{}) (err error) {
+	var zero T
+	v.V, v.Valid = zero, false
+	var bs []byte
+	switch x := src.(type) {
+	case nil:
+		return
+	case []byte:
+		bs = x
+	case string:
+		bs = []byte(x)
+	default:
+		return fmt.Errorf("%s: cannot scan a %T into a SQLValue", msgTagDec, src)
+	}
+	if v.V, err = UnmarshalT[T](bs); err == nil {
+		v.Valid = true
+	}
+	return
+}
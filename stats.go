@@ -0,0 +1,147 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+import (
+	"io"
+	"reflect"
+)
+
+// Stats describes the shape of one encoded value: e.g. to characterize production payloads
+// without sampling the raw traffic (see StatsCollector).
+type Stats struct {
+	Bytes int64                // length of the encoding
+	Counts [ExtType+1]int      // number of values of each wire type, indexed by ValueType
+	MaxDepth int               // deepest nesting of arrays and maps (0 for a scalar)
+	ArrayElems, MapEntries int // total number of array elements and map entries
+	MaxArrayLen, MaxMapLen int // length of the largest array and map
+	MaxBytesLen int            // length of the largest str, bin or ext payload
+}
+
+// StatsCollector receives the Stats of each value encoded by an Encoder's Encode (or EncodeValue), 
+// or decoded by a Decoder's Decode (or DecodeValue), when set on EncoderOptions.Stats or 
+// DecoderOptions.Stats. It is only called for values which were encoded or decoded successfully.
+// 
+// The Stats are computed by walking the encoding after the call, so collecting them
+// costs about as much as a CheckValid of each value.
+type StatsCollector interface {
+	CollectStats(s Stats)
+}
+
+// StatsOf returns the Stats of the (well-formed) encoding of a value.
+func StatsOf(b []byte) (s Stats) {
+	d := newDecoder(&bytesDecReader{b: b}, nil)
+	s.Bytes = int64(len(b))
+	defer func() { recover() }() // a malformed tail is not counted
+	s.add(d, 0)
+	return
+}
+
+func (s *Stats) add(d *Decoder, depth int) {
+	bd := d.readn1()
+	vt := descValueType(bd)
+	s.Counts[vt]++
+	var l int
+	switch vt {
+	case StrType, BinType:
+		l = d.readContainerLen(bd, false, ContainerRawBytes)
+		d.skipb(l)
+	case ExtType:
+		_, l = d.readExtHeader(bd)
+		d.skipb(l)
+	case ArrayType, MapType:
+		ct, n := ContainerList, 1
+		if vt == MapType {
+			ct, n = ContainerMap, 2
+		}
+		l = d.readContainerLen(bd, false, ct)
+		if depth++; depth > s.MaxDepth {
+			s.MaxDepth = depth
+		}
+		if depth > decMaxDepth {
+			d.err("Exceeded max nesting depth of %v", decMaxDepth)
+		}
+		if vt == MapType {
+			s.MapEntries += l
+			s.MaxMapLen = maxInt(s.MaxMapLen, l)
+		} else {
+			s.ArrayElems += l
+			s.MaxArrayLen = maxInt(s.MaxArrayLen, l)
+		}
+		for j := n * l; j > 0; j-- {
+			s.add(d, depth)
+		}
+		return
+	default:
+		d.skip(bd, false)
+		return
+	}
+	s.MaxBytesLen = maxInt(s.MaxBytesLen, l)
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// statsWriter records the bytes written through it by EncodeValue (see EncoderOptions.Stats).
+type statsWriter struct {
+	w io.Writer
+	bs []byte
+}
+
+func (z *statsWriter) Write(bs []byte) (n int, err error) {
+	n, err = z.w.Write(bs)
+	z.bs = append(z.bs, bs[:n]...)
+	return
+}
+
+// decodeStats decodes into rv (as DecodeValue), then passes the Stats of the value 
+// read to DecoderOptions.Stats.
+func (d *Decoder) decodeStats(rv reflect.Value) {
+	var bs []byte
+	if z, ok := d.r.(*bytesDecReader); ok {
+		c := z.c
+		d.decodeValueT(0, -1, true, rv, true, true, true)
+		bs = z.b[c:z.c]
+	} else {
+		z := &recDecReader{decReader: d.r}
+		d.r = z
+		defer func() { d.r = z.decReader }()
+		d.decodeValueT(0, -1, true, rv, true, true, true)
+		bs = z.bs
+	}
+	d.o.Stats.CollectStats(StatsOf(bs))
+}
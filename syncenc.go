@@ -0,0 +1,101 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// usageGuard detects concurrent use of an Encoder or Decoder, in race builds (see raceEnabled).
+type usageGuard struct {
+	busy int32
+}
+
+// enter marks the start of a call, panicking if another is in progress. Call exit when done.
+func (g *usageGuard) enter(what string) {
+	if raceEnabled && !atomic.CompareAndSwapInt32(&g.busy, 0, 1) {
+		panic("msgpack: concurrent use of " + what + " (see SyncEncoder)")
+	}
+}
+
+func (g *usageGuard) exit() {
+	if raceEnabled {
+		atomic.StoreInt32(&g.busy, 0)
+	}
+}
+
+// SyncEncoder wraps an Encoder for use by many goroutines: each call holds a lock, 
+// so values (or the values of one EncodeMulti or Do) are written whole, never interleaved.
+// 
+// Sample Usage:
+//   se := msgpack.NewSyncEncoder(msgpack.NewEncoder(conn))
+//   go func() { err := se.Encode(a) }()
+//   go func() { err := se.Encode(b) }()
+type SyncEncoder struct {
+	mu sync.Mutex
+	e *Encoder
+}
+
+// NewSyncEncoder returns a SyncEncoder wrapping e, which must not then be used directly.
+func NewSyncEncoder(e *Encoder) *SyncEncoder {
+	return &SyncEncoder{ e: e }
+}
+
+// NewSyncEncoderEx returns a SyncEncoder wrapping an Encoder writing to w, configured by opts (which may be nil).
+func NewSyncEncoderEx(w io.Writer, opts *EncoderOptions) *SyncEncoder {
+	return NewSyncEncoder(NewEncoderEx(w, opts))
+}
+
+// Encode encodes v (see Encoder.Encode).
+func (s *SyncEncoder) Encode(v interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.e.Encode(v)
+}
+
+// EncodeMulti encodes vs as successive values, with no other values between them (see Encoder.EncodeMulti).
+func (s *SyncEncoder) EncodeMulti(vs ...interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.e.EncodeMulti(vs...)
+}
+
+// Do calls fn with the Encoder, holding the lock, e.g. to write a value with its streaming methods 
+// (WriteArrayHeader, BeginMap, etc).
+func (s *SyncEncoder) Do(fn func(e *Encoder) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fn(s.e)
+}
@@ -0,0 +1,295 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+// Token API: pull-based, non-reflective reading of a msgpack stream.
+// 
+// These allow an application to walk a (possibly huge) stream incrementally,
+// without materializing it into Go objects. For example, to read a map of strings:
+//   n, err := dec.ReadMapHeader()
+//   for i := 0; i < n; i++ {
+//       k, err := dec.ReadString()
+//       if t, err := dec.NextType(); t == ArrayType { ... } else { dec.Skip() }
+//   }
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// ValueType is the type of a value in the msgpack stream.
+type ValueType byte
+
+const (
+	InvalidType ValueType = iota
+	NilType
+	BoolType
+	IntType      // signed integers and positive fixnums
+	UintType     // unsigned integers
+	FloatType
+	StrType      // raw bytes
+	ArrayType
+	MapType
+	BinType      // bin family of the newer spec
+	ExtType      // ext family of the newer spec
+)
+
+var valueTypeNames = [...]string{
+	InvalidType: "invalid",
+	NilType: "nil",
+	BoolType: "bool",
+	IntType: "int",
+	UintType: "uint",
+	FloatType: "float",
+	StrType: "str",
+	ArrayType: "array",
+	MapType: "map",
+	BinType: "bin",
+	ExtType: "ext",
+}
+
+func (vt ValueType) String() string {
+	if int(vt) < len(valueTypeNames) {
+		return valueTypeNames[vt]
+	}
+	return valueTypeNames[InvalidType]
+}
+
+// descValueType returns the ValueType for a descriptor byte.
+func descValueType(bd byte) (vt ValueType) {
+	switch {
+	case bd == 0xc0:
+		vt = NilType
+	case bd == 0xc2, bd == 0xc3:
+		vt = BoolType
+	case bd <= 0x7f, bd >= 0xe0, bd >= 0xd0 && bd <= 0xd3:
+		vt = IntType
+	case bd >= 0xcc && bd <= 0xcf:
+		vt = UintType
+	case bd == 0xca, bd == 0xcb:
+		vt = FloatType
+	case bd == 0xda, bd == 0xdb, bd == 0xd9, bd >= 0xa0 && bd <= 0xbf:
+		vt = StrType
+	case bd >= 0xc4 && bd <= 0xc6:
+		vt = BinType
+	case bd >= 0xc7 && bd <= 0xc9, bd >= 0xd4 && bd <= 0xd8:
+		vt = ExtType
+	case bd == 0xdc, bd == 0xdd, bd >= 0x90 && bd <= 0x9f:
+		vt = ArrayType
+	case bd == 0xde, bd == 0xdf, bd >= 0x80 && bd <= 0x8f:
+		vt = MapType
+	}
+	return
+}
+
+// PeekType returns the type (msgpack family) of the next value in the stream, 
+// without consuming it. Callers can use it to branch on the wire type before
+// deciding which typed read (or Decode) to perform.
+func (d *Decoder) PeekType() (vt ValueType, err error) {
+	bd, err := d.peekn1()
+	if err != nil {
+		return
+	}
+	if vt = descValueType(bd); vt == InvalidType {
+		err = fmt.Errorf("%v: PeekType: %s: hex: %x, dec: %d", msgTagDec, msgBadDesc, bd, bd)
+	}
+	return
+}
+
+// NextType is the same as PeekType. 
+func (d *Decoder) NextType() (vt ValueType, err error) {
+	return d.PeekType()
+}
+
+// NextValueKind returns the reflect.Kind of the value the next value in the stream
+// decodes to, when decoding into a nil interface{} (e.g. reflect.Int16 for an int 16, 
+// reflect.Map for a map). It returns reflect.Invalid for nil or an ext value.
+// 
+// Str values are reported as reflect.String, though the DecoderContainerResolver 
+// may choose to decode them as []byte.
+func (d *Decoder) NextValueKind() (rk reflect.Kind, err error) {
+	bd, err := d.peekn1()
+	if err != nil {
+		return
+	}
+	switch bd {
+	case 0xca:
+		return reflect.Float32, nil
+	case 0xcc:
+		return reflect.Uint8, nil
+	case 0xcd:
+		return reflect.Uint16, nil
+	case 0xce:
+		return reflect.Uint32, nil
+	case 0xd1:
+		return reflect.Int16, nil
+	case 0xd2:
+		return reflect.Int32, nil
+	case 0xd3:
+		return reflect.Int64, nil
+	}
+	switch descValueType(bd) {
+	case BoolType:
+		rk = reflect.Bool
+	case IntType:
+		rk = reflect.Int8
+	case UintType:
+		rk = reflect.Uint64
+	case FloatType:
+		rk = reflect.Float64
+	case StrType:
+		rk = reflect.String
+	case BinType, ArrayType:
+		rk = reflect.Slice
+	case MapType:
+		rk = reflect.Map
+	case NilType, ExtType:
+	default:
+		err = fmt.Errorf("%v: NextValueKind: %s: hex: %x, dec: %d", msgTagDec, msgBadDesc, bd, bd)
+	}
+	return
+}
+
+func (d *Decoder) peekn1() (bd byte, err error) {
+	if bd, err = d.r.readn1(); err == nil {
+		d.r.unreadn1()
+	}
+	return
+}
+
+// ReadNil consumes a nil value. It is an error if the next value is not nil.
+func (d *Decoder) ReadNil() (err error) {
+	defer panicToErr(&err)
+	if bd := d.readn1(); bd != 0xc0 {
+		d.err("ReadNil: Expecting nil. %s: hex: %x", msgBadDesc, bd)
+	}
+	return
+}
+
+// ReadBool reads a bool value.
+func (d *Decoder) ReadBool() (b bool, err error) {
+	defer panicToErr(&err)
+	switch bd := d.readn1(); bd {
+	case 0xc2:
+	case 0xc3:
+		b = true
+	default:
+		d.err("ReadBool: Expecting bool. %s: hex: %x", msgBadDesc, bd)
+	}
+	return
+}
+
+// ReadInt64 reads any integer value which fits in an int64.
+func (d *Decoder) ReadInt64() (i int64, err error) {
+	defer panicToErr(&err)
+	bd := d.readn1()
+	if bd == 0xcf {
+		if ui := d.readUint64(); ui > math.MaxInt64 {
+			d.err("ReadInt64: Overflow int value: %v", ui)
+		} else {
+			i = int64(ui)
+		}
+		return
+	}
+	i, _ = d.decodeInteger(bd, true)
+	return
+}
+
+// ReadUint64 reads any non-negative integer value.
+func (d *Decoder) ReadUint64() (ui uint64, err error) {
+	defer panicToErr(&err)
+	_, ui = d.decodeInteger(d.readn1(), false)
+	return
+}
+
+// ReadFloat64 reads a float (float32 or float64 in the stream) value.
+func (d *Decoder) ReadFloat64() (f float64, err error) {
+	defer panicToErr(&err)
+	switch bd := d.readn1(); bd {
+	case 0xca:
+		f = float64(math.Float32frombits(d.readUint32()))
+	case 0xcb:
+		f = math.Float64frombits(d.readUint64())
+	default:
+		d.err("ReadFloat64: Expecting float. %s: hex: %x", msgBadDesc, bd)
+	}
+	if d.nonFiniteAsNil(f) {
+		f = 0
+	}
+	return
+}
+
+// ReadString reads raw bytes from the stream as a string.
+func (d *Decoder) ReadString() (s string, err error) {
+	defer panicToErr(&err)
+	if l := d.readContainerLen(0, true, ContainerRawBytes); l > 0 {
+		s = d.readString(l)
+	}
+	return
+}
+
+// ReadBytes reads raw bytes from the stream.
+func (d *Decoder) ReadBytes() (bs []byte, err error) {
+	defer panicToErr(&err)
+	bs = d.readBytes(d.readContainerLen(0, true, ContainerRawBytes))
+	return
+}
+
+// ReadArrayHeader reads the header of an array, returning the number of elements.
+// The caller must then read (or Skip) that many values.
+func (d *Decoder) ReadArrayHeader() (l int, err error) {
+	defer panicToErr(&err)
+	l = d.readContainerLen(0, true, ContainerList)
+	return
+}
+
+// ReadMapHeader reads the header of a map, returning the number of entries.
+// The caller must then read (or Skip) that many key/value pairs (ie 2 * l values).
+func (d *Decoder) ReadMapHeader() (l int, err error) {
+	defer panicToErr(&err)
+	l = d.readContainerLen(0, true, ContainerMap)
+	return
+}
+
+// ReadExt reads an ext value, returning its type and data.
+func (d *Decoder) ReadExt() (xtag int8, data []byte, err error) {
+	defer panicToErr(&err)
+	bd := d.readn1()
+	if !isExtDesc(bd) {
+		d.err("ReadExt: Expecting ext. %s: hex: %x", msgBadDesc, bd)
+	}
+	xtag, l := d.readExtHeader(bd)
+	data = d.readBytes(l)
+	return
+}
@@ -0,0 +1,82 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// TraceEvent describes a value about to be decoded (see DecoderOptions.Trace).
+type TraceEvent struct {
+	Offset int64        // input offset of the value (see Decoder.InputOffset)
+	Type ValueType      // its wire type
+	Target reflect.Type // the type it is decoded into
+	// Path locates the value from the top of the value being decoded, as in Change.Path: 
+	// each element is an array index (int), a map key (as decoded), or a struct field's key (string).
+	Path []interface{}
+}
+
+// String returns a description of the event, e.g. `$.items[2].name: str at offset 41 into string`.
+func (ev TraceEvent) String() string {
+	return fmt.Sprintf("%s: %v at offset %d into %v", pathString(ev.Path), ev.Type, ev.Offset, ev.Target)
+}
+
+// TraceFunc receives the TraceEvent of each value decoded (see DecoderOptions.Trace).
+// 
+// Map keys are not reported themselves (they are in the Path of their values). Neither are 
+// the elements of values decoded by custom decoders (e.g. ext types or decode hooks).
+type TraceFunc func(ev TraceEvent)
+
+// trace reports the value whose descriptor (bd) was just read, being decoded into rt.
+func (d *Decoder) trace(bd byte, rt reflect.Type) {
+	d.o.Trace(TraceEvent{
+		Offset: d.r.numread() - 1, 
+		Type: descValueType(bd), 
+		Target: rt, 
+		Path: append([]interface{}(nil), d.path...),
+	})
+}
+
+// tracePush and tracePop maintain the path of the value being decoded, when tracing.
+func (d *Decoder) tracePush(p interface{}) {
+	if d.o.Trace != nil {
+		d.path = append(d.path, p)
+	}
+}
+
+func (d *Decoder) tracePop() {
+	if d.o.Trace != nil {
+		d.path = d.path[:len(d.path)-1]
+	}
+}
@@ -0,0 +1,154 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// ExtTyped wraps a value of a type named in a TypeRegistry, held in an interface: 
+// its data is the name of the type (a msgpack str) followed by the encoded value.
+// Applications using ext types of their own must not re-use it.
+const ExtTyped int8 = 125
+
+// TypeRegistry names Go types, so values of them held in interfaces (e.g. interface-typed 
+// struct fields, or the elements of a []interface{}) can be decoded back into the same types. 
+// Pass it to Encoders and Decoders via EncoderOptions.Types and DecoderOptions.Types.
+// 
+// Such a value is encoded as an ExtTyped ext, holding the name of its type and the value. 
+// Values of the types in other places (where the type is known statically) are encoded as usual.
+// 
+// It is safe for concurrent use, and types may be added at any time.
+type TypeRegistry struct {
+	mu sync.RWMutex
+	byName map[string]reflect.Type
+	byType map[reflect.Type]string
+}
+
+// NewTypeRegistry returns an empty TypeRegistry.
+func NewTypeRegistry() *TypeRegistry {
+	return &TypeRegistry{
+		byName: make(map[string]reflect.Type),
+		byType: make(map[reflect.Type]string),
+	}
+}
+
+// Register names the type of value (which is otherwise unused) name. 
+// A type can have only one name, and a name only one type.
+// Register the type actually held in the interfaces: e.g. *T if they hold pointers.
+func (r *TypeRegistry) Register(name string, value interface{}) (err error) {
+	rt := reflect.TypeOf(value)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch {
+	case rt == nil || name == "":
+		err = fmt.Errorf("TypeRegistry.Register: type and name must be non-nil")
+	case r.byName[name] != nil && r.byName[name] != rt:
+		err = fmt.Errorf("TypeRegistry.Register: name %q is already registered for type %v", name, r.byName[name])
+	case r.byType[rt] != "" && r.byType[rt] != name:
+		err = fmt.Errorf("TypeRegistry.Register: type %v is already registered as %q", rt, r.byType[rt])
+	}
+	if err != nil {
+		return
+	}
+	r.byName[name] = rt
+	r.byType[rt] = name
+	return
+}
+
+// Name returns the name of the type rt, if registered.
+func (r *TypeRegistry) Name(rt reflect.Type) (name string, ok bool) {
+	r.mu.RLock()
+	name, ok = r.byType[rt]
+	r.mu.RUnlock()
+	return
+}
+
+// Type returns the type named name, if registered.
+func (r *TypeRegistry) Type(name string) (rt reflect.Type, ok bool) {
+	r.mu.RLock()
+	rt, ok = r.byName[name]
+	r.mu.RUnlock()
+	return
+}
+
+// encodeTyped encodes rv (held in an interface) as an ExtTyped ext, if its type is in EncoderOptions.Types.
+func (e *Encoder) encodeTyped(rv reflect.Value) bool {
+	name, ok := e.o.Types.Name(rv.Type())
+	if !ok {
+		return false
+	}
+	// the ext length must be written first, so encode the value into a buffer.
+	w := e.w
+	buf := new(bytes.Buffer)
+	e.w = buf
+	e.inExt++
+	defer func() { e.w = w }()
+	e.encString(name)
+	e.encodeValue(rv)
+	e.inExt--
+	e.w = w
+	e.writeExtHeader(ExtTyped, buf.Len())
+	e.writeb(buf.Len(), buf.Bytes())
+	return true
+}
+
+// decodeTyped decodes an ExtTyped value (whose header was read) into rv. 
+// Into an interface, it decodes a new value of the named type (from DecoderOptions.Types), 
+// and sets rv to it; into anything else, it decodes the value as usual.
+// As rv is set to exactly the decoded value (which may be a pointer, not to be dereferenced), 
+// it is not reported as a nil interface set (see decodeValueT).
+func (d *Decoder) decodeTyped(rv reflect.Value) (wasNilIntf bool, rvn reflect.Value) {
+	name := d.decodeString()
+	if rv.Kind() != reflect.Interface {
+		return d.decodeValue(0, -1, true, rv)
+	}
+	var rt reflect.Type
+	ok := d.o.Types != nil
+	if ok {
+		rt, ok = d.o.Types.Type(name)
+	}
+	if !ok {
+		d.err("Unregistered type name: %q, decoding into: %v", name, rv.Type())
+	}
+	if !rt.AssignableTo(rv.Type()) {
+		d.err("Cannot decode type %v (%q) into: %v", rt, name, rv.Type())
+	}
+	rvn = reflect.New(rt).Elem()
+	d.decodeValue(0, -1, true, rvn)
+	rv.Set(rvn)
+	return false, rv
+}
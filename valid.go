@@ -0,0 +1,125 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// SyntaxError is returned by CheckValid for a malformed document.
+type SyntaxError struct {
+	Offset int64 // offset in the document of the malformed (or missing) value
+	Err error
+}
+
+func (e *SyntaxError) Error() string {
+	msg := e.Err.Error()
+	if !strings.HasPrefix(msg, msgTagDec) {
+		msg = msgTagDec + ": " + msg
+	}
+	return fmt.Sprintf("%s (at offset %d)", msg, e.Offset)
+}
+
+func (e *SyntaxError) Unwrap() error {
+	return e.Err
+}
+
+// Valid reports whether b is a well-formed msgpack document: a single value,
+// with nothing after it. See CheckValid.
+func Valid(b []byte) bool {
+	return CheckValid(b) == nil
+}
+
+// CheckValid checks that b is a well-formed msgpack document (a single value, with
+// nothing after it), without decoding it. If not, it returns a *SyntaxError. 
+// 
+// It walks the encoding without allocating, and rejects reserved descriptors (0xc1), 
+// truncated values and container lengths which cannot fit in the rest of b.
+// Str values are not checked for valid UTF-8.
+func CheckValid(b []byte) (err error) {
+	z := &bytesDecReader{b: b}
+	d := newDecoder(z, nil)
+	var off int
+	defer func() {
+		if x := recover(); x != nil {
+			var err2 error
+			panicToErrT(x, &err2)
+			if err2 == io.EOF {
+				err2 = io.ErrUnexpectedEOF
+			}
+			err = &SyntaxError{Offset: int64(off), Err: err2}
+		}
+	}()
+	// Iterate over the number of values left to check (see Decoder.skip).
+	for n := 1; n > 0; n-- {
+		off = z.c
+		bd := d.readn1()
+		switch {
+		case bd == 0xc0, bd == 0xc2, bd == 0xc3, bd >= 0xe0, bd <= 0x7f:
+		case bd == 0xcc, bd == 0xd0:
+			d.skipb(1)
+		case bd == 0xcd, bd == 0xd1:
+			d.skipb(2)
+		case bd == 0xca, bd == 0xce, bd == 0xd2:
+			d.skipb(4)
+		case bd == 0xcb, bd == 0xcf, bd == 0xd3:
+			d.skipb(8)
+		case bd == 0xda, bd == 0xdb, bd == 0xd9, bd >= 0xa0 && bd <= 0xbf, bd >= 0xc4 && bd <= 0xc6:
+			d.skipb(d.readContainerLen(bd, false, ContainerRawBytes))
+		case bd >= 0xc7 && bd <= 0xc9, bd >= 0xd4 && bd <= 0xd8:
+			_, l := d.readExtHeader(bd)
+			d.skipb(l)
+		case bd == 0xdc, bd == 0xdd, bd >= 0x90 && bd <= 0x9f:
+			n += validLen(d, z, d.readContainerLen(bd, false, ContainerList))
+		case bd == 0xde, bd == 0xdf, bd >= 0x80 && bd <= 0x8f:
+			n += 2 * validLen(d, z, d.readContainerLen(bd, false, ContainerMap))
+		default:
+			d.err("%s: hex: %x, dec: %d", msgBadDesc, bd, bd)
+		}
+	}
+	if off = z.c; off < len(b) {
+		d.err("unexpected data after the value")
+	}
+	return
+}
+
+// validLen checks that a container of l elements (each at least 1 byte) fits in the rest of the input.
+func validLen(d *Decoder, z *bytesDecReader, l int) int {
+	if l > len(z.b) - z.c {
+		d.err("container length %d exceeds the remaining %d bytes", l, len(z.b) - z.c)
+	}
+	return l
+}
+
@@ -0,0 +1,529 @@
+
+/*
+go-msgpack - Msgpack library for Go. Provides pack/unpack and net/rpc support.
+https://github.com/ugorji/go-msgpack
+
+Copyright (c) 2012, Ugorji Nwoke.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification,
+are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice,
+  this list of conditions and the following disclaimer.
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+* Neither the name of the author nor the names of its contributors may be used
+  to endorse or promote products derived from this software
+  without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package msgpack
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// Value is a msgpack document (or a part of one) held as a tree, for programs
+// which must inspect, build or modify arbitrary documents without defining structs.
+// 
+// A Value keeps the wire type of each scalar, and the order of map entries, 
+// so a document decoded into a Value is re-encoded (by Encode, or when it is a field
+// of an encoded struct) much as it was read. The zero Value is nil.
+// 
+// Decoding into a Value (or a struct field of type Value) parses the value whatever its
+// type; ParseValue does the same for a document.
+// For example:
+//   v, _ := msgpack.ParseValue(b)
+//   name, _ := v.Path("users", 0, "name").Str()
+//   v.Path("users", 0).Set("age", msgpack.NewInt(30))
+//   b, _ = v.Encode()
+type Value struct {
+	typ ValueType
+	v interface{} // bool, int64, uint64, float32, float64, string, []byte (bin), valueExt
+	elems []Value // array elements, or map values
+	keys []Value  // map keys
+}
+
+type valueExt struct {
+	tag int8
+	data []byte
+}
+
+var valueTyp = reflect.TypeOf(Value{})
+
+// NewNil returns a nil Value.
+func NewNil() Value { return Value{typ: NilType} }
+
+// NewBool returns a bool Value.
+func NewBool(b bool) Value { return Value{typ: BoolType, v: b} }
+
+// NewInt returns a signed integer Value.
+func NewInt(i int64) Value { return Value{typ: IntType, v: i} }
+
+// NewUint returns an unsigned integer Value.
+func NewUint(ui uint64) Value { return Value{typ: UintType, v: ui} }
+
+// NewFloat returns a float Value (encoded as a float64).
+func NewFloat(f float64) Value { return Value{typ: FloatType, v: f} }
+
+// NewStr returns a str Value.
+func NewStr(s string) Value { return Value{typ: StrType, v: s} }
+
+// NewBin returns a bin Value.
+func NewBin(bs []byte) Value { return Value{typ: BinType, v: bs} }
+
+// NewExt returns an ext Value of type xtag.
+func NewExt(xtag int8, data []byte) Value { return Value{typ: ExtType, v: valueExt{xtag, data}} }
+
+// NewArray returns an array Value with the given elements.
+func NewArray(elems ...Value) Value { 
+	return Value{typ: ArrayType, elems: append(make([]Value, 0, len(elems)), elems...)}
+}
+
+// NewMap returns an empty map Value. Use Set to add entries.
+func NewMap() Value { return Value{typ: MapType, elems: []Value{}, keys: []Value{}} }
+
+// ValueOf returns the Value for x, as it would be encoded by Marshal.
+// If x is a Value, it is returned as is.
+func ValueOf(x interface{}) (v Value, err error) {
+	if v, ok := x.(Value); ok {
+		return v, nil
+	}
+	b, err := Marshal(x)
+	if err != nil {
+		return
+	}
+	return ParseValue(b)
+}
+
+// ParseValue parses the msgpack document b into a Value.
+// The Value does not alias b.
+func ParseValue(b []byte) (v Value, err error) {
+	err = Unmarshal(b, &v, nil)
+	return
+}
+
+// Encode returns the msgpack encoding of v.
+func (v Value) Encode() ([]byte, error) {
+	return Marshal(v)
+}
+
+// Type returns the type of v (NilType for the zero Value).
+func (v Value) Type() ValueType {
+	if v.typ == InvalidType {
+		return NilType
+	}
+	return v.typ
+}
+
+// IsNil reports whether v is nil.
+func (v Value) IsNil() bool { return v.Type() == NilType }
+
+// Len returns the number of elements of an array, or entries of a map (else 0).
+func (v Value) Len() int { return len(v.elems) }
+
+// Index returns the i'th element of an array (or value of a map, in order), 
+// or nil if i is out of range. The returned Value can be modified in place.
+func (v *Value) Index(i int) *Value {
+	if i < 0 || i >= len(v.elems) {
+		return nil
+	}
+	return &v.elems[i]
+}
+
+// Key returns the key of the i'th entry of a map, or nil if i is out of range.
+func (v *Value) Key(i int) *Value {
+	if i < 0 || i >= len(v.keys) {
+		return nil
+	}
+	return &v.keys[i]
+}
+
+// Get returns the value for key in a map, or nil if v is not a map or has no such key.
+// Keys match as for GetPath (e.g. "a" matches a str or bin key "a", 1 matches any integer key 1).
+// The returned Value can be modified in place.
+func (v *Value) Get(key interface{}) *Value {
+	if i := v.find(key); i >= 0 {
+		return &v.elems[i]
+	}
+	return nil
+}
+
+// Path returns the value at path (map keys and array indexes, as for GetPath), 
+// or nil if there is no such value.
+func (v *Value) Path(path ...interface{}) *Value {
+	for _, p := range path {
+		if v == nil {
+			return nil
+		}
+		switch v.typ {
+		case MapType:
+			v = v.Get(p)
+		case ArrayType:
+			switch i := pathKey(p).(type) {
+			case uint64:
+				if i >= uint64(len(v.elems)) {
+					return nil
+				}
+				v = &v.elems[i]
+			default:
+				return nil
+			}
+		default:
+			return nil
+		}
+	}
+	return v
+}
+
+// find returns the index of the map entry with the given key, or -1.
+func (v *Value) find(key interface{}) int {
+	if v.typ != MapType {
+		return -1
+	}
+	var pk interface{}
+	if kv, ok := key.(Value); ok {
+		pk = kv.node().v
+	} else {
+		pk = pathKey(key)
+	}
+	for i := range v.keys {
+		if n := v.keys[i].node(); pathKeyMatch(pk, &n) {
+			return i
+		}
+	}
+	return -1
+}
+
+// node returns v as a scalar diffNode (for comparing keys).
+func (v *Value) node() diffNode {
+	n := diffNode{vt: diffType(v.Type()), v: v.v}
+	switch x := v.v.(type) {
+	case int64:
+		if x >= 0 {
+			n.v = uint64(x)
+		}
+	case float32:
+		n.v = float64(x)
+	}
+	return n
+}
+
+// Set sets the value for key in a map, replacing an existing entry or appending a new one.
+// key is converted by ValueOf, unless it is a Value.
+func (v *Value) Set(key interface{}, val Value) (err error) {
+	if v.typ != MapType {
+		return fmt.Errorf("%v: Value.Set: not a map: %v", msgTagEnc, v.Type())
+	}
+	if i := v.find(key); i >= 0 {
+		v.elems[i] = val
+		return
+	}
+	kv, err := ValueOf(key)
+	if err != nil {
+		return
+	}
+	v.keys, v.elems = append(v.keys, kv), append(v.elems, val)
+	return
+}
+
+// Delete removes the entry for key from a map. It reports whether there was one.
+func (v *Value) Delete(key interface{}) bool {
+	i := v.find(key)
+	if i < 0 {
+		return false
+	}
+	v.keys = append(v.keys[:i], v.keys[i+1:]...)
+	v.elems = append(v.elems[:i], v.elems[i+1:]...)
+	return true
+}
+
+// Append appends elements to an array.
+func (v *Value) Append(elems ...Value) error {
+	if v.typ != ArrayType {
+		return fmt.Errorf("%v: Value.Append: not an array: %v", msgTagEnc, v.Type())
+	}
+	v.elems = append(v.elems, elems...)
+	return nil
+}
+
+// SetIndex sets the i'th element of an array.
+func (v *Value) SetIndex(i int, elem Value) error {
+	if v.typ != ArrayType || i < 0 || i >= len(v.elems) {
+		return fmt.Errorf("%v: Value.SetIndex: index %d out of range of %v (len %d)", msgTagEnc, i, v.Type(), len(v.elems))
+	}
+	v.elems[i] = elem
+	return nil
+}
+
+// RemoveIndex removes the i'th element of an array.
+func (v *Value) RemoveIndex(i int) error {
+	if v.typ != ArrayType || i < 0 || i >= len(v.elems) {
+		return fmt.Errorf("%v: Value.RemoveIndex: index %d out of range of %v (len %d)", msgTagEnc, i, v.Type(), len(v.elems))
+	}
+	v.elems = append(v.elems[:i], v.elems[i+1:]...)
+	return nil
+}
+
+// Bool returns the value of a bool.
+func (v Value) Bool() (b bool, ok bool) {
+	b, ok = v.v.(bool)
+	return
+}
+
+// Int returns the value of an integer, if it fits in an int64.
+func (v Value) Int() (int64, bool) {
+	switch x := v.v.(type) {
+	case int64:
+		return x, true
+	case uint64:
+		return int64(x), x <= math.MaxInt64
+	}
+	return 0, false
+}
+
+// Uint returns the value of a non-negative integer.
+func (v Value) Uint() (uint64, bool) {
+	switch x := v.v.(type) {
+	case int64:
+		return uint64(x), x >= 0
+	case uint64:
+		return x, true
+	}
+	return 0, false
+}
+
+// Float returns the value of a float, or of an integer converted to a float64.
+func (v Value) Float() (float64, bool) {
+	switch x := v.v.(type) {
+	case float32:
+		return float64(x), true
+	case float64:
+		return x, true
+	case int64:
+		return float64(x), true
+	case uint64:
+		return float64(x), true
+	}
+	return 0, false
+}
+
+// Str returns the value of a str (or of a bin, converted to a string).
+func (v Value) Str() (string, bool) {
+	switch x := v.v.(type) {
+	case string:
+		return x, true
+	case []byte:
+		return string(x), true
+	}
+	return "", false
+}
+
+// Bytes returns the value of a bin (or of a str, converted to a []byte).
+func (v Value) Bytes() ([]byte, bool) {
+	switch x := v.v.(type) {
+	case string:
+		return []byte(x), true
+	case []byte:
+		return x, true
+	}
+	return nil, false
+}
+
+// Ext returns the type and data of an ext.
+func (v Value) Ext() (xtag int8, data []byte, ok bool) {
+	x, ok := v.v.(valueExt)
+	return x.tag, x.data, ok
+}
+
+// Interface returns v as a Go value, as decoded into an interface{}: nil, bool, int64, 
+// uint64, float32, float64, string (for str), []byte (for bin), []interface{} or a map. 
+// A map is a map[string]interface{} if all its keys are str, else a map[interface{}]interface{}
+// (in which bin keys become strings). An ext is returned as its encoding (a Raw).
+func (v Value) Interface() interface{} {
+	switch v.typ {
+	case ArrayType:
+		s := make([]interface{}, len(v.elems))
+		for i := range v.elems {
+			s[i] = v.elems[i].Interface()
+		}
+		return s
+	case MapType:
+		strKeys := true
+		for i := range v.keys {
+			strKeys = strKeys && v.keys[i].typ == StrType
+		}
+		if strKeys {
+			m := make(map[string]interface{}, len(v.keys))
+			for i := range v.keys {
+				m[v.keys[i].v.(string)] = v.elems[i].Interface()
+			}
+			return m
+		}
+		m := make(map[interface{}]interface{}, len(v.keys))
+		for i := range v.keys {
+			k := v.keys[i].Interface()
+			if !reflect.TypeOf(k).Comparable() {
+				if bs, ok := k.([]byte); ok {
+					k = string(bs)
+				} else {
+					k = fmt.Sprint(k)
+				}
+			}
+			m[k] = v.elems[i].Interface()
+		}
+		return m
+	case ExtType:
+		b, _ := v.Encode()
+		return Raw(b)
+	}
+	return v.v
+}
+
+// String returns v formatted as JSON (see ToJSON), for debugging.
+func (v Value) String() string {
+	b, err := v.Encode()
+	if err != nil {
+		return fmt.Sprintf("<%v>", err)
+	}
+	return rawString(b)
+}
+
+func (e *Encoder) encodeNode(v *Value) {
+	switch v.Type() {
+	case NilType:
+		e.encNil()
+	case BoolType:
+		e.encBool(v.v.(bool))
+	case IntType:
+		e.encInt(v.v.(int64))
+	case UintType:
+		e.encUint(v.v.(uint64))
+	case FloatType:
+		if f, ok := v.v.(float32); ok {
+			e.encFloat32(f)
+		} else {
+			e.encFloat64(v.v.(float64))
+		}
+	case StrType:
+		e.encString(v.v.(string))
+	case BinType:
+		e.encBin(v.v.([]byte))
+	case ExtType:
+		x := v.v.(valueExt)
+		e.writeExtHeader(x.tag, len(x.data))
+		if len(x.data) > 0 {
+			e.writeb(len(x.data), x.data)
+		}
+	case ArrayType:
+		e.writeContainerLen(ContainerList, len(v.elems))
+		for i := range v.elems {
+			e.encodeNode(&v.elems[i])
+		}
+	case MapType:
+		e.writeContainerLen(ContainerMap, len(v.elems))
+		for i := range v.elems {
+			e.encodeNode(&v.keys[i])
+			e.encodeNode(&v.elems[i])
+		}
+	default:
+		e.err("Unsupported Value type: %v", v.typ)
+	}
+}
+
+// encBin writes bs in the bin format.
+func (e *Encoder) encBin(bs []byte) {
+	e.countValue(0)
+	switch l := len(bs); {
+	case l < 256:
+		e.t2[0], e.t2[1] = 0xc4, byte(l)
+		e.writeb(2, e.t2)
+	case l < 65536:
+		e.t3[0] = 0xc5
+		binary.BigEndian.PutUint16(e.t31, uint16(l))
+		e.writeb(3, e.t3)
+	default:
+		e.t5[0] = 0xc6
+		binary.BigEndian.PutUint32(e.t51, uint32(l))
+		e.writeb(5, e.t5)
+	}
+	if len(bs) > 0 {
+		e.writeb(len(bs), bs)
+	}
+}
+
+// decodeNode decodes the value (whose descriptor byte bd was read, and containerLen 
+// too if >= 0) into v.
+func (d *Decoder) decodeNode(bd byte, containerLen int, v *Value) {
+	*v = Value{typ: descValueType(bd)}
+	switch v.typ {
+	case NilType:
+	case BoolType:
+		v.v = bd == 0xc3
+	case IntType:
+		v.v, _ = d.decodeInteger(bd, true)
+	case UintType:
+		_, v.v = d.decodeInteger(bd, false)
+	case FloatType:
+		if bd == 0xca {
+			v.v = math.Float32frombits(d.readUint32())
+		} else {
+			v.v = math.Float64frombits(d.readUint64())
+		}
+	case StrType, BinType:
+		if containerLen < 0 {
+			containerLen = d.readContainerLen(bd, false, ContainerRawBytes)
+		}
+		if v.typ == StrType {
+			v.v = d.readString(containerLen)
+		} else {
+			v.v = d.readBytes(containerLen)
+		}
+	case ExtType:
+		xtag, l := d.readExtHeader(bd)
+		v.v = valueExt{xtag, d.readBytes(l)}
+	case ArrayType:
+		if containerLen < 0 {
+			containerLen = d.readContainerLen(bd, false, ContainerList)
+		}
+		v.elems = make([]Value, 0, d.initLen(containerLen))
+		d.enter()
+		for i := 0; i < containerLen; i++ {
+			v.elems = append(v.elems, Value{})
+			d.decodeNode(d.readn1(), -1, &v.elems[i])
+		}
+		d.exit()
+	case MapType:
+		if containerLen < 0 {
+			containerLen = d.readContainerLen(bd, false, ContainerMap)
+		}
+		n := d.initLen(containerLen)
+		v.keys, v.elems = make([]Value, 0, n), make([]Value, 0, n)
+		d.enter()
+		for i := 0; i < containerLen; i++ {
+			v.keys, v.elems = append(v.keys, Value{}), append(v.elems, Value{})
+			d.decodeNode(d.readn1(), -1, &v.keys[i])
+			d.decodeNode(d.readn1(), -1, &v.elems[i])
+		}
+		d.exit()
+	default:
+		d.err("%s: hex: %x, dec: %d", msgBadDesc, bd, bd)
+	}
+}
+